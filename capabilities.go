@@ -0,0 +1,116 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
+)
+
+// ErrNotSupportedByServer is the error set on the token of a publish or
+// subscribe which uses a feature the broker said it doesn't support, when
+// EnforceCapabilities is set or, for wildcard subscriptions and a QoS above
+// the broker's maximum, always
+var ErrNotSupportedByServer = errors.New("Feature not supported by broker")
+
+// ServerCapabilities holds the optional features an MQTT 5 broker announces
+// in its CONNACK. Features the broker doesn't mention are available, as they
+// all are with earlier protocol versions.
+type ServerCapabilities struct {
+	MaximumQoS                      byte
+	RetainAvailable                 bool
+	WildcardSubscriptionAvailable   bool
+	SubscriptionIdentifierAvailable bool
+	SharedSubscriptionAvailable     bool
+}
+
+// capabilitiesFromProperties reads the capabilities from the properties of
+// a CONNACK, which may be nil
+func capabilitiesFromProperties(p *packets.Properties) ServerCapabilities {
+	caps := ServerCapabilities{
+		MaximumQoS:                      2,
+		RetainAvailable:                 true,
+		WildcardSubscriptionAvailable:   true,
+		SubscriptionIdentifierAvailable: true,
+		SharedSubscriptionAvailable:     true,
+	}
+	if p == nil {
+		return caps
+	}
+	if p.MaximumQoS != nil {
+		caps.MaximumQoS = *p.MaximumQoS
+	}
+	for _, f := range []struct {
+		flag *bool
+		cap  *bool
+	}{
+		{p.RetainAvailable, &caps.RetainAvailable},
+		{p.WildcardSubscriptionAvailable, &caps.WildcardSubscriptionAvailable},
+		{p.SubscriptionIdentifierAvailable, &caps.SubscriptionIdentifierAvailable},
+		{p.SharedSubscriptionAvailable, &caps.SharedSubscriptionAvailable},
+	} {
+		if f.flag != nil {
+			*f.cap = *f.flag
+		}
+	}
+	return caps
+}
+
+// ServerCapabilities returns the features the broker of the current or last
+// connection announced it supports.
+func (c *Client) ServerCapabilities() ServerCapabilities {
+	c.RLock()
+	defer c.RUnlock()
+	return c.capabilities
+}
+
+func (c *Client) setCapabilities(caps ServerCapabilities) {
+	c.Lock()
+	defer c.Unlock()
+	c.capabilities = caps
+}
+
+// supportsPublish checks a publish against the broker's capabilities and
+// returns the QoS to send it with. A QoS above the broker's maximum is
+// always checked, and lowered to it if downgrade is allowed and the
+// QosAboveMaximum policy says so, retain only when EnforceCapabilities is set.
+func (c *Client) supportsPublish(qos byte, retained bool, downgrade bool) (byte, error) {
+	caps := c.ServerCapabilities()
+	if qos > caps.MaximumQoS {
+		if !downgrade || c.options.QosAboveMaximum != QosAboveMaximumDowngrade {
+			c.warn(CLI, "publish above the broker's maximum QoS", "qos", qos, "maximum", caps.MaximumQoS)
+			return qos, ErrNotSupportedByServer
+		}
+		c.debug(CLI, "publish downgraded to the broker's maximum QoS", "qos", qos, "maximum", caps.MaximumQoS)
+		qos = caps.MaximumQoS
+	}
+	if c.options.EnforceCapabilities && retained && !caps.RetainAvailable {
+		return qos, ErrNotSupportedByServer
+	}
+	return qos, nil
+}
+
+// supportsSubscribe checks the filters of a subscribe against the broker's
+// capabilities. Wildcard filters are always checked, a broker without
+// wildcard subscriptions disconnects clients that use them, the rest only
+// when EnforceCapabilities is set.
+func (c *Client) supportsSubscribe(filters []string) error {
+	caps := c.ServerCapabilities()
+	for _, filter := range filters {
+		if strings.ContainsAny(filter, "+#") && !caps.WildcardSubscriptionAvailable {
+			c.warn(CLI, "broker does not allow wildcard subscriptions", "filter", filter)
+			return ErrNotSupportedByServer
+		}
+		if c.options.EnforceCapabilities && strings.HasPrefix(filter, "$share/") && !caps.SharedSubscriptionAvailable {
+			return ErrNotSupportedByServer
+		}
+	}
+	return nil
+}
@@ -17,11 +17,17 @@ package mqtt
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
@@ -34,6 +40,7 @@ const (
 	connecting
 	reconnecting
 	connected
+	idle // the connection was closed for being idle, see IdleTimeout
 )
 
 // ClientInt is the interface definition for a Client as used by this
@@ -69,18 +76,48 @@ type Client struct {
 	messageIds
 	conn            net.Conn
 	ibound          chan packets.ControlPacket
-	obound          chan *PacketAndToken
+	obound          chan *PacketAndToken // all publishes, whatever their QoS, in submission order
 	oboundP         chan *PacketAndToken
 	msgRouter       *router
 	stopRouter      chan bool
-	incomingPubChan chan *packets.PublishPacket
+	incomingPubChan chan incomingPublish
 	errors          chan error
 	stop            chan struct{}
 	resetPing       chan struct{}
 	resetPingResp   chan struct{}
+	pings           []*latencyToken // PINGREQs written and not yet answered, nil for keepalive ones
+	pingsLock       sync.Mutex
 	persist         Store
+	acks            map[uint16]*pendingAck
+	acksLock        sync.Mutex
+	subscribed      map[string]byte // filters subscribed in the current session and their QoS
+	subscribedLock  sync.Mutex
+	subChans        map[string]*subChan // subscriptions made with SubscribeChan
+	subChansLock    sync.Mutex
+	maxPacketSize   uint32            // announced by the broker, 0 if unlimited
+	generation      uint64            // counts the connections made, see ConnectionGeneration
+	aliases         map[uint16]string // topic aliases set on the current connection
+	aliasMax        uint16            // the broker's topic alias maximum
+	aliasLock       sync.Mutex
+	writeStarted    int64             // UnixNano when outgoing began the current write, 0 when idle
+	lastActive      int64             // UnixNano of the last activity, see IdleTimeout
+	idleClosed      bool              // the connection of an idle client has been closed
+	unsent          []*PacketAndToken // QoS 1 and 2 publishes whose write failed, see keepUnsent
+	unsentLock      sync.Mutex
+	flow            flowControl
+	retained        retainedCache
+	retainedQuiet   retainedTimers
 	options         ClientOptions
+	tlsSet          atomic.Value // *tls.Config, see SetTLSConfig
+	logger          Logger
 	status          connStatus
+	broker          *url.URL // the broker of the current or last connection
+	capabilities    ServerCapabilities
+	responseInfo    string // response information from the broker's last CONNACK
+	online          int32 // 1 while the connection is established and usable, see IsConnected
+	logLevel        int32 // a LogLevel, see SetLogLevel
+	clearSession    int32 // 1 until a connect made after ClearSessionOnce is accepted
+	statusChanged   *sync.Cond
 	workers         sync.WaitGroup
 }
 
@@ -91,12 +128,16 @@ type Client struct {
 func NewClient(o *ClientOptions) *Client {
 	c := &Client{}
 	c.options = *o
+	c.logger = c.options.Logger
+	if c.logger == nil {
+		c.logger = stdLogger{}
+	}
 
 	if c.options.Store == nil {
 		c.options.Store = NewMemoryStore()
 	}
 	switch c.options.ProtocolVersion {
-	case 3, 4:
+	case 3, 4, 5:
 		c.options.protocolVersionExplicit = true
 	default:
 		c.options.ProtocolVersion = 4
@@ -104,18 +145,36 @@ func NewClient(o *ClientOptions) *Client {
 	}
 	c.persist = c.options.Store
 	c.status = disconnected
-	c.messageIds = messageIds{index: make(map[uint16]Token)}
+	c.statusChanged = sync.NewCond(c.RLocker())
+	c.capabilities = capabilitiesFromProperties(nil)
+	c.messageIds = messageIds{index: make(map[uint16]Token), alloc: c.options.MessageIDAllocator}
+	c.acks = make(map[uint16]*pendingAck)
+	c.subscribed = make(map[string]byte)
+	c.subChans = make(map[string]*subChan)
+	c.flow.cond = sync.NewCond(&c.flow)
 	c.msgRouter, c.stopRouter = newRouter()
 	c.msgRouter.setDefaultHandler(c.options.DefaultPublishHander)
 	if !c.options.AutoReconnect {
 		c.options.MessageChannelDepth = 0
 	}
+	if c.options.ReadTimeout > 0 && c.options.KeepAlive > 0 && c.options.ReadTimeout <= c.options.KeepAlive {
+		c.options.ReadTimeout = c.options.KeepAlive + c.options.PingTimeout
+		c.warn(CLI, "read timeout must be larger than keepalive", "readTimeout", c.options.ReadTimeout)
+	}
 	return c
 }
 
-// IsConnected returns a bool signifying whether
-// the client is connected or not.
+// IsConnected returns a bool signifying whether the client currently has
+// an established connection to the broker. It turns false as soon as the
+// connection fails, even if the client is about to reconnect.
 func (c *Client) IsConnected() bool {
+	return atomic.LoadInt32(&c.online) == 1
+}
+
+// isActive reports whether the client is connected or, with AutoReconnect,
+// trying to reconnect, in which case operations are queued rather than
+// refused
+func (c *Client) isActive() bool {
 	c.RLock()
 	defer c.RUnlock()
 	switch {
@@ -128,22 +187,231 @@ func (c *Client) IsConnected() bool {
 	}
 }
 
+// ConnectionGeneration returns the number of connections the client has
+// made to a broker, it is 0 before the first one and advances with every
+// reconnect. Received messages carry the generation they arrived on, see
+// DetailedMessage.
+func (c *Client) ConnectionGeneration() uint64 {
+	return atomic.LoadUint64(&c.generation)
+}
+
+// SetLogLevel changes which log entries this client produces, without
+// affecting any other client. It may be called at any time, for example to
+// raise the verbosity of a misbehaving connection for a while, and
+// LogLevelDefault restores the behaviour chosen by the logger. The default
+// logger writes debug and info entries to DEBUG, which must be set for them
+// to appear.
+func (c *Client) SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&c.logLevel, int32(level))
+}
+
+// LogLevel returns the level set with SetLogLevel.
+func (c *Client) LogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&c.logLevel))
+}
+
+// logEnabled reports whether entries of the given level pass the level set
+// with SetLogLevel
+func (c *Client) logEnabled(level LogLevel) bool {
+	l := c.LogLevel()
+	return l == LogLevelDefault || level <= l
+}
+
+// debugActive reports whether debug entries will be recorded, so that
+// hot paths can skip building them otherwise
+func (c *Client) debugActive() bool {
+	if l := c.LogLevel(); l != LogLevelDefault {
+		return l >= LogLevelDebug
+	}
+	return c.options.Logger != nil || debugActive()
+}
+
+func (c *Client) debug(comp component, msg string, keysAndValues ...interface{}) {
+	if !c.logEnabled(LogLevelDebug) {
+		return
+	}
+	c.logger.Debug(msg, append([]interface{}{"component", comp.name()}, keysAndValues...)...)
+}
+
+func (c *Client) info(comp component, msg string, keysAndValues ...interface{}) {
+	if !c.logEnabled(LogLevelInfo) {
+		return
+	}
+	c.logger.Info(msg, append([]interface{}{"component", comp.name()}, keysAndValues...)...)
+}
+
+func (c *Client) warn(comp component, msg string, keysAndValues ...interface{}) {
+	if !c.logEnabled(LogLevelWarn) {
+		return
+	}
+	c.logger.Warn(msg, append([]interface{}{"component", comp.name()}, keysAndValues...)...)
+}
+
+func (c *Client) error(comp component, msg string, keysAndValues ...interface{}) {
+	if !c.logEnabled(LogLevelError) {
+		return
+	}
+	c.logger.Error(msg, append([]interface{}{"component", comp.name()}, keysAndValues...)...)
+}
+
+// critical records an error which ends the connection, at the Error level
+// unless the logger has a Critical method, as the default one has
+func (c *Client) critical(comp component, msg string, keysAndValues ...interface{}) {
+	if !c.logEnabled(LogLevelError) {
+		return
+	}
+	keysAndValues = append([]interface{}{"component", comp.name()}, keysAndValues...)
+	if l, ok := c.logger.(criticalLogger); ok {
+		l.Critical(msg, keysAndValues...)
+		return
+	}
+	c.logger.Error(msg, keysAndValues...)
+}
+
+// waitConnected blocks while the client is connecting or reconnecting and
+// reports whether it ended up connected
+func (c *Client) waitConnected() bool {
+	c.RLock()
+	defer c.RUnlock()
+	for atomic.LoadInt32(&c.online) == 0 {
+		switch {
+		case c.status == connecting, c.status == connected:
+		case c.options.AutoReconnect && c.status == reconnecting:
+		default:
+			return false
+		}
+		c.statusChanged.Wait()
+	}
+	return true
+}
+
 func (c *Client) connectionStatus() connStatus {
 	c.RLock()
 	defer c.RUnlock()
 	return c.status
 }
 
+func (c *Client) setBroker(broker *url.URL) {
+	c.Lock()
+	defer c.Unlock()
+	c.broker = broker
+}
+
+// ResponseInformation returns the response information an MQTT 5 broker sent
+// in the CONNACK of the current or last connection, when it was requested with
+// SetRequestResponseInfo. Brokers use it to suggest a prefix for the response
+// topics of request/response exchanges. It is empty if the broker sent none.
+func (c *Client) ResponseInformation() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.responseInfo
+}
+
+func (c *Client) setResponseInformation(info string) {
+	c.Lock()
+	defer c.Unlock()
+	c.responseInfo = info
+}
+
+// ConnectedBroker returns the URL of the broker the client is connected to,
+// which with several brokers configured is the one the last successful
+// connection attempt reached. The bool is false when the client isn't
+// connected.
+func (c *Client) ConnectedBroker() (*url.URL, bool) {
+	if !c.IsConnected() {
+		return nil, false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	if c.broker == nil {
+		return nil, false
+	}
+	broker := *c.broker
+	return &broker, true
+}
+
 func (c *Client) setConnected(status connStatus) {
 	c.Lock()
 	defer c.Unlock()
 	c.status = status
+	if status == connected {
+		atomic.StoreInt32(&c.online, 1)
+	} else {
+		atomic.StoreInt32(&c.online, 0)
+	}
+	c.statusChanged.Broadcast()
 }
 
 //ErrNotConnected is the error returned from function calls that are
 //made when the client is not connected to a broker
 var ErrNotConnected = errors.New("Not Connected")
 
+//ErrDuplicateSubscription is the error returned from Subscribe when the
+//client is already subscribed to the topic and DuplicateSubscriptionError
+//is set
+var ErrDuplicateSubscription = errors.New("Already subscribed")
+
+//ErrInvalidConnect is the error a connection attempt fails with when the
+//CONNECT packet built from the options is malformed, for example with a
+//will retain flag but no will, or a will without a topic. The packet is
+//not sent.
+var ErrInvalidConnect = errors.New("Invalid CONNECT packet")
+
+//ErrExpired is the error set on the token of a publish whose TTL ran
+//out before it could be sent
+var ErrExpired = errors.New("Expired before delivery")
+
+//ErrTimeout is the error returned from function calls that did not
+//complete within the time they were given
+var ErrTimeout = errors.New("Timed out")
+
+//ErrOutgoingStalled is the error the connection is lost with when writing
+//a packet takes longer than OutgoingStallTimeout
+var ErrOutgoingStalled = errors.New("Outgoing write stalled")
+
+//ErrPacketReadTimeout is the error the connection is lost with when a
+//packet from the broker isn't received in full within PacketReadTimeout
+var ErrPacketReadTimeout = errors.New("Packet not received in time")
+
+//ErrCancelled is the error set on the token of a subscribe or unsubscribe
+//when Cancel is called before the broker acknowledged it
+var ErrCancelled = errors.New("Cancelled")
+
+//ErrQueueFull is the error set on the token of a publish which would
+//take the encoded size of the publishes queued or in flight over
+//MaxQueuedBytes
+var ErrQueueFull = errors.New("Queued publishes exceed MaxQueuedBytes")
+
+//ErrTopicAliasInvalid is the error set on the token of a publish with a
+//topic alias the broker doesn't accept, either because it is above the
+//broker's topic alias maximum or because MQTT 5 isn't in use
+var ErrTopicAliasInvalid = errors.New("Topic alias not allowed by broker")
+
+//ErrTopicAliasUnknown is the error set on the token of an alias only
+//publish when the alias hasn't been set to its topic on this connection
+var ErrTopicAliasUnknown = errors.New("Topic alias not set for topic")
+
+// ClearSessionOnce makes the next connection, whether made by Connect or
+// by an automatic reconnect, start a clean session even when CleanSession
+// is false, discarding any session the broker holds for the client ID.
+// With MQTT 5 that connection also asks for a session expiry interval of
+// 0. Once the broker has accepted it, later connections go back to the
+// configured behaviour.
+func (c *Client) ClearSessionOnce() {
+	atomic.StoreInt32(&c.clearSession, 1)
+}
+
+// applyClearSession makes cm start a clean session if ClearSessionOnce
+// asked for one, reporting whether it did
+func (c *Client) applyClearSession(cm *packets.ConnectPacket) bool {
+	if atomic.LoadInt32(&c.clearSession) == 0 {
+		return false
+	}
+	cm.CleanSession = true
+	cm.Properties.SessionExpiryInterval = 0
+	return true
+}
+
 // Connect will create a connection to the message broker
 // If clean session is false, then a slice will
 // be returned containing Receipts for all messages
@@ -153,65 +421,83 @@ var ErrNotConnected = errors.New("Not Connected")
 func (c *Client) Connect() Token {
 	var err error
 	t := newToken(packets.Connect).(*ConnectToken)
-	DEBUG.Println(CLI, "Connect()")
+	c.debug(CLI, "Connect()")
 
 	go func() {
 		c.setConnected(connecting)
 		var rc byte
 		cm := newConnectMsgFromOptions(&c.options)
+		clearing := c.applyClearSession(cm)
 
 		for _, broker := range c.options.Servers {
 		CONN:
-			DEBUG.Println(CLI, "about to write new connect msg")
-			c.conn, err = openConnection(broker, &c.options.TLSConfig, c.options.ConnectTimeout)
+			c.debug(CLI, "about to write new connect msg")
+			c.conn, err = c.openConnection(broker)
 			if err == nil {
-				DEBUG.Println(CLI, "socket connected to broker")
+				c.debug(CLI, "socket connected to broker")
 				switch c.options.ProtocolVersion {
 				case 3:
-					DEBUG.Println(CLI, "Using MQTT 3.1 protocol")
+					c.debug(CLI, "Using MQTT 3.1 protocol")
 					cm.ProtocolName = "MQIsdp"
 					cm.ProtocolVersion = 3
+				case 5:
+					c.debug(CLI, "Using MQTT 5 protocol")
+					cm.ProtocolName = "MQTT"
+					cm.ProtocolVersion = 5
 				default:
-					DEBUG.Println(CLI, "Using MQTT 3.1.1 protocol")
+					c.debug(CLI, "Using MQTT 3.1.1 protocol")
 					c.options.ProtocolVersion = 4
 					cm.ProtocolName = "MQTT"
 					cm.ProtocolVersion = 4
 				}
-				w := bufio.NewWriter(c.conn)
-				cm.Write(w)
-				w.Flush()
+				if err = c.writeConnect(cm, broker); err != nil {
+					// no broker would accept it
+					c.conn.Close()
+					c.conn = nil
+					rc = packets.ErrProtocolViolation
+					break
+				}
 
 				rc = c.connect()
+				if rc == packets.Accepted {
+					c.setBroker(broker)
+					if clearing {
+						atomic.StoreInt32(&c.clearSession, 0)
+					}
+				}
 				if rc != packets.Accepted {
 					c.conn.Close()
 					c.conn = nil
 					//if the protocol version was explicitly set don't do any fallback
 					if c.options.protocolVersionExplicit {
-						ERROR.Println(CLI, "Connecting to", broker, "CONNACK was not CONN_ACCEPTED, but rather", packets.ConnackReturnCodes[rc])
+						c.error(CLI, "CONNACK was not CONN_ACCEPTED", "broker", broker, "returnCode", packets.ConnackReturnCodes[rc])
 						continue
 					}
 					if c.options.ProtocolVersion == 4 {
-						DEBUG.Println(CLI, "Trying reconnect using MQTT 3.1 protocol")
+						c.debug(CLI, "Trying reconnect using MQTT 3.1 protocol")
 						c.options.ProtocolVersion = 3
 						goto CONN
 					}
 				}
 				break
 			} else {
-				ERROR.Println(CLI, err.Error())
-				WARN.Println(CLI, "failed to connect to broker, trying next")
+				c.error(CLI, "failed to open connection", "broker", broker, "err", err)
+				c.warn(CLI, "failed to connect to broker, trying next")
 				rc = packets.ErrNetworkError
 			}
 		}
 
 		if c.conn == nil {
-			ERROR.Println(CLI, "Failed to connect to a broker")
+			c.error(CLI, "Failed to connect to a broker")
 			t.returnCode = rc
-			if rc != packets.ErrNetworkError {
-				t.err = packets.ConnErrors[rc]
+			if err == ErrInvalidConnect {
+				t.err = err
+			} else if rc != packets.ErrNetworkError {
+				t.err = c.connackError(rc)
 			} else {
 				t.err = fmt.Errorf("%s : %s", packets.ConnErrors[rc], err)
 			}
+			c.setConnected(disconnected)
 			t.flowComplete()
 			return
 		}
@@ -231,126 +517,192 @@ func (c *Client) Connect() Token {
 		c.errors = make(chan error)
 		c.stop = make(chan struct{})
 
-		c.incomingPubChan = make(chan *packets.PublishPacket, c.options.MessageChannelDepth)
-		c.msgRouter.matchAndDispatch(c.incomingPubChan, c.options.Order, c)
+		c.incomingPubChan = make(chan incomingPublish, c.options.MessageChannelDepth)
+		c.msgRouter.matchAndDispatch(c.incomingPubChan, c.dispatchMode(), c)
+
+		// outgoing resets the keepalive timer, the channels must exist before it starts
+		c.resetPing = nil
+		c.resetPingResp = nil
+		if c.options.KeepAlive != 0 {
+			c.resetPing = make(chan struct{})
+			c.resetPingResp = make(chan struct{})
+		}
 
 		c.workers.Add(1)
 		go outgoing(c)
 		go alllogic(c)
+		c.startWebsocketKeepalive()
+		c.startOutgoingWatchdog()
+		c.startIdleWatch()
+
+		// Take care of any messages in the store
+		if c.options.CleanSession == false && !clearing {
+			c.resume()
+		} else {
+			c.persist.Reset()
+		}
 
 		c.setConnected(connected)
-		DEBUG.Println(CLI, "client is connected")
+		c.info(CLI, "client is connected")
 		if c.options.OnConnect != nil {
 			go c.options.OnConnect(c)
 		}
 
-		c.resetPing = nil
-		c.resetPingResp = nil
 		if c.options.KeepAlive != 0 {
-			c.resetPing = make(chan struct{})
-			c.resetPingResp = make(chan struct{})
 			c.workers.Add(1)
 			go keepalive(c)
 		}
 
-		// Take care of any messages in the store
-		//var leftovers []Receipt
-		if c.options.CleanSession == false {
-			//leftovers = c.resume()
-		} else {
-			c.persist.Reset()
-		}
-
 		// Do not start incoming until resume has completed
 		c.workers.Add(1)
 		go incoming(c)
 
-		DEBUG.Println(CLI, "exit startClient")
+		c.debug(CLI, "exit startClient")
 		t.flowComplete()
 	}()
 	return t
 }
 
-// internal function used to reconnect the client when it loses its connection
-func (c *Client) reconnect() {
-	DEBUG.Println(CLI, "enter reconnect")
+// internal function used to reconnect the client when it loses its connection,
+// which happened at lost
+func (c *Client) reconnect(lost time.Time) {
+	c.debug(CLI, "enter reconnect")
 	c.setConnected(reconnecting)
 	var rc byte = 1
-	var sleep uint = 1
 	var err error
+	var attempts int
+	var clearing bool
+	var reached *url.URL
+	delay := c.options.InitialReconnectDelay
+	if max := c.options.MaxReconnectInterval; max > 0 && delay > max {
+		delay = max
+	}
 
 	for rc != 0 {
 		cm := newConnectMsgFromOptions(&c.options)
+		clearing = c.applyClearSession(cm)
 
 		for _, broker := range c.options.Servers {
 		CONN:
-			DEBUG.Println(CLI, "about to write new connect msg")
-			c.conn, err = openConnection(broker, &c.options.TLSConfig, c.options.ConnectTimeout)
+			c.debug(CLI, "about to write new connect msg")
+			c.conn, err = c.openConnection(broker)
 			if err == nil {
-				DEBUG.Println(CLI, "socket connected to broker")
+				c.debug(CLI, "socket connected to broker")
 				switch c.options.ProtocolVersion {
 				case 3:
-					DEBUG.Println(CLI, "Using MQTT 3.1 protocol")
+					c.debug(CLI, "Using MQTT 3.1 protocol")
 					cm.ProtocolName = "MQIsdp"
 					cm.ProtocolVersion = 3
+				case 5:
+					c.debug(CLI, "Using MQTT 5 protocol")
+					cm.ProtocolName = "MQTT"
+					cm.ProtocolVersion = 5
 				default:
-					DEBUG.Println(CLI, "Using MQTT 3.1.1 protocol")
+					c.debug(CLI, "Using MQTT 3.1.1 protocol")
 					c.options.ProtocolVersion = 4
 					cm.ProtocolName = "MQTT"
 					cm.ProtocolVersion = 4
 				}
-				w := bufio.NewWriter(c.conn)
-				cm.Write(w)
-				w.Flush()
+				if err = c.writeConnect(cm, broker); err != nil {
+					c.conn.Close()
+					c.conn = nil
+					if err == ErrInvalidConnect {
+						// built from the options, so no broker would accept it
+						if c.options.OnError != nil {
+							go c.options.OnError(err)
+						}
+						c.giveUpReconnecting(attempts, err)
+						return
+					}
+					rc = packets.ErrProtocolViolation
+					continue
+				}
 
 				rc = c.connect()
+				if rc == packets.Accepted {
+					c.setBroker(broker)
+					reached = broker
+					if clearing {
+						atomic.StoreInt32(&c.clearSession, 0)
+					}
+				}
 				if rc != packets.Accepted {
 					c.conn.Close()
 					c.conn = nil
 					//if the protocol version was explicitly set don't do any fallback
 					if c.options.protocolVersionExplicit {
-						ERROR.Println(CLI, "Connecting to", broker, "CONNACK was not Accepted, but rather", packets.ConnackReturnCodes[rc])
+						c.error(CLI, "CONNACK was not Accepted", "broker", broker, "returnCode", packets.ConnackReturnCodes[rc])
 						continue
 					}
 					if c.options.ProtocolVersion == 4 {
-						DEBUG.Println(CLI, "Trying reconnect using MQTT 3.1 protocol")
+						c.debug(CLI, "Trying reconnect using MQTT 3.1 protocol")
 						c.options.ProtocolVersion = 3
 						goto CONN
 					}
 				}
 				break
 			} else {
-				ERROR.Println(CLI, err.Error())
-				WARN.Println(CLI, "failed to connect to broker, trying next")
+				c.error(CLI, "failed to open connection", "broker", broker, "err", err)
+				c.warn(CLI, "failed to connect to broker, trying next")
 				rc = packets.ErrNetworkError
 			}
 		}
 		if rc != 0 {
-			DEBUG.Println(CLI, "Reconnect failed, sleeping for", sleep, "seconds")
-			time.Sleep(time.Duration(sleep) * time.Second)
-			if sleep <= uint(c.options.MaxReconnectInterval.Seconds()) {
-				sleep *= 2
+			attempts++
+			if c.options.MaxReconnectAttempts > 0 && attempts >= c.options.MaxReconnectAttempts {
+				if err == nil {
+					err = c.connackError(rc)
+				}
+				c.giveUpReconnecting(attempts, err)
+				return
 			}
+			c.debug(CLI, "Reconnect failed, sleeping", "delay", delay)
+			time.Sleep(delay)
+			delay = nextReconnectDelay(delay, c.options.MaxReconnectInterval)
 		}
 	}
 
 	c.stop = make(chan struct{})
 
+	// outgoing resets the keepalive timer, the channels must exist before it starts
+	c.resetPing = nil
+	c.resetPingResp = nil
+	if c.options.KeepAlive != 0 {
+		c.resetPing = make(chan struct{})
+		c.resetPingResp = make(chan struct{})
+	}
+
 	c.workers.Add(1)
 	go outgoing(c)
 	go alllogic(c)
+	c.startWebsocketKeepalive()
+	c.startOutgoingWatchdog()
+	c.startIdleWatch()
+
+	unsent := c.takeUnsent()
+	if clearing {
+		c.persist.Reset()
+	} else if c.options.CleanSession == false {
+		// the publishes which failed to be written are resent from the store
+		unsent = nil
+		c.resume()
+	}
+	for _, pub := range unsent {
+		c.debug(CLI, "resending publish which failed to be written", "id", pub.p.Details().MessageID)
+	}
+	c.resendInflight(unsent)
 
 	c.setConnected(connected)
-	DEBUG.Println(CLI, "client is reconnected")
+	downtime := time.Since(lost)
+	c.info(CLI, "client is reconnected", "downtime", downtime)
 	if c.options.OnConnect != nil {
 		go c.options.OnConnect(c)
 	}
+	if c.options.OnReconnectSuccess != nil {
+		go c.options.OnReconnectSuccess(downtime, reached)
+	}
 
-	c.resetPing = nil
-	c.resetPingResp = nil
 	if c.options.KeepAlive != 0 {
-		c.resetPing = make(chan struct{})
-		c.resetPingResp = make(chan struct{})
 		c.workers.Add(1)
 		go keepalive(c)
 	}
@@ -358,6 +710,125 @@ func (c *Client) reconnect() {
 	go incoming(c)
 }
 
+// giveUpReconnecting stops the client reconnecting after attempts failed
+// attempts, err being the last error
+func (c *Client) giveUpReconnecting(attempts int, err error) {
+	c.error(CLI, "giving up reconnecting", "attempts", attempts, "err", err)
+	c.setConnected(disconnected)
+	if c.options.OnReconnectGaveUp != nil {
+		go c.options.OnReconnectGaveUp(err)
+	}
+}
+
+// minReconnectDelay is the wait after an immediate retry, which an
+// InitialReconnectDelay of 0 asks for, from which later waits double
+const minReconnectDelay = time.Second
+
+// nextReconnectDelay doubles the wait between reconnection attempts, without
+// going beyond max. A max of 0 keeps the wait as it is.
+func nextReconnectDelay(delay, max time.Duration) time.Duration {
+	if delay >= max {
+		return delay
+	}
+	if delay <= 0 {
+		delay = minReconnectDelay
+	} else {
+		delay *= 2
+	}
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	return delay
+}
+
+// openConnection establishes the network connection to a broker, either
+// with the user supplied function or one of the built in transports
+func (c *Client) openConnection(broker *url.URL) (net.Conn, error) {
+	conn, err := c.dial(broker)
+	if err != nil {
+		return nil, err
+	}
+	c.setSocketBuffers(conn)
+	return conn, nil
+}
+
+// dial opens a connection to broker with the transport its scheme names,
+// or with CustomOpenConnectionFn if set
+func (c *Client) dial(broker *url.URL) (net.Conn, error) {
+	if c.options.CustomOpenConnectionFn != nil {
+		return c.options.CustomOpenConnectionFn(broker)
+	}
+	if c.options.WebsocketCompression && (broker.Scheme == "ws" || broker.Scheme == "wss") {
+		return dialWebsocketDeflate(broker, c.tlsConfig(broker), c.options.ConnectTimeout)
+	}
+	return openConnection(broker, c.tlsConfig(broker), c.options.ConnectTimeout)
+}
+
+// tlsConfig returns the TLS configuration for connecting to broker, which is
+// the one set by SetTLSConfig or else TLSConfig, with the server name given by
+// TLSServerNameForBroker, if any
+func (c *Client) tlsConfig(broker *url.URL) *tls.Config {
+	tlsc := &c.options.TLSConfig
+	if set, _ := c.tlsSet.Load().(*tls.Config); set != nil {
+		tlsc = set
+	}
+	if c.options.TLSServerNameForBroker != nil {
+		if name := c.options.TLSServerNameForBroker(broker); name != "" {
+			tlsc = tlsc.Clone()
+			tlsc.ServerName = name
+		}
+	}
+	return tlsc
+}
+
+// SetTLSConfig replaces the TLS configuration used for the connections the
+// client makes from now on, such as when it reconnects, for example to rotate
+// certificates without recreating the client. The current connection is left
+// as it is, closing it makes the client reconnect with the new configuration
+// if AutoReconnect is set. The configuration is copied, a connection being
+// made at the time uses either the old one or the new one. A nil t goes back
+// to the TLSConfig of the options.
+func (c *Client) SetTLSConfig(t *tls.Config) {
+	if t != nil {
+		t = t.Clone()
+	}
+	c.tlsSet.Store(t)
+}
+
+// socketBuffers is implemented by connections whose socket buffer sizes
+// can be set, such as *net.TCPConn
+type socketBuffers interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setSocketBuffers applies ReadBufferBytes and WriteBufferBytes to conn, or
+// for TLS to the connection beneath it. Failures are only logged, the
+// connection is still usable with the buffers it has.
+func (c *Client) setSocketBuffers(conn net.Conn) {
+	if c.options.ReadBufferBytes <= 0 && c.options.WriteBufferBytes <= 0 {
+		return
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	s, ok := conn.(socketBuffers)
+	if !ok {
+		c.debug(NET, "socket buffer sizes not settable on connection")
+		return
+	}
+	if n := c.options.ReadBufferBytes; n > 0 {
+		if err := s.SetReadBuffer(n); err != nil {
+			c.warn(NET, "failed to set socket read buffer", "bytes", n, "err", err)
+		}
+	}
+	if n := c.options.WriteBufferBytes; n > 0 {
+		if err := s.SetWriteBuffer(n); err != nil {
+			c.warn(NET, "failed to set socket write buffer", "bytes", n, "err", err)
+		}
+	}
+}
+
 type ConnectPacketReader struct {
 	io.Reader
 }
@@ -370,75 +841,295 @@ func (cpr ConnectPacketReader) ReadByte() (byte, error) {
 	return b[0], err
 }
 
+// buildConnect returns the CONNECT to send for one connection attempt to
+// broker, which is cm unless a credentials provider or the
+// ConnectPacketBuilder option changes it
+func (c *Client) buildConnect(cm *packets.ConnectPacket, broker *url.URL) *packets.ConnectPacket {
+	if c.options.ConnectPacketBuilder == nil && c.options.CredentialsProvider == nil && c.options.BrokerCredentialsProvider == nil {
+		return cm
+	}
+	// changes are made to a copy so that cm is the same for each attempt
+	base := *cm
+	if cm.Properties != nil {
+		props := *cm.Properties
+		base.Properties = &props
+	}
+	if c.options.CredentialsProvider != nil || c.options.BrokerCredentialsProvider != nil {
+		var username, password string
+		if c.options.BrokerCredentialsProvider != nil {
+			username, password = c.options.BrokerCredentialsProvider(broker)
+		} else {
+			username, password = c.options.CredentialsProvider()
+		}
+		base.UsernameFlag, base.Username = username != "", username
+		//mustn't have password without user as well
+		base.PasswordFlag = base.UsernameFlag && password != ""
+		base.Password = nil
+		if base.PasswordFlag {
+			base.Password = []byte(password)
+		}
+	}
+	if c.options.ConnectPacketBuilder == nil {
+		return &base
+	}
+	if m := c.options.ConnectPacketBuilder(&base); m != nil {
+		return m
+	}
+	return &base
+}
+
+// writeConnect sends the CONNECT for a connection attempt to broker, built
+// from cm by buildConnect. It fails with ErrInvalidConnect, without sending
+// anything, if the packet is malformed.
+func (c *Client) writeConnect(cm *packets.ConnectPacket, broker *url.URL) error {
+	m := c.buildConnect(cm, broker)
+	if rc := m.Validate(); rc != packets.Accepted {
+		c.error(CLI, "CONNECT packet is invalid", "err", packets.ConnErrors[rc], "willFlag", m.WillFlag, "willTopic", m.WillTopic, "willQos", m.WillQos, "willRetain", m.WillRetain)
+		return ErrInvalidConnect
+	}
+	w := bufio.NewWriter(c.conn)
+	m.Write(w)
+	w.Flush()
+	return nil
+}
+
 // This function is only used for receiving a connack
 // when the connection is first started.
 // This prevents receiving incoming data while resume
 // is in progress if clean session is false.
 func (c *Client) connect() byte {
-	DEBUG.Println(NET, "connect started")
+	c.debug(NET, "connect started")
 
-	ca, err := packets.ReadPacket(ConnectPacketReader{c.conn})
-	if err != nil {
-		ERROR.Println(NET, "connect got error", err)
-		return packets.ErrNetworkError
+	var msg *packets.ConnackPacket
+	for {
+		ca, err := packets.ReadPacketVersion(ConnectPacketReader{c.conn}, byte(c.options.ProtocolVersion))
+		if err != nil {
+			err = c.decodeError(err)
+			c.error(NET, "connect got error", "err", err)
+			return packets.ErrNetworkError
+		}
+		if ca == nil {
+			c.error(NET, "received nil packet")
+			return packets.ErrNetworkError
+		}
+
+		if connack, ok := ca.(*packets.ConnackPacket); ok {
+			msg = connack
+			break
+		}
+		if !c.options.AllowPreConnackPackets {
+			c.error(NET, "received msg that was not CONNACK", "type", reflect.TypeOf(ca))
+			ca.Release()
+			return packets.ErrProtocolViolation
+		}
+		c.warn(NET, "received msg before CONNACK", "type", reflect.TypeOf(ca))
+		if c.options.OnUnhandledPacket != nil {
+			// not released, the handler may keep the packet
+			go c.options.OnUnhandledPacket(ca)
+		} else {
+			ca.Release()
+		}
+	}
+
+	c.debug(NET, "received connack")
+	if c.options.OnConnack != nil {
+		c.options.OnConnack(msg)
 	}
-	if ca == nil {
-		ERROR.Println(NET, "received nil packet")
-		return packets.ErrNetworkError
+	var maxPacketSize uint32
+	var receiveMax uint16
+	if msg.Properties != nil {
+		maxPacketSize = msg.Properties.MaximumPacketSize
+		receiveMax = msg.Properties.ReceiveMaximum
+	}
+	atomic.StoreUint32(&c.maxPacketSize, maxPacketSize)
+	if msg.ReturnCode == packets.Accepted {
+		atomic.AddUint64(&c.generation, 1)
+		// topic aliases only last as long as the connection
+		c.aliasLock.Lock()
+		c.aliases = make(map[uint16]string)
+		c.aliasMax = 0
+		if msg.Properties != nil {
+			c.aliasMax = msg.Properties.TopicAliasMaximum
+		}
+		c.aliasLock.Unlock()
+		sessionPresent := msg.TopicNameCompression&0x01 != 0
+		if !sessionPresent {
+			// the broker has no session for us, so holds none of our subscriptions
+			c.subscribedLock.Lock()
+			c.subscribed = make(map[string]byte)
+			c.subscribedLock.Unlock()
+		}
+		c.setReceiveMaximum(int(receiveMax), sessionPresent)
+		c.setCapabilities(capabilitiesFromProperties(msg.Properties))
+		var responseInfo string
+		if msg.Properties != nil {
+			responseInfo = msg.Properties.ResponseInformation
+		}
+		c.setResponseInformation(responseInfo)
 	}
+	return msg.ReturnCode
+}
 
-	msg, ok := ca.(*packets.ConnackPacket)
-	if !ok {
-		ERROR.Println(NET, "received msg that was not CONNACK")
-		return packets.ErrNetworkError
+// dispatchMode returns how the router is to call message handlers, as set
+// by OrderMatters and OrderPerSubscription
+func (c *Client) dispatchMode() dispatchMode {
+	switch {
+	case c.options.Order:
+		return dispatchOrdered
+	case c.options.OrderPerSubscription:
+		return dispatchPerRoute
 	}
+	return dispatchUnordered
+}
 
-	DEBUG.Println(NET, "received connack")
-	return msg.ReturnCode
+// connackError returns the error for the return code of a CONNACK, which
+// for MQTT 5 is a reason code
+func (c *Client) connackError(rc byte) error {
+	errs := packets.ConnErrors
+	if c.options.ProtocolVersion == 5 {
+		errs = packets.ConnErrorsV5
+	}
+	if err, ok := errs[rc]; ok {
+		return err
+	}
+	return fmt.Errorf("Connection refused with code 0x%02x", rc)
 }
 
 // Disconnect will end the connection with the server, but not before waiting
 // the specified number of milliseconds to wait for existing work to be
 // completed.
 func (c *Client) Disconnect(quiesce uint) {
-	if !c.IsConnected() {
-		WARN.Println(CLI, "already disconnected")
+	if !c.isActive() {
+		c.warn(CLI, "already disconnected")
 		return
 	}
-	DEBUG.Println(CLI, "disconnecting")
+	c.info(CLI, "disconnecting")
+	wasIdle := c.connectionStatus() == idle
 	c.setConnected(disconnected)
 
-	dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
-	dt := newToken(packets.Disconnect)
-	c.oboundP <- &PacketAndToken{p: dm, t: dt}
+	if !wasIdle {
+		dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+		dt := newToken(packets.Disconnect)
+		c.oboundP <- &PacketAndToken{p: dm, t: dt}
 
-	// wait for work to finish, or quiesce time consumed
-	dt.WaitTimeout(time.Duration(quiesce) * time.Millisecond)
+		// wait for work to finish, or quiesce time consumed
+		dt.WaitTimeout(time.Duration(quiesce) * time.Millisecond)
+	}
 	c.disconnect()
 }
 
+// ErrReconnectRequested is the error passed to the ConnectionLostHandler when
+// the connection is dropped by Reconnect
+var ErrReconnectRequested = errors.New("Reconnect requested")
+
+// Reconnect drops the connection to the broker and has the client reconnect at
+// once, rather than waiting for the keepalive to notice a half-open connection,
+// or to pick up a configuration changed with SetTLSConfig. The connection is
+// lost as it would be on a network error, with the ConnectionLostHandler called
+// with ErrReconnectRequested, so AutoReconnect must be set. The token completes
+// once the client has reconnected, or with ErrNotConnected if it gives up or is
+// disconnected first. When the client is already connecting or reconnecting no
+// connection is dropped, the token completes along with that attempt.
+func (c *Client) Reconnect() Token {
+	token := &ReconnectToken{baseToken: baseToken{complete: make(chan struct{})}}
+	if !c.options.AutoReconnect {
+		token.err = errors.New("Reconnect requires AutoReconnect")
+		token.flowComplete()
+		return token
+	}
+	gen := c.ConnectionGeneration()
+	c.RLock()
+	status := c.status
+	var errs chan error
+	var stop chan struct{}
+	if status == connected {
+		// they are only replaced once reconnecting
+		errs, stop = c.errors, c.stop
+	}
+	c.RUnlock()
+	switch status {
+	case connected:
+		c.info(CLI, "reconnect requested")
+		atomic.StoreInt32(&c.online, 0)
+		// alllogic takes this as a connection error, unless the connection
+		// has been lost meanwhile
+		go func() {
+			select {
+			case errs <- ErrReconnectRequested:
+			case <-stop:
+			}
+		}()
+	case connecting, reconnecting:
+	case idle:
+		c.wake()
+	default:
+		token.err = ErrNotConnected
+		token.flowComplete()
+		return token
+	}
+	go func() {
+		if !c.waitReconnected(gen) {
+			token.m.Lock()
+			token.err = ErrNotConnected
+			token.m.Unlock()
+		}
+		token.flowComplete()
+	}()
+	return token
+}
+
+// waitReconnected blocks until the client is connected by a connection made
+// after the generation gen, or has been disconnected, and reports which
+func (c *Client) waitReconnected(gen uint64) bool {
+	c.RLock()
+	defer c.RUnlock()
+	for atomic.LoadUint64(&c.generation) <= gen || atomic.LoadInt32(&c.online) == 0 {
+		if c.status == disconnected {
+			return false
+		}
+		c.statusChanged.Wait()
+	}
+	return true
+}
+
 // ForceDisconnect will end the connection with the mqtt broker immediately.
 func (c *Client) forceDisconnect() {
-	if !c.IsConnected() {
-		WARN.Println(CLI, "already disconnected")
+	if !c.isActive() {
+		c.warn(CLI, "already disconnected")
 		return
 	}
 	c.setConnected(disconnected)
 	c.conn.Close()
-	DEBUG.Println(CLI, "forcefully disconnecting")
+	c.info(CLI, "forcefully disconnecting")
 	c.disconnect()
 }
 
 func (c *Client) internalConnLost(err error) {
-	close(c.stop)
+	lost := time.Now()
+	atomic.StoreInt32(&c.online, 0)
+	select {
+	case <-c.stop:
+		// Disconnect has closed it meanwhile
+	default:
+		close(c.stop)
+	}
 	c.conn.Close()
+	if !c.options.AutoReconnect {
+		// before waiting, as a delivery may be blocked on a full channel
+		c.closeAllSubChans()
+	}
 	c.workers.Wait()
-	if c.IsConnected() {
+	c.failPings()
+	c.freeCancelled()
+	if c.idleDone() {
+		return
+	}
+	if c.isActive() {
 		if c.options.OnConnectionLost != nil {
 			go c.options.OnConnectionLost(c, err)
 		}
 		if c.options.AutoReconnect {
-			go c.reconnect()
+			go c.reconnect(lost)
 		} else {
 			c.setConnected(disconnected)
 		}
@@ -453,31 +1144,215 @@ func (c *Client) disconnect() {
 		close(c.stop)
 	}
 	c.conn.Close()
+	c.closeAllSubChans()
+	c.stopRetainedTimers(nil)
 	c.workers.Wait()
+	c.failPings()
+	// let publishes waiting for the receive maximum fail
+	c.setReceiveMaximum(0, false)
+	c.resetQueued()
+	c.takeUnsent()
 	close(c.stopRouter)
-	DEBUG.Println(CLI, "disconnected")
+	c.info(CLI, "disconnected")
 	c.persist.Close()
 }
 
+// Flush waits until every packet queued for sending before the call, on
+// both the publish and the control packet queues, has been written to the
+// network connection. Unlike the quiesce period of Disconnect it does not
+// wait for acknowledgements. Returns false if the timeout elapses first.
+func (c *Client) Flush(timeout time.Duration) bool {
+	if !c.isActive() {
+		return false
+	}
+	deadline := time.After(timeout)
+	markers := []*baseToken{{complete: make(chan struct{})}, {complete: make(chan struct{})}}
+	for i, queue := range []chan *PacketAndToken{c.obound, c.oboundP} {
+		select {
+		case queue <- &PacketAndToken{p: nil, t: markers[i]}:
+		case <-deadline:
+			return false
+		}
+	}
+	for _, marker := range markers {
+		select {
+		case <-marker.complete:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// keepUnsent holds on to a QoS 1 or 2 publish whose write failed so that
+// it is sent again, with the DUP flag set, once the client has reconnected.
+// Its token is left pending. Reports whether the publish was kept, which it
+// isn't when the client won't reconnect.
+func (c *Client) keepUnsent(pub *PacketAndToken) bool {
+	if pub.p.Details().Qos == 0 || !c.options.AutoReconnect {
+		return false
+	}
+	switch p := pub.p.(type) {
+	case *packets.PublishPacket:
+		p.Dup = true
+	case *packets.EncodedPublishPacket:
+		p.Dup = true
+	}
+	c.unsentLock.Lock()
+	c.unsent = append(c.unsent, pub)
+	c.unsentLock.Unlock()
+	return true
+}
+
+// takeUnsent returns the publishes kept by keepUnsent, forgetting them
+func (c *Client) takeUnsent() []*PacketAndToken {
+	c.unsentLock.Lock()
+	defer c.unsentLock.Unlock()
+	unsent := c.unsent
+	c.unsent = nil
+	return unsent
+}
+
+// resume sends again the messages which were left unacknowledged in the
+// store by an earlier connection, which may have been made by a previous run
+// of the program when a persistent Store is used. Publishes are resent with
+// the DUP flag set, counting against the broker's receive maximum like new
+// ones, and for QoS 2 flows which had already got their PUBREC the PUBREL is
+// sent.
+func (c *Client) resume() {
+	var ids []int
+	for _, key := range c.persist.All() {
+		if strings.HasPrefix(key, outboundPrefix) {
+			ids = append(ids, int(mIDFromKey(key)))
+		}
+	}
+	sort.Ints(ids)
+	var pubs []*PacketAndToken
+	for _, i := range ids {
+		id := uint16(i)
+		m := c.persist.Get(outboundKeyFromMID(id))
+		switch m.(type) {
+		case *packets.PublishPacket, *packets.EncodedPublishPacket, *packets.PubrelPacket:
+		default:
+			// subscriptions stored by older versions are not resumed
+			c.persist.Del(outboundKeyFromMID(id))
+			continue
+		}
+		token := c.getToken(id)
+		if token == nil {
+			token = newToken(packets.Publish)
+			token.(*PublishToken).messageID = id
+			c.claimID(id, token)
+		}
+		c.debug(CLI, "resending stored message", "id", id)
+		switch p := m.(type) {
+		case *packets.PublishPacket:
+			p.Dup = true
+			if pt, ok := token.(*PublishToken); ok && pt.topic == "" {
+				pt.topic = string(p.TopicName)
+			}
+			pubs = append(pubs, &PacketAndToken{p: p, t: token})
+		case *packets.EncodedPublishPacket:
+			p.Dup = true
+			pubs = append(pubs, &PacketAndToken{p: p, t: token})
+		case *packets.PubrelPacket:
+			c.oboundP <- &PacketAndToken{p: p, t: nil}
+		}
+	}
+	c.resendInflight(pubs)
+}
+
 // Publish will publish a message with the specified QoS and content
 // to the specified topic.
 // Returns a token to track delivery of the message to the broker
+// Publishes made from a single goroutine are written to the network
+// in the order Publish was called, regardless of their QoS. Control
+// packets such as subscribes and acks may be sent ahead of them.
 func (c *Client) Publish(topic string, qos byte, retained bool, payload interface{}) Token {
+	return c.PublishWithTTL(topic, qos, retained, payload, 0)
+}
+
+// PublishWithTTL is like Publish but gives up on the message if it is still
+// queued ttl after the call, for example because the client was reconnecting
+// all that time. The token of such a message completes with ErrExpired. A ttl
+// of 0 means the message never expires.
+func (c *Client) PublishWithTTL(topic string, qos byte, retained bool, payload interface{}, ttl time.Duration) Token {
+	return c.publish(topic, qos, retained, payload, ttl, PublishOptions{})
+}
+
+// PublishOptions gives control of MQTT 5 features of a publish to
+// PublishWithOptions, they are ignored with earlier protocol versions.
+//
+// A TopicAlias of 0 means no alias is used. Otherwise when SendFullTopic is
+// set the topic is sent along with the alias, setting or replacing what the
+// alias stands for on the broker, and when it isn't only the alias is sent,
+// which requires the alias to have been set to the same topic earlier on the
+// current connection.
+//
+// MessageExpiry asks the broker to discard the message if it hasn't been
+// delivered to a subscriber that long after it was received, it is sent in
+// whole seconds rounded up. 0 means the message never expires.
+//
+// ResponseTopic and CorrelationData make the message a request, telling the
+// receiver where to publish the response and what to identify it with. The
+// correlation data is binary and is sent as it is.
+type PublishOptions struct {
+	TopicAlias      uint16
+	SendFullTopic   bool
+	MessageExpiry   time.Duration
+	ResponseTopic   string
+	CorrelationData []byte
+}
+
+// PublishWithOptions is like Publish but takes PublishOptions to control how
+// the topic is sent. Aliases are forgotten when the connection is lost, so an
+// alias only publish fails with ErrTopicAliasUnknown until the alias is sent
+// with its topic again. Publishes queued or resent across a reconnect are
+// written with their topic, setting the alias on the new connection.
+func (c *Client) PublishWithOptions(topic string, qos byte, retained bool, payload interface{}, opts PublishOptions) Token {
+	return c.publish(topic, qos, retained, payload, 0, opts)
+}
+
+func (c *Client) publish(topic string, qos byte, retained bool, payload interface{}, ttl time.Duration, opts PublishOptions) Token {
 	token := newToken(packets.Publish).(*PublishToken)
-	DEBUG.Println(CLI, "enter Publish")
-	switch {
-	case !c.IsConnected():
-		token.err = ErrNotConnected
+	token.topic = topic
+	c.debug(CLI, "enter Publish")
+	qos = c.capPublishQos(topic, qos)
+	woke := c.wake()
+	// a QoS 0 publish which woke an idle client isn't dropped while reconnecting
+	if ok, err := c.checkPublish(qos); !ok && !(woke && err == nil) {
+		token.err = err
 		token.flowComplete()
 		return token
-	case c.connectionStatus() == reconnecting && qos == 0:
+	}
+	qos, err := c.supportsPublish(qos, retained, true)
+	if err != nil {
+		token.err = err
 		token.flowComplete()
 		return token
 	}
+	token.qos = qos
 	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.ProtocolLevel = byte(c.options.ProtocolVersion)
 	pub.Qos = qos
 	pub.TopicName = []byte(topic)
 	pub.Retain = retained
+	if c.options.ProtocolVersion == 5 && (opts.MessageExpiry > 0 || opts.ResponseTopic != "" || len(opts.CorrelationData) > 0) {
+		pub.Properties = &packets.Properties{
+			ResponseTopic:   opts.ResponseTopic,
+			CorrelationData: opts.CorrelationData,
+		}
+		if opts.MessageExpiry > 0 {
+			pub.Properties.MessageExpiryInterval = uint32((opts.MessageExpiry + time.Second - 1) / time.Second)
+		}
+	}
+	if opts.TopicAlias != 0 {
+		if err := c.applyTopicAlias(pub, token, topic, opts); err != nil {
+			token.err = err
+			token.flowComplete()
+			return token
+		}
+	}
 	switch payload.(type) {
 	case string:
 		pub.Payload = []byte(payload.(string))
@@ -489,95 +1364,539 @@ func (c *Client) Publish(topic string, qos byte, retained bool, payload interfac
 		return token
 	}
 
-	DEBUG.Println(CLI, "sending publish message, topic:", topic)
-	c.obound <- &PacketAndToken{p: pub, t: token}
+	if retained && len(pub.Payload) == 0 {
+		c.forgetRetained(topic)
+	}
+
+	c.debug(CLI, "sending publish message", "topic", topic)
+	pt := &PacketAndToken{p: pub, t: token}
+	if ttl > 0 {
+		pt.expires = time.Now().Add(ttl)
+	}
+	c.queuePublish(pt, qos)
+	return token
+}
+
+// checkPublish decides, following the PublishWhenDisconnected policy, whether
+// a publish of the given QoS is to be sent. It returns false with a nil error
+// for a QoS 0 publish which is dropped while reconnecting.
+func (c *Client) checkPublish(qos byte) (bool, error) {
+	switch c.options.PublishWhenDisconnected {
+	case PublishWhenDisconnectedError:
+		if !c.IsConnected() {
+			return false, ErrNotConnected
+		}
+	case PublishWhenDisconnectedBlock:
+		if !c.waitConnected() {
+			return false, ErrNotConnected
+		}
+	}
+	switch {
+	case !c.isActive():
+		return false, ErrNotConnected
+	case c.connectionStatus() == reconnecting && qos == 0:
+		return false, nil
+	}
+	return true, nil
+}
+
+// capPublishQos lowers the QoS of a publish to MaxPublishQoS, if set
+func (c *Client) capPublishQos(topic string, qos byte) byte {
+	if max := c.options.MaxPublishQoS; max != nil && qos > *max && qos <= 2 {
+		c.info(CLI, "publish QoS lowered to the maximum", "topic", topic, "qos", qos, "maximum", *max)
+		return *max
+	}
+	return qos
+}
+
+// capSubscribeQos lowers the QoS of a subscription to MaxSubscribeQoS, if set
+func (c *Client) capSubscribeQos(filter string, qos byte) byte {
+	if max := c.options.MaxSubscribeQoS; max != nil && qos > *max && qos <= 2 {
+		c.info(CLI, "subscribe QoS lowered to the maximum", "filter", filter, "qos", qos, "maximum", *max)
+		return *max
+	}
+	return qos
+}
+
+// ClearRetained removes the retained message on topic by publishing an
+// empty retained message to it, which the broker takes as a request to
+// discard what it holds rather than as a message to retain.
+func (c *Client) ClearRetained(topic string, qos byte) Token {
+	return c.Publish(topic, qos, true, []byte(nil))
+}
+
+// applyTopicAlias adds the alias to pub, checking that the broker allows it
+// and, if only the alias is to be sent, that it was set to the same topic
+// earlier. The topic is only left out when pub is written, by useTopicAlias.
+func (c *Client) applyTopicAlias(pub *packets.PublishPacket, token *PublishToken, topic string, opts PublishOptions) error {
+	c.aliasLock.Lock()
+	defer c.aliasLock.Unlock()
+	if c.options.ProtocolVersion != 5 || opts.TopicAlias > c.aliasMax {
+		return ErrTopicAliasInvalid
+	}
+	if opts.SendFullTopic {
+		c.aliases[opts.TopicAlias] = topic
+	} else if c.aliases[opts.TopicAlias] != topic {
+		return ErrTopicAliasUnknown
+	}
+	if pub.Properties == nil {
+		pub.Properties = &packets.Properties{}
+	}
+	pub.Properties.TopicAlias = opts.TopicAlias
+	token.sendFullTopic = opts.SendFullTopic
+	return nil
+}
+
+// useTopicAlias is called by outgoing before writing msg, with the aliases
+// set on its connection. The topic of an aliased publish is left out when
+// the alias already stands for it on this connection, unless the topic was
+// asked to be sent, and the removed topic is returned so that it can be put
+// back. Otherwise the topic is sent to set the alias, which happens when a
+// publish is written on a later connection than the one it was queued on,
+// and an alias above the broker's maximum is dropped.
+func (c *Client) useTopicAlias(aliases map[uint16]string, msg packets.ControlPacket, t Token) []byte {
+	pub, ok := msg.(*packets.PublishPacket)
+	if !ok || pub.Properties == nil || pub.Properties.TopicAlias == 0 {
+		return nil
+	}
+	alias := pub.Properties.TopicAlias
+	c.aliasLock.Lock()
+	defer c.aliasLock.Unlock()
+	if alias > c.aliasMax {
+		pub.Properties.TopicAlias = 0
+		return nil
+	}
+	full := false
+	if token, ok := t.(*PublishToken); ok {
+		full = token.sendFullTopic
+	}
+	topic := string(pub.TopicName)
+	if !full && aliases[alias] == topic {
+		removed := pub.TopicName
+		pub.TopicName = nil
+		return removed
+	}
+	aliases[alias] = topic
+	// later alias only publishes may rely on it
+	c.aliases[alias] = topic
+	return nil
+}
+
+// PublishBytes sends a PUBLISH packet which was encoded in advance with
+// packets.PublishPacket.Marshal, avoiding the cost of encoding a message that
+// is sent repeatedly. Packets are sent as given except that the DUP flag is
+// cleared, it is only set when the client sends a message again, and for QoS
+// 1 and 2 a fresh message ID replaces the encoded one. The slice is not
+// modified so it may be reused for later calls, but must not be changed until
+// the returned token completes.
+func (c *Client) PublishBytes(preEncoded []byte) Token {
+	token := newToken(packets.Publish).(*PublishToken)
+	c.debug(CLI, "enter PublishBytes")
+	pub, err := packets.NewEncodedPublishPacket(preEncoded)
+	if err != nil {
+		token.err = err
+		token.flowComplete()
+		return token
+	}
+	woke := c.wake()
+	if ok, err := c.checkPublish(pub.Qos); !ok && !(woke && err == nil) {
+		token.err = err
+		token.flowComplete()
+		return token
+	}
+	if max := c.options.MaxPublishQoS; max != nil && pub.Qos > *max {
+		// the encoded message can't be lowered
+		c.warn(CLI, "pre-encoded publish above the maximum QoS", "qos", pub.Qos, "maximum", *max)
+		token.err = ErrInvalidQos
+		token.flowComplete()
+		return token
+	}
+	if _, err := c.supportsPublish(pub.Qos, pub.Retain, false); err != nil {
+		token.err = err
+		token.flowComplete()
+		return token
+	}
+	token.qos = pub.Qos
+	// DUP is only set when the message is sent again, see resume
+	pub.Dup = false
+
+	c.debug(CLI, "sending pre-encoded publish message")
+	c.queuePublish(&PacketAndToken{p: pub, t: token}, pub.Qos)
 	return token
 }
 
 // Subscribe starts a new subscription. Provide a MessageHandler to be executed when
-// a message is published on the topic provided.
+// a message is published on the topic provided. What happens when the client is
+// already subscribed to exactly the same topic is set by the DuplicateSubscriptions
+// option.
 func (c *Client) Subscribe(topic string, qos byte, callback MessageHandler) Token {
 	token := newToken(packets.Subscribe).(*SubscribeToken)
-	DEBUG.Println(CLI, "enter Subscribe")
-	if !c.IsConnected() {
+	token.addFilterTokens([]string{topic})
+	c.debug(CLI, "enter Subscribe")
+	c.wake()
+	if !c.isActive() {
 		token.err = ErrNotConnected
 		token.flowComplete()
 		return token
 	}
 	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
-	if err := validateTopicAndQos(topic, qos); err != nil {
+	err := validateTopicAndQos(topic, qos)
+	if err == nil {
+		err = c.supportsSubscribe([]string{topic})
+	}
+	if err != nil {
 		token.err = err
+		token.flowComplete()
 		return token
 	}
+	qos = c.capSubscribeQos(topic, qos)
+	sub.ProtocolLevel = byte(c.options.ProtocolVersion)
 	sub.Topics = append(sub.Topics, topic)
 	sub.Qoss = append(sub.Qoss, qos)
-	DEBUG.Println(CLI, sub.String())
+
+	c.subscribedLock.Lock()
+	current, duplicate := c.subscribed[topic]
+	c.subscribedLock.Unlock()
+	if duplicate {
+		switch {
+		case c.options.DuplicateSubscriptions == DuplicateSubscriptionError:
+			token.err = ErrDuplicateSubscription
+			token.flowComplete()
+			return token
+		case c.options.DuplicateSubscriptions == DuplicateSubscriptionUpdate && current == qos:
+			if callback != nil {
+				c.msgRouter.addRoute(topic, callback)
+			}
+			c.debug(CLI, "already subscribed, updated callback", "topic", topic)
+			c.replayRetained(topic, qos, callback)
+			token.subs = append(token.subs, topic)
+			token.subResult[topic] = qos
+			token.flowComplete()
+			return token
+		}
+	}
 
 	if callback != nil {
-		c.msgRouter.addRoute(topic, callback)
+		if c.options.SubscriptionIdentifiers && c.options.ProtocolVersion == 5 && c.ServerCapabilities().SubscriptionIdentifierAvailable {
+			subID := c.msgRouter.addIdentifiedRoute(topic, callback)
+			sub.Properties = &packets.Properties{SubscriptionIdentifiers: []int{subID}}
+		} else {
+			c.msgRouter.addRoute(topic, callback)
+		}
 	}
+	c.debug(CLI, "subscribe packet", "packet", sub)
+	c.replayRetained(topic, qos, callback)
 
 	token.subs = append(token.subs, topic)
+	token.qoss = append(token.qoss, qos)
+	token.client = c
 	c.oboundP <- &PacketAndToken{p: sub, t: token}
-	DEBUG.Println(CLI, "exit Subscribe")
+	c.debug(CLI, "exit Subscribe")
 	return token
 }
 
+// SubscribeAndWait subscribes to a topic and blocks until the first message
+// published on it arrives, which is returned, or until timeout has passed.
+// The subscription is left in place either way: later messages are passed to
+// callback, or if callback is nil to the handler the topic already had, or
+// else to the default publish handler.
+func (c *Client) SubscribeAndWait(topic string, qos byte, timeout time.Duration, callback MessageHandler) (Message, error) {
+	deadline := time.After(timeout)
+	if err := validateTopicAndQos(topic, qos); err != nil {
+		return nil, err
+	}
+	after := callback
+	previous := c.msgRouter.getRoute(topic)
+	if after == nil {
+		after = previous
+	}
+	first := make(chan Message, 1)
+	var once sync.Once
+	oneShot := func(client *Client, m Message) {
+		received := false
+		once.Do(func() {
+			first <- m
+			received = true
+		})
+		if !received && after != nil {
+			after(client, m)
+		}
+	}
+	// put back the route whether or not Subscribe got as far as routing oneShot
+	defer func() {
+		if after != nil {
+			c.msgRouter.addRoute(topic, after)
+		} else {
+			c.msgRouter.deleteRoute(topic)
+		}
+	}()
+
+	token := c.Subscribe(topic, qos, oneShot)
+	if token.WaitTimeout(timeout) && token.Error() != nil {
+		return nil, token.Error()
+	}
+	select {
+	case m := <-first:
+		return m, nil
+	case <-deadline:
+		return nil, ErrTimeout
+	}
+}
+
 // SubscribeMultiple starts a new subscription for multiple topics. Provide a MessageHandler to
 // be executed when a message is published on one of the topics provided.
 func (c *Client) SubscribeMultiple(filters map[string]byte, callback MessageHandler) Token {
+	return c.subscribeMultiple(filters, func(string) MessageHandler { return callback })
+}
+
+// subscribeMultiple subscribes to filters with the callback returned by
+// callbacks for each of them, which may be nil
+func (c *Client) subscribeMultiple(filters map[string]byte, callbacks func(filter string) MessageHandler) *SubscribeToken {
 	var err error
 	token := newToken(packets.Subscribe).(*SubscribeToken)
-	DEBUG.Println(CLI, "enter SubscribeMultiple")
-	if !c.IsConnected() {
+	topics := make([]string, 0, len(filters))
+	for topic := range filters {
+		topics = append(topics, topic)
+	}
+	token.addFilterTokens(topics)
+	c.debug(CLI, "enter SubscribeMultiple")
+	c.wake()
+	if !c.isActive() {
 		token.err = ErrNotConnected
 		token.flowComplete()
 		return token
 	}
 	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
-	if sub.Topics, sub.Qoss, err = validateSubscribeMap(filters); err != nil {
+	if sub.Topics, sub.Qoss, err = validateSubscribeMap(filters); err == nil {
+		err = sub.Validate()
+	}
+	if err == nil {
+		err = c.supportsSubscribe(sub.Topics)
+	}
+	if err != nil {
 		token.err = err
+		token.flowComplete()
 		return token
 	}
-
-	if callback != nil {
-		for topic := range filters {
+	sub.ProtocolLevel = byte(c.options.ProtocolVersion)
+	for i, topic := range sub.Topics {
+		sub.Qoss[i] = c.capSubscribeQos(topic, sub.Qoss[i])
+	}
+	for i, topic := range sub.Topics {
+		callback := callbacks(topic)
+		if callback != nil {
 			c.msgRouter.addRoute(topic, callback)
 		}
+		c.replayRetained(topic, sub.Qoss[i], callback)
 	}
 	token.subs = make([]string, len(sub.Topics))
 	copy(token.subs, sub.Topics)
-	c.oboundP <- &PacketAndToken{p: sub, t: token}
-	DEBUG.Println(CLI, "exit SubscribeMultiple")
+	token.qoss = make([]byte, len(sub.Qoss))
+	copy(token.qoss, sub.Qoss)
+	token.client = c
+	parts := c.splitSubscribe(sub)
+	if len(parts) == 1 {
+		c.oboundP <- &PacketAndToken{p: sub, t: token}
+	} else {
+		c.debug(CLI, "subscribe split to fit the broker's limits", "packets", len(parts))
+		token.partsLeft = len(parts)
+		for _, part := range parts {
+			partToken := newToken(packets.Subscribe).(*SubscribeToken)
+			partToken.subs = part.Topics
+			partToken.qoss = part.Qoss
+			partToken.parent = token
+			token.parts = append(token.parts, partToken)
+		}
+		for i, part := range parts {
+			c.oboundP <- &PacketAndToken{p: part, t: token.parts[i]}
+		}
+	}
+	c.debug(CLI, "exit SubscribeMultiple")
 	return token
 }
 
+// splitSubscribe divides a SUBSCRIBE into packets which each fit within the
+// maximum packet size the broker announced when connecting and hold at most
+// MaxTopicsPerSubscribe filters. A filter too large for any packet is still
+// sent on its own, for the broker to refuse.
+func (c *Client) splitSubscribe(sub *packets.SubscribePacket) []*packets.SubscribePacket {
+	max := int(atomic.LoadUint32(&c.maxPacketSize))
+	maxTopics := c.options.MaxTopicsPerSubscribe
+	if max == 0 && (maxTopics <= 0 || len(sub.Topics) <= maxTopics) {
+		return []*packets.SubscribePacket{sub}
+	}
+	// fixed header with the longest remaining length and message id
+	overhead := 1 + 4 + 2
+	if sub.ProtocolLevel == 5 {
+		// SubscribeMultiple sends an empty property list
+		overhead++
+	}
+	var parts []*packets.SubscribePacket
+	var part *packets.SubscribePacket
+	var size int
+	for i, topic := range sub.Topics {
+		n := 2 + len(topic) + 1
+		if part == nil || (max > 0 && overhead+size+n > max) || (maxTopics > 0 && len(part.Topics) == maxTopics) {
+			part = packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+			part.ProtocolLevel = sub.ProtocolLevel
+			parts = append(parts, part)
+			size = 0
+		}
+		part.Topics = append(part.Topics, topic)
+		part.Qoss = append(part.Qoss, sub.Qoss[i])
+		size += n
+	}
+	return parts
+}
+
+// recordSubscribed notes that the broker granted a subscription to filter,
+// which was requested with qos, for the duplicate subscription policy and
+// SetSubscriptions. It is called from alllogic as the suback is processed.
+func (c *Client) recordSubscribed(filter string, qos byte) {
+	c.subscribedLock.Lock()
+	c.subscribed[filter] = qos
+	c.subscribedLock.Unlock()
+}
+
+// AddRoute registers callback for messages whose topic matches filter,
+// replacing any callback registered for the same filter, without
+// subscribing. It only changes how received messages are dispatched, the
+// broker isn't told, so messages only arrive once something subscribes to
+// a matching filter. Routes belong to the client and are kept across
+// reconnects.
+func (c *Client) AddRoute(filter string, callback MessageHandler) {
+	if callback != nil {
+		c.msgRouter.addRoute(filter, callback)
+	}
+}
+
+// RemoveRoute removes the callback registered for filter, by AddRoute or
+// Subscribe, without unsubscribing. Matching messages which are still
+// received go to the default publish handler.
+func (c *Client) RemoveRoute(filter string) {
+	c.msgRouter.deleteRoute(filter)
+}
+
+// SubscriptionStats returns, for the filter of each subscription made with a
+// MessageHandler, how many messages have been dispatched to the handler and
+// when the last one was, from which rates can be worked out by sampling it
+// periodically. A message matching several filters is counted for each of them.
+// Counts start from 0 when a filter is subscribed to again after unsubscribing.
+func (c *Client) SubscriptionStats() map[string]SubscriptionStat {
+	return c.msgRouter.stats()
+}
+
 // Unsubscribe will end the subscription from each of the topics provided.
 // Messages published to those topics from other clients will no longer be
 // received.
 func (c *Client) Unsubscribe(topics ...string) Token {
 	token := newToken(packets.Unsubscribe).(*UnsubscribeToken)
-	DEBUG.Println(CLI, "enter Unsubscribe")
-	if !c.IsConnected() {
+	c.debug(CLI, "enter Unsubscribe")
+	c.wake()
+	if !c.isActive() {
 		token.err = ErrNotConnected
 		token.flowComplete()
 		return token
 	}
 	unsub := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+	unsub.ProtocolLevel = byte(c.options.ProtocolVersion)
 	unsub.Topics = make([]string, len(topics))
 	copy(unsub.Topics, topics)
 
+	token.topics = unsub.Topics
+	token.client = c
 	c.oboundP <- &PacketAndToken{p: unsub, t: token}
-	for _, topic := range topics {
-		c.msgRouter.deleteRoute(topic)
+	c.forgetFilters(topics)
+
+	c.debug(CLI, "exit Unsubscribe")
+	return token
+}
+
+// forgetFilters drops the routes and recorded subscriptions of filters, when
+// they are unsubscribed from or their subscribe is cancelled
+func (c *Client) forgetFilters(filters []string) {
+	c.subscribedLock.Lock()
+	for _, filter := range filters {
+		delete(c.subscribed, filter)
+		c.msgRouter.deleteRoute(filter)
+	}
+	c.subscribedLock.Unlock()
+	c.closeSubChans(filters)
+	c.stopRetainedTimers(filters)
+}
+
+// SetSubscriptions changes the subscriptions of the client to desired, for
+// example when a configuration is reloaded. Filters which are no longer wanted
+// are unsubscribed from in one UNSUBSCRIBE and new ones, or ones whose QoS has
+// changed, are subscribed to in one SUBSCRIBE, which is sent first so that
+// messages matching both an old and a new filter keep arriving. Filters
+// subscribed to already with the same QoS only have their handler replaced,
+// without anything being sent. The token completes once both the subscribe and
+// the unsubscribe have been acknowledged, it is a *SubscriptionsToken.
+func (c *Client) SetSubscriptions(desired map[string]Subscription) Token {
+	token := &SubscriptionsToken{baseToken: baseToken{complete: make(chan struct{})}}
+	c.debug(CLI, "enter SetSubscriptions")
+	if !c.isActive() {
+		token.err = ErrNotConnected
+		token.flowComplete()
+		return token
+	}
+	added := make(map[string]byte)
+	for filter, sub := range desired {
+		if err := validateTopicAndQos(filter, sub.Qos); err != nil {
+			token.err = err
+			token.flowComplete()
+			return token
+		}
+		added[filter] = c.capSubscribeQos(filter, sub.Qos)
+	}
+	var removed []string
+	c.subscribedLock.Lock()
+	for filter, qos := range c.subscribed {
+		wanted, ok := added[filter]
+		switch {
+		case !ok:
+			removed = append(removed, filter)
+		case wanted == qos:
+			delete(added, filter)
+		}
+	}
+	c.subscribedLock.Unlock()
+	for filter, sub := range desired {
+		if _, ok := added[filter]; !ok && sub.Handler != nil {
+			c.msgRouter.addRoute(filter, sub.Handler)
+		}
 	}
+	c.debug(CLI, "changing subscriptions", "subscribe", len(added), "unsubscribe", len(removed))
 
-	DEBUG.Println(CLI, "exit Unsubscribe")
+	if len(added) > 0 {
+		token.sub = c.subscribeMultiple(added, func(filter string) MessageHandler { return desired[filter].Handler })
+	}
+	if len(removed) > 0 {
+		token.unsub = c.Unsubscribe(removed...).(*UnsubscribeToken)
+	}
+	go token.wait()
+	c.debug(CLI, "exit SetSubscriptions")
 	return token
 }
 
+// cancelToken abandons the subscribe or unsubscribe flow whose baseToken is
+// b. Its ids aren't freed here: outgoing frees them if it hasn't sent the
+// packet yet, otherwise they are kept until the ack arrives or the
+// connection is lost, so that a late ack can't complete a flow which
+// reused them. It reports whether the flow was cancelled, which it isn't
+// once completed.
+func (c *Client) cancelToken(b *baseToken) bool {
+	atomic.StoreInt32(&b.cancelled, 1)
+	if b.completeWith(func() { b.err = ErrCancelled }) {
+		c.debug(CLI, "flow cancelled before it was acknowledged")
+		return true
+	}
+	return false
+}
+
 //DefaultConnectionLostHandler is a definition of a function that simply
 //reports to the DEBUG log the reason for the client losing a connection.
 func DefaultConnectionLostHandler(client *Client, reason error) {
-	DEBUG.Println("Connection lost:", reason.Error())
+	client.debug(CLI, "Connection lost", "reason", reason)
 }
@@ -14,8 +14,16 @@
 
 package mqtt
 
+import "strings"
+
 type component string
 
+// name returns the bare component name, as used for the "component"
+// field of structured log entries
+func (c component) name() string {
+	return strings.Trim(string(c), "[] ")
+}
+
 // Component names for debug output
 const (
 	NET component = "[net]     "
@@ -0,0 +1,233 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
+)
+
+// flowControl counts the QoS 1 and 2 publishes that are waiting for an
+// ack, so that no more are sent than the receive maximum an MQTT 5 broker
+// announced in its CONNACK allows. It also totals the encoded size of all
+// the publishes queued or in flight, for MaxQueuedBytes.
+type flowControl struct {
+	sync.Mutex
+	cond      *sync.Cond
+	inflight  int
+	max       int // 0 if the broker set no limit
+	gen       int // advanced whenever the count is reset
+	queued    int64
+	queuedGen int // advanced whenever queued is reset
+}
+
+// setReceiveMaximum applies the receive maximum from a CONNACK. When the
+// broker has no session the publishes that were in flight are gone, so
+// they stop counting against the limit.
+func (c *Client) setReceiveMaximum(max int, sessionPresent bool) {
+	c.flow.Lock()
+	defer c.flow.Unlock()
+	c.flow.max = max
+	if !sessionPresent {
+		c.flow.inflight = 0
+		c.flow.gen++
+	}
+	c.flow.cond.Broadcast()
+}
+
+// acquireInflight blocks until another publish may be in flight, reporting
+// the wait to the flow control handlers, and records on t that it holds a
+// slot which is given back by releaseInflight.
+func (c *Client) acquireInflight(t *PublishToken) {
+	c.flow.Lock()
+	defer c.flow.Unlock()
+	blocked := false
+	for c.flow.max > 0 && c.flow.inflight >= c.flow.max {
+		if !blocked {
+			blocked = true
+			c.debug(CLI, "publish waiting for receive maximum", "inflight", c.flow.inflight, "max", c.flow.max)
+			if c.options.OnFlowControlBlocked != nil {
+				go c.options.OnFlowControlBlocked(c.flow.inflight, c.flow.max)
+			}
+		}
+		c.flow.cond.Wait()
+	}
+	c.flow.inflight++
+	t.flowGen = c.flow.gen
+	t.inflight = true
+	if blocked && c.options.OnFlowControlResumed != nil {
+		go c.options.OnFlowControlResumed(c.flow.inflight, c.flow.max)
+	}
+}
+
+// tryAcquireInflight is acquireInflight without the wait, it reports whether
+// t holds a slot afterwards. A slot t already holds from before reconnecting
+// is kept if it still counts, as it does when the broker had a session.
+func (c *Client) tryAcquireInflight(t *PublishToken) bool {
+	c.flow.Lock()
+	defer c.flow.Unlock()
+	if t.inflight && t.flowGen == c.flow.gen {
+		return true
+	}
+	if c.flow.max > 0 && c.flow.inflight >= c.flow.max {
+		return false
+	}
+	c.flow.inflight++
+	t.flowGen = c.flow.gen
+	t.inflight = true
+	return true
+}
+
+// resendInflight queues QoS 1 and 2 publishes which are sent again after
+// connecting, each needing a slot like a new publish. Acks are only read
+// once connecting has finished, so when the receive maximum is reached the
+// rest are queued in order by a goroutine as slots are freed.
+func (c *Client) resendInflight(pubs []*PacketAndToken) {
+	for i, pub := range pubs {
+		if !c.tryAcquireInflight(pub.t.(*PublishToken)) {
+			c.debug(CLI, "resending publishes waiting for receive maximum", "left", len(pubs)-i)
+			go c.resendWaiting(pubs[i:], atomic.LoadUint64(&c.generation))
+			return
+		}
+		c.obound <- pub
+	}
+}
+
+// resendWaiting queues pubs for resendInflight, waiting for a slot for each.
+// It gives up if the client disconnects, or if it reconnects meanwhile with
+// a session, as the stored publishes are then resent by resume.
+func (c *Client) resendWaiting(pubs []*PacketAndToken, gen uint64) {
+	for _, pub := range pubs {
+		token := pub.t.(*PublishToken)
+		if !c.tryAcquireInflight(token) {
+			c.acquireInflight(token)
+		}
+		if !c.isActive() || (!c.options.CleanSession && atomic.LoadUint64(&c.generation) != gen) {
+			c.debug(CLI, "stopped resending publishes waiting for receive maximum")
+			return
+		}
+		c.obound <- pub
+	}
+}
+
+// releaseInflight gives back the slot held by a publish once its flow has
+// ended, t may be any token and is ignored unless it holds a slot.
+func (c *Client) releaseInflight(t Token) {
+	pt, ok := t.(*PublishToken)
+	if !ok || !pt.inflight {
+		return
+	}
+	pt.inflight = false
+	c.flow.Lock()
+	defer c.flow.Unlock()
+	if pt.flowGen == c.flow.gen {
+		c.flow.inflight--
+		c.flow.cond.Signal()
+	}
+}
+
+// QueuedBytes returns the total encoded size of the publishes which are
+// queued to be sent or are in flight, as limited by MaxQueuedBytes
+func (c *Client) QueuedBytes() int64 {
+	c.flow.Lock()
+	defer c.flow.Unlock()
+	return c.flow.queued
+}
+
+// reserveQueued counts the size of p against MaxQueuedBytes until t
+// completes. If there isn't room it waits with PublishWhenDisconnectedBlock,
+// and otherwise fails with ErrQueueFull.
+func (c *Client) reserveQueued(t *PublishToken, p packets.ControlPacket) error {
+	var size int64
+	switch p := p.(type) {
+	case *packets.PublishPacket:
+		size = int64(p.Size())
+	case *packets.EncodedPublishPacket:
+		size = int64(p.Size())
+	}
+	c.flow.Lock()
+	defer c.flow.Unlock()
+	max := c.options.MaxQueuedBytes
+	if max > 0 {
+		if size > max {
+			return ErrQueueFull
+		}
+		for c.flow.queued+size > max {
+			if c.options.PublishWhenDisconnected != PublishWhenDisconnectedBlock {
+				return ErrQueueFull
+			}
+			if !c.isActive() {
+				return ErrNotConnected
+			}
+			c.flow.cond.Wait()
+		}
+	}
+	c.flow.queued += size
+	t.queued = size
+	t.queuedGen = c.flow.queuedGen
+	t.done = func() { c.releaseQueued(t) }
+	return nil
+}
+
+// releaseQueued stops counting the size of t's publish once it completes
+func (c *Client) releaseQueued(t *PublishToken) {
+	c.flow.Lock()
+	defer c.flow.Unlock()
+	if t.queuedGen == c.flow.queuedGen {
+		c.flow.queued -= t.queued
+		c.flow.cond.Broadcast()
+	}
+}
+
+// resetQueued stops counting the publishes that are left when the client
+// disconnects, as their tokens may never complete
+func (c *Client) resetQueued() {
+	c.flow.Lock()
+	defer c.flow.Unlock()
+	c.flow.queued = 0
+	c.flow.queuedGen++
+	c.flow.cond.Broadcast()
+}
+
+// queuePublish passes a publish to outgoing, first waiting for a slot if
+// it is QoS 1 or 2 and giving it its message ID
+func (c *Client) queuePublish(pt *PacketAndToken, qos byte) {
+	token := pt.t.(*PublishToken)
+	if err := c.reserveQueued(token, pt.p); err != nil {
+		token.err = err
+		token.flowComplete()
+		return
+	}
+	if qos > 0 {
+		c.acquireInflight(token)
+		if !c.isActive() {
+			// disconnected while waiting
+			c.releaseInflight(token)
+			token.err = ErrNotConnected
+			token.flowComplete()
+			return
+		}
+		c.assignPublishID(pt)
+	}
+	c.obound <- pt
+}
+
+// assignPublishID gives a QoS 1 or 2 publish the next free message ID and
+// records it on the publish's token
+func (c *Client) assignPublishID(pt *PacketAndToken) {
+	id := c.getID(pt.t)
+	switch p := pt.p.(type) {
+	case *packets.PublishPacket:
+		p.MessageID = id
+	case *packets.EncodedPublishPacket:
+		p.MessageID = id
+	}
+	pt.t.(*PublishToken).messageID = id
+}
@@ -0,0 +1,145 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
+)
+
+// ErrIdleTimeout is the error the connection is closed with when it has been
+// idle for IdleTimeout
+var ErrIdleTimeout = errors.New("Connection idle")
+
+// idleQuiesce is how long an idle close waits for the DISCONNECT to be written
+const idleQuiesce = time.Second
+
+// markActive records activity which keeps the connection from being closed
+// as idle
+func (c *Client) markActive() {
+	if c.options.IdleTimeout > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	}
+}
+
+// wake records activity and, if the connection was closed for being idle,
+// has the client reconnect. It reports whether the client was idle.
+func (c *Client) wake() bool {
+	if c.options.IdleTimeout <= 0 {
+		return false
+	}
+	c.markActive()
+	c.Lock()
+	if c.status != idle {
+		c.Unlock()
+		return false
+	}
+	c.status = reconnecting
+	c.statusChanged.Broadcast()
+	// until the connection has been closed internalConnLost reconnects
+	closed := c.idleClosed
+	c.idleClosed = false
+	c.Unlock()
+	if closed {
+		c.info(CLI, "reconnecting idle client")
+		go c.reconnect(time.Now())
+	}
+	return true
+}
+
+// idleDone is called by internalConnLost once the connection is closed, if
+// it was closed for being idle it reports true and the client is left
+// unconnected until it is woken
+func (c *Client) idleDone() bool {
+	c.Lock()
+	if c.status != idle {
+		c.Unlock()
+		return false
+	}
+	c.idleClosed = true
+	c.Unlock()
+	c.info(CLI, "closed idle connection")
+	if c.options.OnIdleDisconnect != nil {
+		go c.options.OnIdleDisconnect(c)
+	}
+	return true
+}
+
+// startIdleWatch starts closing the connection once it has been idle for
+// IdleTimeout, if set
+func (c *Client) startIdleWatch() {
+	if c.options.IdleTimeout <= 0 {
+		return
+	}
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	go idleWatch(c, c.stop)
+}
+
+func idleWatch(c *Client, stop chan struct{}) {
+	timer := time.NewTimer(c.options.IdleTimeout)
+	defer timer.Stop()
+	c.debug(CLI, "idle watch starting")
+
+	for {
+		select {
+		case <-stop:
+			c.debug(CLI, "idle watch stopped")
+			return
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+			if idle < c.options.IdleTimeout {
+				timer.Reset(c.options.IdleTimeout - idle)
+				continue
+			}
+			c.idleClose(stop)
+			return
+		}
+	}
+}
+
+// idleClose ends the connection which stop belongs to after it has been idle
+func (c *Client) idleClose(stop chan struct{}) {
+	c.info(CLI, "connection idle, disconnecting", "timeout", c.options.IdleTimeout)
+	if !c.options.AutoReconnect {
+		if c.connectionStatus() != connected {
+			return
+		}
+		c.Disconnect(uint(idleQuiesce / time.Millisecond))
+		if c.options.OnIdleDisconnect != nil {
+			go c.options.OnIdleDisconnect(c)
+		}
+		return
+	}
+
+	c.Lock()
+	if c.status != connected {
+		c.Unlock()
+		return
+	}
+	c.status = idle
+	atomic.StoreInt32(&c.online, 0)
+	c.statusChanged.Broadcast()
+	errs := c.errors
+	c.Unlock()
+
+	dm := packets.NewControlPacket(packets.Disconnect).(*packets.DisconnectPacket)
+	dt := newToken(packets.Disconnect)
+	select {
+	case c.oboundP <- &PacketAndToken{p: dm, t: dt}:
+		dt.WaitTimeout(idleQuiesce)
+	case <-stop:
+	}
+	// alllogic closes the connection, leaving the client idle
+	select {
+	case errs <- ErrIdleTimeout:
+	case <-stop:
+	}
+}
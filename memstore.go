@@ -80,8 +80,10 @@ func (store *MemoryStore) All() []string {
 	defer store.RUnlock()
 	chkcond(store.opened)
 	keys := []string{}
-	for k := range store.messages {
-		keys = append(keys, k)
+	for k, m := range store.messages {
+		if m != nil {
+			keys = append(keys, k)
+		}
 	}
 	return keys
 }
@@ -15,6 +15,9 @@
 package mqtt
 
 import (
+	"sync"
+	"time"
+
 	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
 )
 
@@ -30,13 +33,57 @@ type Message interface {
 	Payload() []byte
 }
 
+// AckableMessage is implemented by the messages the client passes to
+// callbacks, which can be reached with a type assertion on a Message.
+//
+// Ack and Nack are only meaningful when the client is created with ManualAck
+// set. Ack sends the PUBACK (QoS 1) or PUBREC (QoS 2) for the message, Nack
+// or never calling Ack leaves it unacknowledged so the broker will redeliver
+// it after the client reconnects. Only the first call to either has effect.
+type AckableMessage interface {
+	Message
+	Ack()
+	Nack()
+}
+
+// DetailedMessage is implemented by the messages the client passes to
+// callbacks, which can be reached with a type assertion on a Message. It
+// gives what is known about a message beyond the Message interface.
+//
+// TopicBytes returns the topic without the allocation Topic makes the first
+// time it is called, for handlers on a hot path. The slice must not be
+// modified, and is only valid until the handler it was passed to returns:
+// a handler which keeps the message, or hands it to another goroutine, must
+// use Topic or copy the bytes.
+//
+// ResponseTopic and CorrelationData return the MQTT 5 properties a request
+// was published with, for replying to it. The correlation data is binary, it
+// is returned as it was sent. Both are empty if the message didn't carry them.
+type DetailedMessage interface {
+	Message
+	SubscriptionQos() byte
+	TopicBytes() []byte
+	MessageExpiry() time.Duration
+	ResponseTopic() string
+	CorrelationData() []byte
+	ConnectionGeneration() uint64
+}
+
 type message struct {
-	duplicate bool
-	qos       byte
-	retained  bool
-	topic     string
-	messageID uint16
-	payload   []byte
+	duplicate  bool
+	qos        byte
+	subQos     byte
+	retained   bool
+	topic      []byte
+	topicOnce  sync.Once
+	topicStr   string
+	messageID  uint16
+	payload    []byte
+	expiry     time.Duration
+	respTopic  string
+	corrData   []byte
+	generation uint64
+	ack        *pendingAck
 }
 
 func (m *message) Duplicate() bool {
@@ -47,11 +94,26 @@ func (m *message) Qos() byte {
 	return m.qos
 }
 
+// SubscriptionQos returns the QoS the broker granted for the subscription
+// the message was routed to. The broker may deliver a message at a lower
+// QoS than this, in which case Qos is the smaller of the two. Messages that
+// matched no subscription report their delivery QoS.
+func (m *message) SubscriptionQos() byte {
+	return m.subQos
+}
+
 func (m *message) Retained() bool {
 	return m.retained
 }
 
 func (m *message) Topic() string {
+	m.topicOnce.Do(func() {
+		m.topicStr = string(m.topic)
+	})
+	return m.topicStr
+}
+
+func (m *message) TopicBytes() []byte {
 	return m.topic
 }
 
@@ -63,31 +125,96 @@ func (m *message) Payload() []byte {
 	return m.payload
 }
 
-func messageFromPublish(p *packets.PublishPacket) Message {
-	copiedPayload := make([]byte, len(p.Payload))
-	copy(copiedPayload, p.Payload)
+// MessageExpiry returns how much longer an MQTT 5 message is valid for, which
+// the broker works out from the expiry interval the message was published with
+// and the time it was held for. It is 0 for a message without an expiry.
+func (m *message) MessageExpiry() time.Duration {
+	return m.expiry
+}
+
+func (m *message) ResponseTopic() string {
+	return m.respTopic
+}
+
+func (m *message) CorrelationData() []byte {
+	return m.corrData
+}
+
+// ConnectionGeneration returns the generation of the connection the message
+// was received on, see Client.ConnectionGeneration. Handlers can compare it
+// with the client's current generation to ignore messages delivered before
+// a reconnect.
+func (m *message) ConnectionGeneration() uint64 {
+	return m.generation
+}
+
+func (m *message) Ack() {
+	if m.ack != nil {
+		m.ack.complete(true)
+	}
+}
+
+func (m *message) Nack() {
+	if m.ack != nil {
+		m.ack.complete(false)
+	}
+}
+
+func messageFromPublish(p *packets.PublishPacket, subQos byte, generation uint64, ack *pendingAck) Message {
+	// the packet is released once dispatched, the topic and payload are
+	// copied out of it together to save an allocation
+	copied := make([]byte, len(p.TopicName)+len(p.Payload))
+	n := copy(copied, p.TopicName)
+	copy(copied[n:], p.Payload)
+	var expiry time.Duration
+	var respTopic string
+	var corrData []byte
+	if p.Properties != nil {
+		expiry = time.Duration(p.Properties.MessageExpiryInterval) * time.Second
+		// properties are decoded into their own memory, they outlive the packet
+		respTopic = p.Properties.ResponseTopic
+		corrData = p.Properties.CorrelationData
+	}
 	return &message{
-		duplicate: p.Dup,
-		qos:       p.Qos,
-		retained:  p.Retain,
-		topic:     string(p.TopicName),
-		messageID: p.MessageID,
-		payload:   copiedPayload,
+		duplicate:  p.Dup,
+		qos:        p.Qos,
+		subQos:     subQos,
+		retained:   p.Retain,
+		topic:      copied[:n:n],
+		messageID:  p.MessageID,
+		payload:    copied[n:],
+		expiry:     expiry,
+		respTopic:  respTopic,
+		corrData:   corrData,
+		generation: generation,
+		ack:        ack,
 	}
 }
 
 func newConnectMsgFromOptions(options *ClientOptions) *packets.ConnectPacket {
 	m := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
 
+	// for MQTT 5 this is the clean start flag, the lifetime of the session
+	// is given by the session expiry interval instead
 	m.CleanSession = options.CleanSession
+	m.Properties = &packets.Properties{SessionExpiryInterval: uint32(options.SessionExpiryInterval.Seconds())}
+	if !options.CleanSession && options.SessionExpiryInterval == 0 {
+		m.Properties.SessionExpiryInterval = packets.SessionNeverExpires
+	}
+	m.Properties.RequestResponseInformation = options.RequestResponseInfo
 	m.WillFlag = options.WillEnabled
-	m.WillRetain = options.WillRetained
 	m.ClientIdentifier = options.ClientID
 
+	// the will flags must be clear without a will
 	if options.WillEnabled {
+		m.WillRetain = options.WillRetained
 		m.WillQos = options.WillQos
 		m.WillTopic = options.WillTopic
 		m.WillMessage = options.WillPayload
+		if options.WillDelay > 0 {
+			// rounded up, a delay under a second must not become no delay
+			m.WillProperties = &packets.Properties{WillDelayInterval: uint32((options.WillDelay + time.Second - 1) / time.Second)}
+		}
 	}
 
 	if options.Username != "" {
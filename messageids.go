@@ -23,9 +23,24 @@ import (
 // the client application.
 type MId uint16
 
+// MessageIDAllocator chooses the message IDs of QoS 1 and 2 publishes,
+// subscribes and unsubscribes in place of the built in allocator, which
+// reuses the lowest free ID. Next returns an ID from 1 to 65535, or false
+// when none is free, and Free is passed each ID once its flow has ended.
+// IDs returned by Next which the client can't use are skipped without a Free
+// of their own: 0 is never passed to Free, and an ID the client already holds,
+// such as that of a message resent from the store, is passed to Free once,
+// when the flow holding it ends. The methods may be called from several
+// goroutines at once.
+type MessageIDAllocator interface {
+	Next() (uint16, bool)
+	Free(id uint16)
+}
+
 type messageIds struct {
 	sync.RWMutex
 	index map[uint16]Token
+	alloc MessageIDAllocator // nil for the built in allocation
 }
 
 const (
@@ -36,12 +51,27 @@ const (
 func (mids *messageIds) freeID(id uint16) {
 	mids.Lock()
 	defer mids.Unlock()
+	mids.release(id)
+}
+
+// release forgets the token holding id, handing the id back to the
+// allocator if it was in use. The lock must be held.
+func (mids *messageIds) release(id uint16) {
+	if _, ok := mids.index[id]; !ok {
+		return
+	}
 	delete(mids.index, id)
+	if mids.alloc != nil {
+		mids.alloc.Free(id)
+	}
 }
 
 func (mids *messageIds) getID(t Token) uint16 {
 	mids.Lock()
 	defer mids.Unlock()
+	if mids.alloc != nil {
+		return mids.allocate(t)
+	}
 	for i := midMin; i < midMax; i++ {
 		if _, ok := mids.index[i]; !ok {
 			mids.index[i] = t
@@ -51,6 +81,66 @@ func (mids *messageIds) getID(t Token) uint16 {
 	return 0
 }
 
+// allocate takes an id for t from the MessageIDAllocator, skipping 0 and
+// ids which are still in use, such as those claimed by messages resent
+// from the store. Skipped ids aren't freed here, those in use are freed by
+// release once their flow ends. Returns 0 if the allocator has no free id.
+// The lock must be held.
+func (mids *messageIds) allocate(t Token) uint16 {
+	for tries := 0; tries < int(midMax); tries++ {
+		id, ok := mids.alloc.Next()
+		if !ok {
+			return 0
+		}
+		if _, used := mids.index[id]; id == 0 || used {
+			continue
+		}
+		mids.index[id] = t
+		return id
+	}
+	return 0
+}
+
+// claimID assigns a specific id to t, for messages which were given
+// their id by an earlier connection
+func (mids *messageIds) claimID(id uint16, t Token) {
+	mids.Lock()
+	defer mids.Unlock()
+	mids.index[id] = t
+}
+
+// freeToken frees the id held by t, or the ids held by the parts of a
+// subscription t that was split over several packets
+func (mids *messageIds) freeToken(t Token) {
+	mids.Lock()
+	defer mids.Unlock()
+	for id, held := range mids.index {
+		if part, ok := held.(*SubscribeToken); held == t || (ok && part.parent != nil && Token(part.parent) == t) {
+			mids.release(id)
+		}
+	}
+}
+
+// freeCancelled frees the ids kept by subscribes and unsubscribes which were
+// cancelled after being sent, once the connection their acks would have come
+// on is lost
+func (mids *messageIds) freeCancelled() {
+	mids.Lock()
+	defer mids.Unlock()
+	for id, held := range mids.index {
+		switch t := held.(type) {
+		case *SubscribeToken:
+			if t.isCancelled() {
+				mids.release(id)
+			}
+		case *UnsubscribeToken:
+			if t.isCancelled() {
+				mids.release(id)
+			}
+		}
+	}
+}
+
 func (mids *messageIds) getToken(id uint16) Token {
 	mids.RLock()
 	defer mids.RUnlock()
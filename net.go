@@ -16,11 +16,15 @@ package mqtt
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
@@ -78,11 +82,32 @@ func openConnection(uri *url.URL, tlsc *tls.Config, timeout time.Duration) (net.
 
 var packetsSent = 0
 var packetsReceived = 0
+var publishesExpired int64
+var messagesStale int64
+var messagesUnsolicited int64
 
 func GetStats() (int, int) {
 	return packetsSent, packetsReceived
 }
 
+// GetExpiredCount returns the number of publishes which were dropped
+// because their TTL ran out while they were queued
+func GetExpiredCount() int {
+	return int(atomic.LoadInt64(&publishesExpired))
+}
+
+// GetStaleCount returns the number of incoming messages which weren't passed
+// to a handler because they were older than MaxDeliveryAge by then
+func GetStaleCount() int {
+	return int(atomic.LoadInt64(&messagesStale))
+}
+
+// GetUnsolicitedCount returns the number of incoming messages which were
+// rejected for matching no subscription, see RejectUnsolicitedMessages
+func GetUnsolicitedCount() int {
+	return int(atomic.LoadInt64(&messagesUnsolicited))
+}
+
 // actually read incoming messages off the wire
 // send Message object into ibound channel
 func incoming(c *Client) {
@@ -90,11 +115,30 @@ func incoming(c *Client) {
 	var err error
 	var cp packets.ControlPacket
 
-	DEBUG.Println(NET, "incoming started")
+	c.debug(NET, "incoming started")
 
 	reader := bufio.NewReaderSize(c.conn, IN_BUF_SIZE)
 	for {
-		if cp, err = packets.ReadPacket(reader); err != nil {
+		// The deadline is pushed forward before each packet so that
+		// only a stalled read, not an overall slow session, times out.
+		if c.options.ReadTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.options.ReadTimeout))
+		} else if c.options.PacketReadTimeout > 0 {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		if c.options.PacketReadTimeout > 0 {
+			// once a packet starts arriving it must be complete in time,
+			// however long the wait for it to start was
+			if _, err = reader.Peek(1); err != nil {
+				break
+			}
+			c.conn.SetReadDeadline(time.Now().Add(c.options.PacketReadTimeout))
+		}
+		if cp, err = packets.ReadPacketVersion(reader, byte(c.options.ProtocolVersion)); err != nil {
+			err = c.decodeError(err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && c.options.PacketReadTimeout > 0 {
+				err = ErrPacketReadTimeout
+			}
 			break
 		}
 		// Make sure the client isn't stopped yet. There still
@@ -105,116 +149,426 @@ func incoming(c *Client) {
 		// closed after this select.
 		select {
 		case <-c.stop:
-			DEBUG.Println(NET, "incoming stopped")
+			c.debug(NET, "incoming stopped")
 			return
 		default:
 		}
 		// Not trying to disconnect, send the error to the errors channel
-		if debugActive() {
-			DEBUG.Println(NET, "Received Message")
+		if c.debugActive() {
+			c.debug(NET, "Received Message")
 		}
 		packetsReceived += 1
-		c.ibound <- cp
+		// alllogic may stop while ibound is full of packets that arrived
+		// as it was held up by slow handlers
+		select {
+		case c.ibound <- cp:
+		case <-c.stop:
+			c.debug(NET, "incoming stopped")
+			cp.Release()
+			return
+		}
 	}
 	// We received an error on read.
 	// If disconnect is in progress, swallow error and return
 	select {
 	case <-c.stop:
-		DEBUG.Println(NET, "incoming stopped")
+		c.debug(NET, "incoming stopped")
 		return
 		// Not trying to disconnect, send the error to the errors channel
 	default:
-		ERROR.Println(NET, "incoming stopped with error")
-		c.errors <- err
+		c.error(NET, "incoming stopped with error", "err", err)
+		c.reportError(err)
+		return
+	}
+}
+
+// decodeError passes the details of a packet which couldn't be read to the
+// OnDecodeError handler, returning the underlying error
+func (c *Client) decodeError(err error) error {
+	de, ok := err.(*packets.DecodeError)
+	if !ok {
+		return err
+	}
+	if c.options.OnDecodeError != nil {
+		c.options.OnDecodeError(de.FixedHeader, de.Body, de.Err)
+	}
+	return de.Err
+}
+
+// reportError passes a connection error to the OnError handler and
+// then on to alllogic, which treats the connection as lost
+func (c *Client) reportError(err error) {
+	// the connection is unusable from here on, don't wait for alllogic
+	// to pick up the error before reporting it
+	atomic.StoreInt32(&c.online, 0)
+	if c.options.OnError != nil {
+		go c.options.OnError(err)
+	}
+	// only the first error is taken by alllogic, once it has stopped the
+	// connection any further ones would block forever
+	select {
+	case c.errors <- err:
+	case <-c.stop:
+	}
+}
+
+// adaptiveWriteMargin is how many times longer than the average write
+// time a write may take with AdaptiveWriteTimeout
+const adaptiveWriteMargin = 4
+
+// writeDeadline gives the time allowed for each publish written by
+// outgoing, which is WriteTimeout unless AdaptiveWriteTimeout is set
+type writeDeadline struct {
+	fixed    time.Duration
+	adaptive bool
+	floor    time.Duration
+	ceiling  time.Duration
+	average  time.Duration // moving average of the write times recorded
+	measured bool
+}
+
+func newWriteDeadline(o *ClientOptions) *writeDeadline {
+	w := &writeDeadline{
+		fixed:    o.WriteTimeout,
+		adaptive: o.AdaptiveWriteTimeout,
+		floor:    o.WriteTimeoutFloor,
+		ceiling:  o.WriteTimeoutCeiling,
+	}
+	// bounds set in the struct directly may be the wrong way round
+	if w.ceiling > 0 && w.floor > w.ceiling {
+		w.floor = w.ceiling
+	}
+	return w
+}
+
+// enabled reports whether writes have a deadline
+func (w *writeDeadline) enabled() bool {
+	return w.adaptive || w.fixed > 0
+}
+
+// timeout returns the time allowed for the next write, 0 meaning that it
+// has no deadline
+func (w *writeDeadline) timeout() time.Duration {
+	if !w.adaptive {
+		return w.fixed
+	}
+	if !w.measured {
+		// a ceiling of 0 is no ceiling, the floor is all there is to go by
+		if w.ceiling > 0 {
+			return w.ceiling
+		}
+		return w.floor
+	}
+	t := w.average * adaptiveWriteMargin
+	if t < w.floor {
+		t = w.floor
+	}
+	if w.ceiling > 0 && t > w.ceiling {
+		t = w.ceiling
+	}
+	return t
+}
+
+// record adds the time a write took to the average, weighting it as TCP
+// does its round trip time samples
+func (w *writeDeadline) record(d time.Duration) {
+	if !w.measured {
+		w.average, w.measured = d, true
 		return
 	}
+	w.average += (d - w.average) / 8
+}
+
+// noDelayer is implemented by connections on which Nagle's algorithm can
+// be turned off, such as *net.TCPConn
+type noDelayer interface {
+	SetNoDelay(noDelay bool) error
+}
+
+// noDelayToggle switches TCP_NODELAY between control packets and publishes
+// for LowLatencyControlPackets, only changing it when the kind of packet
+// written changes
+type noDelayToggle struct {
+	c     *Client
+	conn  noDelayer
+	state int // 0 unknown, 1 on, -1 off
+}
+
+func newNoDelayToggle(c *Client) *noDelayToggle {
+	if !c.options.LowLatencyControlPackets {
+		return &noDelayToggle{c: c}
+	}
+	conn := c.conn
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	nd, ok := conn.(noDelayer)
+	if !ok {
+		c.debug(NET, "TCP_NODELAY not settable on connection")
+	}
+	return &noDelayToggle{c: c, conn: nd}
+}
+
+// set turns TCP_NODELAY on before a control packet and off before a publish
+func (t *noDelayToggle) set(noDelay bool) {
+	if t.conn == nil {
+		return
+	}
+	state := -1
+	if noDelay {
+		state = 1
+	}
+	if state == t.state {
+		return
+	}
+	if err := t.conn.SetNoDelay(noDelay); err != nil {
+		t.c.warn(NET, "failed to set TCP_NODELAY", "noDelay", noDelay, "err", err)
+		return
+	}
+	t.state = state
+}
+
+// ratePermits hands outgoing a permit to write a publish each time the
+// PublishRateLimiter allows one, until ctx is done
+func ratePermits(c *Client, ctx context.Context, permits chan<- struct{}) {
+	for {
+		if err := c.options.PublishRateLimiter.Wait(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.warn(NET, "publish rate limiter failed, sending anyway", "err", err)
+		}
+		select {
+		case permits <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 // receive a Message object on obound, and then
 // actually send outgoing message to the wire
 func outgoing(c *Client) {
 	defer c.workers.Done()
-	DEBUG.Println(NET, "outgoing started")
+	c.debug(NET, "outgoing started")
 
 	writer := bufio.NewWriter(c.conn)
+	deadline := newWriteDeadline(&c.options)
+	noDelay := newNoDelayToggle(c)
+	// the watchdog needs to know how long the current write has taken
+	watched := !deadline.enabled() && c.options.OutgoingStallTimeout > 0
+	// ctx is cancelled when the client stops, so that waiting on the
+	// rate limiter doesn't hold up disconnecting
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if c.options.PublishRateLimiter != nil {
+		go func(stop chan struct{}) {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}(c.stop)
+	}
+	// with a PublishRateLimiter a publish is only taken from obound once
+	// the limiter has given a permit, so that control packets are still
+	// written while it waits
+	var permits chan struct{}
+	permitted := true
+	if c.options.PublishRateLimiter != nil {
+		permits = make(chan struct{})
+		permitted = false
+		go ratePermits(c, ctx, permits)
+	}
+	// control packets written since the last publish, see OutboundFairness
+	prioritySent := 0
+	// topic aliases set on this connection, see useTopicAlias
+	aliases := make(map[uint16]string)
 	for {
-		if debugActive() {
-			DEBUG.Println(NET, "outgoing waiting for an outbound message")
+		if c.debugActive() {
+			c.debug(NET, "outgoing waiting for an outbound message")
+		}
+		// with OutboundFairness one queue is left out of the select when the
+		// other has a packet which is due, otherwise the pick is random
+		publishes, priority := c.obound, c.oboundP
+		if fairness := c.options.OutboundFairness; fairness > 0 {
+			switch {
+			case prioritySent >= fairness && len(c.obound) > 0:
+				priority = nil
+			case len(c.oboundP) > 0:
+				publishes = nil
+			}
+		}
+		permit := permits
+		if permitted {
+			permit = nil
+		} else {
+			publishes = nil
 		}
 		select {
 		case <-c.stop:
-			DEBUG.Println(NET, "outgoing stopped")
+			c.debug(NET, "outgoing stopped")
 			return
-		case pub := <-c.obound:
-			msg := pub.p.(*packets.PublishPacket)
-			if msg.Qos != 0 && msg.MessageID == 0 {
-				msg.MessageID = c.getID(pub.t)
-				pub.t.(*PublishToken).messageID = msg.MessageID
+		case <-permit:
+			permitted = true
+			continue
+		case pub := <-publishes:
+			prioritySent = 0
+			if pub.p == nil {
+				// a Flush marker, everything queued before it has been written
+				pub.t.flowComplete()
+				continue
+			}
+			if !pub.expires.IsZero() && time.Now().After(pub.expires) {
+				c.debug(NET, "dropping expired publish")
+				atomic.AddInt64(&publishesExpired, 1)
+				if token, ok := pub.t.(*PublishToken); ok {
+					c.releaseInflight(token)
+					if token.messageID != 0 {
+						c.freeID(token.messageID)
+					}
+					token.err = ErrExpired
+					token.flowComplete()
+				}
+				pub.p.Release()
+				continue
+			}
+			permitted = permits == nil
+			msg := pub.p
+			if pub.t == nil && msg.Details().Qos != 0 {
+				// publishes without a token still need one to match their acks
+				pub.t = newToken(packets.Publish)
 			}
-			//persist_obound(c.persist, msg)
+			if details := msg.Details(); details.Qos != 0 && details.MessageID == 0 {
+				c.assignPublishID(pub)
+			}
+			persistOutbound(c.persist, msg)
+			// the topic left out for an alias is put back once written,
+			// in case the publish has to be sent again
+			topic := c.useTopicAlias(aliases, msg, pub.t)
 
-			if c.options.WriteTimeout > 0 {
-				c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout))
+			started := time.Now()
+			if deadline.enabled() {
+				if timeout := deadline.timeout(); timeout > 0 {
+					c.conn.SetWriteDeadline(started.Add(timeout))
+				}
 			}
 
+			noDelay.set(false)
+			if watched {
+				atomic.StoreInt64(&c.writeStarted, started.UnixNano())
+			}
 			err := msg.Write(writer)
 			if err == nil {
 				err = writer.Flush()
 			}
+			if watched {
+				atomic.StoreInt64(&c.writeStarted, 0)
+			}
+			if topic != nil {
+				msg.(*packets.PublishPacket).TopicName = topic
+			}
 			if err != nil {
-				ERROR.Println(NET, "outgoing stopped with error")
-				c.errors <- err
-				msg.Release()
+				c.error(NET, "outgoing stopped with error", "err", err)
+				if !c.keepUnsent(pub) {
+					msg.Release()
+				}
+				c.reportError(err)
 				return
 			}
 
-			if c.options.WriteTimeout > 0 {
+			if deadline.enabled() {
+				deadline.record(time.Since(started))
 				// If we successfully wrote, we don't want the timeout to happen during an idle period
 				// so we reset it to infinite.
 				c.conn.SetWriteDeadline(time.Time{})
 			}
 
-			if msg.Qos == 0 {
+			if msg.Details().Qos == 0 && pub.t != nil {
 				pub.t.flowComplete()
 			}
-			if debugActive() {
-				DEBUG.Println(NET, "obound wrote msg, id:", msg.MessageID)
+			if c.debugActive() {
+				c.debug(NET, "obound wrote msg", "id", msg.Details().MessageID)
 			}
 			msg.Release()
 			packetsSent += 1
-		case msg := <-c.oboundP:
-			switch msg.p.(type) {
+		case msg := <-priority:
+			prioritySent++
+			if msg.p == nil {
+				msg.t.flowComplete()
+				continue
+			}
+			switch p := msg.p.(type) {
 			case *packets.SubscribePacket:
-				msg.p.(*packets.SubscribePacket).MessageID = c.getID(msg.t)
+				p.MessageID = c.getID(msg.t)
+				if msg.t.(*SubscribeToken).isCancelled() {
+					c.debug(NET, "dropping cancelled subscribe")
+					c.freeID(p.MessageID)
+					p.Release()
+					continue
+				}
 			case *packets.UnsubscribePacket:
-				msg.p.(*packets.UnsubscribePacket).MessageID = c.getID(msg.t)
+				p.MessageID = c.getID(msg.t)
+				if msg.t.(*UnsubscribeToken).isCancelled() {
+					c.debug(NET, "dropping cancelled unsubscribe")
+					c.freeID(p.MessageID)
+					p.Release()
+					continue
+				}
+			case *packets.PubackPacket, *packets.PubrecPacket, *packets.PubrelPacket, *packets.PubcompPacket:
+				persistOutbound(c.persist, msg.p)
+			}
+			if c.debugActive() {
+				c.debug(NET, "obound priority msg to write", "type", reflect.TypeOf(msg.p))
 			}
-			if debugActive() {
-				DEBUG.Println(NET, "obound priority msg to write, type", reflect.TypeOf(msg.p))
+			noDelay.set(true)
+			if watched {
+				atomic.StoreInt64(&c.writeStarted, time.Now().UnixNano())
+			}
+			// pings must be queued in the order they are written, keepalive
+			// pings as nil
+			_, ping := msg.p.(*packets.PingreqPacket)
+			if ping {
+				latency, _ := msg.t.(*latencyToken)
+				c.pingsLock.Lock()
+				if latency != nil {
+					latency.sent = time.Now()
+				}
+				c.pings = append(c.pings, latency)
 			}
 			err := msg.p.Write(writer)
 			msg.p.Release()
 			if err == nil {
 				writer.Flush()
 			}
+			if ping {
+				c.pingsLock.Unlock()
+			}
+			if watched {
+				atomic.StoreInt64(&c.writeStarted, 0)
+			}
 			if err != nil {
-				ERROR.Println(NET, "outgoing stopped with error")
-				c.errors <- err
+				c.error(NET, "outgoing stopped with error", "err", err)
+				c.reportError(err)
 				return
 			}
 			switch msg.p.(type) {
 			case *packets.DisconnectPacket:
 				msg.t.(*DisconnectToken).flowComplete()
-				if debugActive() {
-					DEBUG.Println(NET, "outbound wrote disconnect, stopping")
+				if c.debugActive() {
+					c.debug(NET, "outbound wrote disconnect, stopping")
 				}
 				return
 			}
 			packetsSent += 1
 		}
-		// Reset ping timer after sending control packet.
+		// Reset ping timer after sending control packet, keepalive may
+		// already have stopped.
 		if c.resetPing != nil {
-			c.resetPing <- struct{}{}
+			select {
+			case c.resetPing <- struct{}{}:
+			case <-c.stop:
+			}
 		}
 	}
 }
@@ -225,122 +579,220 @@ func outgoing(c *Client) {
 // delete messages from store if necessary
 func alllogic(c *Client) {
 
-	DEBUG.Println(NET, "logic started")
+	c.debug(NET, "logic started")
+	// alllogic is started for each connection, after the CONNACK
+	gen := c.ConnectionGeneration()
 
 	for {
-		if debugActive() {
-			DEBUG.Println(NET, "logic waiting for msg on ibound")
+		if c.debugActive() {
+			c.debug(NET, "logic waiting for msg on ibound")
 		}
 
 		select {
 		case msg := <-c.ibound:
-			if debugActive() {
-				DEBUG.Println(NET, "logic got msg on ibound")
+			if c.debugActive() {
+				c.debug(NET, "logic got msg on ibound")
+			}
+			select {
+			case <-c.stop:
+				// disconnecting, the store may already be closed
+			default:
+				persistIncoming(c.persist, msg)
 			}
-			//persist_ibound(c.persist, msg)
 			switch msg.(type) {
 			case *packets.PingrespPacket:
-				if debugActive() {
-					DEBUG.Println(NET, "received pingresp")
+				if c.debugActive() {
+					c.debug(NET, "received pingresp")
 				}
-				if c.resetPingResp != nil {
+				if c.pingAnswered() && c.resetPingResp != nil {
 					c.resetPingResp <- struct{}{}
 				}
 				msg.Release()
 			case *packets.SubackPacket:
 				sa := msg.(*packets.SubackPacket)
-				if debugActive() {
-					DEBUG.Println(NET, "received suback, id:", sa.MessageID)
+				if c.debugActive() {
+					c.debug(NET, "received suback", "id", sa.MessageID)
+				}
+				token, ok := c.getToken(sa.MessageID).(*SubscribeToken)
+				if !ok {
+					c.debug(NET, "dropping suback for unknown id", "id", sa.MessageID)
+					msg.Release()
+					break
+				}
+				if token.isCancelled() {
+					// the id was kept for this suback, so that it
+					// can't complete a later subscribe
+					c.debug(NET, "dropping suback for cancelled subscribe", "id", sa.MessageID)
+					go c.freeID(sa.MessageID)
+					msg.Release()
+					break
 				}
-				token := c.getToken(sa.MessageID).(*SubscribeToken)
-				if debugActive() {
-					DEBUG.Println(NET, "granted qoss", sa.GrantedQoss)
+				if c.debugActive() {
+					c.debug(NET, "granted qoss", "qoss", sa.GrantedQoss)
 				}
-				for i, qos := range sa.GrantedQoss {
-					token.subResult[token.subs[i]] = qos
+				completed := token.completeWith(func() {
+					for i, qos := range sa.GrantedQoss {
+						token.subResult[token.subs[i]] = qos
+						if qos < 0x80 {
+							c.recordSubscribed(token.subs[i], token.qoss[i])
+							c.msgRouter.setGrantedQos(token.subs[i], qos)
+							c.startRetainedTimer(token.subs[i])
+						}
+						token.completeFilter(token.subs[i], qos)
+					}
+					if sa.Properties != nil {
+						token.reasonString = sa.Properties.ReasonString
+						token.userProperties = sa.Properties.UserProperties
+					}
+				})
+				if completed && token.parent != nil {
+					token.parent.partComplete()
 				}
-				token.flowComplete()
 				go c.freeID(sa.MessageID)
 				msg.Release()
 			case *packets.UnsubackPacket:
 				ua := msg.(*packets.UnsubackPacket)
-				if debugActive() {
-					DEBUG.Println(NET, "received unsuback, id:", ua.MessageID)
+				if c.debugActive() {
+					c.debug(NET, "received unsuback", "id", ua.MessageID)
 				}
-				token := c.getToken(ua.MessageID).(*UnsubscribeToken)
-				token.flowComplete()
+				token, ok := c.getToken(ua.MessageID).(*UnsubscribeToken)
+				if !ok {
+					c.debug(NET, "dropping unsuback for unknown id", "id", ua.MessageID)
+					msg.Release()
+					break
+				}
+				token.completeWith(func() {
+					for i, topic := range token.topics {
+						var code byte
+						if ua.ReasonCodes != nil {
+							code = 0x80 // missing from the unsuback
+							if i < len(ua.ReasonCodes) {
+								code = ua.ReasonCodes[i]
+							}
+						}
+						token.unsubResult[topic] = code
+					}
+					if ua.Properties != nil {
+						token.reasonString = ua.Properties.ReasonString
+						token.userProperties = ua.Properties.UserProperties
+					}
+				})
 				go c.freeID(ua.MessageID)
 				msg.Release()
 			case *packets.PublishPacket:
 				pp := msg.(*packets.PublishPacket)
-				if debugActive() {
-					DEBUG.Println(NET, "received publish, msgId:", pp.MessageID)
-					DEBUG.Println(NET, "putting msg on onPubChan")
+				if c.debugActive() {
+					c.debug(NET, "received publish", "id", pp.MessageID)
+					c.debug(NET, "putting msg on onPubChan")
+				}
+				c.retainedArrived(pp)
+				c.markActive()
+				var received time.Time
+				if c.options.MaxDeliveryAge > 0 {
+					received = time.Now()
 				}
 				switch pp.Qos {
 				case 2:
-					c.incomingPubChan <- pp
-					if debugActive() {
-						DEBUG.Println(NET, "done putting msg on incomingPubChan")
-					}
 					pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
 					pr.MessageID = pp.MessageID
-					if debugActive() {
-						DEBUG.Println(NET, "putting pubrec msg on obound")
+					var m Message
+					switch {
+					case c.options.ManualAck:
+						// the pubrec is sent once a handler calls Message.Ack
+						c.expectAck(pr)
+					case c.options.AckPolicy != nil:
+						// pp is released once dispatched, so take a copy for the policy
+						m = messageFromPublish(pp, pp.Qos, gen, nil)
 					}
-					c.oboundP <- &PacketAndToken{p: pr, t: nil}
-					if debugActive() {
-						DEBUG.Println(NET, "done putting pubrec msg on obound")
+					c.incomingPubChan <- incomingPublish{packet: pp, generation: gen, received: received}
+					if c.debugActive() {
+						c.debug(NET, "done putting msg on incomingPubChan")
 					}
-				case 1:
-					c.incomingPubChan <- pp
-					if debugActive() {
-						DEBUG.Println(NET, "done putting msg on incomingPubChan")
+					if !c.options.ManualAck {
+						if c.debugActive() {
+							c.debug(NET, "putting pubrec msg on obound")
+						}
+						c.sendAck(m, pr)
+						if c.debugActive() {
+							c.debug(NET, "done putting pubrec msg on obound")
+						}
 					}
+				case 1:
 					pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
 					pa.MessageID = pp.MessageID
-					if debugActive() {
-						DEBUG.Println(NET, "putting puback msg on obound")
+					var m Message
+					switch {
+					case c.options.ManualAck:
+						c.expectAck(pa)
+					case c.options.AckPolicy != nil:
+						m = messageFromPublish(pp, pp.Qos, gen, nil)
 					}
-					c.oboundP <- &PacketAndToken{p: pa, t: nil}
-					if debugActive() {
-						DEBUG.Println(NET, "done putting puback msg on obound")
+					c.incomingPubChan <- incomingPublish{packet: pp, generation: gen, received: received}
+					if c.debugActive() {
+						c.debug(NET, "done putting msg on incomingPubChan")
 					}
-				case 0:
-					select {
-					case c.incomingPubChan <- pp:
-						if debugActive() {
-							DEBUG.Println(NET, "done putting msg on incomingPubChan")
+					if !c.options.ManualAck {
+						if c.debugActive() {
+							c.debug(NET, "putting puback msg on obound")
 						}
-					case err, ok := <-c.errors:
-						if debugActive() {
-							DEBUG.Println(NET, "error while putting msg on pubChanZero")
+						c.sendAck(m, pa)
+						if c.debugActive() {
+							c.debug(NET, "done putting puback msg on obound")
 						}
-						// We are unblocked, but need to put the error back on so the outer
-						// select can handle it appropriately.
-						if ok {
-							go func(errVal error, errChan chan error) {
-								errChan <- errVal
-							}(err, c.errors)
+					}
+				case 0:
+					select {
+					case c.incomingPubChan <- incomingPublish{packet: pp, generation: gen, received: received}:
+						if c.debugActive() {
+							c.debug(NET, "done putting msg on incomingPubChan")
 						}
+					case err := <-c.errors:
+						// the connection is lost while the handlers are behind, the
+						// message is dropped as QoS 0 allows rather than waiting for
+						// them, and the error is handled here instead of being put
+						// back for the outer select, which would need a goroutine
+						c.error(NET, "logic got error while putting msg on incomingPubChan", "err", err)
+						pp.Release()
+						c.internalConnLost(err)
+						return
+					case <-c.stop:
+						c.warn(NET, "logic stopped")
+						pp.Release()
+						return
 					}
 				}
 				// publish messages aren't released because they are used in another
 				// goroutine
 			case *packets.PubackPacket:
 				pa := msg.(*packets.PubackPacket)
-				if debugActive() {
-					DEBUG.Println(NET, "received puback, id:", pa.MessageID)
+				if c.debugActive() {
+					c.debug(NET, "received puback", "id", pa.MessageID)
 				}
 				// c.receipts.get(msg.MsgId()) <- Receipt{}
 				// c.receipts.end(msg.MsgId())
+				if pt, ok := c.getToken(pa.MessageID).(*PublishToken); ok {
+					pt.setReason(pa.ReasonCode, pa.Properties)
+					c.releaseInflight(pt)
+					c.publishDelivered(pt)
+				}
 				c.getToken(pa.MessageID).flowComplete()
 				c.freeID(pa.MessageID)
 				msg.Release()
 			case *packets.PubrecPacket:
 				prec := msg.(*packets.PubrecPacket)
-				if debugActive() {
-					DEBUG.Println(NET, "received pubrec, id:", prec.MessageID)
+				if c.debugActive() {
+					c.debug(NET, "received pubrec", "id", prec.MessageID)
+				}
+				if prec.ReasonCode >= 0x80 {
+					// the broker refused the message, the flow ends without a pubrel
+					if pt, ok := c.getToken(prec.MessageID).(*PublishToken); ok {
+						pt.setReason(prec.ReasonCode, prec.Properties)
+						c.releaseInflight(pt)
+						pt.flowComplete()
+					}
+					c.freeID(prec.MessageID)
+					msg.Release()
+					break
 				}
 				prel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
 				prel.MessageID = prec.MessageID
@@ -351,8 +803,8 @@ func alllogic(c *Client) {
 				msg.Release()
 			case *packets.PubrelPacket:
 				pr := msg.(*packets.PubrelPacket)
-				if debugActive() {
-					DEBUG.Println(NET, "received pubrel, id:", pr.MessageID)
+				if c.debugActive() {
+					c.debug(NET, "received pubrel", "id", pr.MessageID)
 				}
 				pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
 				pc.MessageID = pr.MessageID
@@ -363,20 +815,126 @@ func alllogic(c *Client) {
 				msg.Release()
 			case *packets.PubcompPacket:
 				pc := msg.(*packets.PubcompPacket)
-				if debugActive() {
-					DEBUG.Println(NET, "received pubcomp, id:", pc.MessageID)
+				if c.debugActive() {
+					c.debug(NET, "received pubcomp", "id", pc.MessageID)
+				}
+				if pt, ok := c.getToken(pc.MessageID).(*PublishToken); ok {
+					pt.setReason(pc.ReasonCode, pc.Properties)
+					c.releaseInflight(pt)
+					c.publishDelivered(pt)
 				}
 				c.getToken(pc.MessageID).flowComplete()
 				c.freeID(pc.MessageID)
 				msg.Release()
+			default:
+				c.warn(NET, "received unexpected packet", "type", reflect.TypeOf(msg))
+				if c.options.OnUnhandledPacket != nil {
+					// not released, the handler may keep the packet
+					go c.options.OnUnhandledPacket(msg)
+				} else {
+					msg.Release()
+				}
+				if c.options.StrictProtocol {
+					c.internalConnLost(fmt.Errorf("%s: unexpected %v", packets.ConnErrors[packets.ErrProtocolViolation], reflect.TypeOf(msg)))
+					return
+				}
 			}
 		case <-c.stop:
-			WARN.Println(NET, "logic stopped")
+			c.warn(NET, "logic stopped")
 			return
 		case err := <-c.errors:
-			ERROR.Println(NET, "logic got error")
+			c.error(NET, "logic got error", "err", err)
 			c.internalConnLost(err)
 			return
 		}
 	}
 }
+
+// publishDelivered passes a publish the broker accepted to the
+// OnPublishDelivered handler
+func (c *Client) publishDelivered(pt *PublishToken) {
+	if c.options.OnPublishDelivered != nil && pt.reasonCode < 0x80 {
+		c.options.OnPublishDelivered(pt.topic, pt.messageID)
+	}
+}
+
+// sendAck queues the PUBACK or PUBREC for an incoming publish. When an
+// AckPolicy is set it is consulted on its own goroutine so that a slow
+// policy doesn't hold up the processing of other incoming packets. If
+// the policy declines, or the connection is lost before it decides, the
+// ack is never sent and the broker will redeliver the message.
+func (c *Client) sendAck(m Message, ack packets.ControlPacket) {
+	if c.options.AckPolicy == nil {
+		c.oboundP <- &PacketAndToken{p: ack, t: nil}
+		return
+	}
+	stop := c.stop
+	go func() {
+		if !c.options.AckPolicy(c, m) {
+			c.debug(NET, "ack withheld by policy", "id", m.MessageID())
+			return
+		}
+		select {
+		case c.oboundP <- &PacketAndToken{p: ack, t: nil}:
+		case <-stop:
+			c.debug(NET, "connection lost before ack", "id", m.MessageID())
+		}
+	}()
+}
+
+// pendingAck is the PUBACK or PUBREC for an incoming message which is held
+// back, when ManualAck is set, until a handler calls Ack or Nack on it.
+type pendingAck struct {
+	sync.Mutex
+	c      *Client
+	packet packets.ControlPacket
+	stop   chan struct{}
+	done   bool
+}
+
+// expectAck registers the ack for an incoming message, this must be done
+// before the message is dispatched so that handlers can find it.
+func (c *Client) expectAck(ack packets.ControlPacket) {
+	c.acksLock.Lock()
+	defer c.acksLock.Unlock()
+	c.acks[ack.Details().MessageID] = &pendingAck{c: c, packet: ack, stop: c.stop}
+}
+
+// pendingAck returns the held back ack for an incoming message, if any.
+func (c *Client) pendingAck(p *packets.PublishPacket) *pendingAck {
+	if c == nil || !c.options.ManualAck || p.Qos == 0 {
+		return nil
+	}
+	c.acksLock.Lock()
+	defer c.acksLock.Unlock()
+	return c.acks[p.MessageID]
+}
+
+// complete sends the ack if accept is set, otherwise drops it so that the
+// broker redelivers the message. Only the first call has any effect.
+func (a *pendingAck) complete(accept bool) {
+	a.Lock()
+	done := a.done
+	a.done = true
+	a.Unlock()
+	if done {
+		return
+	}
+
+	id := a.packet.Details().MessageID
+	a.c.acksLock.Lock()
+	if a.c.acks[id] == a {
+		delete(a.c.acks, id)
+	}
+	a.c.acksLock.Unlock()
+
+	if !accept {
+		a.c.debug(NET, "message nacked", "id", id)
+		return
+	}
+	select {
+	case a.c.oboundP <- &PacketAndToken{p: a.packet, t: nil}:
+	case <-a.stop:
+		a.c.debug(NET, "connection lost before ack", "id", id)
+	}
+}
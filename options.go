@@ -15,9 +15,13 @@
 package mqtt
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"net/url"
 	"time"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
 )
 
 // MessageHandler is a callback type which can be set to be
@@ -36,33 +40,232 @@ type ConnectionLostHandler func(*Client, error)
 // at initial connection and on reconnection
 type OnConnectHandler func(*Client)
 
+// AckPolicyHandler is a callback which decides whether an incoming QoS 1
+// or QoS 2 message should be acknowledged. Returning false leaves the
+// message unacknowledged so that the broker will redeliver it.
+type AckPolicyHandler func(*Client, Message) bool
+
+// ErrorHandler is a callback which is passed every read or write error
+// encountered on the connection to the broker, before the connection is
+// treated as lost.
+type ErrorHandler func(err error)
+
+// DuplicateSubscriptionPolicy decides what Subscribe does when the client is
+// already subscribed to exactly the same topic filter in the current session.
+type DuplicateSubscriptionPolicy byte
+
+// Below are the policies for duplicate subscriptions
+const (
+	// DuplicateSubscriptionResend always sends a new SUBSCRIBE to the broker
+	DuplicateSubscriptionResend DuplicateSubscriptionPolicy = iota
+	// DuplicateSubscriptionUpdate replaces the MessageHandler of the existing
+	// subscription without sending a SUBSCRIBE, unless a different QoS is
+	// requested, in which case the broker is subscribed again
+	DuplicateSubscriptionUpdate
+	// DuplicateSubscriptionError makes Subscribe fail with ErrDuplicateSubscription
+	DuplicateSubscriptionError
+)
+
+// PublishWhenDisconnectedPolicy decides what Publish does when the client
+// is not connected to a broker.
+type PublishWhenDisconnectedPolicy byte
+
+// Below are the policies for publishing while disconnected
+const (
+	// PublishWhenDisconnectedQueue queues QoS 1 and 2 publishes made while the
+	// client is reconnecting to be sent once it is connected again, QoS 0
+	// publishes are dropped
+	PublishWhenDisconnectedQueue PublishWhenDisconnectedPolicy = iota
+	// PublishWhenDisconnectedError makes Publish fail with ErrNotConnected
+	// unless IsConnected is true
+	PublishWhenDisconnectedError
+	// PublishWhenDisconnectedBlock makes Publish wait, while the client is
+	// connecting or reconnecting, until the connection is made
+	PublishWhenDisconnectedBlock
+)
+
+// QosAboveMaximumPolicy decides what Publish does with a message whose QoS is
+// above the maximum the MQTT 5 broker announced in its CONNACK, which brokers
+// answer by disconnecting the client.
+type QosAboveMaximumPolicy byte
+
+// Below are the policies for publishes above the broker's maximum QoS
+const (
+	// QosAboveMaximumReject makes Publish fail with ErrNotSupportedByServer
+	QosAboveMaximumReject QosAboveMaximumPolicy = iota
+	// QosAboveMaximumDowngrade sends the message with the broker's maximum QoS
+	// instead, see PublishToken.Qos
+	QosAboveMaximumDowngrade
+)
+
+// ChannelFullPolicy decides what happens to a message for a subscription
+// made with SubscribeChan when the subscription's channel is full.
+type ChannelFullPolicy byte
+
+// Below are the policies for full subscription channels
+const (
+	// ChannelFullBlock waits for room in the channel. With OrderMatters set
+	// this holds up the delivery of messages for every subscription.
+	ChannelFullBlock ChannelFullPolicy = iota
+	// ChannelFullDrop discards the message
+	ChannelFullDrop
+)
+
+// UnhandledPacketHandler is a callback which is passed any control packet
+// received from the broker that the client has no use for, such as a
+// CONNECT or a second CONNACK.
+type UnhandledPacketHandler func(packets.ControlPacket)
+
+// ReconnectGaveUpHandler is a callback which is executed when the client
+// stops trying to reconnect, it is passed the error from the last attempt.
+type ReconnectGaveUpHandler func(lastErr error)
+
+// ReconnectSuccessHandler is a callback which is executed once the client has
+// reconnected, it is passed how long the client was without a connection and
+// the broker it reconnected to.
+type ReconnectSuccessHandler func(downtime time.Duration, broker *url.URL)
+
+// FlowControlHandler is a callback which is passed the number of publishes
+// waiting for an ack and the broker's receive maximum.
+type FlowControlHandler func(inflight, max int)
+
+// PublishDeliveredHandler is a callback which is passed the topic and message
+// ID of a QoS 1 or 2 publish which the broker has acknowledged.
+type PublishDeliveredHandler func(topic string, messageID uint16)
+
+// ConnackHandler is a callback which is passed each CONNACK packet received
+// from the broker.
+type ConnackHandler func(*packets.ConnackPacket)
+
+// RetainedCompleteHandler is a callback which is passed a subscription's filter
+// once the broker seems to have sent all the retained messages for it.
+type RetainedCompleteHandler func(filter string)
+
+// HandlerPanicHandler is a callback which is passed the topic of a message
+// whose handler panicked and the value recovered from the panic.
+type HandlerPanicHandler func(topic string, recovered interface{})
+
+// TLSServerNameFunc returns the name to verify the certificate of broker
+// against, and to send in SNI, or "" for the default.
+type TLSServerNameFunc func(broker *url.URL) string
+
+// DecodeErrorHandler is a callback which is passed the fixed header and the
+// bytes of the body that were read of a packet which couldn't be decoded,
+// along with the reason.
+type DecodeErrorHandler func(fixedHeader packets.FixedHeader, rawBody []byte, err error)
+
+// IdleDisconnectHandler is a callback which is executed when the client has
+// closed its connection for being idle, see SetIdleTimeout.
+type IdleDisconnectHandler func(client *Client)
+
+// RateLimiter limits how often an action may happen. Wait blocks until the
+// action is allowed or ctx is done. *rate.Limiter from golang.org/x/time/rate
+// satisfies this interface.
+type RateLimiter interface {
+	Wait(ctx context.Context) error
+}
+
+// OpenConnectionFunc is a function which establishes the network connection
+// to the broker at the given URI. It allows the client to run over transports
+// which aren't built in.
+type OpenConnectionFunc func(uri *url.URL) (net.Conn, error)
+
+// CredentialsProviderFunc is a function which returns the username and
+// password to connect with.
+type CredentialsProviderFunc func() (username string, password string)
+
+// BrokerCredentialsProviderFunc is a function which returns the username and
+// password to connect to broker with.
+type BrokerCredentialsProviderFunc func(broker *url.URL) (username string, password string)
+
+// ConnectPacketBuilderFunc is a function which is passed the CONNECT packet
+// built from the options and returns the packet to send in its place.
+type ConnectPacketBuilderFunc func(base *packets.ConnectPacket) *packets.ConnectPacket
+
 // ClientOptions contains configurable options for an Client.
 type ClientOptions struct {
-	Servers                 []*url.URL
-	ClientID                string
-	Username                string
-	Password                string
-	CleanSession            bool
-	Order                   bool
-	WillEnabled             bool
-	WillTopic               string
-	WillPayload             []byte
-	WillQos                 byte
-	WillRetained            bool
-	ProtocolVersion         uint
-	protocolVersionExplicit bool
-	TLSConfig               tls.Config
-	KeepAlive               time.Duration
-	PingTimeout             time.Duration
-	ConnectTimeout          time.Duration
-	MaxReconnectInterval    time.Duration
-	AutoReconnect           bool
-	Store                   Store
-	DefaultPublishHander    MessageHandler
-	OnConnect               OnConnectHandler
-	OnConnectionLost        ConnectionLostHandler
-	WriteTimeout            time.Duration
-	MessageChannelDepth     uint
+	Servers                   []*url.URL
+	ClientID                  string
+	Username                  string
+	Password                  string
+	CleanSession              bool
+	SessionExpiryInterval     time.Duration
+	RequestResponseInfo       bool
+	Order                     bool
+	OrderPerSubscription      bool
+	CacheRetained             bool
+	WillEnabled               bool
+	WillTopic                 string
+	WillPayload               []byte
+	WillQos                   byte
+	WillRetained              bool
+	WillDelay                 time.Duration
+	ProtocolVersion           uint
+	protocolVersionExplicit   bool
+	SubscriptionIdentifiers   bool
+	MaxTopicsPerSubscribe     int
+	MessageIDAllocator        MessageIDAllocator
+	DuplicateSubscriptions    DuplicateSubscriptionPolicy
+	PublishWhenDisconnected   PublishWhenDisconnectedPolicy
+	QosAboveMaximum           QosAboveMaximumPolicy
+	MaxSubscribeQoS           *byte
+	MaxPublishQoS             *byte
+	SubscribeChannelFull      ChannelFullPolicy
+	TLSConfig                 tls.Config
+	TLSServerNameForBroker    TLSServerNameFunc
+	KeepAlive                 time.Duration
+	PingTimeout               time.Duration
+	WebsocketPingInterval     time.Duration
+	WebsocketCompression      bool
+	ConnectTimeout            time.Duration
+	ReadBufferBytes           int
+	WriteBufferBytes          int
+	LowLatencyControlPackets  bool
+	InitialReconnectDelay     time.Duration
+	MaxReconnectInterval      time.Duration
+	MaxReconnectAttempts      int
+	AutoReconnect             bool
+	Store                     Store
+	Logger                    Logger
+	DefaultPublishHander      MessageHandler
+	OnConnect                 OnConnectHandler
+	OnConnectionLost          ConnectionLostHandler
+	OnError                   ErrorHandler
+	OnReconnectGaveUp         ReconnectGaveUpHandler
+	OnReconnectSuccess        ReconnectSuccessHandler
+	OnUnhandledPacket         UnhandledPacketHandler
+	OnFlowControlBlocked      FlowControlHandler
+	OnFlowControlResumed      FlowControlHandler
+	OnPublishDelivered        PublishDeliveredHandler
+	OnConnack                 ConnackHandler
+	OnRetainedComplete        RetainedCompleteHandler
+	OnHandlerPanic            HandlerPanicHandler
+	OnDecodeError             DecodeErrorHandler
+	OnIdleDisconnect          IdleDisconnectHandler
+	RetainedQuietWindow       time.Duration
+	StrictProtocol            bool
+	RejectUnsolicitedMessages bool
+	AllowPreConnackPackets    bool
+	EnforceCapabilities       bool
+	CustomOpenConnectionFn    OpenConnectionFunc
+	ConnectPacketBuilder      ConnectPacketBuilderFunc
+	CredentialsProvider       CredentialsProviderFunc
+	BrokerCredentialsProvider BrokerCredentialsProviderFunc
+	AckPolicy                 AckPolicyHandler
+	ManualAck                 bool
+	PublishRateLimiter        RateLimiter
+	OutboundFairness          int
+	WriteTimeout              time.Duration
+	AdaptiveWriteTimeout      bool
+	WriteTimeoutFloor         time.Duration
+	WriteTimeoutCeiling       time.Duration
+	OutgoingStallTimeout      time.Duration
+	IdleTimeout               time.Duration
+	ReadTimeout               time.Duration
+	PacketReadTimeout         time.Duration
+	MessageChannelDepth       uint
+	MaxDeliveryAge            time.Duration
+	MaxQueuedBytes            int64
 }
 
 // NewClientOptions will create a new ClientClientOptions type with some
@@ -72,34 +275,92 @@ type ClientOptions struct {
 //   Order: True
 //   KeepAlive: 30 (seconds)
 //   ConnectTimeout: 30 (seconds)
+//   InitialReconnectDelay 1 (second)
 //   MaxReconnectInterval 10 (minutes)
 //   AutoReconnect: True
 func NewClientOptions() *ClientOptions {
 	o := &ClientOptions{
-		Servers:                 nil,
-		ClientID:                "",
-		Username:                "",
-		Password:                "",
-		CleanSession:            true,
-		Order:                   true,
-		WillEnabled:             false,
-		WillTopic:               "",
-		WillPayload:             nil,
-		WillQos:                 0,
-		WillRetained:            false,
-		ProtocolVersion:         0,
-		protocolVersionExplicit: false,
-		TLSConfig:               tls.Config{},
-		KeepAlive:               30 * time.Second,
-		PingTimeout:             10 * time.Second,
-		ConnectTimeout:          30 * time.Second,
-		MaxReconnectInterval:    10 * time.Minute,
-		AutoReconnect:           true,
-		Store:                   nil,
-		OnConnect:               nil,
-		OnConnectionLost:        DefaultConnectionLostHandler,
-		WriteTimeout:            0, // 0 represents timeout disabled
-		MessageChannelDepth:     100,
+		Servers:                   nil,
+		ClientID:                  "",
+		Username:                  "",
+		Password:                  "",
+		CleanSession:              true,
+		SessionExpiryInterval:     0,
+		RequestResponseInfo:       false,
+		Order:                     true,
+		OrderPerSubscription:      false,
+		CacheRetained:             false,
+		WillEnabled:               false,
+		WillTopic:                 "",
+		WillPayload:               nil,
+		WillQos:                   0,
+		WillRetained:              false,
+		WillDelay:                 0,
+		ProtocolVersion:           0,
+		protocolVersionExplicit:   false,
+		SubscriptionIdentifiers:   false,
+		MaxTopicsPerSubscribe:     0, // 0 represents no limit
+		MessageIDAllocator:        nil,
+		DuplicateSubscriptions:    DuplicateSubscriptionResend,
+		PublishWhenDisconnected:   PublishWhenDisconnectedQueue,
+		QosAboveMaximum:           QosAboveMaximumReject,
+		MaxSubscribeQoS:           nil,
+		MaxPublishQoS:             nil,
+		SubscribeChannelFull:      ChannelFullBlock,
+		TLSConfig:                 tls.Config{},
+		TLSServerNameForBroker:    nil,
+		KeepAlive:                 30 * time.Second,
+		PingTimeout:               10 * time.Second,
+		WebsocketPingInterval:     0,
+		WebsocketCompression:      false,
+		ConnectTimeout:            30 * time.Second,
+		ReadBufferBytes:           0, // 0 leaves the system default
+		WriteBufferBytes:          0, // 0 leaves the system default
+		LowLatencyControlPackets:  false,
+		InitialReconnectDelay:     1 * time.Second,
+		MaxReconnectInterval:      10 * time.Minute,
+		MaxReconnectAttempts:      0, // 0 represents no limit
+		AutoReconnect:             true,
+		Store:                     nil,
+		Logger:                    nil,
+		OnConnect:                 nil,
+		OnConnectionLost:          DefaultConnectionLostHandler,
+		OnError:                   nil,
+		OnReconnectGaveUp:         nil,
+		OnReconnectSuccess:        nil,
+		OnUnhandledPacket:         nil,
+		OnFlowControlBlocked:      nil,
+		OnFlowControlResumed:      nil,
+		OnPublishDelivered:        nil,
+		OnConnack:                 nil,
+		OnRetainedComplete:        nil,
+		OnHandlerPanic:            nil,
+		OnDecodeError:             nil,
+		OnIdleDisconnect:          nil,
+		RetainedQuietWindow:       500 * time.Millisecond,
+		StrictProtocol:            false,
+		RejectUnsolicitedMessages: false,
+		AllowPreConnackPackets:    false,
+		EnforceCapabilities:       false,
+		CustomOpenConnectionFn:    nil,
+		ConnectPacketBuilder:      nil,
+		CredentialsProvider:       nil,
+		BrokerCredentialsProvider: nil,
+		AckPolicy:                 nil,
+		ManualAck:                 false,
+		PublishRateLimiter:        nil,
+		OutboundFairness:          0, // 0 represents a random pick between the queues
+		WriteTimeout:              0, // 0 represents timeout disabled
+		AdaptiveWriteTimeout:      false,
+		WriteTimeoutFloor:         500 * time.Millisecond,
+		WriteTimeoutCeiling:       30 * time.Second,
+		OutgoingStallTimeout:      0, // 0 represents the watchdog disabled
+		IdleTimeout:               0, // 0 represents idle connections kept open
+		ReadTimeout:               0, // 0 represents timeout disabled
+		PacketReadTimeout:         0, // 0 represents timeout disabled
+		MessageChannelDepth:       100,
+		MaxDeliveryAge:            0,
+		MaxQueuedBytes:            0, // 0 represents no limit
 	}
 	return o
 }
@@ -149,6 +410,25 @@ func (o *ClientOptions) SetCleanSession(clean bool) *ClientOptions {
 	return o
 }
 
+// SetSessionExpiryInterval sets how long the broker keeps the session after the
+// connection is closed when MQTT 5 is used, with MQTT 5 the "clean session" flag
+// only discards an existing session when connecting. If left at 0 the MQTT 3.1.1
+// behaviour is kept: a clean session ends when the connection closes and any other
+// session never expires. This is ignored for earlier protocol versions.
+func (o *ClientOptions) SetSessionExpiryInterval(d time.Duration) *ClientOptions {
+	o.SessionExpiryInterval = d
+	return o
+}
+
+// SetRequestResponseInfo sets whether an MQTT 5 broker is asked for response
+// information when connecting, which some brokers answer with a prefix for the
+// response topics of request/response exchanges, see Client.ResponseInformation.
+// This is ignored for earlier protocol versions.
+func (o *ClientOptions) SetRequestResponseInfo(request bool) *ClientOptions {
+	o.RequestResponseInfo = request
+	return o
+}
+
 // SetOrderMatters will set the message routing to guarantee order within
 // each QoS level. By default, this value is true. If set to false,
 // this flag indicates that messages can be delivered asynchronously
@@ -158,11 +438,48 @@ func (o *ClientOptions) SetOrderMatters(order bool) *ClientOptions {
 	return o
 }
 
+// SetOrderPerSubscription, when OrderMatters is false, keeps messages in order
+// for each subscription while still letting different subscriptions' handlers
+// run at the same time. Each subscription's handler is called for one message
+// at a time in the order they arrived, and once a handler falls far enough
+// behind, dispatching waits for it to catch up. Messages for the default
+// handler are ordered in the same way.
+func (o *ClientOptions) SetOrderPerSubscription(order bool) *ClientOptions {
+	o.OrderPerSubscription = order
+	return o
+}
+
+// SetCacheRetained sets whether the client keeps the last retained message it
+// received on each topic, and replays the ones matching a topic filter to the
+// handler whenever the filter is subscribed to, before the broker's own retained
+// messages arrive. This keeps a display up to date while resubscribing after a
+// reconnect. A retained message with an empty payload, including one published
+// by the client, removes the topic from the cache. The cache holds up to 10000
+// topics, dropping the one updated longest ago to make room. Default false.
+func (o *ClientOptions) SetCacheRetained(cache bool) *ClientOptions {
+	o.CacheRetained = cache
+	return o
+}
+
 // SetTLSConfig will set an SSL/TLS configuration to be used when connecting
 // to an MQTT broker. Please read the official Go documentation for more
-// information.
+// information. The configuration is cloned, which keeps its callbacks such as
+// VerifyConnection, VerifyPeerCertificate and GetClientCertificate, they are
+// called for every connection the client makes including reconnections.
 func (o *ClientOptions) SetTLSConfig(t *tls.Config) *ClientOptions {
-	o.TLSConfig = *t
+	// cloned rather than copied, t may be in use
+	o.TLSConfig = *t.Clone()
+	return o
+}
+
+// SetTLSServerNameForBroker sets a function giving the server name for each
+// broker, which replaces the ServerName of the TLS configuration when connecting
+// to it. It is needed when a broker is dialled by an IP address or through a load
+// balancer whose name isn't in the broker's certificate, and lets each broker of a
+// failover list have its own name. When it returns "" the TLS configuration is
+// used as it is, with the host being dialled as the server name if none is set.
+func (o *ClientOptions) SetTLSServerNameForBroker(serverName TLSServerNameFunc) *ClientOptions {
+	o.TLSServerNameForBroker = serverName
 	return o
 }
 
@@ -175,6 +492,14 @@ func (o *ClientOptions) SetStore(s Store) *ClientOptions {
 	return o
 }
 
+// SetLogger will set the Logger used for the output of this client. If no
+// logger is provided, then the client writes to the package level DEBUG,
+// WARN and ERROR loggers.
+func (o *ClientOptions) SetLogger(l Logger) *ClientOptions {
+	o.Logger = l
+	return o
+}
+
 // SetKeepAlive will set the amount of time (in seconds) that the client
 // should wait before sending a PING request to the broker. This will
 // allow the client to know that a connection has not been lost with the
@@ -192,16 +517,65 @@ func (o *ClientOptions) SetPingTimeout(k time.Duration) *ClientOptions {
 	return o
 }
 
+// SetWebsocketPingInterval will set how often a WebSocket ping frame is sent on
+// ws and wss connections. Some proxies close WebSocket connections which carry
+// no WebSocket level traffic, regardless of the MQTT keepalive packets inside.
+// A duration of 0 disables the pings. Default 0.
+func (o *ClientOptions) SetWebsocketPingInterval(d time.Duration) *ClientOptions {
+	o.WebsocketPingInterval = d
+	return o
+}
+
+// SetWebsocketCompression sets whether ws and wss connections offer the WebSocket
+// permessage-deflate extension, compressing each MQTT packet sent and received when
+// the server accepts it. Servers which don't support it are connected to without
+// compression. Default false.
+func (o *ClientOptions) SetWebsocketCompression(compress bool) *ClientOptions {
+	o.WebsocketCompression = compress
+	return o
+}
+
 // SetProtocolVersion sets the MQTT version to be used to connect to the
-// broker. Legitimate values are currently 3 - MQTT 3.1 or 4 - MQTT 3.1.1
+// broker. Legitimate values are currently 3 - MQTT 3.1, 4 - MQTT 3.1.1
+// or 5 - MQTT 5
 func (o *ClientOptions) SetProtocolVersion(pv uint) *ClientOptions {
-	if pv >= 3 && pv <= 4 {
+	if pv >= 3 && pv <= 5 {
 		o.ProtocolVersion = pv
 		o.protocolVersionExplicit = true
 	}
 	return o
 }
 
+// SetSubscriptionIdentifiers will make Subscribe attach an MQTT 5 subscription
+// identifier to each subscription which has a MessageHandler. Messages which the
+// broker tags with that identifier are then dispatched to the handler directly,
+// without matching their topic against every subscription. Subscriptions made
+// with SubscribeMultiple are always matched by topic. This is only used when
+// MQTT 5 is used and the broker supports it, it is otherwise ignored.
+func (o *ClientOptions) SetSubscriptionIdentifiers(enabled bool) *ClientOptions {
+	o.SubscriptionIdentifiers = enabled
+	return o
+}
+
+// SetMaxTopicsPerSubscribe limits how many topic filters are sent in one SUBSCRIBE
+// packet, for brokers which refuse larger ones. SubscribeMultiple splits the filters
+// over as many packets as needed, its token completing once all of them have been
+// acknowledged, as it does to stay within the broker's maximum packet size. The
+// default of 0 means no limit.
+func (o *ClientOptions) SetMaxTopicsPerSubscribe(n int) *ClientOptions {
+	o.MaxTopicsPerSubscribe = n
+	return o
+}
+
+// SetMessageIDAllocator replaces the way message IDs are chosen, for example
+// with one which counts up and wraps so that packet captures are easier to
+// follow. IDs the allocator returns while they are still in use, or 0, are
+// skipped. The default of nil reuses the lowest free ID.
+func (o *ClientOptions) SetMessageIDAllocator(alloc MessageIDAllocator) *ClientOptions {
+	o.MessageIDAllocator = alloc
+	return o
+}
+
 // UnsetWill will cause any set will message to be disregarded.
 func (o *ClientOptions) UnsetWill() *ClientOptions {
 	o.WillEnabled = false
@@ -230,6 +604,47 @@ func (o *ClientOptions) SetBinaryWill(topic string, payload []byte, qos byte, re
 	return o
 }
 
+// SetDuplicateSubscriptions sets what Subscribe does when it is called for a topic
+// filter the client is already subscribed to. The default, DuplicateSubscriptionResend,
+// sends a new SUBSCRIBE every time, as earlier versions did, which makes the broker
+// send its retained messages again. DuplicateSubscriptionUpdate only replaces the
+// MessageHandler unless the QoS changes. A filter only counts as subscribed to
+// once the broker has granted it in a SUBACK. Subscriptions are
+// forgotten when the broker reports that it has no session for the client, so
+// subscribing again after such a reconnect always reaches the broker.
+func (o *ClientOptions) SetDuplicateSubscriptions(policy DuplicateSubscriptionPolicy) *ClientOptions {
+	o.DuplicateSubscriptions = policy
+	return o
+}
+
+// SetPublishWhenDisconnected sets what Publish does when the client is not connected.
+// The default, PublishWhenDisconnectedQueue, queues QoS 1 and 2 messages while the
+// client is reconnecting and drops QoS 0 ones. PublishWhenDisconnectedError fails
+// straight away with ErrNotConnected and PublishWhenDisconnectedBlock waits for the
+// connection to be made. In every case a client which has stopped trying to connect
+// fails with ErrNotConnected.
+func (o *ClientOptions) SetPublishWhenDisconnected(policy PublishWhenDisconnectedPolicy) *ClientOptions {
+	o.PublishWhenDisconnected = policy
+	return o
+}
+
+// SetSubscribeChannelFull sets what happens to a message for a subscription made
+// with SubscribeChan when its channel is full. The default, ChannelFullBlock, waits
+// for the application to make room, ChannelFullDrop discards the message.
+func (o *ClientOptions) SetSubscribeChannelFull(policy ChannelFullPolicy) *ClientOptions {
+	o.SubscribeChannelFull = policy
+	return o
+}
+
+// SetWillDelay sets how long the broker should wait after the connection is
+// lost before publishing the will message. If the client reconnects within
+// this interval the will is not published. This is only sent to the broker
+// when MQTT 5 is used, it is otherwise ignored.
+func (o *ClientOptions) SetWillDelay(d time.Duration) *ClientOptions {
+	o.WillDelay = d
+	return o
+}
+
 // SetDefaultPublishHandler sets the MessageHandler that will be called when a message
 // is received that does not match any known subscriptions.
 func (o *ClientOptions) SetDefaultPublishHandler(defaultHandler MessageHandler) *ClientOptions {
@@ -251,6 +666,152 @@ func (o *ClientOptions) SetConnectionLostHandler(onLost ConnectionLostHandler) *
 	return o
 }
 
+// SetOnErrorHandler sets the function to be called with each network error
+// seen by the client, in addition to the usual connection lost handling.
+// It is run on its own goroutine so it may block without delaying reconnection.
+func (o *ClientOptions) SetOnErrorHandler(onError ErrorHandler) *ClientOptions {
+	o.OnError = onError
+	return o
+}
+
+// SetUnhandledPacketHandler sets the function to be called, on its own goroutine,
+// with each packet from the broker of a type the client doesn't expect. Such
+// packets are otherwise only logged and dropped.
+func (o *ClientOptions) SetUnhandledPacketHandler(onUnhandled UnhandledPacketHandler) *ClientOptions {
+	o.OnUnhandledPacket = onUnhandled
+	return o
+}
+
+// SetStrictProtocol sets whether an unexpected packet from the broker is treated
+// as a protocol violation, which closes the connection as if it had been lost.
+func (o *ClientOptions) SetStrictProtocol(strict bool) *ClientOptions {
+	o.StrictProtocol = strict
+	return o
+}
+
+// SetRejectUnsolicitedMessages sets whether a message from the broker on a topic
+// matching no subscription is rejected, for when policy forbids receiving messages
+// that weren't asked for, which a misbehaving broker could send. Such messages are
+// passed to the DefaultPublishHandler if there is one, otherwise they are dropped
+// whatever this is set to, but when it is set they are also logged as warnings and
+// counted by GetUnsolicitedCount, and acknowledged even with ManualAck so that the
+// broker doesn't send them again.
+func (o *ClientOptions) SetRejectUnsolicitedMessages(reject bool) *ClientOptions {
+	o.RejectUnsolicitedMessages = reject
+	return o
+}
+
+// SetAllowPreConnackPackets sets whether packets a broker sends before its CONNACK
+// are tolerated. By default the first packet must be the CONNACK, as the spec
+// requires, and anything else fails the connection attempt with a protocol
+// violation. When allowed, earlier packets are passed to the unhandled packet
+// handler, or dropped if there is none, while waiting for the CONNACK.
+func (o *ClientOptions) SetAllowPreConnackPackets(allow bool) *ClientOptions {
+	o.AllowPreConnackPackets = allow
+	return o
+}
+
+// SetEnforceCapabilities sets whether publishes and subscribes which use a feature the
+// MQTT 5 broker said in its CONNACK it doesn't support, such as a retained message or a
+// shared subscription, fail locally with ErrNotSupportedByServer. Brokers otherwise
+// close the connection when they receive them. See Client.ServerCapabilities.
+// Wildcard subscriptions a broker doesn't allow are refused whatever the setting, and
+// publishes above its maximum QoS are handled as SetQosAboveMaximum sets.
+func (o *ClientOptions) SetEnforceCapabilities(enforce bool) *ClientOptions {
+	o.EnforceCapabilities = enforce
+	return o
+}
+
+// SetQosAboveMaximum sets what Publish does with a message whose QoS is above the
+// maximum the MQTT 5 broker announced. The default, QosAboveMaximumReject, fails
+// the publish with ErrNotSupportedByServer, QosAboveMaximumDowngrade sends it with
+// the broker's maximum QoS. Messages from PublishBytes are always rejected, as
+// their encoding can't be changed.
+func (o *ClientOptions) SetQosAboveMaximum(policy QosAboveMaximumPolicy) *ClientOptions {
+	o.QosAboveMaximum = policy
+	return o
+}
+
+// SetMaxSubscribeQoS sets the highest QoS the client subscribes with, for brokers
+// which handle the QoS 2 handshake badly. Subscriptions asking for more are sent
+// with this QoS instead, which is logged. By default, or when MaxSubscribeQoS is
+// left nil, they are unchanged.
+func (o *ClientOptions) SetMaxSubscribeQoS(qos byte) *ClientOptions {
+	o.MaxSubscribeQoS = &qos
+	return o
+}
+
+// SetMaxPublishQoS sets the highest QoS the client publishes with. Messages
+// published with a higher QoS are sent with this one instead, which is logged,
+// except for those pre-encoded for PublishBytes which fail with ErrInvalidQos.
+// By default, or when MaxPublishQoS is left nil, they are unchanged.
+func (o *ClientOptions) SetMaxPublishQoS(qos byte) *ClientOptions {
+	o.MaxPublishQoS = &qos
+	return o
+}
+
+// SetCustomOpenConnectionFn replaces the built in transports with a function that
+// returns an established connection for a broker URI. The function is called for
+// each broker in turn on every connection attempt, including when reconnecting,
+// and the URI scheme is not interpreted by the client. TLSConfig and ConnectTimeout
+// are not applied to connections opened this way.
+func (o *ClientOptions) SetCustomOpenConnectionFn(fn OpenConnectionFunc) *ClientOptions {
+	o.CustomOpenConnectionFn = fn
+	return o
+}
+
+// SetConnectPacketBuilder sets a function which may change the CONNECT packet
+// right before it is sent, for example to put a freshly signed token in the
+// password. It is called on every connection attempt, including when
+// reconnecting, with a copy of the packet built from the options, which it
+// may modify and return. Setting Username or Password requires setting
+// UsernameFlag or PasswordFlag too.
+func (o *ClientOptions) SetConnectPacketBuilder(fn ConnectPacketBuilderFunc) *ClientOptions {
+	o.ConnectPacketBuilder = fn
+	return o
+}
+
+// SetCredentialsProvider sets a function which is called for the username and
+// password on every connection attempt, including when reconnecting, in place of
+// the values set with SetUsername and SetPassword. This suits passwords which are
+// short lived tokens. As with SetUsername, an empty username sends neither. Any
+// ConnectPacketBuilder is passed the packet with these credentials.
+func (o *ClientOptions) SetCredentialsProvider(fn CredentialsProviderFunc) *ClientOptions {
+	o.CredentialsProvider = fn
+	return o
+}
+
+// SetBrokerCredentialsProvider sets a function which is called, like the one set
+// with SetCredentialsProvider, for the username and password on every connection
+// attempt, but which is passed the broker being connected to. This allows brokers
+// in a failover list which authenticate clients differently to each get their own
+// credentials. It takes precedence over a CredentialsProvider.
+func (o *ClientOptions) SetBrokerCredentialsProvider(fn BrokerCredentialsProviderFunc) *ClientOptions {
+	o.BrokerCredentialsProvider = fn
+	return o
+}
+
+// SetAckPolicy sets the function which is consulted before a PUBACK (QoS 1) or
+// PUBREC (QoS 2) is sent for an incoming message. It runs on its own goroutine,
+// concurrently with the message handlers, so it may wait for downstream processing
+// to finish. If it returns false the message is not acknowledged and the broker will
+// redeliver it, usually after the client reconnects. By default every message is
+// acknowledged immediately.
+func (o *ClientOptions) SetAckPolicy(policy AckPolicyHandler) *ClientOptions {
+	o.AckPolicy = policy
+	return o
+}
+
+// SetManualAck will stop the client from acknowledging incoming QoS 1 and QoS 2
+// messages itself. Instead a handler must call Ack on the Message, as an AckableMessage,
+// once it has been processed; calling Nack, or not calling Ack at all, leaves the message unacknowledged
+// so that the broker redelivers it after the client reconnects. When set, any
+// AckPolicy is ignored.
+func (o *ClientOptions) SetManualAck(manual bool) *ClientOptions {
+	o.ManualAck = manual
+	return o
+}
+
 // SetWriteTimeout puts a limit on how long a mqtt publish should block until it unblocks with a
 // timeout error. A duration of 0 never times out. Default 30 seconds
 func (o *ClientOptions) SetWriteTimeout(t time.Duration) *ClientOptions {
@@ -258,6 +819,71 @@ func (o *ClientOptions) SetWriteTimeout(t time.Duration) *ClientOptions {
 	return o
 }
 
+// SetAdaptiveWriteTimeout replaces the fixed WriteTimeout with one that follows the
+// network: each write must complete within a few times the moving average of how
+// long recent writes took, kept between WriteTimeoutFloor and WriteTimeoutCeiling.
+// A stall is then noticed quickly on a fast network while slow ones are tolerated.
+// Until the first write completes the ceiling, or without one the floor, is used.
+func (o *ClientOptions) SetAdaptiveWriteTimeout(adaptive bool) *ClientOptions {
+	o.AdaptiveWriteTimeout = adaptive
+	return o
+}
+
+// SetWriteTimeoutBounds sets the shortest and longest write timeouts used with
+// AdaptiveWriteTimeout. A ceiling of 0 means there is none, and until the first
+// write completes the floor is used instead. Bounds with the floor above a non zero
+// ceiling are ignored. Defaults 500 milliseconds and 30 seconds.
+func (o *ClientOptions) SetWriteTimeoutBounds(floor, ceiling time.Duration) *ClientOptions {
+	if ceiling > 0 && floor > ceiling {
+		return o
+	}
+	o.WriteTimeoutFloor = floor
+	o.WriteTimeoutCeiling = ceiling
+	return o
+}
+
+// SetOutgoingStallTimeout sets how long writing a single packet to the network may
+// take before the connection is considered dead and is dropped, so that a reconnect
+// can be made. It is a safety net for when WriteTimeout isn't set, for example
+// because the transport doesn't support write deadlines, and is ignored otherwise.
+// A duration of 0, the default, disables the check.
+func (o *ClientOptions) SetOutgoingStallTimeout(t time.Duration) *ClientOptions {
+	o.OutgoingStallTimeout = t
+	return o
+}
+
+// SetIdleTimeout has the client close its connection, with a DISCONNECT, once no
+// publish, subscribe or unsubscribe has been made and no message has been received
+// for the duration t, for request/response clients that only talk to the broker now
+// and then and shouldn't hold a connection in between. With AutoReconnect the client
+// stays usable: the next publish, subscribe or unsubscribe reconnects it, and is
+// queued as it would be while reconnecting, QoS 0 publishes included. Without it
+// the client is disconnected as by Disconnect. Keepalive pings don't count as
+// activity. A duration of 0, the default, keeps idle connections open.
+func (o *ClientOptions) SetIdleTimeout(t time.Duration) *ClientOptions {
+	o.IdleTimeout = t
+	return o
+}
+
+// SetReadTimeout limits how long the client will wait for the next packet from the
+// broker before deciding that the connection has been lost. The timer is restarted
+// after each packet is read. It must be larger than the KeepAlive interval, otherwise
+// an idle connection would be dropped between pings; smaller values are raised to
+// KeepAlive + PingTimeout. A duration of 0 never times out. Default 0.
+func (o *ClientOptions) SetReadTimeout(t time.Duration) *ClientOptions {
+	o.ReadTimeout = t
+	return o
+}
+
+// SetPacketReadTimeout limits how long the rest of a packet may take to arrive once
+// its first byte has been received, so that a peer sending a packet slowly can't
+// hold up the client indefinitely. If it is exceeded the connection is lost with
+// ErrPacketReadTimeout. A duration of 0 never times out. Default 0.
+func (o *ClientOptions) SetPacketReadTimeout(t time.Duration) *ClientOptions {
+	o.PacketReadTimeout = t
+	return o
+}
+
 // SetConnectTimeout limits how long the client will wait when trying to open a connection
 // to an MQTT server before timeing out and erroring the attempt. A duration of 0 never times out.
 // Default 30 seconds. Currently only operational on TCP/TLS connections.
@@ -266,13 +892,74 @@ func (o *ClientOptions) SetConnectTimeout(t time.Duration) *ClientOptions {
 	return o
 }
 
+// SetReadBufferBytes sets the size of the socket receive buffer (SO_RCVBUF) of
+// TCP and TLS connections, which may need raising to make full use of links with
+// a high bandwidth-delay product. The operating system may clamp or adjust the
+// value. Connections from CustomOpenConnectionFn are changed as well if they have
+// a SetReadBuffer method. The default of 0 leaves the system default.
+func (o *ClientOptions) SetReadBufferBytes(n int) *ClientOptions {
+	o.ReadBufferBytes = n
+	return o
+}
+
+// SetWriteBufferBytes sets the size of the socket send buffer (SO_SNDBUF) in the
+// same way as SetReadBufferBytes does for the receive buffer.
+func (o *ClientOptions) SetWriteBufferBytes(n int) *ClientOptions {
+	o.WriteBufferBytes = n
+	return o
+}
+
+// SetLowLatencyControlPackets turns TCP_NODELAY on while control packets such as
+// acks and PINGREQ are written, so that they are sent at once, and off while
+// publishes are written, so that bursts of them are coalesced into fewer segments.
+// It applies to TCP and TLS connections, and to connections from
+// CustomOpenConnectionFn which have a SetNoDelay method. Default false, which
+// leaves TCP_NODELAY on for everything as Go does.
+func (o *ClientOptions) SetLowLatencyControlPackets(lowLatency bool) *ClientOptions {
+	o.LowLatencyControlPackets = lowLatency
+	return o
+}
+
+// SetInitialReconnectDelay sets the time waited after the first failed reconnection
+// attempt. The wait doubles after each further failure, up to MaxReconnectInterval.
+// With 0 the first retry is immediate and the waits double from 1 second after it.
+// Default 1 second.
+func (o *ClientOptions) SetInitialReconnectDelay(t time.Duration) *ClientOptions {
+	o.InitialReconnectDelay = t
+	return o
+}
+
 // SetMaxReconnectInterval sets the maximum time that will be waited between reconnection attempts
-// when connection is lost
+// when connection is lost. A value of 0 stops the wait growing beyond InitialReconnectDelay.
 func (o *ClientOptions) SetMaxReconnectInterval(t time.Duration) *ClientOptions {
 	o.MaxReconnectInterval = t
 	return o
 }
 
+// SetMaxReconnectAttempts sets how many consecutive reconnection attempts are made,
+// each trying every server, before the client gives up and becomes disconnected.
+// A value of 0, the default, means the client keeps trying forever.
+func (o *ClientOptions) SetMaxReconnectAttempts(n int) *ClientOptions {
+	o.MaxReconnectAttempts = n
+	return o
+}
+
+// SetReconnectGaveUpHandler sets the function to be called when the client gives
+// up reconnecting after MaxReconnectAttempts failed attempts, or at once with
+// ErrInvalidConnect when the options make a CONNECT packet no broker would accept.
+func (o *ClientOptions) SetReconnectGaveUpHandler(onGaveUp ReconnectGaveUpHandler) *ClientOptions {
+	o.OnReconnectGaveUp = onGaveUp
+	return o
+}
+
+// SetReconnectSuccessHandler sets the function to be called after each automatic
+// reconnection, along with OnConnect, with the time since the connection was lost.
+// It is useful for reporting availability, which OnConnect can't do on its own.
+func (o *ClientOptions) SetReconnectSuccessHandler(onSuccess ReconnectSuccessHandler) *ClientOptions {
+	o.OnReconnectSuccess = onSuccess
+	return o
+}
+
 // SetAutoReconnect sets whether the automatic reconnection logic should be used
 // when the connection is lost, even if disabled the ConnectionLostHandler is still
 // called
@@ -281,6 +968,105 @@ func (o *ClientOptions) SetAutoReconnect(a bool) *ClientOptions {
 	return o
 }
 
+// SetFlowControlBlockedHandler sets the function to be called when a QoS 1 or 2
+// Publish has to wait because as many publishes as the MQTT 5 broker's receive
+// maximum allows are already waiting for an ack.
+func (o *ClientOptions) SetFlowControlBlockedHandler(onBlocked FlowControlHandler) *ClientOptions {
+	o.OnFlowControlBlocked = onBlocked
+	return o
+}
+
+// SetFlowControlResumedHandler sets the function to be called when a Publish that
+// was held back by the broker's receive maximum is able to continue.
+func (o *ClientOptions) SetFlowControlResumedHandler(onResumed FlowControlHandler) *ClientOptions {
+	o.OnFlowControlResumed = onResumed
+	return o
+}
+
+// SetPublishDeliveredHandler sets the function to be called when a QoS 1 or 2
+// publish is acknowledged by the broker, with a PUBACK or a PUBCOMP, without
+// having to keep or wait on its token. It is called from the goroutine which
+// handles incoming packets so it must return quickly. The topic is empty for
+// messages sent with PublishBytes.
+func (o *ClientOptions) SetPublishDeliveredHandler(onDelivered PublishDeliveredHandler) *ClientOptions {
+	o.OnPublishDelivered = onDelivered
+	return o
+}
+
+// SetConnackHandler sets the function to be called with every CONNACK received,
+// whether or not it accepts the connection, before the connect token completes.
+// It gives access to parts of the packet which the client doesn't model, such as
+// broker specific MQTT 5 user properties. The packet must not be modified.
+func (o *ClientOptions) SetConnackHandler(onConnack ConnackHandler) *ClientOptions {
+	o.OnConnack = onConnack
+	return o
+}
+
+// SetRetainedCompleteHandler sets the function to be called once the retained
+// messages for a new subscription have all arrived. MQTT has no signal for this, so
+// it is a best-effort guess: after the SUBACK, the handler is called when no retained
+// message matching the filter has arrived for RetainedQuietWindow. A slow broker or
+// network can make it come too early, and it comes after the window even when there
+// were no retained messages. It is called once for each filter subscribed to.
+func (o *ClientOptions) SetRetainedCompleteHandler(onComplete RetainedCompleteHandler) *ClientOptions {
+	o.OnRetainedComplete = onComplete
+	return o
+}
+
+// SetHandlerPanicHandler sets the function to be called when a message handler
+// panics. The panic is always recovered from and logged, so that one faulty
+// handler can't stop the delivery of messages to the others, and this is where
+// it can be reported further. It is called on the goroutine of the handler.
+func (o *ClientOptions) SetHandlerPanicHandler(onPanic HandlerPanicHandler) *ClientOptions {
+	o.OnHandlerPanic = onPanic
+	return o
+}
+
+// SetDecodeErrorHandler sets the function to be called when a packet from the
+// broker can't be decoded, for debugging malformed packets. It is given the fixed
+// header and the raw bytes of the body that were read, which are all of them
+// unless the connection failed or the remaining length was wrong. The connection
+// is treated as lost afterwards, as usual. It is called on the goroutine reading
+// from the network, so it must return quickly.
+func (o *ClientOptions) SetDecodeErrorHandler(onDecodeError DecodeErrorHandler) *ClientOptions {
+	o.OnDecodeError = onDecodeError
+	return o
+}
+
+// SetIdleDisconnectHandler sets the function to be called when the client has
+// closed its connection after IdleTimeout without activity.
+func (o *ClientOptions) SetIdleDisconnectHandler(onIdle IdleDisconnectHandler) *ClientOptions {
+	o.OnIdleDisconnect = onIdle
+	return o
+}
+
+// SetRetainedQuietWindow sets how long to wait for another retained message before
+// calling the RetainedCompleteHandler. Default 500 milliseconds.
+func (o *ClientOptions) SetRetainedQuietWindow(window time.Duration) *ClientOptions {
+	o.RetainedQuietWindow = window
+	return o
+}
+
+// SetPublishRateLimiter sets a limiter which is waited on before each PUBLISH is
+// written to the network, keeping the client within a broker's message rate quota.
+// Publishes beyond the rate are held in the outbound queue rather than dropped,
+// control packets such as acks and subscribes are not limited.
+func (o *ClientOptions) SetPublishRateLimiter(l RateLimiter) *ClientOptions {
+	o.PublishRateLimiter = l
+	return o
+}
+
+// SetOutboundFairness sets how packets waiting to be written are shared out between
+// control packets, such as acks and subscribes, and publishes. When n is above 0
+// control packets are written first, but after n of them in a row a waiting publish
+// is written before the next, so that neither can hold up the other under heavy load
+// in both directions. With the default of 0 the next packet is picked at random from
+// the two queues.
+func (o *ClientOptions) SetOutboundFairness(n int) *ClientOptions {
+	o.OutboundFairness = n
+	return o
+}
+
 // SetMessageChannelDepth sets the size of the internal queue that holds messages while the
 // client is temporairily offline, allowing the application to publish when the client is
 // reconnecting. This setting is only valid if AutoReconnect is set to true, it is otherwise
@@ -289,3 +1075,25 @@ func (o *ClientOptions) SetMessageChannelDepth(s uint) *ClientOptions {
 	o.MessageChannelDepth = s
 	return o
 }
+
+// SetMaxDeliveryAge sets how old an incoming message may be when its handler is
+// about to be called, older messages are skipped, for applications such as live
+// dashboards to which a late message is of no use. The age is measured from when
+// the message was read from the network, so it includes the time spent waiting
+// behind slow handlers. Skipped messages are still acknowledged and are counted
+// by GetStaleCount. Default 0, which delivers every message.
+func (o *ClientOptions) SetMaxDeliveryAge(age time.Duration) *ClientOptions {
+	o.MaxDeliveryAge = age
+	return o
+}
+
+// SetMaxQueuedBytes limits the memory taken by publishes that are queued to be
+// sent or are in flight waiting for an ack, counted as the total of their
+// encoded sizes. A publish which would take the total over n fails with
+// ErrQueueFull, unless PublishWhenDisconnected is PublishWhenDisconnectedBlock
+// in which case it waits for earlier publishes to complete. A publish larger
+// than n on its own always fails. The default of 0 sets no limit.
+func (o *ClientOptions) SetMaxQueuedBytes(n int64) *ClientOptions {
+	o.MaxQueuedBytes = n
+	return o
+}
@@ -1,7 +1,9 @@
 package packets
 
 import (
+	"bytes"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -11,10 +13,32 @@ const (
 
 var byteSlicePools [MAX_SLICE_SIZE + 1]sync.Pool
 
+// pooledCounts tracks how many slices of each size are held by
+// byteSlicePools, counting those put and not taken since. The garbage
+// collector empties the pools without telling, so a count is reset when
+// its pool comes back empty.
+var pooledCounts [MAX_SLICE_SIZE + 1]int64
+
+// current limits, see ConfigurePool
+var (
+	maxSliceSize    int64 = MAX_SLICE_SIZE
+	maxPooledSlices int64 = MAX_POOLED_SLICES
+)
+
 type sliceHolder struct {
 	slice []byte
 }
 
+func newSliceHolder(size int) *sliceHolder {
+	return &sliceHolder{slice: make([]byte, size)}
+}
+
+// putSliceHolder returns holder to the pool for its size
+func putSliceHolder(holder *sliceHolder) {
+	atomic.AddInt64(&pooledCounts[len(holder.slice)], 1)
+	byteSlicePools[len(holder.slice)].Put(holder)
+}
+
 type ByteSlicePool struct {
 	pooledSlices    [MAX_POOLED_SLICES]*sliceHolder
 	numPooledSlices int
@@ -24,6 +48,28 @@ var objectPools = sync.Pool{
 	New: func() interface{} { return &ByteSlicePool{} },
 }
 
+//bufferPool holds the scratch buffers packets are encoded into before
+//being written
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+//maxPooledBuffer is the capacity beyond which a scratch buffer is left
+//to the garbage collector rather than kept for the next packet
+const maxPooledBuffer = 64 * 1024
+
+func getBuffer() *bytes.Buffer {
+	b := bufferPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledBuffer {
+		bufferPool.Put(b)
+	}
+}
+
 // var rmmePool ByteSlicePool
 
 func getObjectPool() *ByteSlicePool {
@@ -31,19 +77,78 @@ func getObjectPool() *ByteSlicePool {
 	// return &rmmePool
 }
 
+//ConfigurePool sets the largest slice size that is pooled and how many
+//pooled slices a single packet may hold, slices beyond either limit are
+//allocated normally and left to the garbage collector. Values are capped
+//at MAX_SLICE_SIZE and MAX_POOLED_SLICES, a maxSize of 0 disables pooling.
+//Lowering the limits trades allocations for a smaller resident size.
+func ConfigurePool(maxSize, maxPooled int) {
+	if maxSize < 0 {
+		maxSize = 0
+	}
+	if maxSize > MAX_SLICE_SIZE {
+		maxSize = MAX_SLICE_SIZE
+	}
+	if maxPooled < 0 {
+		maxPooled = 0
+	}
+	if maxPooled > MAX_POOLED_SLICES {
+		maxPooled = MAX_POOLED_SLICES
+	}
+	atomic.StoreInt64(&maxSliceSize, int64(maxSize))
+	atomic.StoreInt64(&maxPooledSlices, int64(maxPooled))
+}
+
+//PoolStats returns the approximate number of slices retained by the pool
+//for each slice size, sizes with no retained slices are omitted. Slices
+//the garbage collector frees from the pool are still counted until a
+//slice of their size is next asked for, so the figures are an upper bound.
+func PoolStats() map[int]int {
+	stats := make(map[int]int)
+	for size := range pooledCounts {
+		if n := atomic.LoadInt64(&pooledCounts[size]); n > 0 {
+			stats[size] = int(n)
+		}
+	}
+	return stats
+}
+
+//WarmPools fills the pools with count of each kind of object they hold,
+//so that the first burst of traffic is decoded without allocating. That
+//is count fixed headers, packets of each type and scratch buffers, and
+//count byte slices of each size up to the limit set by ConfigurePool,
+//which is about 40KB per count with the default limit. The pools are
+//still emptied by the garbage collector, warming only helps at startup.
+func WarmPools(count int) {
+	maxSize := int(atomic.LoadInt64(&maxSliceSize))
+	for i := 0; i < count; i++ {
+		fixedHeaderPool.Put(&FixedHeader{})
+		for t := byte(1); t <= MaxMessageType; t++ {
+			packetPools[t-1].Put(newControlPacketWithHeader(&FixedHeader{MessageType: t}))
+		}
+		bufferPool.Put(new(bytes.Buffer))
+		for size := 1; size <= maxSize; size++ {
+			putSliceHolder(newSliceHolder(size))
+		}
+	}
+}
+
 func (pool *ByteSlicePool) getByteSlice(size int) []byte {
-	if size > MAX_SLICE_SIZE {
+	if int64(size) > atomic.LoadInt64(&maxSliceSize) {
 		return make([]byte, size)
 	}
-	if pool.numPooledSlices == MAX_POOLED_SLICES {
+	if int64(pool.numPooledSlices) >= atomic.LoadInt64(&maxPooledSlices) {
 		return make([]byte, size)
 	}
 	sliceObj := byteSlicePools[size].Get()
 	var holder *sliceHolder
 	if sliceObj != nil {
 		holder = sliceObj.(*sliceHolder)
+		atomic.AddInt64(&pooledCounts[size], -1)
 	} else {
-		holder = &sliceHolder{make([]byte, size)}
+		// the pool is empty, whatever was counted was collected
+		atomic.StoreInt64(&pooledCounts[size], 0)
+		holder = newSliceHolder(size)
 	}
 	pool.pooledSlices[pool.numPooledSlices] = holder
 	pool.numPooledSlices += 1
@@ -51,10 +156,16 @@ func (pool *ByteSlicePool) getByteSlice(size int) []byte {
 }
 
 func (pool *ByteSlicePool) Release() {
+	pool.releaseSlices()
+	objectPools.Put(pool)
+}
+
+//releaseSlices returns the slices taken by pool to byteSlicePools, it
+//is all a FixedHeader releases as its pool is part of the header
+func (pool *ByteSlicePool) releaseSlices() {
 	for i := 0; i < pool.numPooledSlices; i += 1 {
-		holder := pool.pooledSlices[i]
-		byteSlicePools[len(holder.slice)].Put(holder)
+		putSliceHolder(pool.pooledSlices[i])
+		pool.pooledSlices[i] = nil
 	}
 	pool.numPooledSlices = 0
-	objectPools.Put(pool)
 }
@@ -0,0 +1,195 @@
+package packets
+
+//PublishBuilder assembles a PublishPacket field by field, see NewPublish
+type PublishBuilder struct {
+	p *PublishPacket
+}
+
+//NewPublish starts building a QoS 0 PUBLISH, for example
+//
+//	NewPublish().Topic("a/b").QoS(1).Payload([]byte("x")).Build()
+func NewPublish() *PublishBuilder {
+	return &PublishBuilder{p: NewControlPacket(Publish).(*PublishPacket)}
+}
+
+//Topic sets the topic name
+func (b *PublishBuilder) Topic(topic string) *PublishBuilder {
+	b.p.TopicName = []byte(topic)
+	return b
+}
+
+//QoS sets the quality of service
+func (b *PublishBuilder) QoS(qos byte) *PublishBuilder {
+	b.p.Qos = qos
+	return b
+}
+
+//Retained sets the retain flag
+func (b *PublishBuilder) Retained(retained bool) *PublishBuilder {
+	b.p.Retain = retained
+	return b
+}
+
+//Dup sets the duplicate delivery flag
+func (b *PublishBuilder) Dup(dup bool) *PublishBuilder {
+	b.p.Dup = dup
+	return b
+}
+
+//MessageID sets the message ID, which is only sent for QoS 1 and 2
+func (b *PublishBuilder) MessageID(id uint16) *PublishBuilder {
+	b.p.MessageID = id
+	return b
+}
+
+//Payload sets the payload, which is not copied
+func (b *PublishBuilder) Payload(payload []byte) *PublishBuilder {
+	b.p.Payload = payload
+	return b
+}
+
+//Properties sets the MQTT 5 properties and makes the packet MQTT 5
+func (b *PublishBuilder) Properties(props *Properties) *PublishBuilder {
+	b.p.ProtocolLevel = 5
+	b.p.Properties = props
+	return b
+}
+
+//ProtocolLevel sets the protocol level the packet is encoded for
+func (b *PublishBuilder) ProtocolLevel(level byte) *PublishBuilder {
+	b.p.ProtocolLevel = level
+	return b
+}
+
+//Build returns the packet, which is ready to write. The builder must not
+//be used afterwards.
+func (b *PublishBuilder) Build() *PublishPacket {
+	return b.p
+}
+
+//SubscribeBuilder assembles a SubscribePacket, see NewSubscribe
+type SubscribeBuilder struct {
+	p *SubscribePacket
+}
+
+//NewSubscribe starts building a SUBSCRIBE, to which filters are added
+//with Filter
+func NewSubscribe() *SubscribeBuilder {
+	return &SubscribeBuilder{p: NewControlPacket(Subscribe).(*SubscribePacket)}
+}
+
+//Filter adds a topic filter with the QoS requested for it
+func (b *SubscribeBuilder) Filter(filter string, qos byte) *SubscribeBuilder {
+	b.p.Topics = append(b.p.Topics, filter)
+	b.p.Qoss = append(b.p.Qoss, qos)
+	return b
+}
+
+//MessageID sets the message ID
+func (b *SubscribeBuilder) MessageID(id uint16) *SubscribeBuilder {
+	b.p.MessageID = id
+	return b
+}
+
+//Properties sets the MQTT 5 properties and makes the packet MQTT 5
+func (b *SubscribeBuilder) Properties(props *Properties) *SubscribeBuilder {
+	b.p.ProtocolLevel = 5
+	b.p.Properties = props
+	return b
+}
+
+//ProtocolLevel sets the protocol level the packet is encoded for
+func (b *SubscribeBuilder) ProtocolLevel(level byte) *SubscribeBuilder {
+	b.p.ProtocolLevel = level
+	return b
+}
+
+//Build returns the packet, which is ready to write. The builder must not
+//be used afterwards.
+func (b *SubscribeBuilder) Build() *SubscribePacket {
+	return b.p
+}
+
+//ConnectBuilder assembles a ConnectPacket, see NewConnect
+type ConnectBuilder struct {
+	p *ConnectPacket
+}
+
+//NewConnect starts building an MQTT 3.1.1 CONNECT with a clean session
+//and no keepalive
+func NewConnect() *ConnectBuilder {
+	p := NewControlPacket(Connect).(*ConnectPacket)
+	p.ProtocolName = "MQTT"
+	p.ProtocolVersion = 4
+	p.CleanSession = true
+	return &ConnectBuilder{p: p}
+}
+
+//ProtocolVersion sets the protocol version, 3 for MQTT 3.1, 4 for 3.1.1
+//or 5, along with the protocol name that goes with it
+func (b *ConnectBuilder) ProtocolVersion(version byte) *ConnectBuilder {
+	b.p.ProtocolVersion = version
+	b.p.ProtocolName = "MQTT"
+	if version == 3 {
+		b.p.ProtocolName = "MQIsdp"
+	}
+	return b
+}
+
+//ClientID sets the client identifier
+func (b *ConnectBuilder) ClientID(id string) *ConnectBuilder {
+	b.p.ClientIdentifier = id
+	return b
+}
+
+//CleanSession sets the clean session, in MQTT 5 clean start, flag
+func (b *ConnectBuilder) CleanSession(clean bool) *ConnectBuilder {
+	b.p.CleanSession = clean
+	return b
+}
+
+//KeepAlive sets the keepalive interval in seconds
+func (b *ConnectBuilder) KeepAlive(seconds uint16) *ConnectBuilder {
+	b.p.KeepaliveTimer = seconds
+	return b
+}
+
+//Credentials sets the user name and, unless it is empty, the password
+func (b *ConnectBuilder) Credentials(username, password string) *ConnectBuilder {
+	b.p.UsernameFlag, b.p.Username = true, username
+	b.p.PasswordFlag = password != ""
+	b.p.Password = nil
+	if b.p.PasswordFlag {
+		b.p.Password = []byte(password)
+	}
+	return b
+}
+
+//Will sets the will message
+func (b *ConnectBuilder) Will(topic string, payload []byte, qos byte, retained bool) *ConnectBuilder {
+	b.p.WillFlag = true
+	b.p.WillTopic = topic
+	b.p.WillMessage = payload
+	b.p.WillQos = qos
+	b.p.WillRetain = retained
+	return b
+}
+
+//Properties sets the MQTT 5 properties, they are only sent when the
+//protocol version is 5
+func (b *ConnectBuilder) Properties(props *Properties) *ConnectBuilder {
+	b.p.Properties = props
+	return b
+}
+
+//WillProperties sets the MQTT 5 properties of the will message
+func (b *ConnectBuilder) WillProperties(props *Properties) *ConnectBuilder {
+	b.p.WillProperties = props
+	return b
+}
+
+//Build returns the packet, which is ready to write. The builder must not
+//be used afterwards.
+func (b *ConnectBuilder) Build() *ConnectPacket {
+	return b.p
+}
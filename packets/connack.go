@@ -1,7 +1,6 @@
 package packets
 
 import (
-	"bytes"
 	"fmt"
 )
 
@@ -11,6 +10,7 @@ type ConnackPacket struct {
 	*FixedHeader
 	TopicNameCompression byte
 	ReturnCode           byte
+	Properties           *Properties
 }
 
 func (ca *ConnackPacket) String() string {
@@ -20,26 +20,29 @@ func (ca *ConnackPacket) String() string {
 }
 
 func (ca *ConnackPacket) Write(w PacketWriter) error {
-	var body bytes.Buffer
-	var err error
+	body := getBuffer()
+	defer putBuffer(body)
 
 	body.WriteByte(ca.TopicNameCompression)
 	body.WriteByte(ca.ReturnCode)
-	ca.FixedHeader.RemainingLength = 2
-	packet := ca.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	_, err = packet.WriteTo(w)
-
-	return err
+	if ca.ProtocolLevel == 5 {
+		ca.Properties.packTo(body)
+	}
+	return writePacket(ca.FixedHeader, body, w)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (ca *ConnackPacket) Unpack(src []byte) {
+	ca.Properties = nil
 	if len(src) >= 2 {
 		ca.TopicNameCompression = src[0]
 		ca.ReturnCode = src[1]
 	}
+	if ca.ProtocolLevel == 5 && len(src) > 2 {
+		ca.Properties = &Properties{}
+		ca.Properties.unpack(src[2:])
+	}
 }
 
 //Details returns a Details struct containing the Qos and
@@ -47,3 +50,13 @@ func (ca *ConnackPacket) Unpack(src []byte) {
 func (ca *ConnackPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (ca *ConnackPacket) Fields() map[string]interface{} {
+	f := ca.FixedHeader.fields()
+	f["sessionPresent"] = ca.TopicNameCompression&0x01 != 0
+	f["returnCode"] = ca.ReturnCode
+	addPropertiesField(f, "properties", ca.Properties)
+	return f
+}
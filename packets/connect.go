@@ -1,12 +1,13 @@
 package packets
 
 import (
-	"bytes"
 	"fmt"
 )
 
 //ConnectPacket is an internal representation of the fields of the
-//Connect MQTT packet
+//Connect MQTT packet. In MQTT 5 the CleanSession flag is the Clean Start
+//flag, it discards any existing session but doesn't affect how long the
+//new session lasts, which is set by the session expiry interval property.
 type ConnectPacket struct {
 	*FixedHeader
 	ProtocolName    string
@@ -25,6 +26,9 @@ type ConnectPacket struct {
 	WillMessage      []byte
 	Username         string
 	Password         []byte
+
+	Properties     *Properties
+	WillProperties *Properties
 }
 
 func (c *ConnectPacket) String() string {
@@ -34,15 +38,21 @@ func (c *ConnectPacket) String() string {
 }
 
 func (c *ConnectPacket) Write(w PacketWriter) error {
-	var body bytes.Buffer
-	var err error
+	body := getBuffer()
+	defer putBuffer(body)
 
 	body.Write(encodeString(c.ProtocolName))
 	body.WriteByte(c.ProtocolVersion)
 	body.WriteByte(boolToByte(c.CleanSession)<<1 | boolToByte(c.WillFlag)<<2 | c.WillQos<<3 | boolToByte(c.WillRetain)<<5 | boolToByte(c.PasswordFlag)<<6 | boolToByte(c.UsernameFlag)<<7)
 	body.Write(encodeUint16(c.KeepaliveTimer))
+	if c.ProtocolVersion == 5 {
+		c.Properties.packTo(body)
+	}
 	body.Write(encodeString(c.ClientIdentifier))
 	if c.WillFlag {
+		if c.ProtocolVersion == 5 {
+			c.WillProperties.packTo(body)
+		}
 		body.Write(encodeString(c.WillTopic))
 		body.Write(encodeBytes(c.WillMessage))
 	}
@@ -52,12 +62,7 @@ func (c *ConnectPacket) Write(w PacketWriter) error {
 	if c.PasswordFlag {
 		body.Write(encodeBytes(c.Password))
 	}
-	c.FixedHeader.RemainingLength = body.Len()
-	packet := c.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writePacket(c.FixedHeader, body, w)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
@@ -79,10 +84,18 @@ func (c *ConnectPacket) Unpack(src []byte) {
 	c.UsernameFlag = 1&(options>>7) > 0
 	c.KeepaliveTimer = loadUint16(src)
 	src = src[2:]
+	if c.ProtocolVersion == 5 {
+		c.Properties = &Properties{}
+		src = src[c.Properties.unpack(src):]
+	}
 	c.ClientIdentifier, end = loadString(src)
 	src = src[end:]
 
 	if c.WillFlag {
+		if c.ProtocolVersion == 5 {
+			c.WillProperties = &Properties{}
+			src = src[c.WillProperties.unpack(src):]
+		}
 		c.WillTopic, end = loadString(src)
 		src = src[end:]
 		c.WillMessage, end = loadBytes(src)
@@ -97,7 +110,9 @@ func (c *ConnectPacket) Unpack(src []byte) {
 	}
 }
 
-//Validate performs validation of the fields of a Connect packet
+//Validate performs validation of the fields of a Connect packet. The
+//will QoS and retain flags must be clear when there is no will, and a
+//will must have a topic.
 func (c *ConnectPacket) Validate() byte {
 	if c.PasswordFlag && !c.UsernameFlag {
 		return ErrRefusedBadUsernameOrPassword
@@ -106,7 +121,7 @@ func (c *ConnectPacket) Validate() byte {
 		//Bad reserved bit
 		return ErrProtocolViolation
 	}
-	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != 3) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != 4) {
+	if (c.ProtocolName == "MQIsdp" && c.ProtocolVersion != 3) || (c.ProtocolName == "MQTT" && c.ProtocolVersion != 4 && c.ProtocolVersion != 5) {
 		//Mismatched or unsupported protocol version
 		return ErrRefusedBadProtocolVersion
 	}
@@ -118,6 +133,14 @@ func (c *ConnectPacket) Validate() byte {
 		//Bad size field
 		return ErrProtocolViolation
 	}
+	if !c.WillFlag && (c.WillQos != 0 || c.WillRetain) {
+		//Will QoS or retain without a will
+		return ErrProtocolViolation
+	}
+	if c.WillFlag && (c.WillTopic == "" || c.WillQos > 2) {
+		//Will without a topic, or with an invalid QoS
+		return ErrProtocolViolation
+	}
 	return Accepted
 }
 
@@ -126,3 +149,27 @@ func (c *ConnectPacket) Validate() byte {
 func (c *ConnectPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (c *ConnectPacket) Fields() map[string]interface{} {
+	f := c.FixedHeader.fields()
+	f["protocolName"] = c.ProtocolName
+	f["protocolVersion"] = c.ProtocolVersion
+	f["cleanSession"] = c.CleanSession
+	f["keepalive"] = c.KeepaliveTimer
+	f["clientID"] = c.ClientIdentifier
+	if c.WillFlag {
+		f["willTopic"] = c.WillTopic
+		f["willQos"] = c.WillQos
+		f["willRetain"] = c.WillRetain
+		f["willPayloadLength"] = len(c.WillMessage)
+		addPropertiesField(f, "willProperties", c.WillProperties)
+	}
+	if c.UsernameFlag {
+		f["username"] = c.Username
+	}
+	f["passwordFlag"] = c.PasswordFlag
+	addPropertiesField(f, "properties", c.Properties)
+	return f
+}
@@ -16,10 +16,7 @@ func (d *DisconnectPacket) String() string {
 }
 
 func (d *DisconnectPacket) Write(w PacketWriter) error {
-	packet := d.FixedHeader.pack()
-	_, err := packet.WriteTo(w)
-
-	return err
+	return d.FixedHeader.writeTo(w)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
@@ -32,3 +29,9 @@ func (d *DisconnectPacket) Unpack(src []byte) {
 func (d *DisconnectPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (d *DisconnectPacket) Fields() map[string]interface{} {
+	return d.FixedHeader.fields()
+}
@@ -21,12 +21,20 @@ type PacketReader interface {
 
 //ControlPacket defines the interface for structs intended to hold
 //decoded MQTT packets, either from being read or before being
-//written
+//written.
+//
+//Fields summarises the content of a packet for tools such as protocol
+//analysers. Every packet has the fixed header entries "type" (the name
+//from PacketNames), "dup", "qos", "retain" and "remainingLength", the
+//others depend on the type, for example "topic", "messageID" and
+//"payloadLength" for a PUBLISH. MQTT 5 properties are under
+//"properties" when the packet has any. Passwords are never included.
 type ControlPacket interface {
 	Write(PacketWriter) error
 	Unpack([]byte)
 	String() string
 	Details() Details
+	Fields() map[string]interface{}
 	Release()
 	getByteSlice(int) []byte
 }
@@ -108,36 +116,153 @@ var ConnErrors = map[byte]error{
 	ErrProtocolViolation:            errors.New("Protocol Violation"),
 }
 
+//ConnErrorsV5 is the equivalent of ConnErrors for MQTT 5, where the
+//CONNACK carries a reason code in place of the return code
+var ConnErrorsV5 = map[byte]error{
+	Accepted:             nil,
+	0x80:                 errors.New("Unspecified error"),
+	0x81:                 errors.New("Malformed packet"),
+	0x82:                 errors.New("Protocol error"),
+	0x83:                 errors.New("Implementation specific error"),
+	0x84:                 errors.New("Unsupported protocol version"),
+	0x85:                 errors.New("Client identifier not valid"),
+	0x86:                 errors.New("Bad user name or password"),
+	0x87:                 errors.New("Not authorized"),
+	0x88:                 errors.New("Server unavailable"),
+	0x89:                 errors.New("Server busy"),
+	0x8A:                 errors.New("Banned"),
+	0x8C:                 errors.New("Bad authentication method"),
+	0x90:                 errors.New("Topic name invalid"),
+	0x95:                 errors.New("Packet too large"),
+	0x97:                 errors.New("Quota exceeded"),
+	0x99:                 errors.New("Payload format invalid"),
+	0x9A:                 errors.New("Retain not supported"),
+	0x9B:                 errors.New("QoS not supported"),
+	0x9C:                 errors.New("Use another server"),
+	0x9D:                 errors.New("Server moved"),
+	0x9F:                 errors.New("Connection rate exceeded"),
+	ErrNetworkError:      ConnErrors[ErrNetworkError],
+	ErrProtocolViolation: ConnErrors[ErrProtocolViolation],
+}
+
 var fixedHeaderPool = sync.Pool{
 	New: func() interface{} { return &FixedHeader{} },
 }
-var packetPools [MaxMessageType - 1]sync.Pool
+//packetPools holds the released packets of each type, indexed by the
+//type less one
+var packetPools [MaxMessageType]sync.Pool
 
 //ReadPacket takes an instance of an PacketReader (such as bufio.Reader) and attempts
 //to read an MQTT packet from the stream. It returns a ControlPacket
 //representing the decoded MQTT packet and an error. One of these returns will
 //always be nil, a nil ControlPacket indicating an error occurred.
 func ReadPacket(r PacketReader) (cp ControlPacket, err error) {
+	return ReadPacketVersion(r, 4)
+}
+
+//ReadPacketVersion is like ReadPacket but decodes the packet according to
+//the given MQTT protocol level, which is needed to read the properties
+//carried by packets in MQTT 5.
+func ReadPacketVersion(r PacketReader, level byte) (cp ControlPacket, err error) {
 	fh := fixedHeaderPool.Get().(*FixedHeader)
 
 	b, err := r.ReadByte()
 	if err != nil {
 		return nil, err
 	}
-	fh.unpack(b, r)
+	if err = fh.unpack(b, r); err != nil {
+		return nil, err
+	}
+	fh.ProtocolLevel = level
 	cp = NewControlPacketWithHeader(fh)
 	if cp == nil {
-		return nil, errors.New("Bad data from client")
+		return nil, newDecodeError(fh, nil, errors.New("Bad data from client"))
 	}
 	packetBytes := cp.getByteSlice(fh.RemainingLength)
-	_, err = io.ReadFull(r, packetBytes)
+	n, err := io.ReadFull(r, packetBytes)
 	if err != nil {
-		return nil, err
+		return nil, newDecodeError(fh, packetBytes[:n], err)
+	}
+	if err = checkFlags(fh); err != nil {
+		return nil, newDecodeError(fh, packetBytes, err)
+	}
+	if err = unpack(cp, packetBytes); err != nil {
+		return nil, newDecodeError(fh, packetBytes, err)
 	}
-	cp.Unpack(packetBytes)
 	return cp, nil
 }
 
+//ErrInvalidFlags is the error held by the DecodeError of a packet whose
+//fixed header has flag bits the specification reserves for its type.
+var ErrInvalidFlags = errors.New("invalid fixed header flags")
+
+// checkFlags validates the flag bits of a fixed header: PUBLISH may use
+// them all but QoS 3, PUBREL, SUBSCRIBE and UNSUBSCRIBE must have exactly
+// QoS 1 set and every other packet none of them.
+func checkFlags(fh *FixedHeader) error {
+	switch fh.MessageType {
+	case Publish:
+		if fh.Qos > 2 {
+			return ErrInvalidFlags
+		}
+	case Pubrel, Subscribe, Unsubscribe:
+		if fh.Dup || fh.Qos != 1 || fh.Retain {
+			return ErrInvalidFlags
+		}
+	default:
+		if fh.Dup || fh.Qos != 0 || fh.Retain {
+			return ErrInvalidFlags
+		}
+	}
+	return nil
+}
+
+//DecodeError is the error returned by ReadPacket when a packet can't be
+//decoded, either because it is malformed or because the stream ended or
+//failed part way through it. It holds the fixed header and the bytes of
+//the body that were read, for debugging.
+type DecodeError struct {
+	FixedHeader FixedHeader
+	Body        []byte
+	Err         error
+}
+
+func newDecodeError(fh *FixedHeader, body []byte, err error) *DecodeError {
+	return &DecodeError{
+		FixedHeader: FixedHeader{
+			MessageType:     fh.MessageType,
+			Dup:             fh.Dup,
+			Qos:             fh.Qos,
+			Retain:          fh.Retain,
+			RemainingLength: fh.RemainingLength,
+			ProtocolLevel:   fh.ProtocolLevel,
+		},
+		// the body may be in a pooled slice
+		Body: append([]byte(nil), body...),
+		Err:  err,
+	}
+}
+
+func (e *DecodeError) Error() string {
+	name, ok := PacketNames[e.FixedHeader.MessageType]
+	if !ok {
+		name = fmt.Sprintf("packet type %d", e.FixedHeader.MessageType)
+	}
+	return fmt.Sprintf("decoding %s: %v", name, e.Err)
+}
+
+//unpack calls cp.Unpack, turning the panic of an index out of range on
+//a malformed body into an error
+func unpack(cp ControlPacket, src []byte) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("malformed packet: %v", p)
+		}
+	}()
+	cp.Unpack(src)
+	return nil
+}
+
 //NewControlPacket is used to create a new ControlPacket of the type specified
 //by packetType, this is usually done by reference to the packet type constants
 //defined in packets.go. The newly created ControlPacket is empty and a pointer
@@ -182,7 +307,7 @@ func NewControlPacket(packetType byte) (cp ControlPacket) {
 //specified within the FixedHeader that is passed to the function.
 //The newly created ControlPacket is empty and a pointer is returned.
 func NewControlPacketWithHeader(fh *FixedHeader) (cp ControlPacket) {
-	if fh.MessageType == 0 && fh.MessageType > MaxMessageType {
+	if fh.MessageType == 0 || fh.MessageType > MaxMessageType {
 		return nil
 	}
 	pooled := packetPools[fh.MessageType-1].Get()
@@ -313,7 +438,9 @@ type Details struct {
 }
 
 //FixedHeader is a struct to hold the decoded information from
-//the fixed header of an MQTT ControlPacket
+//the fixed header of an MQTT ControlPacket. ProtocolLevel isn't
+//part of the header on the wire, it records the MQTT version the
+//packet is encoded for; packets with a level of 5 carry properties.
 type FixedHeader struct {
 	ByteSlicePool
 	MessageType     byte
@@ -321,15 +448,46 @@ type FixedHeader struct {
 	Qos             byte
 	Retain          bool
 	RemainingLength int
+	ProtocolLevel   byte
 	selfPtr         interface{}
 }
 
+//fields returns the entries of the fixed header for Fields, to which
+//the packet adds its own
+func (fh *FixedHeader) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"type":            PacketNames[fh.MessageType],
+		"dup":             fh.Dup,
+		"qos":             fh.Qos,
+		"retain":          fh.Retain,
+		"remainingLength": fh.RemainingLength,
+	}
+}
+
+//ackFields returns the Fields of the acknowledgements of a publish
+func ackFields(fh *FixedHeader, messageID uint16, reasonCode byte, props *Properties) map[string]interface{} {
+	f := fh.fields()
+	f["messageID"] = messageID
+	if fh.ProtocolLevel == 5 {
+		f["reasonCode"] = reasonCode
+	}
+	addPropertiesField(f, "properties", props)
+	return f
+}
+
+//addPropertiesField adds props to f under key unless it is nil
+func addPropertiesField(f map[string]interface{}, key string, props *Properties) {
+	if props != nil {
+		f[key] = props
+	}
+}
+
 func (fh *FixedHeader) String() string {
 	return fmt.Sprintf("%s: dup: %t qos: %d retain: %t rLength: %d", PacketNames[fh.MessageType], fh.Dup, fh.Qos, fh.Retain, fh.RemainingLength)
 }
 
 func (fh *FixedHeader) Release() {
-	fh.ByteSlicePool.Release()
+	fh.ByteSlicePool.releaseSlices()
 	if fh.selfPtr != nil && fh.MessageType > 0 && fh.MessageType <= MaxMessageType {
 		packetPools[fh.MessageType-1].Put(fh.selfPtr)
 		// only do the following for incoming packets
@@ -354,12 +512,51 @@ func (fh *FixedHeader) pack() bytes.Buffer {
 	return header
 }
 
-func (fh *FixedHeader) unpack(typeAndFlags byte, r PacketReader) {
+// writeTo writes the header a byte at a time, unlike pack it doesn't
+// allocate
+func (fh *FixedHeader) writeTo(w PacketWriter) error {
+	if err := w.WriteByte(fh.MessageType<<4 | boolToByte(fh.Dup)<<3 | fh.Qos<<1 | boolToByte(fh.Retain)); err != nil {
+		return err
+	}
+	return writeLength(w, fh.RemainingLength)
+}
+
+// writePacket writes the header, with the remaining length taken from
+// body, followed by body
+func writePacket(fh *FixedHeader, body *bytes.Buffer, w PacketWriter) error {
+	fh.RemainingLength = body.Len()
+	if err := fh.writeTo(w); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+// writeLength writes a variable byte integer, as encodeLength encodes it
+func writeLength(w io.ByteWriter, length int) error {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		if err := w.WriteByte(digit); err != nil {
+			return err
+		}
+		if length == 0 {
+			return nil
+		}
+	}
+}
+
+func (fh *FixedHeader) unpack(typeAndFlags byte, r PacketReader) error {
 	fh.MessageType = typeAndFlags >> 4
 	fh.Dup = (typeAndFlags>>3)&0x01 > 0
 	fh.Qos = (typeAndFlags >> 1) & 0x03
 	fh.Retain = typeAndFlags&0x01 > 0
-	fh.RemainingLength = decodeLength(r)
+	var err error
+	fh.RemainingLength, err = readLength(r)
+	return err
 }
 
 func decodeByte(b PacketReader) byte {
@@ -382,6 +579,13 @@ func encodeUint16(num uint16) []byte {
 	return bytes
 }
 
+func writeUint16(w PacketWriter, num uint16) error {
+	if err := w.WriteByte(byte(num >> 8)); err != nil {
+		return err
+	}
+	return w.WriteByte(byte(num))
+}
+
 func encodeString(field string) []byte {
 	fieldLength := make([]byte, 2)
 	binary.BigEndian.PutUint16(fieldLength, uint16(len(field)))
@@ -426,13 +630,15 @@ func encodeLength(length int) []byte {
 	return encLength
 }
 
-func decodeLength(r PacketReader) int {
+// readLength decodes the remaining length of a fixed header, a read
+// error is returned rather than a panic as it comes from the network
+func readLength(r PacketReader) (int, error) {
 	var rLength uint32
 	var multiplier uint32
 	for {
 		digit, err := r.ReadByte()
 		if err != nil {
-			panic("decodeLength() failed")
+			return 0, err
 		}
 		rLength |= uint32(digit&127) << multiplier
 		if (digit & 128) == 0 {
@@ -440,7 +646,7 @@ func decodeLength(r PacketReader) int {
 		}
 		multiplier += 7
 	}
-	return int(rLength)
+	return int(rLength), nil
 }
 
 // pooled & direct write fns (TBD: use just them) [RM]
@@ -459,6 +665,38 @@ func (pool *ByteSlicePool) encodeBytes(field []byte) []byte {
 	return out
 }
 
+// writeAck writes one of the QoS acknowledgements, PUBACK, PUBREC, PUBREL
+// or PUBCOMP. For MQTT 5 the reason code and properties follow the message
+// ID, but may be left out when the code is success and there are no
+// properties.
+func writeAck(fh *FixedHeader, w PacketWriter, messageID uint16, reasonCode byte, props *Properties) error {
+	body := getBuffer()
+	defer putBuffer(body)
+	body.Write(encodeUint16(messageID))
+	if fh.ProtocolLevel == 5 && (reasonCode != 0 || props != nil) {
+		body.WriteByte(reasonCode)
+		if props != nil {
+			props.packTo(body)
+		}
+	}
+	return writePacket(fh, body, w)
+}
+
+// unpackAck decodes the body of a QoS acknowledgement written by writeAck,
+// a missing reason code is success
+func unpackAck(level byte, src []byte) (uint16, byte, *Properties) {
+	messageID := loadUint16(src)
+	if level != 5 || len(src) <= 2 {
+		return messageID, 0, nil
+	}
+	var props *Properties
+	if len(src) > 3 {
+		props = &Properties{}
+		props.unpack(src[3:])
+	}
+	return messageID, src[2], props
+}
+
 func loadByte(src []byte) byte {
 	if len(src) == 0 {
 		return 0 // FIXME: error
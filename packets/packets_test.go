@@ -1,7 +1,15 @@
 package packets
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"runtime"
+	"runtime/debug"
 	"testing"
 )
 
@@ -157,3 +165,1063 @@ func TestConnectPacket(t *testing.T) {
 		t.Errorf("Connect Packet WillMessage is %s, should be %s", string(cp.WillMessage), "Test Payload")
 	}
 }
+
+func TestConnectPacketValidateWill(t *testing.T) {
+	valid := func() *ConnectPacket {
+		cp := NewControlPacket(Connect).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.ClientIdentifier = "will"
+		return cp
+	}
+	if rc := valid().Validate(); rc != Accepted {
+		t.Fatalf("connect without a will is invalid: %d", rc)
+	}
+
+	cp := valid()
+	cp.WillRetain = true
+	if rc := cp.Validate(); rc != ErrProtocolViolation {
+		t.Errorf("will retain without a will validated as %d", rc)
+	}
+
+	cp = valid()
+	cp.WillQos = 1
+	if rc := cp.Validate(); rc != ErrProtocolViolation {
+		t.Errorf("will QoS without a will validated as %d", rc)
+	}
+
+	cp = valid()
+	cp.WillFlag = true
+	cp.WillMessage = []byte("gone")
+	if rc := cp.Validate(); rc != ErrProtocolViolation {
+		t.Errorf("will without a topic validated as %d", rc)
+	}
+
+	cp.WillTopic = "status"
+	cp.WillQos = 1
+	cp.WillRetain = true
+	if rc := cp.Validate(); rc != Accepted {
+		t.Errorf("connect with a will is invalid: %d", rc)
+	}
+}
+
+func TestConnectPacketWillDelay(t *testing.T) {
+	cp := NewControlPacket(Connect).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 5
+	cp.ClientIdentifier = "test"
+	cp.WillFlag = true
+	cp.WillTopic = "will"
+	cp.WillMessage = []byte("gone")
+	cp.WillProperties = &Properties{WillDelayInterval: 30}
+
+	var buf bytes.Buffer
+	if err := cp.Write(&buf); err != nil {
+		t.Fatalf("Error writing packet: %s", err.Error())
+	}
+	willProps := []byte{5, PropWillDelayInterval, 0, 0, 0, 30, 0, 4, 'w', 'i', 'l', 'l'}
+	if !bytes.Contains(buf.Bytes(), willProps) {
+		t.Errorf("Connect Packet will properties not encoded: %v", buf.Bytes())
+	}
+
+	packet, err := ReadPacket(&buf)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	rp := packet.(*ConnectPacket)
+	if rp.WillProperties == nil || rp.WillProperties.WillDelayInterval != 30 {
+		t.Errorf("Connect Packet WillDelayInterval is %v, should be %d", rp.WillProperties, 30)
+	}
+	if rp.WillTopic != "will" {
+		t.Errorf("Connect Packet WillTopic is %s, should be %s", rp.WillTopic, "will")
+	}
+	if string(rp.WillMessage) != "gone" {
+		t.Errorf("Connect Packet WillMessage is %s, should be %s", string(rp.WillMessage), "gone")
+	}
+}
+
+func TestConnectPacketWillDelayV4(t *testing.T) {
+	cp := NewControlPacket(Connect).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 4
+	cp.WillFlag = true
+	cp.WillTopic = "will"
+	cp.WillProperties = &Properties{WillDelayInterval: 30}
+
+	var buf bytes.Buffer
+	cp.Write(&buf)
+	if bytes.IndexByte(buf.Bytes(), PropWillDelayInterval) >= 0 {
+		t.Errorf("Connect Packet for MQTT 3.1.1 must not contain properties: %v", buf.Bytes())
+	}
+}
+
+func TestSubscribePacketSubscriptionIdentifier(t *testing.T) {
+	sp := NewControlPacket(Subscribe).(*SubscribePacket)
+	sp.ProtocolLevel = 5
+	sp.MessageID = 10
+	sp.Topics = []string{"a/+"}
+	sp.Qoss = []byte{1}
+	sp.Properties = &Properties{SubscriptionIdentifiers: []int{300}}
+
+	var buf bytes.Buffer
+	sp.Write(&buf)
+	exp := []byte{0x82, 12, 0, 10, 3, PropSubscriptionIdentifier, 0xAC, 0x02, 0, 3, 'a', '/', '+', 1}
+	if !bytes.Equal(buf.Bytes(), exp) {
+		t.Fatalf("Subscribe Packet is %v, should be %v", buf.Bytes(), exp)
+	}
+
+	packet, err := ReadPacketVersion(&buf, 5)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	rp := packet.(*SubscribePacket)
+	if rp.Properties == nil || len(rp.Properties.SubscriptionIdentifiers) != 1 || rp.Properties.SubscriptionIdentifiers[0] != 300 {
+		t.Errorf("Subscribe Packet identifiers are %v, should be [300]", rp.Properties)
+	}
+	if len(rp.Topics) != 1 || rp.Topics[0] != "a/+" || rp.Qoss[0] != 1 {
+		t.Errorf("Subscribe Packet topics are %v %v", rp.Topics, rp.Qoss)
+	}
+}
+
+func TestPublishPacketSubscriptionIdentifiers(t *testing.T) {
+	pp := NewControlPacket(Publish).(*PublishPacket)
+	pp.ProtocolLevel = 5
+	pp.Qos = 1
+	pp.MessageID = 3
+	pp.TopicName = []byte("a/b")
+	pp.Properties = &Properties{SubscriptionIdentifiers: []int{1, 2}}
+	pp.Payload = []byte("hello")
+
+	var buf bytes.Buffer
+	pp.Write(&buf)
+	packet, err := ReadPacketVersion(&buf, 5)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	rp := packet.(*PublishPacket)
+	if rp.Properties == nil || len(rp.Properties.SubscriptionIdentifiers) != 2 {
+		t.Fatalf("Publish Packet identifiers are %v, should be [1 2]", rp.Properties)
+	}
+	if string(rp.Payload) != "hello" || string(rp.TopicName) != "a/b" || rp.MessageID != 3 {
+		t.Errorf("Publish Packet decoded wrongly: %s", rp)
+	}
+}
+
+func TestReadPacketDecodeError(t *testing.T) {
+	// a QoS 1 publish whose topic is longer than the packet, leaving no
+	// room for the message ID
+	corrupt := []byte{Publish<<4 | 0x02, 3, 0x00, 0x05, 'a'}
+	_, err := ReadPacket(bytes.NewReader(corrupt))
+	de, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("corrupt publish read with error %v", err)
+	}
+	if de.FixedHeader.MessageType != Publish || de.FixedHeader.Qos != 1 || de.FixedHeader.RemainingLength != 3 {
+		t.Errorf("DecodeError has fixed header %v", de.FixedHeader.String())
+	}
+	if !bytes.Equal(de.Body, corrupt[2:]) || de.Err == nil {
+		t.Errorf("DecodeError has body %v and error %v", de.Body, de.Err)
+	}
+
+	// the body is cut short
+	_, err = ReadPacket(bytes.NewReader([]byte{Puback << 4, 2, 0x01}))
+	if de, ok = err.(*DecodeError); !ok || !bytes.Equal(de.Body, []byte{0x01}) || de.Err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated puback read with error %v", err)
+	}
+
+	_, err = ReadPacket(bytes.NewReader([]byte{0xF0, 0}))
+	if de, ok = err.(*DecodeError); !ok || de.FixedHeader.MessageType != 15 {
+		t.Errorf("unknown packet type read with error %v", err)
+	}
+
+	// a puback with QoS bits set
+	_, err = ReadPacket(bytes.NewReader([]byte{0x42, 0x02, 0x00, 0x07}))
+	if de, ok = err.(*DecodeError); !ok || de.Err != ErrInvalidFlags {
+		t.Errorf("puback with reserved flags read with error %v", err)
+	}
+
+	_, err = ReadPacket(bytes.NewReader([]byte{Pubrel << 4, 0x02, 0x00, 0x07}))
+	if de, ok = err.(*DecodeError); !ok || de.Err != ErrInvalidFlags {
+		t.Errorf("pubrel without QoS 1 read with error %v", err)
+	}
+}
+
+func TestReadDisconnectPacket(t *testing.T) {
+	var buf bytes.Buffer
+	NewControlPacket(Disconnect).Write(&buf)
+	cp, err := ReadPacket(&buf)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	if _, ok := cp.(*DisconnectPacket); !ok {
+		t.Fatalf("read %v, should be a disconnect", cp)
+	}
+	cp.Release()
+}
+
+func TestReadSubscribePacketReused(t *testing.T) {
+	// packets from the pools, including those added by WarmPools, are
+	// handed out as they were released, so decoding into a packet which
+	// still holds the filters of an earlier one must replace them
+	var rp *SubscribePacket
+	for _, topics := range [][]string{{"a/#", "b", "c/+"}, {"d"}} {
+		var buf bytes.Buffer
+		sp := NewControlPacket(Subscribe).(*SubscribePacket)
+		sp.MessageID = 1
+		sp.Topics = topics
+		sp.Qoss = make([]byte, len(topics))
+		sp.Write(&buf)
+		if rp == nil {
+			cp, err := ReadPacket(&buf)
+			if err != nil {
+				t.Fatalf("Error reading packet: %s", err.Error())
+			}
+			rp = cp.(*SubscribePacket)
+		} else {
+			// skip the fixed header
+			body := buf.Bytes()[2:]
+			rp.Unpack(body)
+		}
+		if !reflect.DeepEqual(rp.Topics, topics) || len(rp.Qoss) != len(topics) {
+			t.Fatalf("read topics %v and qoss %v, should be %v", rp.Topics, rp.Qoss, topics)
+		}
+	}
+	rp.Release()
+}
+
+func TestWarmPools(t *testing.T) {
+	const burst = 16
+	if raceEnabled {
+		t.Skip("sync.Pool drops objects at random with the race detector")
+	}
+	var data bytes.Buffer
+	for i := 0; i < burst; i++ {
+		pub := NewControlPacket(Publish).(*PublishPacket)
+		pub.Qos = 1
+		pub.MessageID = uint16(i + 1)
+		pub.TopicName = []byte("warm/topic")
+		pub.Payload = []byte("payload")
+		pub.Write(&data)
+	}
+	// a garbage collection would empty the pools again
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	// AllocsPerRun makes a first run which isn't counted, the packets
+	// are held until the end so that the counted run can't reuse them
+	WarmPools(2 * burst)
+
+	r := bytes.NewReader(data.Bytes())
+	held := make([]ControlPacket, 0, 2*burst)
+	allocs := testing.AllocsPerRun(1, func() {
+		r.Reset(data.Bytes())
+		for i := 0; i < burst; i++ {
+			cp, _ := ReadPacket(r)
+			held = append(held, cp)
+		}
+	})
+	for _, cp := range held {
+		cp.Release()
+	}
+	if allocs != 0 {
+		t.Errorf("reading %d packets after warming made %v allocations", burst, allocs)
+	}
+}
+
+func TestConfigurePool(t *testing.T) {
+	defer ConfigurePool(MAX_SLICE_SIZE, MAX_POOLED_SLICES)
+
+	ConfigurePool(16, 1)
+	pool := getObjectPool()
+	pool.getByteSlice(32)
+	if pool.numPooledSlices != 0 {
+		t.Errorf("slice larger than the max size was pooled")
+	}
+	pool.getByteSlice(7)
+	pool.getByteSlice(7)
+	if pool.numPooledSlices != 1 {
+		t.Errorf("pooled %d slices, should be %d", pool.numPooledSlices, 1)
+	}
+	before := PoolStats()[7]
+	pool.Release()
+	if after := PoolStats()[7]; after != before+1 {
+		t.Errorf("PoolStats for size 7 is %d, should be %d", after, before+1)
+	}
+
+	ConfigurePool(0, MAX_POOLED_SLICES)
+	pool = getObjectPool()
+	pool.getByteSlice(7)
+	if pool.numPooledSlices != 0 {
+		t.Errorf("slice was pooled with pooling disabled")
+	}
+	pool.Release()
+}
+
+func TestPoolStatsAfterGC(t *testing.T) {
+	WarmPools(3)
+	if n := PoolStats()[9]; n < 3 {
+		t.Fatalf("PoolStats for size 9 is %d after warming, should be at least 3", n)
+	}
+	// the pools are emptied over two collections, the count is only
+	// corrected when the next slice of the size is asked for
+	runtime.GC()
+	runtime.GC()
+	pool := getObjectPool()
+	defer pool.Release()
+	pool.getByteSlice(9)
+	if n := PoolStats()[9]; n != 0 {
+		t.Fatalf("PoolStats for size 9 is %d after collecting, should be 0", n)
+	}
+}
+
+func TestPublishPacketCopyAfterRelease(t *testing.T) {
+	publish := func(topic, payload string) *bytes.Buffer {
+		pp := NewControlPacket(Publish).(*PublishPacket)
+		pp.TopicName = []byte(topic)
+		pp.Payload = []byte(payload)
+		var buf bytes.Buffer
+		pp.Write(&buf)
+		return &buf
+	}
+
+	packet, err := ReadPacket(publish("a/b", "first"))
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	cp := packet.(*PublishPacket).Copy()
+	packet.Release()
+
+	// same sized packets reuse the released slices
+	for i := 0; i < 10; i++ {
+		other, err := ReadPacket(publish("x/y", "other"))
+		if err != nil {
+			t.Fatalf("Error reading packet: %s", err.Error())
+		}
+		other.Release()
+	}
+
+	if string(cp.TopicName) != "a/b" {
+		t.Errorf("Copied TopicName is %s, should be %s", cp.TopicName, "a/b")
+	}
+	if string(cp.Payload) != "first" {
+		t.Errorf("Copied Payload is %s, should be %s", cp.Payload, "first")
+	}
+}
+
+func TestEncodedPublishPacket(t *testing.T) {
+	pub := NewControlPacket(Publish).(*PublishPacket)
+	pub.Qos = 1
+	pub.Retain = true
+	pub.TopicName = []byte("status/topic")
+	pub.MessageID = 1
+	pub.Payload = []byte("online")
+	encoded, err := pub.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	original := append([]byte(nil), encoded...)
+
+	enc, err := NewEncodedPublishPacket(encoded)
+	if err != nil {
+		t.Fatalf("encoded publish rejected: %v", err)
+	}
+	if enc.Qos != 1 || !enc.Retain {
+		t.Fatalf("bad header decoded: %v", enc.FixedHeader)
+	}
+	enc.MessageID = 300
+	var b bytes.Buffer
+	if err := enc.Write(&b); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if !bytes.Equal(encoded, original) {
+		t.Fatalf("encoded slice was modified")
+	}
+	cp, err := ReadPacket(&b)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	got := cp.(*PublishPacket)
+	if got.MessageID != 300 || string(got.TopicName) != "status/topic" || string(got.Payload) != "online" {
+		t.Fatalf("bad packet after patching id: %v", got)
+	}
+
+	if _, err := NewEncodedPublishPacket(encoded[:len(encoded)-1]); err == nil {
+		t.Fatalf("truncated packet accepted")
+	}
+	if _, err := NewEncodedPublishPacket([]byte{Puback << 4, 2, 0, 1}); err == nil {
+		t.Fatalf("PUBACK accepted as a publish")
+	}
+}
+
+func TestConnectPacketCleanStart(t *testing.T) {
+	for _, version := range []byte{4, 5} {
+		cp := NewControlPacket(Connect).(*ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = version
+		cp.CleanSession = false
+		cp.ClientIdentifier = "id"
+		cp.Properties = &Properties{SessionExpiryInterval: SessionNeverExpires}
+
+		var buf bytes.Buffer
+		cp.Write(&buf)
+		flags := buf.Bytes()[9]
+		if flags&0x02 != 0 {
+			t.Errorf("version %d: clean flag set in %08b", version, flags)
+		}
+		packet, err := ReadPacket(&buf)
+		if err != nil {
+			t.Fatalf("Error reading packet: %s", err.Error())
+		}
+		rp := packet.(*ConnectPacket)
+		switch version {
+		case 4:
+			if rp.Properties != nil {
+				t.Errorf("Connect Packet for MQTT 3.1.1 must not contain properties: %v", rp.Properties)
+			}
+		case 5:
+			if rp.Properties == nil || rp.Properties.SessionExpiryInterval != SessionNeverExpires {
+				t.Errorf("Connect Packet SessionExpiryInterval is %v, should be %d", rp.Properties, uint32(SessionNeverExpires))
+			}
+		}
+		if rp.CleanSession || rp.ClientIdentifier != "id" {
+			t.Errorf("version %d: bad connect packet decoded %v", version, rp)
+		}
+	}
+}
+
+func TestSubackPacketReasonString(t *testing.T) {
+	sa := NewControlPacket(Suback).(*SubackPacket)
+	sa.ProtocolLevel = 5
+	sa.MessageID = 3
+	sa.Properties = &Properties{
+		ReasonString:   "not authorized for a/b",
+		UserProperties: []UserProperty{{Key: "policy", Value: "acl-7"}},
+	}
+	sa.GrantedQoss = []byte{0x87}
+
+	var buf bytes.Buffer
+	sa.Write(&buf)
+	packet, err := ReadPacketVersion(&buf, 5)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	rp := packet.(*SubackPacket)
+	if rp.Properties == nil || rp.Properties.ReasonString != "not authorized for a/b" {
+		t.Errorf("Suback Packet ReasonString is %v", rp.Properties)
+	}
+	if len(rp.Properties.UserProperties) != 1 || rp.Properties.UserProperties[0] != (UserProperty{Key: "policy", Value: "acl-7"}) {
+		t.Errorf("Suback Packet UserProperties is %v", rp.Properties.UserProperties)
+	}
+	if !bytes.Equal(rp.GrantedQoss, []byte{0x87}) || rp.MessageID != 3 {
+		t.Errorf("Suback Packet decoded as %d %v", rp.MessageID, rp.GrantedQoss)
+	}
+
+	// the MQTT 3.1.1 layout has no properties
+	v4 := NewControlPacket(Suback).(*SubackPacket)
+	v4.MessageID = 3
+	v4.GrantedQoss = []byte{1, 0}
+	buf.Reset()
+	v4.Write(&buf)
+	if !bytes.Equal(buf.Bytes(), []byte{Suback << 4, 4, 0, 3, 1, 0}) {
+		t.Errorf("Suback Packet for MQTT 3.1.1 encoded as %v", buf.Bytes())
+	}
+}
+
+func TestUnsubackPacketReasonCodes(t *testing.T) {
+	ua := NewControlPacket(Unsuback).(*UnsubackPacket)
+	ua.ProtocolLevel = 5
+	ua.MessageID = 4
+	ua.Properties = &Properties{ReasonString: "partly unsubscribed"}
+	ua.ReasonCodes = []byte{0x00, 0x11}
+
+	var buf bytes.Buffer
+	ua.Write(&buf)
+	packet, err := ReadPacketVersion(&buf, 5)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	rp := packet.(*UnsubackPacket)
+	if rp.Properties == nil || rp.Properties.ReasonString != "partly unsubscribed" {
+		t.Errorf("Unsuback Packet ReasonString is %v", rp.Properties)
+	}
+	if !bytes.Equal(rp.ReasonCodes, []byte{0x00, 0x11}) || rp.MessageID != 4 {
+		t.Errorf("Unsuback Packet decoded as %d %v", rp.MessageID, rp.ReasonCodes)
+	}
+
+	// the MQTT 3.1.1 layout only has the message id
+	v4 := NewControlPacket(Unsuback).(*UnsubackPacket)
+	v4.MessageID = 4
+	v4.ReasonCodes = []byte{0x00}
+	buf.Reset()
+	v4.Write(&buf)
+	if !bytes.Equal(buf.Bytes(), []byte{Unsuback << 4, 2, 0, 4}) {
+		t.Errorf("Unsuback Packet for MQTT 3.1.1 encoded as %v", buf.Bytes())
+	}
+}
+
+func TestConnackPacketMaximumPacketSize(t *testing.T) {
+	ca := NewControlPacket(Connack).(*ConnackPacket)
+	ca.ProtocolLevel = 5
+	ca.ReturnCode = Accepted
+	ca.Properties = &Properties{MaximumPacketSize: 1024}
+
+	var buf bytes.Buffer
+	ca.Write(&buf)
+	packet, err := ReadPacketVersion(&buf, 5)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	rp := packet.(*ConnackPacket)
+	if rp.Properties == nil || rp.Properties.MaximumPacketSize != 1024 {
+		t.Errorf("Connack Packet MaximumPacketSize is %v, should be %d", rp.Properties, 1024)
+	}
+}
+
+func TestConnackPacketCapabilities(t *testing.T) {
+	maxQos := byte(1)
+	unavailable := false
+	ca := NewControlPacket(Connack).(*ConnackPacket)
+	ca.ProtocolLevel = 5
+	ca.ReturnCode = Accepted
+	ca.Properties = &Properties{MaximumQoS: &maxQos, RetainAvailable: &unavailable, SharedSubscriptionAvailable: &unavailable}
+
+	var buf bytes.Buffer
+	ca.Write(&buf)
+	packet, err := ReadPacketVersion(&buf, 5)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	p := packet.(*ConnackPacket).Properties
+	if p == nil || p.MaximumQoS == nil || *p.MaximumQoS != 1 {
+		t.Fatalf("Connack Packet MaximumQoS is %v, should be 1", p)
+	}
+	if p.RetainAvailable == nil || *p.RetainAvailable || p.SharedSubscriptionAvailable == nil || *p.SharedSubscriptionAvailable {
+		t.Errorf("Connack Packet should say retain and shared subscriptions are unavailable")
+	}
+	if p.WildcardSubscriptionAvailable != nil || p.SubscriptionIdentifierAvailable != nil {
+		t.Errorf("Connack Packet has capabilities which weren't sent")
+	}
+}
+
+func TestResponseInformation(t *testing.T) {
+	cp := NewControlPacket(Connect).(*ConnectPacket)
+	cp.ProtocolName = "MQTT"
+	cp.ProtocolVersion = 5
+	cp.ClientIdentifier = "rr"
+	cp.Properties = &Properties{RequestResponseInformation: true}
+
+	var buf bytes.Buffer
+	cp.Write(&buf)
+	packet, err := ReadPacket(&buf)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	if p := packet.(*ConnectPacket).Properties; p == nil || !p.RequestResponseInformation {
+		t.Errorf("Connect Packet RequestResponseInformation not set")
+	}
+
+	ca := NewControlPacket(Connack).(*ConnackPacket)
+	ca.ProtocolLevel = 5
+	ca.Properties = &Properties{ResponseInformation: "responses/rr"}
+	buf.Reset()
+	ca.Write(&buf)
+	packet, err = ReadPacketVersion(&buf, 5)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	if p := packet.(*ConnackPacket).Properties; p == nil || p.ResponseInformation != "responses/rr" {
+		t.Errorf("Connack Packet ResponseInformation is %v, should be responses/rr", p)
+	}
+}
+
+func TestPublishPacketMessageExpiry(t *testing.T) {
+	pp := NewControlPacket(Publish).(*PublishPacket)
+	pp.ProtocolLevel = 5
+	pp.TopicName = []byte("a/b")
+	pp.Properties = &Properties{MessageExpiryInterval: 30}
+	pp.Payload = []byte("x")
+
+	var buf bytes.Buffer
+	pp.Write(&buf)
+	packet, err := ReadPacketVersion(&buf, 5)
+	if err != nil {
+		t.Fatalf("Error reading packet: %s", err.Error())
+	}
+	rp := packet.(*PublishPacket)
+	if rp.Properties == nil || rp.Properties.MessageExpiryInterval != 30 {
+		t.Errorf("Publish Packet MessageExpiryInterval is %v, should be %d", rp.Properties, 30)
+	}
+}
+
+func TestPublishPacketEmptyPayload(t *testing.T) {
+	for _, qos := range []byte{0, 1} {
+		pub := NewControlPacket(Publish).(*PublishPacket)
+		pub.Qos = qos
+		pub.Retain = true
+		pub.TopicName = []byte("a/b")
+		pub.MessageID = 7
+		var b bytes.Buffer
+		if err := pub.Write(&b); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		want := []byte{Publish<<4 | qos<<1 | 1, 5, 0, 3, 'a', '/', 'b'}
+		if qos > 0 {
+			want[1] += 2
+			want = append(want, 0, 7)
+		}
+		if !bytes.Equal(b.Bytes(), want) {
+			t.Fatalf("qos %d: expected %x, got %x", qos, want, b.Bytes())
+		}
+		cp, err := ReadPacket(&b)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		got := cp.(*PublishPacket)
+		if !got.Retain || len(got.Payload) != 0 || string(got.TopicName) != "a/b" {
+			t.Fatalf("qos %d: bad packet decoded: %v", qos, got)
+		}
+	}
+}
+
+// bufferedPublishWrite is the encoding PublishPacket.Write used before
+// EncodeTo, assembling the packet in buffers before writing it
+func bufferedPublishWrite(p *PublishPacket, w PacketWriter) error {
+	var body bytes.Buffer
+	body.Write(encodeBytes(p.TopicName))
+	if p.Qos > 0 {
+		body.Write(encodeUint16(p.MessageID))
+	}
+	if p.ProtocolLevel == 5 {
+		body.Write(p.Properties.pack())
+	}
+	p.FixedHeader.RemainingLength = body.Len() + len(p.Payload)
+	packet := p.FixedHeader.pack()
+	packet.Write(body.Bytes())
+	packet.Write(p.Payload)
+	_, err := w.Write(packet.Bytes())
+	return err
+}
+
+func TestPublishPacketEncodeTo(t *testing.T) {
+	for _, level := range []byte{4, 5} {
+		for _, size := range []int{0, 256, 20000} {
+			pub := NewControlPacket(Publish).(*PublishPacket)
+			pub.ProtocolLevel = level
+			pub.Qos = 1
+			pub.Dup = true
+			pub.TopicName = []byte("encode/to")
+			pub.MessageID = 513
+			pub.Properties = &Properties{SubscriptionIdentifiers: []int{3}}
+			pub.Payload = bytes.Repeat([]byte{'x'}, size)
+			var direct, buffered bytes.Buffer
+			if err := pub.EncodeTo(&direct); err != nil {
+				t.Fatalf("encode failed: %v", err)
+			}
+			if err := bufferedPublishWrite(pub, &buffered); err != nil {
+				t.Fatalf("buffered write failed: %v", err)
+			}
+			if !bytes.Equal(direct.Bytes(), buffered.Bytes()) {
+				t.Fatalf("level %d, %d byte payload: encodings differ", level, size)
+			}
+			if pub.Size() != direct.Len() {
+				t.Fatalf("level %d, %d byte payload: size %d, encoded as %d bytes", level, size, pub.Size(), direct.Len())
+			}
+		}
+	}
+}
+
+func benchmarkPublishWrite(b *testing.B, write func(*PublishPacket, PacketWriter) error) {
+	pub := NewControlPacket(Publish).(*PublishPacket)
+	pub.Qos = 1
+	pub.TopicName = []byte("bench/topic")
+	pub.MessageID = 1
+	pub.Payload = make([]byte, 256)
+	w := bufio.NewWriter(ioutil.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := write(pub, w); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishPacketEncodeTo(b *testing.B) {
+	benchmarkPublishWrite(b, (*PublishPacket).EncodeTo)
+}
+
+func BenchmarkPublishPacketBufferedWrite(b *testing.B) {
+	benchmarkPublishWrite(b, bufferedPublishWrite)
+}
+
+func TestPacketWriteEncodings(t *testing.T) {
+	// encodings from before the body buffers were pooled; writing each
+	// packet twice checks a reused buffer carries nothing over
+	want := []string{
+		"102800044d51545404c400000004676f6c64000477696c6c0004676f6e65000475736572000470617373",
+		"20020000",
+		"320e0003612f6200077061796c6f6164",
+		"40020007",
+		"820c00080003612f230100016202",
+		"900400080180",
+		"a20700090003612f23",
+		"b0020009",
+		"103400044d51545405c4000005110000003c0004676f6c64051800000005000477696c6c0004676f6e65000475736572000470617373",
+		"200600000321000a",
+		"321b0003612f6200070c020000001e2600016b0001767061796c6f6164",
+		"400a000710061f0003776879",
+		"820f0008020b030003612f230100016202",
+		"900a0008051f00026e6f0180",
+		"a21400090c020000001e2600016b0001760003612f23",
+		"b0020009",
+		"c000",
+		"d000",
+		"e000",
+	}
+	samples := encodingSamples()
+	if len(samples) != len(want) {
+		t.Fatalf("%d samples for %d encodings", len(samples), len(want))
+	}
+	for i, cp := range samples {
+		for n := 0; n < 2; n++ {
+			var b bytes.Buffer
+			if err := cp.Write(&b); err != nil {
+				t.Fatalf("writing sample %d failed: %v", i, err)
+			}
+			if got := hex.EncodeToString(b.Bytes()); got != want[i] {
+				t.Fatalf("sample %d encoded as %s, should be %s", i, got, want[i])
+			}
+		}
+	}
+}
+
+func encodingSamples() []ControlPacket {
+	expiry := &Properties{MessageExpiryInterval: 30, UserProperties: []UserProperty{{Key: "k", Value: "v"}}}
+	var samples []ControlPacket
+	for _, level := range []byte{4, 5} {
+		c := NewControlPacket(Connect).(*ConnectPacket)
+		c.ProtocolName, c.ProtocolVersion, c.ClientIdentifier = "MQTT", level, "gold"
+		c.WillFlag, c.WillTopic, c.WillMessage = true, "will", []byte("gone")
+		c.UsernameFlag, c.Username, c.PasswordFlag, c.Password = true, "user", true, []byte("pass")
+		c.Properties, c.WillProperties = &Properties{SessionExpiryInterval: 60}, &Properties{WillDelayInterval: 5}
+		ca := NewControlPacket(Connack).(*ConnackPacket)
+		ca.ProtocolLevel, ca.ReturnCode, ca.Properties = level, 0, &Properties{ReceiveMaximum: 10}
+		p := NewControlPacket(Publish).(*PublishPacket)
+		p.ProtocolLevel, p.Qos, p.MessageID, p.TopicName, p.Payload, p.Properties = level, 1, 7, []byte("a/b"), []byte("payload"), expiry
+		pa := NewControlPacket(Puback).(*PubackPacket)
+		pa.ProtocolLevel, pa.MessageID, pa.ReasonCode, pa.Properties = level, 7, 0x10, &Properties{ReasonString: "why"}
+		s := NewControlPacket(Subscribe).(*SubscribePacket)
+		s.ProtocolLevel, s.MessageID, s.Topics, s.Qoss, s.Properties = level, 8, []string{"a/#", "b"}, []byte{1, 2}, &Properties{SubscriptionIdentifiers: []int{3}}
+		sa := NewControlPacket(Suback).(*SubackPacket)
+		sa.ProtocolLevel, sa.MessageID, sa.GrantedQoss, sa.Properties = level, 8, []byte{1, 0x80}, &Properties{ReasonString: "no"}
+		u := NewControlPacket(Unsubscribe).(*UnsubscribePacket)
+		u.ProtocolLevel, u.MessageID, u.Topics, u.Properties = level, 9, []string{"a/#"}, expiry
+		ua := NewControlPacket(Unsuback).(*UnsubackPacket)
+		ua.MessageID = 9
+		samples = append(samples, c, ca, p, pa, s, sa, u, ua)
+	}
+	return append(samples, NewControlPacket(Pingreq), NewControlPacket(Pingresp), NewControlPacket(Disconnect))
+}
+
+// go test -bench PacketWrite -benchmem reports the allocations made by
+// each Write
+func BenchmarkPacketWrite(b *testing.B) {
+	samples := encodingSamples()
+	w := bufio.NewWriter(ioutil.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, cp := range samples {
+			if err := cp.Write(w); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestPubackPacketReasonCode(t *testing.T) {
+	pa := NewControlPacket(Puback).(*PubackPacket)
+	pa.ProtocolLevel = 5
+	pa.MessageID = 9
+	pa.ReasonCode = 0x10
+	var b bytes.Buffer
+	if err := pa.Write(&b); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if want := []byte{Puback << 4, 3, 0, 9, 0x10}; !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("expected %x, got %x", want, b.Bytes())
+	}
+	cp, err := ReadPacketVersion(&b, 5)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if rp := cp.(*PubackPacket); rp.MessageID != 9 || rp.ReasonCode != 0x10 || rp.Properties != nil {
+		t.Fatalf("bad puback decoded: %v", rp)
+	}
+
+	// a success code without properties is left out
+	pc := NewControlPacket(Pubcomp).(*PubcompPacket)
+	pc.ProtocolLevel = 5
+	pc.MessageID = 9
+	b.Reset()
+	pc.Write(&b)
+	if b.Len() != 4 {
+		t.Fatalf("expected a 2 byte pubcomp body, got %x", b.Bytes())
+	}
+
+	pr := NewControlPacket(Pubrec).(*PubrecPacket)
+	pr.ProtocolLevel = 5
+	pr.MessageID = 10
+	pr.ReasonCode = 0x99
+	pr.Properties = &Properties{ReasonString: "not json"}
+	b.Reset()
+	pr.Write(&b)
+	cp, err = ReadPacketVersion(&b, 5)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if rp := cp.(*PubrecPacket); rp.ReasonCode != 0x99 || rp.Properties == nil || rp.Properties.ReasonString != "not json" {
+		t.Fatalf("bad pubrec decoded: %v", rp)
+	}
+}
+
+func TestSubscribePacketValidate(t *testing.T) {
+	sp := NewControlPacket(Subscribe).(*SubscribePacket)
+	sp.MessageID = 1
+	var b bytes.Buffer
+	if err := sp.Validate(); err != ErrNoTopics {
+		t.Errorf("expected %v for no topics, got %v", ErrNoTopics, err)
+	}
+	if err := sp.Write(&b); err != ErrNoTopics || b.Len() != 0 {
+		t.Errorf("empty subscribe was written: %v %x", err, b.Bytes())
+	}
+
+	sp.Topics = []string{"a/b", "c/d"}
+	sp.Qoss = []byte{1}
+	if err := sp.Validate(); err != ErrTopicsQossMismatch {
+		t.Errorf("expected %v for mismatched lengths, got %v", ErrTopicsQossMismatch, err)
+	}
+	if err := sp.Write(&b); err != ErrTopicsQossMismatch || b.Len() != 0 {
+		t.Errorf("mismatched subscribe was written: %v %x", err, b.Bytes())
+	}
+
+	sp.Qoss = append(sp.Qoss, 2)
+	if err := sp.Validate(); err != nil {
+		t.Errorf("valid subscribe rejected: %v", err)
+	}
+}
+
+func TestPublishPacketTopicAlias(t *testing.T) {
+	pub := NewControlPacket(Publish).(*PublishPacket)
+	pub.ProtocolLevel = 5
+	pub.Properties = &Properties{TopicAlias: 7}
+	pub.Payload = []byte("x")
+	var b bytes.Buffer
+	if err := pub.Write(&b); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	// empty topic, then the alias property
+	if want := []byte{Publish << 4, 7, 0, 0, 3, PropTopicAlias, 0, 7, 'x'}; !bytes.Equal(b.Bytes(), want) {
+		t.Fatalf("expected %x, got %x", want, b.Bytes())
+	}
+	cp, err := ReadPacketVersion(&b, 5)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if rp := cp.(*PublishPacket); len(rp.TopicName) != 0 || rp.Properties.TopicAlias != 7 || string(rp.Payload) != "x" {
+		t.Fatalf("bad publish decoded: %v", rp)
+	}
+}
+
+func TestReadPacketTruncatedHeader(t *testing.T) {
+	// remaining length says more bytes follow, but the stream ends
+	b := bytes.NewBuffer([]byte{Publish << 4, 0x80})
+	if _, err := ReadPacket(b); err != io.EOF {
+		t.Fatalf("expected %v, got %v", io.EOF, err)
+	}
+}
+
+func FuzzSubscribePacketUnpack(f *testing.F) {
+	sp := NewControlPacket(Subscribe).(*SubscribePacket)
+	sp.MessageID = 7
+	sp.Topics = []string{"a/b", "c/#", ""}
+	sp.Qoss = []byte{0, 1, 2}
+	var buf bytes.Buffer
+	sp.Write(&buf)
+	//the body after the two byte fixed header, and every truncation of it
+	body := buf.Bytes()[2:]
+	for i := 0; i <= len(body); i++ {
+		f.Add(body[:i])
+	}
+	f.Add([]byte{0x00, 0x07, 0xff, 0xff, 'a'})
+	f.Add([]byte{0x00, 0x07, 0x00, 0x01})
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		p := NewControlPacket(Subscribe).(*SubscribePacket)
+		p.Unpack(src)
+		if len(p.Topics) != len(p.Qoss) {
+			t.Fatalf("%d topics but %d QoSs from %x", len(p.Topics), len(p.Qoss), src)
+		}
+		//a truncated packet decodes only the filters it holds whole
+		if bytes.HasPrefix(body, src) {
+			for i, topic := range p.Topics {
+				if topic != sp.Topics[i] || p.Qoss[i] != sp.Qoss[i] {
+					t.Fatalf("filter %d decoded as %q/%d from %x", i, topic, p.Qoss[i], src)
+				}
+			}
+		}
+	})
+}
+
+func TestNormalizeTopic(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		err    error
+	}{
+		// empty levels are significant and kept as they are
+		{"sport/tennis/", nil},
+		{"sport/tennis", nil},
+		{"//a", nil},
+		{"/", nil},
+		{"sport/+/player1", nil},
+		{"+", nil},
+		{"#", nil},
+		{"sport/#", nil},
+		{"", ErrInvalidTopicEmptyString},
+		{"sport/#/player1", ErrInvalidTopicMultilevel},
+		{"sport#", ErrInvalidTopicMultilevel},
+		{"sport/tennis#", ErrInvalidTopicMultilevel},
+		{"sport+", ErrInvalidTopicSingleLevel},
+		{"sport/+tennis", ErrInvalidTopicSingleLevel},
+		{"bad\x00topic", ErrInvalidTopicEncoding},
+		{"bad\xfftopic", ErrInvalidTopicEncoding},
+		// $ topics are checked like any other
+		{"$SYS/broker/#", nil},
+		{"$SYS/#/load", ErrInvalidTopicMultilevel},
+		// except for the share name of a shared subscription
+		{"$share/group/sport/tennis/", nil},
+		{"$share/group/#", nil},
+		{"$share/group//a", nil},
+		{"$share/group", ErrInvalidSharedSubscription},
+		{"$share/group/", ErrInvalidSharedSubscription},
+		{"$share//sport", ErrInvalidSharedSubscription},
+		{"$share/gr+oup/sport", ErrInvalidSharedSubscription},
+		{"$share/#/sport", ErrInvalidSharedSubscription},
+		{"$share/group/sport+", ErrInvalidTopicSingleLevel},
+	} {
+		normalized, err := NormalizeTopic(test.filter)
+		if err != test.err {
+			t.Errorf("NormalizeTopic(%q) returned error %v, should be %v", test.filter, err, test.err)
+			continue
+		}
+		if err == nil && normalized != test.filter {
+			t.Errorf("NormalizeTopic(%q) returned %q", test.filter, normalized)
+		}
+	}
+}
+
+func TestPacketBuilders(t *testing.T) {
+	roundTrip := func(cp ControlPacket, level byte) ControlPacket {
+		t.Helper()
+		var b bytes.Buffer
+		if err := cp.Write(&b); err != nil {
+			t.Fatalf("writing built packet failed: %v", err)
+		}
+		read, err := ReadPacketVersion(&b, level)
+		if err != nil {
+			t.Fatalf("reading built packet failed: %v", err)
+		}
+		return read
+	}
+
+	pub := roundTrip(NewPublish().Topic("a/b").QoS(1).Retained(true).MessageID(7).Payload([]byte("x")).Build(), 4).(*PublishPacket)
+	if string(pub.TopicName) != "a/b" || pub.Qos != 1 || !pub.Retain || pub.Dup || pub.MessageID != 7 || string(pub.Payload) != "x" {
+		t.Fatalf("publish read back as %v", pub)
+	}
+	pub = roundTrip(NewPublish().Topic("a/c").Dup(true).Properties(&Properties{MessageExpiryInterval: 30}).Build(), 5).(*PublishPacket)
+	if string(pub.TopicName) != "a/c" || !pub.Dup || pub.Properties == nil || pub.Properties.MessageExpiryInterval != 30 {
+		t.Fatalf("MQTT 5 publish read back as %v", pub)
+	}
+
+	sub := roundTrip(NewSubscribe().Filter("a/#", 1).Filter("b", 2).MessageID(9).Build(), 4).(*SubscribePacket)
+	if len(sub.Topics) != 2 || sub.Topics[0] != "a/#" || sub.Topics[1] != "b" || sub.Qoss[0] != 1 || sub.Qoss[1] != 2 || sub.MessageID != 9 {
+		t.Fatalf("subscribe read back as %v", sub)
+	}
+	sub = roundTrip(NewSubscribe().Filter("c/+", 0).MessageID(10).Properties(&Properties{SubscriptionIdentifiers: []int{4}}).Build(), 5).(*SubscribePacket)
+	if len(sub.Topics) != 1 || sub.Topics[0] != "c/+" || sub.Properties == nil || len(sub.Properties.SubscriptionIdentifiers) != 1 || sub.Properties.SubscriptionIdentifiers[0] != 4 {
+		t.Fatalf("MQTT 5 subscribe read back as %v", sub)
+	}
+
+	conn := roundTrip(NewConnect().ClientID("builder").KeepAlive(30).CleanSession(false).Credentials("user", "pass").Will("will/topic", []byte("gone"), 1, true).Build(), 4).(*ConnectPacket)
+	if conn.ProtocolName != "MQTT" || conn.ProtocolVersion != 4 || conn.ClientIdentifier != "builder" || conn.KeepaliveTimer != 30 || conn.CleanSession {
+		t.Fatalf("connect read back as %v", conn)
+	}
+	if !conn.UsernameFlag || conn.Username != "user" || !conn.PasswordFlag || string(conn.Password) != "pass" {
+		t.Fatalf("connect credentials read back as %v", conn)
+	}
+	if !conn.WillFlag || conn.WillTopic != "will/topic" || string(conn.WillMessage) != "gone" || conn.WillQos != 1 || !conn.WillRetain {
+		t.Fatalf("connect will read back as %v", conn)
+	}
+	if err := conn.Validate(); err != Accepted {
+		t.Fatalf("built connect failed validation with %d", err)
+	}
+	conn = roundTrip(NewConnect().ProtocolVersion(5).ClientID("v5").Credentials("user", "").Properties(&Properties{SessionExpiryInterval: 60}).Build(), 5).(*ConnectPacket)
+	if conn.ProtocolVersion != 5 || conn.PasswordFlag || conn.Properties == nil || conn.Properties.SessionExpiryInterval != 60 {
+		t.Fatalf("MQTT 5 connect read back as %v", conn)
+	}
+	if conn = roundTrip(NewConnect().ProtocolVersion(3).Build(), 3).(*ConnectPacket); conn.ProtocolName != "MQIsdp" || conn.ProtocolVersion != 3 {
+		t.Fatalf("MQTT 3.1 connect read back as %v", conn)
+	}
+}
+
+func TestPacketFields(t *testing.T) {
+	read := func(cp ControlPacket, level byte) map[string]interface{} {
+		t.Helper()
+		var b bytes.Buffer
+		if err := cp.Write(&b); err != nil {
+			t.Fatalf("writing packet failed: %v", err)
+		}
+		read, err := ReadPacketVersion(&b, level)
+		if err != nil {
+			t.Fatalf("reading packet failed: %v", err)
+		}
+		return read.Fields()
+	}
+	check := func(fields map[string]interface{}, want map[string]string) {
+		t.Helper()
+		for key, value := range want {
+			got, ok := fields[key]
+			if !ok {
+				t.Fatalf("field %s missing from %v", key, fields)
+			}
+			if fmt.Sprint(got) != value {
+				t.Fatalf("field %s is %v, expected %s", key, got, value)
+			}
+		}
+	}
+
+	pub := read(NewPublish().Topic("a/b").QoS(1).Retained(true).MessageID(7).Payload([]byte("hello")).Properties(&Properties{MessageExpiryInterval: 30}).Build(), 5)
+	check(pub, map[string]string{
+		"type":            "PUBLISH",
+		"dup":             "false",
+		"qos":             "1",
+		"retain":          "true",
+		"topic":           "a/b",
+		"messageID":       "7",
+		"payloadLength":   "5",
+		"remainingLength": "18",
+	})
+	if p, ok := pub["properties"].(*Properties); !ok || p.MessageExpiryInterval != 30 {
+		t.Fatalf("publish properties are %v", pub["properties"])
+	}
+
+	sub := read(NewSubscribe().Filter("a/#", 1).Filter("b", 2).MessageID(9).Build(), 4)
+	check(sub, map[string]string{
+		"type":      "SUBSCRIBE",
+		"qos":       "1",
+		"messageID": "9",
+		"topics":    "[a/# b]",
+		"qoss":      "[1 2]",
+	})
+	if _, ok := sub["properties"]; ok {
+		t.Fatalf("MQTT 3.1.1 subscribe has properties: %v", sub)
+	}
+}
@@ -16,10 +16,7 @@ func (pr *PingreqPacket) String() string {
 }
 
 func (pr *PingreqPacket) Write(w PacketWriter) error {
-	packet := pr.FixedHeader.pack()
-	_, err := packet.WriteTo(w)
-
-	return err
+	return pr.FixedHeader.writeTo(w)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
@@ -32,3 +29,9 @@ func (pr *PingreqPacket) Unpack(src []byte) {
 func (pr *PingreqPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (pr *PingreqPacket) Fields() map[string]interface{} {
+	return pr.FixedHeader.fields()
+}
@@ -16,10 +16,7 @@ func (pr *PingrespPacket) String() string {
 }
 
 func (pr *PingrespPacket) Write(w PacketWriter) error {
-	packet := pr.FixedHeader.pack()
-	_, err := packet.WriteTo(w)
-
-	return err
+	return pr.FixedHeader.writeTo(w)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
@@ -32,3 +29,9 @@ func (pr *PingrespPacket) Unpack(src []byte) {
 func (pr *PingrespPacket) Details() Details {
 	return Details{Qos: 0, MessageID: 0}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (pr *PingrespPacket) Fields() map[string]interface{} {
+	return pr.FixedHeader.fields()
+}
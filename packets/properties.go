@@ -0,0 +1,328 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+//Below are the identifiers of the MQTT 5 properties
+const (
+	PropPayloadFormatIndicator          = 0x01
+	PropMessageExpiryInterval           = 0x02
+	PropContentType                     = 0x03
+	PropResponseTopic                   = 0x08
+	PropCorrelationData                 = 0x09
+	PropSubscriptionIdentifier          = 0x0B
+	PropSessionExpiryInterval           = 0x11
+	PropAssignedClientIdentifier        = 0x12
+	PropServerKeepAlive                 = 0x13
+	PropAuthenticationMethod            = 0x15
+	PropAuthenticationData              = 0x16
+	PropRequestProblemInformation       = 0x17
+	PropWillDelayInterval               = 0x18
+	PropRequestResponseInformation      = 0x19
+	PropResponseInformation             = 0x1A
+	PropServerReference                 = 0x1C
+	PropReasonString                    = 0x1F
+	PropReceiveMaximum                  = 0x21
+	PropTopicAliasMaximum               = 0x22
+	PropTopicAlias                      = 0x23
+	PropMaximumQoS                      = 0x24
+	PropRetainAvailable                 = 0x25
+	PropUserProperty                    = 0x26
+	PropMaximumPacketSize               = 0x27
+	PropWildcardSubscriptionAvailable   = 0x28
+	PropSubscriptionIdentifierAvailable = 0x29
+	PropSharedSubscriptionAvailable     = 0x2A
+)
+
+//SessionNeverExpires is the session expiry interval which asks the broker
+//to keep a session until it is explicitly cleaned
+const SessionNeverExpires = 0xFFFFFFFF
+
+const (
+	propByte = iota + 1
+	propUint16
+	propUint32
+	propVarint
+	propString
+	propBinary
+	propStringPair
+)
+
+// propertyTypes maps each property identifier to the encoding of its
+// value, so that properties which aren't decoded can still be skipped
+var propertyTypes = map[byte]byte{
+	PropPayloadFormatIndicator:          propByte,
+	PropMessageExpiryInterval:           propUint32,
+	PropContentType:                     propString,
+	PropResponseTopic:                   propString,
+	PropCorrelationData:                 propBinary,
+	PropSubscriptionIdentifier:          propVarint,
+	PropSessionExpiryInterval:           propUint32,
+	PropAssignedClientIdentifier:        propString,
+	PropServerKeepAlive:                 propUint16,
+	PropAuthenticationMethod:            propString,
+	PropAuthenticationData:              propBinary,
+	PropRequestProblemInformation:       propByte,
+	PropWillDelayInterval:               propUint32,
+	PropRequestResponseInformation:      propByte,
+	PropResponseInformation:             propString,
+	PropServerReference:                 propString,
+	PropReasonString:                    propString,
+	PropReceiveMaximum:                  propUint16,
+	PropTopicAliasMaximum:               propUint16,
+	PropTopicAlias:                      propUint16,
+	PropMaximumQoS:                      propByte,
+	PropRetainAvailable:                 propByte,
+	PropUserProperty:                    propStringPair,
+	PropMaximumPacketSize:               propUint32,
+	PropWildcardSubscriptionAvailable:   propByte,
+	PropSubscriptionIdentifierAvailable: propByte,
+	PropSharedSubscriptionAvailable:     propByte,
+}
+
+//UserProperty is a name and value pair defined by the application,
+//the same name may appear in several user properties of a packet
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+//Properties holds the MQTT 5 properties of a packet. Properties
+//with a zero value are not encoded. The broker capabilities of a
+//CONNACK are pointers as their zero value is meaningful, they are
+//nil when the property is absent. CorrelationData is binary and is
+//kept as it was sent, it need not be UTF-8.
+type Properties struct {
+	SessionExpiryInterval           uint32
+	WillDelayInterval               uint32
+	MessageExpiryInterval           uint32
+	ResponseTopic                   string
+	CorrelationData                 []byte
+	SubscriptionIdentifiers         []int
+	ReasonString                    string
+	UserProperties                  []UserProperty
+	RequestResponseInformation      bool
+	ResponseInformation             string
+	MaximumPacketSize               uint32
+	ReceiveMaximum                  uint16
+	TopicAliasMaximum               uint16
+	TopicAlias                      uint16
+	MaximumQoS                      *byte
+	RetainAvailable                 *bool
+	WildcardSubscriptionAvailable   *bool
+	SubscriptionIdentifierAvailable *bool
+	SharedSubscriptionAvailable     *bool
+}
+
+func encodeUint32(num uint32) []byte {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, num)
+	return bytes
+}
+
+func loadUint32(src []byte) uint32 {
+	if len(src) < 4 {
+		return 0 // FIXME: error
+	}
+	return binary.BigEndian.Uint32(src)
+}
+
+// loadLength decodes a variable byte integer from the start of src,
+// returning its value and the number of bytes it occupied
+func loadLength(src []byte) (int, int) {
+	var length uint32
+	var multiplier uint32
+	for i := 0; i < len(src) && i < 4; i++ {
+		length |= uint32(src[i]&127) << multiplier
+		if src[i]&128 == 0 {
+			return int(length), i + 1
+		}
+		multiplier += 7
+	}
+	return 0, len(src) // FIXME: error
+}
+
+// pack encodes the properties prefixed by their length. A nil
+// Properties encodes as an empty property list.
+func (p *Properties) pack() []byte {
+	var b bytes.Buffer
+	p.packTo(&b)
+	return b.Bytes()
+}
+
+// packTo appends the encoding made by pack to w
+func (p *Properties) packTo(w *bytes.Buffer) {
+	body := getBuffer()
+	defer putBuffer(body)
+	if p != nil {
+		if p.SessionExpiryInterval != 0 {
+			body.WriteByte(PropSessionExpiryInterval)
+			body.Write(encodeUint32(p.SessionExpiryInterval))
+		}
+		if p.WillDelayInterval != 0 {
+			body.WriteByte(PropWillDelayInterval)
+			body.Write(encodeUint32(p.WillDelayInterval))
+		}
+		if p.MessageExpiryInterval != 0 {
+			body.WriteByte(PropMessageExpiryInterval)
+			body.Write(encodeUint32(p.MessageExpiryInterval))
+		}
+		if p.ResponseTopic != "" {
+			body.WriteByte(PropResponseTopic)
+			body.Write(encodeString(p.ResponseTopic))
+		}
+		if len(p.CorrelationData) > 0 {
+			body.WriteByte(PropCorrelationData)
+			body.Write(encodeBytes(p.CorrelationData))
+		}
+		for _, id := range p.SubscriptionIdentifiers {
+			body.WriteByte(PropSubscriptionIdentifier)
+			body.Write(encodeLength(id))
+		}
+		if p.MaximumPacketSize != 0 {
+			body.WriteByte(PropMaximumPacketSize)
+			body.Write(encodeUint32(p.MaximumPacketSize))
+		}
+		if p.ReceiveMaximum != 0 {
+			body.WriteByte(PropReceiveMaximum)
+			body.Write(encodeUint16(p.ReceiveMaximum))
+		}
+		if p.TopicAliasMaximum != 0 {
+			body.WriteByte(PropTopicAliasMaximum)
+			body.Write(encodeUint16(p.TopicAliasMaximum))
+		}
+		if p.TopicAlias != 0 {
+			body.WriteByte(PropTopicAlias)
+			body.Write(encodeUint16(p.TopicAlias))
+		}
+		if p.MaximumQoS != nil {
+			body.WriteByte(PropMaximumQoS)
+			body.WriteByte(*p.MaximumQoS)
+		}
+		packAvailable(body, PropRetainAvailable, p.RetainAvailable)
+		packAvailable(body, PropWildcardSubscriptionAvailable, p.WildcardSubscriptionAvailable)
+		packAvailable(body, PropSubscriptionIdentifierAvailable, p.SubscriptionIdentifierAvailable)
+		packAvailable(body, PropSharedSubscriptionAvailable, p.SharedSubscriptionAvailable)
+		if p.RequestResponseInformation {
+			body.WriteByte(PropRequestResponseInformation)
+			body.WriteByte(1)
+		}
+		if p.ResponseInformation != "" {
+			body.WriteByte(PropResponseInformation)
+			body.Write(encodeString(p.ResponseInformation))
+		}
+		if p.ReasonString != "" {
+			body.WriteByte(PropReasonString)
+			body.Write(encodeString(p.ReasonString))
+		}
+		for _, up := range p.UserProperties {
+			body.WriteByte(PropUserProperty)
+			body.Write(encodeString(up.Key))
+			body.Write(encodeString(up.Value))
+		}
+	}
+	writeLength(w, body.Len())
+	w.Write(body.Bytes())
+}
+
+// packAvailable encodes one of the broker capability flags if it is set
+func packAvailable(body *bytes.Buffer, id byte, available *bool) {
+	if available != nil {
+		body.WriteByte(id)
+		body.WriteByte(boolToByte(*available))
+	}
+}
+
+func loadAvailable(value []byte) *bool {
+	available := value[0] != 0
+	return &available
+}
+
+// unpack decodes a length-prefixed property list from the start of
+// src and returns the number of bytes consumed
+func (p *Properties) unpack(src []byte) int {
+	length, n := loadLength(src)
+	end := n + length
+	if end > len(src) {
+		end = len(src) // FIXME: error
+	}
+	props := src[n:end]
+	for len(props) > 0 {
+		id := props[0]
+		props = props[1:]
+		var size int
+		switch propertyTypes[id] {
+		case propByte:
+			size = 1
+		case propUint16:
+			size = 2
+		case propUint32:
+			size = 4
+		case propVarint:
+			_, size = loadLength(props)
+		case propString, propBinary:
+			size = int(loadUint16(props)) + 2
+		case propStringPair:
+			size = int(loadUint16(props)) + 2
+			if size < len(props) {
+				size += int(loadUint16(props[size:])) + 2
+			}
+		default:
+			return end // FIXME: error, unknown property
+		}
+		if size > len(props) {
+			return end // FIXME: error
+		}
+		value := props[:size]
+		switch id {
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval = loadUint32(value)
+		case PropWillDelayInterval:
+			p.WillDelayInterval = loadUint32(value)
+		case PropMessageExpiryInterval:
+			p.MessageExpiryInterval = loadUint32(value)
+		case PropResponseTopic:
+			p.ResponseTopic, _ = loadString(value)
+		case PropCorrelationData:
+			// src may be a pooled buffer
+			data, _ := loadBytes(value)
+			p.CorrelationData = append([]byte(nil), data...)
+		case PropSubscriptionIdentifier:
+			subID, _ := loadLength(value)
+			p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, subID)
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize = loadUint32(value)
+		case PropReceiveMaximum:
+			p.ReceiveMaximum = loadUint16(value)
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum = loadUint16(value)
+		case PropTopicAlias:
+			p.TopicAlias = loadUint16(value)
+		case PropMaximumQoS:
+			qos := value[0]
+			p.MaximumQoS = &qos
+		case PropRetainAvailable:
+			p.RetainAvailable = loadAvailable(value)
+		case PropWildcardSubscriptionAvailable:
+			p.WildcardSubscriptionAvailable = loadAvailable(value)
+		case PropSubscriptionIdentifierAvailable:
+			p.SubscriptionIdentifierAvailable = loadAvailable(value)
+		case PropSharedSubscriptionAvailable:
+			p.SharedSubscriptionAvailable = loadAvailable(value)
+		case PropRequestResponseInformation:
+			p.RequestResponseInformation = value[0] != 0
+		case PropResponseInformation:
+			p.ResponseInformation, _ = loadString(value)
+		case PropReasonString:
+			p.ReasonString, _ = loadString(value)
+		case PropUserProperty:
+			key, end := loadString(value)
+			val, _ := loadString(value[end:])
+			p.UserProperties = append(p.UserProperties, UserProperty{Key: key, Value: val})
+		}
+		props = props[size:]
+	}
+	return end
+}
@@ -8,7 +8,9 @@ import (
 //Puback MQTT packet
 type PubackPacket struct {
 	*FixedHeader
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pa *PubackPacket) String() string {
@@ -18,19 +20,13 @@ func (pa *PubackPacket) String() string {
 }
 
 func (pa *PubackPacket) Write(w PacketWriter) error {
-	var err error
-	pa.FixedHeader.RemainingLength = 2
-	packet := pa.FixedHeader.pack()
-	packet.Write(encodeUint16(pa.MessageID))
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writeAck(pa.FixedHeader, w, pa.MessageID, pa.ReasonCode, pa.Properties)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (pa *PubackPacket) Unpack(src []byte) {
-	pa.MessageID = loadUint16(src)
+	pa.MessageID, pa.ReasonCode, pa.Properties = unpackAck(pa.ProtocolLevel, src)
 }
 
 //Details returns a Details struct containing the Qos and
@@ -38,3 +34,9 @@ func (pa *PubackPacket) Unpack(src []byte) {
 func (pa *PubackPacket) Details() Details {
 	return Details{Qos: pa.Qos, MessageID: pa.MessageID}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (pa *PubackPacket) Fields() map[string]interface{} {
+	return ackFields(pa.FixedHeader, pa.MessageID, pa.ReasonCode, pa.Properties)
+}
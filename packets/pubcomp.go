@@ -8,7 +8,9 @@ import (
 //Pubcomp MQTT packet
 type PubcompPacket struct {
 	*FixedHeader
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pc *PubcompPacket) String() string {
@@ -18,19 +20,13 @@ func (pc *PubcompPacket) String() string {
 }
 
 func (pc *PubcompPacket) Write(w PacketWriter) error {
-	var err error
-	pc.FixedHeader.RemainingLength = 2
-	packet := pc.FixedHeader.pack()
-	packet.Write(encodeUint16(pc.MessageID))
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writeAck(pc.FixedHeader, w, pc.MessageID, pc.ReasonCode, pc.Properties)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (pc *PubcompPacket) Unpack(src []byte) {
-	pc.MessageID = loadUint16(src)
+	pc.MessageID, pc.ReasonCode, pc.Properties = unpackAck(pc.ProtocolLevel, src)
 }
 
 //Details returns a Details struct containing the Qos and
@@ -38,3 +34,9 @@ func (pc *PubcompPacket) Unpack(src []byte) {
 func (pc *PubcompPacket) Details() Details {
 	return Details{Qos: pc.Qos, MessageID: pc.MessageID}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (pc *PubcompPacket) Fields() map[string]interface{} {
+	return ackFields(pc.FixedHeader, pc.MessageID, pc.ReasonCode, pc.Properties)
+}
@@ -2,6 +2,7 @@ package packets
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	// "log"
 )
@@ -10,9 +11,10 @@ import (
 //Publish MQTT packet
 type PublishPacket struct {
 	*FixedHeader
-	TopicName []byte
-	MessageID uint16
-	Payload   []byte
+	TopicName  []byte
+	MessageID  uint16
+	Properties *Properties
+	Payload    []byte
 }
 
 func (p *PublishPacket) String() string {
@@ -23,22 +25,67 @@ func (p *PublishPacket) String() string {
 }
 
 func (p *PublishPacket) Write(w PacketWriter) error {
-	var body bytes.Buffer
-	var err error
+	return p.EncodeTo(w)
+}
 
-	body.Write(p.encodeBytes(p.TopicName))
+//EncodeTo writes the packet to w field by field, without assembling it
+//in an intermediate buffer first. The output is the same as Write, but w
+//should be buffered (as a bufio.Writer is) to avoid many small writes.
+func (p *PublishPacket) EncodeTo(w PacketWriter) error {
+	props := getBuffer()
+	defer putBuffer(props)
+	if p.ProtocolLevel == 5 {
+		p.Properties.packTo(props)
+	}
+	p.FixedHeader.RemainingLength = 2 + len(p.TopicName) + props.Len() + len(p.Payload)
 	if p.Qos > 0 {
-		body.Write(encodeUint16(p.MessageID))
+		p.FixedHeader.RemainingLength += 2
 	}
-	p.FixedHeader.RemainingLength = body.Len() + len(p.Payload)
-	packet := p.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	packet.Write(p.Payload)
-	_, err = w.Write(packet.Bytes())
-
+	if err := p.FixedHeader.writeTo(w); err != nil {
+		return err
+	}
+	if err := writeUint16(w, uint16(len(p.TopicName))); err != nil {
+		return err
+	}
+	if _, err := w.Write(p.TopicName); err != nil {
+		return err
+	}
+	if p.Qos > 0 {
+		if err := writeUint16(w, p.MessageID); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(props.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(p.Payload)
 	return err
 }
 
+//Size returns the number of bytes Write writes for the packet
+func (p *PublishPacket) Size() int {
+	length := 2 + len(p.TopicName) + len(p.Payload)
+	if p.Qos > 0 {
+		length += 2
+	}
+	if p.ProtocolLevel == 5 {
+		props := getBuffer()
+		p.Properties.packTo(props)
+		length += props.Len()
+		putBuffer(props)
+	}
+	return 1 + len(encodeLength(length)) + length
+}
+
+//Marshal returns the complete wire encoding of the packet. The result
+//can be kept and sent repeatedly using NewEncodedPublishPacket, saving
+//the cost of encoding an unchanging message each time.
+func (p *PublishPacket) Marshal() ([]byte, error) {
+	var b bytes.Buffer
+	err := p.Write(&b)
+	return b.Bytes(), err
+}
+
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (p *PublishPacket) Unpack(src []byte) {
@@ -49,17 +96,23 @@ func (p *PublishPacket) Unpack(src []byte) {
 		p.MessageID = loadUint16(src)
 		src = src[2:]
 	}
+	p.Properties = nil
+	if p.ProtocolLevel == 5 {
+		p.Properties = &Properties{}
+		src = src[p.Properties.unpack(src):]
+	}
 	p.Payload = src
 }
 
 //Copy creates a new PublishPacket with the same topic and payload
 //but an empty fixed header, useful for when you want to deliver
 //a message with different properties such as Qos but the same
-//content
+//content. The topic and payload are copied into newly allocated
+//slices, so the copy remains valid after the original is released.
 func (p *PublishPacket) Copy() *PublishPacket {
 	newP := NewControlPacket(Publish).(*PublishPacket)
-	newP.TopicName = p.TopicName
-	newP.Payload = p.Payload
+	newP.TopicName = append([]byte(nil), p.TopicName...)
+	newP.Payload = append([]byte(nil), p.Payload...)
 
 	return newP
 }
@@ -69,3 +122,108 @@ func (p *PublishPacket) Copy() *PublishPacket {
 func (p *PublishPacket) Details() Details {
 	return Details{Qos: p.Qos, MessageID: p.MessageID}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (p *PublishPacket) Fields() map[string]interface{} {
+	f := p.FixedHeader.fields()
+	f["topic"] = string(p.TopicName)
+	if p.Qos > 0 {
+		f["messageID"] = p.MessageID
+	}
+	f["payloadLength"] = len(p.Payload)
+	addPropertiesField(f, "properties", p.Properties)
+	return f
+}
+
+//EncodedPublishPacket is a PUBLISH packet held in the wire encoding
+//produced by PublishPacket.Marshal. When it is written the encoding is
+//sent unchanged, except that the DUP flag is taken from the FixedHeader
+//and for QoS 1 and 2 MessageID is put in place of the one that was encoded.
+type EncodedPublishPacket struct {
+	*FixedHeader
+	MessageID uint16
+	encoded   []byte
+	idOffset  int
+}
+
+//NewEncodedPublishPacket checks that b holds a single complete PUBLISH
+//packet and returns an EncodedPublishPacket for it. b is not copied and
+//must not be modified while the packet is in use, but it is never
+//written to so it may be shared between packets.
+func NewEncodedPublishPacket(b []byte) (*EncodedPublishPacket, error) {
+	if len(b) < 2 || b[0]>>4 != Publish {
+		return nil, errors.New("Not a PUBLISH packet")
+	}
+	fh := &FixedHeader{
+		MessageType: Publish,
+		Dup:         (b[0]>>3)&0x01 > 0,
+		Qos:         (b[0] >> 1) & 0x03,
+		Retain:      b[0]&0x01 > 0,
+	}
+	if fh.Qos > 2 {
+		return nil, errors.New("Invalid QoS in PUBLISH packet")
+	}
+	length, n := loadLength(b[1:])
+	header := 1 + n
+	if header+length != len(b) || length < 2 {
+		return nil, errors.New("Incomplete PUBLISH packet")
+	}
+	fh.RemainingLength = length
+	p := &EncodedPublishPacket{FixedHeader: fh, encoded: b}
+	p.idOffset = header + 2 + int(loadUint16(b[header:]))
+	if fh.Qos > 0 && p.idOffset+2 > len(b) {
+		return nil, errors.New("Incomplete PUBLISH packet")
+	}
+	return p, nil
+}
+
+func (p *EncodedPublishPacket) String() string {
+	str := fmt.Sprintf("%s\n", p.FixedHeader)
+	str += fmt.Sprintf("encoded: %d bytes MessageID: %d\n", len(p.encoded), p.MessageID)
+	return str
+}
+
+func (p *EncodedPublishPacket) Write(w PacketWriter) error {
+	if err := w.WriteByte(p.encoded[0]&^0x08 | boolToByte(p.Dup)<<3); err != nil {
+		return err
+	}
+	if p.Qos == 0 {
+		_, err := w.Write(p.encoded[1:])
+		return err
+	}
+	if _, err := w.Write(p.encoded[1:p.idOffset]); err != nil {
+		return err
+	}
+	if _, err := w.Write(encodeUint16(p.MessageID)); err != nil {
+		return err
+	}
+	_, err := w.Write(p.encoded[p.idOffset+2:])
+	return err
+}
+
+//Size returns the number of bytes Write writes for the packet
+func (p *EncodedPublishPacket) Size() int {
+	return len(p.encoded)
+}
+
+//Unpack does nothing, an EncodedPublishPacket is never read from
+//the network
+func (p *EncodedPublishPacket) Unpack(src []byte) {}
+
+//Details returns a Details struct containing the Qos and
+//MessageID of this ControlPacket
+func (p *EncodedPublishPacket) Details() Details {
+	return Details{Qos: p.Qos, MessageID: p.MessageID}
+}
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (p *EncodedPublishPacket) Fields() map[string]interface{} {
+	f := p.FixedHeader.fields()
+	if p.Qos > 0 {
+		f["messageID"] = p.MessageID
+	}
+	f["encodedLength"] = len(p.encoded)
+	return f
+}
@@ -8,7 +8,9 @@ import (
 //Pubrec MQTT packet
 type PubrecPacket struct {
 	*FixedHeader
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pr *PubrecPacket) String() string {
@@ -18,19 +20,13 @@ func (pr *PubrecPacket) String() string {
 }
 
 func (pr *PubrecPacket) Write(w PacketWriter) error {
-	var err error
-	pr.FixedHeader.RemainingLength = 2
-	packet := pr.FixedHeader.pack()
-	packet.Write(encodeUint16(pr.MessageID))
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writeAck(pr.FixedHeader, w, pr.MessageID, pr.ReasonCode, pr.Properties)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (pr *PubrecPacket) Unpack(src []byte) {
-	pr.MessageID = loadUint16(src)
+	pr.MessageID, pr.ReasonCode, pr.Properties = unpackAck(pr.ProtocolLevel, src)
 }
 
 //Details returns a Details struct containing the Qos and
@@ -38,3 +34,9 @@ func (pr *PubrecPacket) Unpack(src []byte) {
 func (pr *PubrecPacket) Details() Details {
 	return Details{Qos: pr.Qos, MessageID: pr.MessageID}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (pr *PubrecPacket) Fields() map[string]interface{} {
+	return ackFields(pr.FixedHeader, pr.MessageID, pr.ReasonCode, pr.Properties)
+}
@@ -8,7 +8,9 @@ import (
 //Pubrel MQTT packet
 type PubrelPacket struct {
 	*FixedHeader
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode byte
+	Properties *Properties
 }
 
 func (pr *PubrelPacket) String() string {
@@ -18,19 +20,13 @@ func (pr *PubrelPacket) String() string {
 }
 
 func (pr *PubrelPacket) Write(w PacketWriter) error {
-	var err error
-	pr.FixedHeader.RemainingLength = 2
-	packet := pr.FixedHeader.pack()
-	packet.Write(encodeUint16(pr.MessageID))
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writeAck(pr.FixedHeader, w, pr.MessageID, pr.ReasonCode, pr.Properties)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (pr *PubrelPacket) Unpack(src []byte) {
-	pr.MessageID = loadUint16(src)
+	pr.MessageID, pr.ReasonCode, pr.Properties = unpackAck(pr.ProtocolLevel, src)
 }
 
 //Details returns a Details struct containing the Qos and
@@ -38,3 +34,9 @@ func (pr *PubrelPacket) Unpack(src []byte) {
 func (pr *PubrelPacket) Details() Details {
 	return Details{Qos: pr.Qos, MessageID: pr.MessageID}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (pr *PubrelPacket) Fields() map[string]interface{} {
+	return ackFields(pr.FixedHeader, pr.MessageID, pr.ReasonCode, pr.Properties)
+}
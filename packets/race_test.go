@@ -0,0 +1,7 @@
+//go:build race
+
+package packets
+
+//raceEnabled is set when testing with the race detector, under which
+//sync.Pool drops objects at random
+const raceEnabled = true
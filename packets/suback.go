@@ -1,7 +1,6 @@
 package packets
 
 import (
-	"bytes"
 	"fmt"
 )
 
@@ -10,6 +9,7 @@ import (
 type SubackPacket struct {
 	*FixedHeader
 	MessageID   uint16
+	Properties  *Properties
 	GrantedQoss []byte
 }
 
@@ -20,27 +20,31 @@ func (sa *SubackPacket) String() string {
 }
 
 func (sa *SubackPacket) Write(w PacketWriter) error {
-	var body bytes.Buffer
-	var err error
+	body := getBuffer()
+	defer putBuffer(body)
 	body.Write(encodeUint16(sa.MessageID))
+	if sa.ProtocolLevel == 5 {
+		sa.Properties.packTo(body)
+	}
 	body.Write(sa.GrantedQoss)
-	sa.FixedHeader.RemainingLength = body.Len()
-	packet := sa.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writePacket(sa.FixedHeader, body, w)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (sa *SubackPacket) Unpack(src []byte) {
 	sa.MessageID = loadUint16(src)
+	sa.Properties = nil
 	if len(src) < 2 {
 		sa.GrantedQoss = make([]byte, 0) // FIXME: error
-	} else {
-		sa.GrantedQoss = src[2:]
+		return
+	}
+	src = src[2:]
+	if sa.ProtocolLevel == 5 {
+		sa.Properties = &Properties{}
+		src = src[sa.Properties.unpack(src):]
 	}
+	sa.GrantedQoss = src
 }
 
 //Details returns a Details struct containing the Qos and
@@ -48,3 +52,13 @@ func (sa *SubackPacket) Unpack(src []byte) {
 func (sa *SubackPacket) Details() Details {
 	return Details{Qos: 0, MessageID: sa.MessageID}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (sa *SubackPacket) Fields() map[string]interface{} {
+	f := sa.FixedHeader.fields()
+	f["messageID"] = sa.MessageID
+	f["grantedQoss"] = sa.GrantedQoss
+	addPropertiesField(f, "properties", sa.Properties)
+	return f
+}
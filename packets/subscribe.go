@@ -1,17 +1,26 @@
 package packets
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 )
 
+//ErrNoTopics is returned by SubscribePacket.Validate when the packet
+//has no topic filters, which the MQTT spec doesn't allow
+var ErrNoTopics = errors.New("SUBSCRIBE must contain at least one topic filter")
+
+//ErrTopicsQossMismatch is returned by SubscribePacket.Validate when
+//there isn't exactly one QoS for each topic filter
+var ErrTopicsQossMismatch = errors.New("SUBSCRIBE must have a QoS for each topic filter")
+
 //SubscribePacket is an internal representation of the fields of the
 //Subscribe MQTT packet
 type SubscribePacket struct {
 	*FixedHeader
-	MessageID uint16
-	Topics    []string
-	Qoss      []byte
+	MessageID  uint16
+	Properties *Properties
+	Topics     []string
+	Qoss       []byte
 }
 
 func (s *SubscribePacket) String() string {
@@ -21,20 +30,23 @@ func (s *SubscribePacket) String() string {
 }
 
 func (s *SubscribePacket) Write(w PacketWriter) error {
-	var body bytes.Buffer
+	body := getBuffer()
+	defer putBuffer(body)
 	var err error
 
+	if err = s.Validate(); err != nil {
+		return err
+	}
+
 	body.Write(encodeUint16(s.MessageID))
+	if s.ProtocolLevel == 5 {
+		s.Properties.packTo(body)
+	}
 	for i, topic := range s.Topics {
 		body.Write(encodeString(topic))
 		body.WriteByte(s.Qoss[i])
 	}
-	s.FixedHeader.RemainingLength = body.Len()
-	packet := s.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writePacket(s.FixedHeader, body, w)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
@@ -45,21 +57,51 @@ func (s *SubscribePacket) Unpack(src []byte) {
 		return // FIXME: error
 	}
 	src = src[2:]
-	for len(src) > 2 {
-		topic, end := loadString(src)
-		src = src[end:]
-		if len(src) < 1 {
-			break // FIXME: error
+	s.Properties = nil
+	if s.ProtocolLevel == 5 {
+		s.Properties = &Properties{}
+		src = src[s.Properties.unpack(src):]
+	}
+	//the packet may be a pooled one holding the filters of an earlier packet
+	s.Topics, s.Qoss = nil, nil
+	for len(src) > 0 {
+		//each filter is a length prefixed string followed by its options byte
+		end := 2 + int(loadUint16(src))
+		if end >= len(src) {
+			break // FIXME: error, truncated topic filter
 		}
+		topic, _ := loadString(src[:end])
 		s.Topics = append(s.Topics, topic)
-		qos := loadByte(src)
-		src = src[1:]
-		s.Qoss = append(s.Qoss, qos)
+		s.Qoss = append(s.Qoss, src[end])
+		src = src[end+1:]
 	}
 }
 
+//Validate checks that the packet has at least one topic filter and
+//a QoS for each of them
+func (s *SubscribePacket) Validate() error {
+	if len(s.Topics) == 0 {
+		return ErrNoTopics
+	}
+	if len(s.Topics) != len(s.Qoss) {
+		return ErrTopicsQossMismatch
+	}
+	return nil
+}
+
 //Details returns a Details struct containing the Qos and
 //MessageID of this ControlPacket
 func (s *SubscribePacket) Details() Details {
 	return Details{Qos: 1, MessageID: s.MessageID}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (s *SubscribePacket) Fields() map[string]interface{} {
+	f := s.FixedHeader.fields()
+	f["messageID"] = s.MessageID
+	f["topics"] = s.Topics
+	f["qoss"] = s.Qoss
+	addPropertiesField(f, "properties", s.Properties)
+	return f
+}
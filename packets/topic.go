@@ -0,0 +1,74 @@
+package packets
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+//ErrInvalidTopicEmptyString is returned by NormalizeTopic for a topic
+//filter of 0 length
+var ErrInvalidTopicEmptyString = errors.New("Invalid Topic; empty string")
+
+//ErrInvalidTopicMultilevel is returned by NormalizeTopic for a topic
+//filter with the multi level wildcard anywhere but as the whole of the
+//last level
+var ErrInvalidTopicMultilevel = errors.New("Invalid Topic; multi-level wildcard must be last level")
+
+//ErrInvalidTopicSingleLevel is returned by NormalizeTopic for a topic
+//filter with the single level wildcard as only part of a level
+var ErrInvalidTopicSingleLevel = errors.New("Invalid Topic; single-level wildcard must occupy an entire level")
+
+//ErrInvalidTopicEncoding is returned by NormalizeTopic for a topic filter
+//which is too long for a packet, isn't UTF-8 or contains a null character
+var ErrInvalidTopicEncoding = errors.New("Invalid Topic; must be UTF-8 of at most 65535 bytes without null characters")
+
+//ErrInvalidSharedSubscription is returned by NormalizeTopic for a
+//$share/ filter without a valid share name or topic filter after it
+var ErrInvalidSharedSubscription = errors.New("Invalid Topic; shared subscription must be $share/{ShareName}/{filter}")
+
+const sharePrefix = "$share/"
+
+//NormalizeTopic checks that filter is a valid topic filter and returns
+//its canonical form. MQTT treats empty levels, including those made by a
+//leading or trailing slash, as levels in their own right, so
+//"sport/tennis/" and "sport/tennis" are different filters and neither is
+//rewritten: the canonical form of a valid filter is the filter itself.
+//Filters starting with $ are topics reserved by the broker, such as
+//$SYS/#, and are checked like any other, except for shared subscriptions
+//of the form $share/{ShareName}/{filter} where the share name must be a
+//single level without wildcards.
+func NormalizeTopic(filter string) (string, error) {
+	if len(filter) > 65535 || !utf8.ValidString(filter) || strings.IndexByte(filter, 0) >= 0 {
+		return "", ErrInvalidTopicEncoding
+	}
+	rest := filter
+	if strings.HasPrefix(filter, sharePrefix) {
+		i := strings.IndexByte(filter[len(sharePrefix):], '/')
+		if i <= 0 {
+			return "", ErrInvalidSharedSubscription
+		}
+		if strings.ContainsAny(filter[len(sharePrefix):len(sharePrefix)+i], "+#") {
+			return "", ErrInvalidSharedSubscription
+		}
+		rest = filter[len(sharePrefix)+i+1:]
+	}
+	if len(rest) == 0 {
+		if rest != filter {
+			return "", ErrInvalidSharedSubscription
+		}
+		return "", ErrInvalidTopicEmptyString
+	}
+	levels := strings.Split(rest, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return "", ErrInvalidTopicMultilevel
+		case level != "#" && strings.IndexByte(level, '#') >= 0:
+			return "", ErrInvalidTopicMultilevel
+		case level != "+" && strings.IndexByte(level, '+') >= 0:
+			return "", ErrInvalidTopicSingleLevel
+		}
+	}
+	return filter, nil
+}
@@ -5,10 +5,13 @@ import (
 )
 
 //UnsubackPacket is an internal representation of the fields of the
-//Unsuback MQTT packet
+//Unsuback MQTT packet. ReasonCodes and Properties are only present in
+//MQTT 5, with a reason code for each topic of the UNSUBSCRIBE in order.
 type UnsubackPacket struct {
 	*FixedHeader
-	MessageID uint16
+	MessageID   uint16
+	Properties  *Properties
+	ReasonCodes []byte
 }
 
 func (ua *UnsubackPacket) String() string {
@@ -18,19 +21,34 @@ func (ua *UnsubackPacket) String() string {
 }
 
 func (ua *UnsubackPacket) Write(w PacketWriter) error {
-	var err error
+	if ua.ProtocolLevel == 5 {
+		body := getBuffer()
+		defer putBuffer(body)
+		body.Write(encodeUint16(ua.MessageID))
+		ua.Properties.packTo(body)
+		body.Write(ua.ReasonCodes)
+		return writePacket(ua.FixedHeader, body, w)
+	}
 	ua.FixedHeader.RemainingLength = 2
-	packet := ua.FixedHeader.pack()
-	packet.Write(encodeUint16(ua.MessageID))
-	_, err = packet.WriteTo(w)
-
-	return err
+	if err := ua.FixedHeader.writeTo(w); err != nil {
+		return err
+	}
+	return writeUint16(w, ua.MessageID)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (ua *UnsubackPacket) Unpack(src []byte) {
 	ua.MessageID = loadUint16(src)
+	ua.Properties = nil
+	ua.ReasonCodes = nil
+	if ua.ProtocolLevel != 5 || len(src) < 2 {
+		return
+	}
+	src = src[2:]
+	ua.Properties = &Properties{}
+	src = src[ua.Properties.unpack(src):]
+	ua.ReasonCodes = src
 }
 
 //Details returns a Details struct containing the Qos and
@@ -38,3 +56,15 @@ func (ua *UnsubackPacket) Unpack(src []byte) {
 func (ua *UnsubackPacket) Details() Details {
 	return Details{Qos: 0, MessageID: ua.MessageID}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (ua *UnsubackPacket) Fields() map[string]interface{} {
+	f := ua.FixedHeader.fields()
+	f["messageID"] = ua.MessageID
+	if ua.ProtocolLevel == 5 {
+		f["reasonCodes"] = ua.ReasonCodes
+	}
+	addPropertiesField(f, "properties", ua.Properties)
+	return f
+}
@@ -1,7 +1,6 @@
 package packets
 
 import (
-	"bytes"
 	"fmt"
 )
 
@@ -9,8 +8,9 @@ import (
 //Unsubscribe MQTT packet
 type UnsubscribePacket struct {
 	*FixedHeader
-	MessageID uint16
-	Topics    []string
+	MessageID  uint16
+	Properties *Properties
+	Topics     []string
 }
 
 func (u *UnsubscribePacket) String() string {
@@ -20,27 +20,34 @@ func (u *UnsubscribePacket) String() string {
 }
 
 func (u *UnsubscribePacket) Write(w PacketWriter) error {
-	var body bytes.Buffer
-	var err error
+	body := getBuffer()
+	defer putBuffer(body)
 	body.Write(encodeUint16(u.MessageID))
+	if u.ProtocolLevel == 5 {
+		u.Properties.packTo(body)
+	}
 	for _, topic := range u.Topics {
 		body.Write(encodeString(topic))
 	}
-	u.FixedHeader.RemainingLength = body.Len()
-	packet := u.FixedHeader.pack()
-	packet.Write(body.Bytes())
-	_, err = packet.WriteTo(w)
-
-	return err
+	return writePacket(u.FixedHeader, body, w)
 }
 
 //Unpack decodes the details of a ControlPacket after the fixed
 //header has been read
 func (u *UnsubscribePacket) Unpack(src []byte) {
 	u.MessageID = loadUint16(src)
-	var topic string
-	var end int
-	for topic, end = loadString(src); topic != ""; topic, end = loadString(src) {
+	if len(src) < 2 {
+		return // FIXME: error
+	}
+	src = src[2:]
+	u.Properties = nil
+	if u.ProtocolLevel == 5 {
+		u.Properties = &Properties{}
+		src = src[u.Properties.unpack(src):]
+	}
+	u.Topics = nil
+	for len(src) >= 2 {
+		topic, end := loadString(src)
 		u.Topics = append(u.Topics, topic)
 		src = src[end:]
 	}
@@ -51,3 +58,13 @@ func (u *UnsubscribePacket) Unpack(src []byte) {
 func (u *UnsubscribePacket) Details() Details {
 	return Details{Qos: 1, MessageID: u.MessageID}
 }
+
+//Fields returns the decoded content of the packet by field name, see
+//ControlPacket
+func (u *UnsubscribePacket) Fields() map[string]interface{} {
+	f := u.FixedHeader.fields()
+	f["messageID"] = u.MessageID
+	f["topics"] = u.Topics
+	addPropertiesField(f, "properties", u.Properties)
+	return f
+}
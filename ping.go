@@ -16,22 +16,25 @@ package mqtt
 
 import (
 	"bufio"
+	"context"
 	"errors"
+	"sync/atomic"
 	"time"
 
 	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
+	"golang.org/x/net/websocket"
 )
 
 func keepalive(c *Client) {
 	pingTimer := time.NewTimer(c.options.KeepAlive)
 	pingRespTimer := time.NewTimer(time.Duration(10) * time.Second)
 	pingRespTimer.Stop()
-	DEBUG.Println(PNG, "keepalive starting")
+	c.debug(PNG, "keepalive starting")
 
 	for {
 		select {
 		case <-c.stop:
-			DEBUG.Println(PNG, "keepalive stopped")
+			c.debug(PNG, "keepalive stopped")
 			pingTimer.Stop()
 			pingRespTimer.Stop()
 			c.workers.Done()
@@ -42,16 +45,17 @@ func keepalive(c *Client) {
 		case <-c.resetPing:
 			pingTimer.Reset(c.options.PingTimeout)
 		case <-pingTimer.C:
-			DEBUG.Println(PNG, "keepalive sending ping")
-			ping := packets.NewControlPacket(packets.Pingreq).(*packets.PingreqPacket)
-			//We don't want to wait behind large messages being sent, the Write call
-			//will block until it it able to send the packet.
-			w := bufio.NewWriter(c.conn)
-			ping.Write(w)
-			w.Flush()
+			c.debug(PNG, "keepalive sending ping")
+			if !sendKeepalivePing(c) {
+				c.debug(PNG, "keepalive stopped")
+				pingTimer.Stop()
+				pingRespTimer.Stop()
+				c.workers.Done()
+				return
+			}
 			pingRespTimer.Reset(c.options.PingTimeout)
 		case <-pingRespTimer.C:
-			CRITICAL.Println(PNG, "pingresp not received, disconnecting")
+			c.critical(PNG, "pingresp not received, disconnecting")
 			pingTimer.Stop()
 			c.workers.Done()
 			c.internalConnLost(errors.New("pingresp not received, disconnecting"))
@@ -59,3 +63,192 @@ func keepalive(c *Client) {
 		}
 	}
 }
+
+// sendKeepalivePing writes a PINGREQ straight to the connection, so that it
+// doesn't wait behind publishes queued for outgoing, which may be held up by
+// a PublishRateLimiter. With LowLatencyControlPackets the ping is queued for
+// outgoing instead, so that it is written with TCP_NODELAY like other control
+// packets. It returns false if the client stops first.
+func sendKeepalivePing(c *Client) bool {
+	if c.options.LowLatencyControlPackets {
+		return queueKeepalivePing(c)
+	}
+	ping := packets.NewControlPacket(packets.Pingreq).(*packets.PingreqPacket)
+	//We don't want to wait behind large messages being sent, the Write call
+	//will block until it it able to send the packet.
+	w := bufio.NewWriter(c.conn)
+	c.pingsLock.Lock()
+	c.pings = append(c.pings, nil)
+	ping.Write(w)
+	w.Flush()
+	c.pingsLock.Unlock()
+	return true
+}
+
+// queueKeepalivePing hands a PINGREQ to outgoing on the priority queue, so
+// that it doesn't wait behind large publishes and is written like any other
+// control packet. Timer resets arriving meanwhile are dropped, the timers are
+// restarted once the ping is queued, so that outgoing and alllogic don't block
+// on keepalive. It returns false if the client stops first.
+func queueKeepalivePing(c *Client) bool {
+	ping := &PacketAndToken{p: packets.NewControlPacket(packets.Pingreq)}
+	for {
+		select {
+		case c.oboundP <- ping:
+			return true
+		case <-c.resetPing:
+		case <-c.resetPingResp:
+		case <-c.stop:
+			ping.p.Release()
+			return false
+		}
+	}
+}
+
+// latencyToken tracks a PINGREQ sent by MeasureLatency
+type latencyToken struct {
+	baseToken
+	sent time.Time
+	rtt  time.Duration
+}
+
+// MeasureLatency sends a PINGREQ to the broker, ahead of any queued
+// publishes, and returns the time from writing it to the network until
+// the PINGRESP arrived. These pings don't count as keepalive pings, and
+// several measurements may be made at once. It fails with ErrNotConnected
+// if the connection is lost first, or with the context's error.
+func (c *Client) MeasureLatency(ctx context.Context) (time.Duration, error) {
+	if !c.IsConnected() {
+		return 0, ErrNotConnected
+	}
+	token := &latencyToken{baseToken: baseToken{complete: make(chan struct{})}}
+	ping := packets.NewControlPacket(packets.Pingreq)
+	select {
+	case c.oboundP <- &PacketAndToken{p: ping, t: token}:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	select {
+	case <-token.complete:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	if err := token.Error(); err != nil {
+		return 0, err
+	}
+	return token.rtt, nil
+}
+
+// pingAnswered matches a PINGRESP to the oldest unanswered PINGREQ, as the
+// broker answers them in order. It reports whether that was a keepalive ping,
+// or one nobody is waiting for.
+func (c *Client) pingAnswered() bool {
+	c.pingsLock.Lock()
+	if len(c.pings) == 0 {
+		c.pingsLock.Unlock()
+		return true
+	}
+	token := c.pings[0]
+	c.pings = c.pings[1:]
+	c.pingsLock.Unlock()
+	if token == nil {
+		return true
+	}
+	token.completeWith(func() { token.rtt = time.Since(token.sent) })
+	return false
+}
+
+// failPings ends the latency measurements waiting for a PINGRESP on a
+// connection which has gone
+func (c *Client) failPings() {
+	c.pingsLock.Lock()
+	pings := c.pings
+	c.pings = nil
+	c.pingsLock.Unlock()
+	for _, token := range pings {
+		if token != nil {
+			token.completeWith(func() { token.err = ErrNotConnected })
+		}
+	}
+}
+
+// websocketPing is a codec which sends an empty WebSocket ping frame, the
+// broker's pong is consumed by the websocket package itself.
+var websocketPing = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return nil, websocket.PingFrame, nil
+	},
+}
+
+// startWebsocketKeepalive starts sending WebSocket ping frames on the
+// current connection if it is a ws/wss connection and an interval is set.
+// This keeps proxies which only look at WebSocket traffic from closing the
+// connection, independently of the MQTT keepalive.
+func (c *Client) startWebsocketKeepalive() {
+	if c.options.WebsocketPingInterval <= 0 {
+		return
+	}
+	var ping func() error
+	switch conn := c.conn.(type) {
+	case *websocket.Conn:
+		ping = func() error { return websocketPing.Send(conn, nil) }
+	case *deflateConn:
+		ping = conn.ping
+	default:
+		return
+	}
+	go websocketKeepalive(c, ping, c.stop)
+}
+
+func websocketKeepalive(c *Client, ping func() error, stop chan struct{}) {
+	ticker := time.NewTicker(c.options.WebsocketPingInterval)
+	defer ticker.Stop()
+	c.debug(PNG, "websocket keepalive starting")
+
+	for {
+		select {
+		case <-stop:
+			c.debug(PNG, "websocket keepalive stopped")
+			return
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				// the failed write will also be noticed by the
+				// outgoing and incoming goroutines
+				c.warn(PNG, "websocket ping failed", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// startOutgoingWatchdog checks that outgoing doesn't get stuck writing to
+// the current connection, when write deadlines don't already take care of it.
+func (c *Client) startOutgoingWatchdog() {
+	if newWriteDeadline(&c.options).enabled() || c.options.OutgoingStallTimeout <= 0 {
+		return
+	}
+	go outgoingWatchdog(c, c.stop)
+}
+
+func outgoingWatchdog(c *Client, stop chan struct{}) {
+	ticker := time.NewTicker(c.options.OutgoingStallTimeout / 4)
+	defer ticker.Stop()
+	c.debug(NET, "outgoing watchdog starting")
+
+	for {
+		select {
+		case <-stop:
+			c.debug(NET, "outgoing watchdog stopped")
+			return
+		case <-ticker.C:
+			started := atomic.LoadInt64(&c.writeStarted)
+			if started == 0 || time.Since(time.Unix(0, started)) < c.options.OutgoingStallTimeout {
+				continue
+			}
+			c.error(NET, "outgoing stalled, disconnecting", "timeout", c.options.OutgoingStallTimeout)
+			// alllogic drops the connection, which unblocks the write
+			c.reportError(ErrOutgoingStalled)
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+)
+
+// PublishOnceStage names the step of PublishOnce which failed
+type PublishOnceStage int
+
+const (
+	// PublishOnceConnect is connecting to the broker
+	PublishOnceConnect PublishOnceStage = iota
+	// PublishOncePublish is sending the message, or the broker refusing it
+	PublishOncePublish
+	// PublishOnceAck is waiting for the broker to acknowledge a QoS 1 or 2 message
+	PublishOnceAck
+)
+
+func (s PublishOnceStage) String() string {
+	switch s {
+	case PublishOnceConnect:
+		return "connect"
+	case PublishOncePublish:
+		return "publish"
+	case PublishOnceAck:
+		return "ack"
+	}
+	return fmt.Sprintf("stage %d", int(s))
+}
+
+// PublishOnceError is the error returned by PublishOnce, Stage tells which step
+// failed and Err why, it is the context's error when the context was done first
+type PublishOnceError struct {
+	Stage PublishOnceStage
+	Err   error
+}
+
+func (e *PublishOnceError) Error() string {
+	return fmt.Sprintf("publish once: %s failed: %v", e.Stage, e.Err)
+}
+
+// Unwrap returns Err
+func (e *PublishOnceError) Unwrap() error {
+	return e.Err
+}
+
+// publishOnceQuiesce is how long, in milliseconds, PublishOnce waits for the
+// DISCONNECT to be written
+const publishOnceQuiesce = 250
+
+// PublishOnce connects to the broker with opts, publishes a single message,
+// waits until it has been written or, for QoS 1 and 2, acknowledged, and
+// disconnects, for short lived publishers such as cron jobs. ctx limits the
+// whole exchange. Errors are a *PublishOnceError telling whether connecting,
+// publishing or waiting for the ack failed. The client is disconnected however
+// it ends. As the client is used only once, AutoReconnect is best turned off in
+// opts, otherwise a connection lost while waiting for the ack is made again.
+func PublishOnce(ctx context.Context, opts *ClientOptions, topic string, qos byte, retained bool, payload interface{}) error {
+	c := NewClient(opts)
+	ct := c.Connect().(*ConnectToken)
+	select {
+	case <-ct.complete:
+	case <-ctx.Done():
+		// the client can only be disconnected once the attempt is over
+		go func() {
+			if ct.Wait() && ct.Error() == nil {
+				c.Disconnect(0)
+			}
+		}()
+		return &PublishOnceError{Stage: PublishOnceConnect, Err: ctx.Err()}
+	}
+	if err := ct.Error(); err != nil {
+		return &PublishOnceError{Stage: PublishOnceConnect, Err: err}
+	}
+	defer c.Disconnect(publishOnceQuiesce)
+
+	pt := c.Publish(topic, qos, retained, payload).(*PublishToken)
+	select {
+	case <-pt.complete:
+	case <-ctx.Done():
+		if pt.Qos() > 0 {
+			return &PublishOnceError{Stage: PublishOnceAck, Err: ctx.Err()}
+		}
+		return &PublishOnceError{Stage: PublishOncePublish, Err: ctx.Err()}
+	}
+	if err := pt.Error(); err != nil {
+		return &PublishOnceError{Stage: PublishOncePublish, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
+)
+
+// maxRetainedCache is the most topics the retained cache holds, the topic
+// updated longest ago is dropped to make room for a new one
+const maxRetainedCache = 10000
+
+// retainedCache holds the last retained message received on each topic,
+// when CacheRetained is set. order lists the messages from the least
+// recently updated.
+type retainedCache struct {
+	sync.Mutex
+	messages map[string]*list.Element
+	order    *list.List
+}
+
+type retainedMessage struct {
+	qos        byte
+	topic      []byte
+	payload    []byte
+	generation uint64
+}
+
+// cacheRetained records p if it is a retained message, a retained message
+// with an empty payload removes the topic from the cache
+func (c *Client) cacheRetained(p *packets.PublishPacket, generation uint64) {
+	if c == nil || !c.options.CacheRetained || !p.Retain || len(p.TopicName) == 0 {
+		return
+	}
+	c.retained.Lock()
+	defer c.retained.Unlock()
+	c.retained.remove(string(p.TopicName))
+	if len(p.Payload) == 0 {
+		return
+	}
+	if c.retained.messages == nil {
+		c.retained.messages = make(map[string]*list.Element)
+		c.retained.order = list.New()
+	}
+	if c.retained.order.Len() >= maxRetainedCache {
+		oldest := c.retained.order.Front().Value.(retainedMessage)
+		c.retained.remove(string(oldest.topic))
+	}
+	c.retained.messages[string(p.TopicName)] = c.retained.order.PushBack(retainedMessage{
+		qos:        p.Qos,
+		topic:      append([]byte(nil), p.TopicName...),
+		payload:    append([]byte(nil), p.Payload...),
+		generation: generation,
+	})
+}
+
+// remove drops topic from the cache, it is called with the lock held
+func (r *retainedCache) remove(topic string) {
+	if e, ok := r.messages[topic]; ok {
+		r.order.Remove(e)
+		delete(r.messages, topic)
+	}
+}
+
+// forgetRetained removes topic from the cache, for retained messages the
+// client clears itself
+func (c *Client) forgetRetained(topic string) {
+	if !c.options.CacheRetained {
+		return
+	}
+	c.retained.Lock()
+	defer c.retained.Unlock()
+	c.retained.remove(topic)
+}
+
+// replayRetained passes the cached retained messages matching filter to
+// callback, or the default handler if it is nil. The router passes them on
+// ahead of the next message from the broker, so they must be replayed
+// before the SUBSCRIBE is sent to arrive ahead of the broker's own retained
+// messages. Nothing here waits for the router, a handler may subscribe.
+func (c *Client) replayRetained(filter string, qos byte, callback MessageHandler) {
+	if !c.options.CacheRetained {
+		return
+	}
+	if callback == nil {
+		callback = c.options.DefaultPublishHander
+	}
+	if callback == nil {
+		return
+	}
+	var matched []retainedMessage
+	c.retained.Lock()
+	for _, e := range c.retained.messages {
+		if m := e.Value.(retainedMessage); routeIncludesTopic([]byte(filter), m.topic) {
+			matched = append(matched, m)
+		}
+	}
+	c.retained.Unlock()
+	if len(matched) == 0 {
+		return
+	}
+	replays := make([]replay, 0, len(matched))
+	for _, m := range matched {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.Qos = m.qos
+		p.Retain = true
+		p.TopicName = m.topic
+		p.Payload = m.payload
+		c.debug(CLI, "replaying cached retained message", "topic", string(m.topic))
+		replays = append(replays, replay{packet: p, generation: m.generation, callback: callback, qos: qos})
+	}
+	c.msgRouter.queueReplay(replays)
+}
+
+// retainedTimers holds a timer for each subscription whose retained
+// messages are still arriving, for OnRetainedComplete
+type retainedTimers struct {
+	sync.Mutex
+	timers map[string]*time.Timer
+}
+
+// startRetainedTimer starts waiting for the retained messages of a newly
+// acknowledged subscription to stop arriving
+func (c *Client) startRetainedTimer(filter string) {
+	handler := c.options.OnRetainedComplete
+	if handler == nil {
+		return
+	}
+	c.retainedQuiet.Lock()
+	defer c.retainedQuiet.Unlock()
+	if c.retainedQuiet.timers == nil {
+		c.retainedQuiet.timers = make(map[string]*time.Timer)
+	}
+	if t, ok := c.retainedQuiet.timers[filter]; ok {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(c.options.RetainedQuietWindow, func() {
+		c.retainedQuiet.Lock()
+		// a timer reset after it fired runs again, only the first counts
+		current := c.retainedQuiet.timers[filter] == t
+		if current {
+			delete(c.retainedQuiet.timers, filter)
+		}
+		c.retainedQuiet.Unlock()
+		if current {
+			c.debug(CLI, "retained messages complete", "filter", filter)
+			handler(filter)
+		}
+	})
+	c.retainedQuiet.timers[filter] = t
+}
+
+// retainedArrived restarts the timers of the subscriptions p matches if
+// it is a retained message
+func (c *Client) retainedArrived(p *packets.PublishPacket) {
+	if c.options.OnRetainedComplete == nil || !p.Retain {
+		return
+	}
+	c.retainedQuiet.Lock()
+	defer c.retainedQuiet.Unlock()
+	for filter, t := range c.retainedQuiet.timers {
+		if routeIncludesTopic([]byte(filter), p.TopicName) {
+			t.Reset(c.options.RetainedQuietWindow)
+		}
+	}
+}
+
+// stopRetainedTimers stops waiting for the retained messages of filters,
+// or of every subscription if filters is nil
+func (c *Client) stopRetainedTimers(filters []string) {
+	c.retainedQuiet.Lock()
+	defer c.retainedQuiet.Unlock()
+	if filters == nil {
+		for _, t := range c.retainedQuiet.timers {
+			t.Stop()
+		}
+		c.retainedQuiet.timers = nil
+		return
+	}
+	for _, filter := range filters {
+		if t, ok := c.retainedQuiet.timers[filter]; ok {
+			t.Stop()
+			delete(c.retainedQuiet.timers, filter)
+		}
+	}
+}
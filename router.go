@@ -17,6 +17,8 @@ package mqtt
 import (
 	"container/list"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
 )
@@ -25,8 +27,14 @@ import (
 // callback to be executed upon the arrival of a message associated
 // with a subscription to that topic.
 type route struct {
+	// first, as atomically accessed int64s must be 64 bit aligned
+	received   int64 // messages dispatched to the route, see router.stats
+	lastSeen   int64 // UnixNano of the last of them
 	topicBytes []byte
 	callback   MessageHandler
+	subID      int
+	grantedQos byte         // from the suback, see Message.SubscriptionQos
+	worker     *routeWorker // calls callback in turn with dispatchPerRoute, see router.workerFor
 }
 
 func routeIncludesTopic(route, topic []byte) bool {
@@ -64,34 +72,138 @@ func (r *route) match(topic string) bool {
 	return string(r.topicBytes) == topic || routeIncludesTopic(r.topicBytes, []byte(topic))
 }
 
+// is reports whether the route is for exactly filter, routes for
+// overlapping filters such as a/+ and a/b are kept apart
+func (r *route) is(filter string) bool {
+	return string(r.topicBytes) == filter
+}
+
 func (r *route) matchBytes(topic []byte) bool {
 	return routeIncludesTopic(r.topicBytes, topic)
 }
 
+// maxSubID is the largest subscription identifier allowed by MQTT 5
+const maxSubID = 268435455
+
+// incomingPublish is a received publish tagged with the generation of the
+// connection it arrived on, see Client.ConnectionGeneration
+type incomingPublish struct {
+	packet     *packets.PublishPacket
+	generation uint64
+	received   time.Time // when the message arrived, set when MaxDeliveryAge is
+}
+
+// dispatchMode decides how matchAndDispatch calls the handlers
+type dispatchMode int
+
+// Below are the ways of dispatching messages to handlers
+const (
+	// dispatchUnordered calls each handler on a goroutine of its own
+	dispatchUnordered dispatchMode = iota
+	// dispatchOrdered calls the handlers one after another, in the order
+	// the messages arrived
+	dispatchOrdered
+	// dispatchPerRoute calls the handlers of each route one after another,
+	// while the handlers of different routes run concurrently
+	dispatchPerRoute
+)
+
+// routeQueueDepth is how many messages may wait for a route's handler
+// with dispatchPerRoute before dispatching waits for it
+const routeQueueDepth = 100
+
+// routeWorker calls the handler of a route for its messages one at a time
+type routeWorker struct {
+	work    chan func()
+	quit    chan struct{} // closed by stop, so that enqueue no longer waits for room
+	lock    sync.RWMutex  // held by enqueue while it sends, see stop
+	stopped bool
+}
+
+func newRouteWorker() *routeWorker {
+	w := &routeWorker{work: make(chan func(), routeQueueDepth), quit: make(chan struct{})}
+	go func() {
+		// the messages queued before the worker was stopped are handled
+		// before it exits
+		for f := range w.work {
+			f()
+		}
+	}()
+	return w
+}
+
+// enqueue queues f, which handles m, waiting for room in the queue unless
+// the worker has stopped. In that case no handler will see m, so it is
+// acked as it would be without ManualAck.
+func (w *routeWorker) enqueue(m Message, f func()) {
+	w.lock.RLock()
+	queued := false
+	if !w.stopped {
+		select {
+		case w.work <- f:
+			queued = true
+		case <-w.quit:
+		}
+	}
+	w.lock.RUnlock()
+	if !queued {
+		if a, ok := m.(AckableMessage); ok {
+			a.Ack()
+		}
+	}
+}
+
+// stop makes the worker exit once it has handled the messages already
+// queued. It doesn't wait for them, so a handler may stop its own worker.
+func (w *routeWorker) stop() {
+	close(w.quit)
+	// enqueue returns at once now, and can't send once stopped is set
+	w.lock.Lock()
+	w.stopped = true
+	close(w.work)
+	w.lock.Unlock()
+}
+
 type router struct {
 	sync.RWMutex
 	routes         *list.List
+	subIDs         map[int]*route
+	lastSubID      int
 	defaultHandler MessageHandler
+	defaultWorker  *routeWorker
+	workersLock    sync.Mutex // guards the workers, which are started while only reading the routes
 	messages       chan *packets.PublishPacket
 	stop           chan bool
+	replayLock     sync.Mutex // guards replays
+	replays        []replay
+	replayed       chan struct{} // signalled when replays are queued
+}
+
+// replay is a cached retained message waiting to be passed to the handler
+// of the subscription that asked for it, see Client.replayRetained
+type replay struct {
+	packet     *packets.PublishPacket
+	generation uint64
+	callback   MessageHandler
+	qos        byte // the QoS of the subscription
 }
 
 // newRouter returns a new instance of a Router and channel which can be used to tell the Router
 // to stop
 func newRouter() (*router, chan bool) {
-	router := &router{routes: list.New(), messages: make(chan *packets.PublishPacket), stop: make(chan bool)}
+	router := &router{routes: list.New(), subIDs: make(map[int]*route), messages: make(chan *packets.PublishPacket), stop: make(chan bool), replayed: make(chan struct{}, 1)}
 	stop := router.stop
 	return router, stop
 }
 
 // addRoute takes a topic string and MessageHandler callback. It looks in the current list of
-// routes to see if there is already a matching Route. If there is it replaces the current
+// routes to see if there is already a Route for the same topic. If there is it replaces the current
 // callback with the new one. If not it add a new entry to the list of Routes.
 func (r *router) addRoute(topic string, callback MessageHandler) {
 	r.Lock()
 	defer r.Unlock()
 	for e := r.routes.Front(); e != nil; e = e.Next() {
-		if e.Value.(*route).match(topic) {
+		if e.Value.(*route).is(topic) {
 			r := e.Value.(*route)
 			r.callback = callback
 			return
@@ -100,62 +212,306 @@ func (r *router) addRoute(topic string, callback MessageHandler) {
 	r.routes.PushBack(&route{topicBytes: []byte(topic), callback: callback})
 }
 
-// deleteRoute takes a route string, looks for a matching Route in the list of Routes. If
+// addIdentifiedRoute is like addRoute but also assigns the route a subscription identifier,
+// which is returned. Incoming messages carrying that identifier are dispatched straight to
+// the route without matching their topic.
+func (r *router) addIdentifiedRoute(topic string, callback MessageHandler) int {
+	r.Lock()
+	defer r.Unlock()
+	var rt *route
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		if e.Value.(*route).is(topic) {
+			rt = e.Value.(*route)
+			rt.callback = callback
+			break
+		}
+	}
+	if rt == nil {
+		rt = &route{topicBytes: []byte(topic), callback: callback}
+		r.routes.PushBack(rt)
+	}
+	if rt.subID == 0 {
+		for {
+			r.lastSubID = r.lastSubID%maxSubID + 1
+			if _, ok := r.subIDs[r.lastSubID]; !ok {
+				break
+			}
+		}
+		rt.subID = r.lastSubID
+		r.subIDs[rt.subID] = rt
+	}
+	return rt.subID
+}
+
+// setGrantedQos records the QoS the broker granted for the subscription to
+// topic on its route, if there is one.
+func (r *router) setGrantedQos(topic string, qos byte) {
+	r.Lock()
+	defer r.Unlock()
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		if e.Value.(*route).is(topic) {
+			e.Value.(*route).grantedQos = qos
+			return
+		}
+	}
+}
+
+// getRoute returns the callback of the route for exactly the filter topic,
+// nil if there is none
+func (r *router) getRoute(topic string) MessageHandler {
+	r.RLock()
+	defer r.RUnlock()
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		if e.Value.(*route).is(topic) {
+			return e.Value.(*route).callback
+		}
+	}
+	return nil
+}
+
+// deleteRoute takes a route string, looks for the Route for it in the list of Routes. If
 // found it removes the Route from the list.
 func (r *router) deleteRoute(topic string) {
 	r.Lock()
 	defer r.Unlock()
 	for e := r.routes.Front(); e != nil; e = e.Next() {
-		if e.Value.(*route).match(topic) {
+		if e.Value.(*route).is(topic) {
+			delete(r.subIDs, e.Value.(*route).subID)
+			r.stopWorker(&e.Value.(*route).worker)
 			r.routes.Remove(e)
 			return
 		}
 	}
 }
 
+// workerFor returns the worker of a route, or of the default handler,
+// starting it if need be
+func (r *router) workerFor(w **routeWorker) *routeWorker {
+	r.workersLock.Lock()
+	defer r.workersLock.Unlock()
+	if *w == nil {
+		*w = newRouteWorker()
+	}
+	return *w
+}
+
+// stopWorker stops a worker started by workerFor, which still handles the
+// messages waiting for it
+func (r *router) stopWorker(w **routeWorker) {
+	r.workersLock.Lock()
+	defer r.workersLock.Unlock()
+	if *w != nil {
+		(*w).stop()
+		*w = nil
+	}
+}
+
+// stopWorkers stops the workers of every route and the default handler
+func (r *router) stopWorkers() {
+	r.RLock()
+	defer r.RUnlock()
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		r.stopWorker(&e.Value.(*route).worker)
+	}
+	r.stopWorker(&r.defaultWorker)
+}
+
+// SubscriptionStat counts the messages dispatched to the handler of a
+// subscription, see Client.SubscriptionStats
+type SubscriptionStat struct {
+	Count    int64
+	LastSeen time.Time // zero until the first message
+}
+
+// stats returns the counts of every route, by filter
+func (r *router) stats() map[string]SubscriptionStat {
+	r.RLock()
+	defer r.RUnlock()
+	stats := make(map[string]SubscriptionStat, r.routes.Len())
+	for e := r.routes.Front(); e != nil; e = e.Next() {
+		rt := e.Value.(*route)
+		stat := SubscriptionStat{Count: atomic.LoadInt64(&rt.received)}
+		if last := atomic.LoadInt64(&rt.lastSeen); last != 0 {
+			stat.LastSeen = time.Unix(0, last)
+		}
+		stats[string(rt.topicBytes)] = stat
+	}
+	return stats
+}
+
 // setDefaultHandler assigns a default callback that will be called if no matching Route
 // is found for an incoming Publish.
 func (r *router) setDefaultHandler(handler MessageHandler) {
 	r.defaultHandler = handler
 }
 
+// containsID reports whether ids holds id, the identifiers of a message
+// are too few to be worth a map
+func containsID(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
 // matchAndDispatch takes a channel of Message pointers as input and starts a go routine that
 // takes messages off the channel, matches them against the internal route list and calls the
-// associated callback (or the defaultHandler, if one exists and no other route matched). If
-// anything is sent down the stop channel the function will end.
-func (r *router) matchAndDispatch(messages <-chan *packets.PublishPacket, order bool, client *Client) {
+// associated callback (or the defaultHandler, if one exists and no other route matched). Messages
+// carrying MQTT 5 subscription identifiers are dispatched to the identified routes directly, topic
+// matching is only used when none of the identifiers is known. mode decides whether the callbacks
+// are called in order. If anything is sent down the stop channel the function will end.
+func (r *router) matchAndDispatch(messages <-chan incomingPublish, mode dispatchMode, client *Client) {
+	order := mode == dispatchOrdered
+	// dispatch calls the callback of rt for m as mode requires, it is
+	// called with the read lock held
+	dispatch := func(rt *route, m Message, received time.Time) {
+		atomic.AddInt64(&rt.received, 1)
+		atomic.StoreInt64(&rt.lastSeen, time.Now().UnixNano())
+		switch mode {
+		case dispatchOrdered:
+			callback := rt.callback
+			r.RUnlock()
+			client.deliver(callback, m, received)
+			r.RLock()
+		case dispatchPerRoute:
+			callback, w := rt.callback, r.workerFor(&rt.worker)
+			r.RUnlock()
+			w.enqueue(m, func() { client.deliver(callback, m, received) })
+			r.RLock()
+		default:
+			go client.deliver(rt.callback, m, received)
+		}
+	}
 	go func() {
 		for {
 			select {
-			case message := <-messages:
+			case <-r.replayed:
+				r.runReplays(client, order)
+			case in := <-messages:
+				// replays are queued before the SUBSCRIBE they belong to is
+				// sent, so they go ahead of anything the broker sends for it
+				r.runReplays(client, order)
+				message, gen := in.packet, in.generation
+				client.cacheRetained(message, gen)
 				sent := false
+				ack := client.pendingAck(message)
 				r.RLock()
-				for e := r.routes.Front(); e != nil; e = e.Next() {
-					if e.Value.(*route).matchBytes(message.TopicName) {
-						if order {
-							r.RUnlock()
-							e.Value.(*route).callback(client, messageFromPublish(message))
-							r.RLock()
-						} else {
-							go e.Value.(*route).callback(client, messageFromPublish(message))
+				if message.Properties != nil {
+					// a message matching several subscriptions carries all their
+					// identifiers, each route is called once even if one repeats
+					ids := message.Properties.SubscriptionIdentifiers
+					for i, id := range ids {
+						rt, ok := r.subIDs[id]
+						if !ok || containsID(ids[:i], id) {
+							continue
 						}
+						dispatch(rt, messageFromPublish(message, rt.grantedQos, gen, ack), in.received)
 						sent = true
 					}
 				}
+				if !sent {
+					for e := r.routes.Front(); e != nil; e = e.Next() {
+						if rt := e.Value.(*route); rt.matchBytes(message.TopicName) {
+							dispatch(rt, messageFromPublish(message, rt.grantedQos, gen, ack), in.received)
+							sent = true
+						}
+					}
+				}
 				r.RUnlock()
 				if !sent && r.defaultHandler != nil {
-					if order {
+					switch mode {
+					case dispatchOrdered:
 						r.RLock()
-						r.defaultHandler(client, messageFromPublish(message))
+						client.deliver(r.defaultHandler, messageFromPublish(message, message.Qos, gen, ack), in.received)
 						r.RUnlock()
-					} else {
-						go r.defaultHandler(client, messageFromPublish(message))
+					case dispatchPerRoute:
+						handler, m, received := r.defaultHandler, messageFromPublish(message, message.Qos, gen, ack), in.received
+						r.workerFor(&r.defaultWorker).enqueue(m, func() { client.deliver(handler, m, received) })
+					default:
+						go client.deliver(r.defaultHandler, messageFromPublish(message, message.Qos, gen, ack), in.received)
 					}
+				} else if !sent && client != nil && client.options.RejectUnsolicitedMessages {
+					client.rejectUnsolicited(message, ack)
+				} else if !sent && ack != nil {
+					// no handler can ack it, so it is acked as it would
+					// be without ManualAck
+					ack.complete(true)
 				}
 				message.Release()
 			case <-r.stop:
+				r.stopWorkers()
 				return
 			}
 		}
 	}()
 }
+
+// queueReplay queues replays for matchAndDispatch, which passes them to
+// their handlers ahead of the next message from the broker
+func (r *router) queueReplay(replays []replay) {
+	r.replayLock.Lock()
+	r.replays = append(r.replays, replays...)
+	r.replayLock.Unlock()
+	select {
+	case r.replayed <- struct{}{}:
+	default:
+	}
+}
+
+// runReplays passes the queued replays to their handlers, in order if
+// order is set
+func (r *router) runReplays(client *Client, order bool) {
+	r.replayLock.Lock()
+	replays := r.replays
+	r.replays = nil
+	r.replayLock.Unlock()
+	for _, rp := range replays {
+		m := messageFromPublish(rp.packet, rp.qos, rp.generation, nil)
+		if order {
+			client.callHandler(rp.callback, m)
+		} else {
+			go client.callHandler(rp.callback, m)
+		}
+		rp.packet.Release()
+	}
+}
+
+// rejectUnsolicited counts and logs a message which matched no subscription,
+// acknowledging it so that the broker doesn't send it again
+func (c *Client) rejectUnsolicited(message *packets.PublishPacket, ack *pendingAck) {
+	atomic.AddInt64(&messagesUnsolicited, 1)
+	c.warn(MES, "rejecting message matching no subscription", "topic", string(message.TopicName))
+	if ack != nil {
+		ack.complete(true)
+	}
+}
+
+// deliver calls handler with m unless m arrived more than MaxDeliveryAge
+// ago, in which case it is counted and acked without being handled
+func (c *Client) deliver(handler MessageHandler, m Message, received time.Time) {
+	if c != nil && !received.IsZero() && time.Since(received) > c.options.MaxDeliveryAge {
+		atomic.AddInt64(&messagesStale, 1)
+		c.debug(MES, "skipping stale message", "topic", m.Topic())
+		if a, ok := m.(AckableMessage); ok {
+			a.Ack()
+		}
+		return
+	}
+	c.callHandler(handler, m)
+}
+
+// callHandler calls handler with m, recovering from a panic in it so that
+// one faulty handler can't stop the delivery of messages to the others
+func (c *Client) callHandler(handler MessageHandler, m Message) {
+	defer func() {
+		if p := recover(); p != nil && c != nil {
+			c.error(MES, "message handler panicked", "topic", m.Topic(), "panic", p)
+			if c.options.OnHandlerPanic != nil {
+				c.options.OnHandlerPanic(m.Topic(), p)
+			}
+		}
+	}()
+	handler(c, m)
+}
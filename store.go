@@ -72,16 +72,19 @@ func persistOutbound(s Store, m packets.ControlPacket) {
 		}
 	case 1:
 		switch m.(type) {
-		case *packets.PublishPacket, *packets.PubrelPacket, *packets.SubscribePacket, *packets.UnsubscribePacket:
+		case *packets.PublishPacket, *packets.EncodedPublishPacket, *packets.PubrelPacket:
 			// Sending publish. store in obound
 			// until puback received
 			s.Put(outboundKeyFromMID(m.Details().MessageID), m)
+		case *packets.SubscribePacket, *packets.UnsubscribePacket:
+			// subscriptions are not resumed, the client
+			// subscribes again on connect
 		default:
 			chkcond(false)
 		}
 	case 2:
 		switch m.(type) {
-		case *packets.PublishPacket:
+		case *packets.PublishPacket, *packets.EncodedPublishPacket:
 			// Sending publish. store in obound
 			// until pubrel received
 			s.Put(outboundKeyFromMID(m.Details().MessageID), m)
@@ -124,3 +127,13 @@ func persistInbound(s Store, m packets.ControlPacket) {
 		}
 	}
 }
+
+// persistIncoming updates the store for a packet read from the network.
+// Only the acks ending outbound flows matter: nothing reads inbound
+// messages back, so received publishes aren't kept.
+func persistIncoming(s Store, m packets.ControlPacket) {
+	switch m.(type) {
+	case *packets.PubackPacket, *packets.PubcompPacket:
+		s.Del(outboundKeyFromMID(m.Details().MessageID))
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"sync"
+)
+
+// subChan is the channel a subscription made with SubscribeChan delivers
+// its messages to
+type subChan struct {
+	sync.RWMutex
+	ch     chan Message
+	done   chan struct{} // closed first, to release deliveries waiting for room
+	closed bool
+}
+
+func newSubChan(size int) *subChan {
+	return &subChan{ch: make(chan Message, size), done: make(chan struct{})}
+}
+
+// deliver is the MessageHandler of the subscription
+func (s *subChan) deliver(c *Client, m Message) {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return
+	}
+	if c.options.SubscribeChannelFull == ChannelFullDrop {
+		select {
+		case s.ch <- m:
+		default:
+			c.debug(CLI, "subscription channel full, message dropped", "topic", m.Topic())
+		}
+		return
+	}
+	select {
+	case s.ch <- m:
+	case <-s.done:
+	}
+}
+
+// drain takes the messages in the channel, only as many as it held when called
+// so that deliveries waiting for room don't keep it going
+func (s *subChan) drain() []Message {
+	var drained []Message
+	for n := len(s.ch); n > 0; n-- {
+		select {
+		case m, ok := <-s.ch:
+			if !ok {
+				return drained
+			}
+			drained = append(drained, m)
+		default:
+			return drained
+		}
+	}
+	return drained
+}
+
+func (s *subChan) close() {
+	close(s.done)
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	close(s.ch)
+}
+
+// SubscribeChan subscribes to filter like Subscribe, but delivers the
+// matching messages to the returned channel, which has room for bufferSize
+// of them, instead of calling a MessageHandler. What happens when the channel
+// is full is set by the SubscribeChannelFull option. The channel is closed
+// when the filter is unsubscribed, when the filter is subscribed to again,
+// which replaces the channel, and when the client disconnects or loses its
+// connection without reconnecting. Errors found before the SUBSCRIBE is sent
+// are returned as well as set on the token, in which case the channel is nil.
+func (c *Client) SubscribeChan(filter string, qos byte, bufferSize int) (<-chan Message, Token, error) {
+	s := newSubChan(bufferSize)
+	token := c.Subscribe(filter, qos, s.deliver).(*SubscribeToken)
+	select {
+	case <-token.complete:
+		if err := token.Error(); err != nil {
+			return nil, token, err
+		}
+	default:
+	}
+	c.subChansLock.Lock()
+	previous := c.subChans[filter]
+	c.subChans[filter] = s
+	c.subChansLock.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+	return s.ch, token, nil
+}
+
+// DrainChan takes the messages buffered in the channel of the subscription made
+// with SubscribeChan to filter out of it and returns them, oldest first, without
+// waiting for more, so that they can be flushed before the client shuts down. It
+// returns nil if there is no such subscription, so it must be called before the
+// channel is closed, by Disconnect for example. Draining doesn't acknowledge the
+// messages: with ManualAck, QoS 1 and 2 messages are acknowledged when Ack is
+// called on them, as if they had been read from the channel, otherwise they were
+// acknowledged when they were received.
+func (c *Client) DrainChan(filter string) []Message {
+	c.subChansLock.Lock()
+	s := c.subChans[filter]
+	c.subChansLock.Unlock()
+	if s == nil {
+		return nil
+	}
+	drained := s.drain()
+	c.debug(CLI, "drained subscription channel", "filter", filter, "messages", len(drained))
+	return drained
+}
+
+// closeSubChans closes the channels of the given filters
+func (c *Client) closeSubChans(filters []string) {
+	var closing []*subChan
+	c.subChansLock.Lock()
+	for _, filter := range filters {
+		if s, ok := c.subChans[filter]; ok {
+			closing = append(closing, s)
+			delete(c.subChans, filter)
+		}
+	}
+	c.subChansLock.Unlock()
+	for _, s := range closing {
+		s.close()
+	}
+}
+
+// closeAllSubChans closes the channel of every subscription made with
+// SubscribeChan
+func (c *Client) closeAllSubChans() {
+	c.subChansLock.Lock()
+	subChans := c.subChans
+	c.subChans = make(map[string]*subChan)
+	c.subChansLock.Unlock()
+	for _, s := range subChans {
+		s.close()
+	}
+}
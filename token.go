@@ -13,7 +13,9 @@
 package mqtt
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
@@ -24,8 +26,9 @@ import (
 //code and the underlying code responsible for sending and receiving
 //MQTT messages.
 type PacketAndToken struct {
-	p packets.ControlPacket
-	t Token
+	p       packets.ControlPacket
+	t       Token
+	expires time.Time // publishes still queued at this time are dropped, unset if zero
 }
 
 //Token defines the interface for the tokens used to indicate when
@@ -38,10 +41,13 @@ type Token interface {
 }
 
 type baseToken struct {
-	m        sync.RWMutex
-	complete chan struct{}
-	ready    bool
-	err      error
+	m         sync.RWMutex
+	complete  chan struct{}
+	ready     bool
+	err       error
+	once      sync.Once
+	cancelled int32
+	done      func() // run once the token has completed, if set
 }
 
 // Wait will wait indefinitely for the Token to complete, ie the Publish
@@ -74,7 +80,29 @@ func (b *baseToken) WaitTimeout(d time.Duration) bool {
 }
 
 func (b *baseToken) flowComplete() {
-	close(b.complete)
+	b.completeWith(nil)
+}
+
+// completeWith runs f, which records the outcome of the flow, and then
+// completes the token, unless it has already been completed, for flows
+// which may also be cancelled. Reports whether it completed the token.
+func (b *baseToken) completeWith(f func()) bool {
+	done := false
+	b.once.Do(func() {
+		if f != nil {
+			f()
+		}
+		close(b.complete)
+		if b.done != nil {
+			b.done()
+		}
+		done = true
+	})
+	return done
+}
+
+func (b *baseToken) isCancelled() bool {
+	return atomic.LoadInt32(&b.cancelled) == 1
 }
 
 func (b *baseToken) Error() error {
@@ -92,7 +120,7 @@ func newToken(tType byte) Token {
 	case packets.Publish:
 		return &PublishToken{baseToken: baseToken{complete: make(chan struct{})}}
 	case packets.Unsubscribe:
-		return &UnsubscribeToken{baseToken: baseToken{complete: make(chan struct{})}}
+		return &UnsubscribeToken{baseToken: baseToken{complete: make(chan struct{})}, unsubResult: make(map[string]byte)}
 	case packets.Disconnect:
 		return &DisconnectToken{baseToken: baseToken{complete: make(chan struct{})}}
 	}
@@ -118,21 +146,114 @@ func (c *ConnectToken) ReturnCode() byte {
 //required to provide information about calls to Publish()
 type PublishToken struct {
 	baseToken
-	messageID uint16
+	messageID    uint16
+	topic        string
+	qos          byte
+	reasonCode   byte
+	reasonString string
+	inflight     bool // holds a receive maximum slot, see flowControl
+	flowGen      int
+	queued       int64 // bytes counted against MaxQueuedBytes, see reserveQueued
+	queuedGen    int
+	// sendFullTopic keeps the topic of an aliased publish, see useTopicAlias
+	sendFullTopic bool
 }
 
-//MessageID returns the MQTT message ID that was assigned to the
-//Publish packet when it was sent to the broker
+//MessageID returns the MQTT message ID assigned to the Publish packet.
+//For QoS 1 and 2 it is assigned before Publish returns, for QoS 0 it
+//is always 0
 func (p *PublishToken) MessageID() uint16 {
 	return p.messageID
 }
 
+//Qos returns the QoS the message is sent with, which is lower than the
+//one asked for when it was downgraded to the broker's maximum, see
+//ClientOptions.SetQosAboveMaximum
+func (p *PublishToken) Qos() byte {
+	return p.qos
+}
+
+//ReasonCode returns the reason code an MQTT 5 broker sent in the puback,
+//or for QoS 2 the pubrec or pubcomp, acknowledging the publish. Codes of
+//0x80 and above mean the publish failed and the token has an error, lower
+//ones such as 0x10 (no matching subscribers) are informational.
+func (p *PublishToken) ReasonCode() byte {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.reasonCode
+}
+
+//ReasonString returns the reason string an MQTT 5 broker sent with the
+//acknowledgement, usually to explain a failure
+func (p *PublishToken) ReasonString() string {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.reasonString
+}
+
+// setReason records the reason code and string of an MQTT 5 ack, it must
+// be called before the token completes
+func (p *PublishToken) setReason(code byte, props *packets.Properties) {
+	p.reasonCode = code
+	if props != nil {
+		p.reasonString = props.ReasonString
+	}
+	if code >= 0x80 {
+		p.err = fmt.Errorf("publish failed with reason code 0x%02x", code)
+	}
+}
+
 //SubscribeToken is an extension of Token containing the extra fields
 //required to provide information about calls to Subscribe()
 type SubscribeToken struct {
 	baseToken
-	subs      []string
-	subResult map[string]byte
+	subs           []string
+	qoss           []byte // the QoS requested for each of subs
+	subResult      map[string]byte
+	reasonString   string
+	userProperties []packets.UserProperty
+	parent         *SubscribeToken // set when the subscription was split over several packets
+	parts          []*SubscribeToken
+	partsLeft      int
+	client         *Client // set once the subscribe is queued, for Cancel
+	filters        map[string]*FilterToken
+}
+
+//FilterTokens returns a token for each of the filters subscribed to,
+//which completes as soon as the broker's grant for that filter has been
+//processed, or with the error of the whole subscription if it fails.
+func (s *SubscribeToken) FilterTokens() map[string]*FilterToken {
+	return s.filters
+}
+
+// addFilterTokens gives s a FilterToken for each of filters, those not
+// completed by completeFilter are completed along with s
+func (s *SubscribeToken) addFilterTokens(filters []string) {
+	s.filters = make(map[string]*FilterToken, len(filters))
+	for _, filter := range filters {
+		s.filters[filter] = &FilterToken{baseToken: baseToken{complete: make(chan struct{})}, filter: filter}
+	}
+	s.done = func() {
+		for filter, ft := range s.filters {
+			qos, ok := s.subResult[filter]
+			if !ok {
+				qos = 0x80
+			}
+			ft.grant(qos, s.err)
+		}
+	}
+}
+
+// completeFilter completes the token of one filter with its grant from
+// the suback, for a part of a split subscription the token is held by
+// the parent
+func (s *SubscribeToken) completeFilter(filter string, qos byte) {
+	if s.parent != nil {
+		s = s.parent
+	}
+	if ft, ok := s.filters[filter]; ok {
+		ft.grant(qos, nil)
+	}
 }
 
 //Result returns a map of topics that were subscribed to along with
@@ -144,10 +265,189 @@ func (s *SubscribeToken) Result() map[string]byte {
 	return s.subResult
 }
 
+// partComplete counts off one of the packets a subscription was split
+// into, merging in their results and completing s once every part has
+// been acknowledged. Like the other updates of subscribe results it is
+// only called from alllogic.
+func (s *SubscribeToken) partComplete() {
+	s.partsLeft--
+	if s.partsLeft > 0 {
+		return
+	}
+	s.completeWith(func() {
+		for _, part := range s.parts {
+			for topic, qos := range part.subResult {
+				s.subResult[topic] = qos
+			}
+			if s.reasonString == "" {
+				s.reasonString = part.reasonString
+			}
+			s.userProperties = append(s.userProperties, part.userProperties...)
+		}
+	})
+}
+
+// Cancel stops waiting for the broker to acknowledge the subscription,
+// completing the token with ErrCancelled. Once the SUBSCRIBE has been sent
+// its message ID is only freed when the SUBACK arrives or the connection is
+// lost, so that the late SUBACK can't complete another subscribe. The
+// handlers of its filters are removed and the filters no longer count as
+// subscribed to, so subscribing to them again sends a new SUBSCRIBE. An
+// acknowledgement which arrives later is ignored, though the broker may
+// still have made the subscription. It has no effect on a completed token.
+func (s *SubscribeToken) Cancel() {
+	if s.client != nil && s.client.cancelToken(&s.baseToken) {
+		s.client.forgetFilters(s.subs)
+	}
+}
+
+// isCancelled reports whether s, or the subscription it is part of, was cancelled
+func (s *SubscribeToken) isCancelled() bool {
+	return s.baseToken.isCancelled() || (s.parent != nil && s.parent.isCancelled())
+}
+
+//ReasonString returns the reason string an MQTT 5 broker sent in the
+//suback, usually to explain why a subscription was refused
+func (s *SubscribeToken) ReasonString() string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.reasonString
+}
+
+//UserProperties returns the user properties an MQTT 5 broker sent
+//in the suback
+func (s *SubscribeToken) UserProperties() []packets.UserProperty {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.userProperties
+}
+
+//FilterToken is the Token for one of the filters of a subscription, see
+//SubscribeToken.FilterTokens
+type FilterToken struct {
+	baseToken
+	filter string
+	qos    byte
+}
+
+//Filter returns the topic filter the token is for
+func (f *FilterToken) Filter() string {
+	return f.filter
+}
+
+//Qos returns the QoS the broker granted for the filter, or the code it
+//refused the subscription with, in which case the token has an error
+func (f *FilterToken) Qos() byte {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return f.qos
+}
+
+func (f *FilterToken) grant(qos byte, err error) {
+	f.completeWith(func() {
+		f.qos = qos
+		f.err = err
+		if err == nil && qos >= 0x80 {
+			f.err = fmt.Errorf("subscription refused with code 0x%02x", qos)
+		}
+	})
+}
+
 //UnsubscribeToken is an extension of Token containing the extra fields
 //required to provide information about calls to Unsubscribe()
 type UnsubscribeToken struct {
 	baseToken
+	topics         []string
+	unsubResult    map[string]byte
+	reasonString   string
+	userProperties []packets.UserProperty
+	client         *Client // set once the unsubscribe is queued, for Cancel
+}
+
+//Result returns a map of the topics that were unsubscribed from along
+//with the reason code the broker returned for each. MQTT 5 brokers
+//return 0x00 on success, 0x11 when there was no such subscription or
+//an error code of 0x80 or above, before MQTT 5 every topic is 0x00.
+func (u *UnsubscribeToken) Result() map[string]byte {
+	u.m.RLock()
+	defer u.m.RUnlock()
+	return u.unsubResult
+}
+
+//ReasonString returns the reason string an MQTT 5 broker sent in the
+//unsuback
+func (u *UnsubscribeToken) ReasonString() string {
+	u.m.RLock()
+	defer u.m.RUnlock()
+	return u.reasonString
+}
+
+//UserProperties returns the user properties an MQTT 5 broker sent
+//in the unsuback
+func (u *UnsubscribeToken) UserProperties() []packets.UserProperty {
+	u.m.RLock()
+	defer u.m.RUnlock()
+	return u.userProperties
+}
+
+// Cancel stops waiting for the broker to acknowledge the unsubscribe,
+// completing the token with ErrCancelled. As with SubscribeToken.Cancel a
+// message ID already sent stays reserved until the UNSUBACK arrives or the
+// connection is lost. It has no effect on a completed token.
+func (u *UnsubscribeToken) Cancel() {
+	if u.client != nil {
+		u.client.cancelToken(&u.baseToken)
+	}
+}
+
+//Subscription is the QoS and handler wanted for a filter, see
+//Client.SetSubscriptions
+type Subscription struct {
+	Qos     byte
+	Handler MessageHandler
+}
+
+//SubscriptionsToken is returned by SetSubscriptions and completes once
+//the subscribe and the unsubscribe it made have both completed
+type SubscriptionsToken struct {
+	baseToken
+	sub   *SubscribeToken
+	unsub *UnsubscribeToken
+}
+
+//Subscribe returns the token of the subscribe to the added filters, or
+//nil if no filters were added
+func (s *SubscriptionsToken) Subscribe() *SubscribeToken {
+	return s.sub
+}
+
+//Unsubscribe returns the token of the unsubscribe from the removed
+//filters, or nil if no filters were removed
+func (s *SubscriptionsToken) Unsubscribe() *UnsubscribeToken {
+	return s.unsub
+}
+
+// wait completes s with the first error of its subscribe and unsubscribe
+// once both have completed
+func (s *SubscriptionsToken) wait() {
+	var err error
+	if s.sub != nil {
+		s.sub.Wait()
+		err = s.sub.Error()
+	}
+	if s.unsub != nil {
+		s.unsub.Wait()
+		if err == nil {
+			err = s.unsub.Error()
+		}
+	}
+	s.completeWith(func() { s.err = err })
+}
+
+//ReconnectToken is the Token returned by Reconnect, it completes once
+//the client has reconnected
+type ReconnectToken struct {
+	baseToken
 }
 
 //DisconnectToken is an extension of Token containing the extra fields
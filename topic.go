@@ -16,7 +16,8 @@ package mqtt
 
 import (
 	"errors"
-	"strings"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
 )
 
 //InvalidQos is the error returned when an packet is to be sent
@@ -25,12 +26,12 @@ var ErrInvalidQos = errors.New("Invalid QoS")
 
 //InvalidTopicEmptyString is the error returned when a topic string
 //is passed in that is 0 length
-var ErrInvalidTopicEmptyString = errors.New("Invalid Topic; empty string")
+var ErrInvalidTopicEmptyString = packets.ErrInvalidTopicEmptyString
 
 //InvalidTopicMultilevel is the error returned when a topic string
 //is passed in that has the multi level wildcard in any position but
 //the last
-var ErrInvalidTopicMultilevel = errors.New("Invalid Topic; multi-level wildcard must be last level")
+var ErrInvalidTopicMultilevel = packets.ErrInvalidTopicMultilevel
 
 // Topic Names and Topic Filters
 // The MQTT v3.1.1 spec clarifies a number of ambiguities with regard
@@ -64,15 +65,8 @@ func validateSubscribeMap(subs map[string]byte) ([]string, []byte, error) {
 }
 
 func validateTopicAndQos(topic string, qos byte) error {
-	if len(topic) == 0 {
-		return ErrInvalidTopicEmptyString
-	}
-
-	levels := strings.Split(topic, "/")
-	for i, level := range levels {
-		if level == "#" && i != len(levels)-1 {
-			return ErrInvalidTopicMultilevel
-		}
+	if _, err := packets.NormalizeTopic(topic); err != nil {
+		return err
 	}
 
 	if qos < 0 || qos > 2 {
@@ -15,6 +15,8 @@
 package mqtt
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
 )
@@ -40,3 +42,90 @@ func init() {
 func debugActive() bool {
 	return DEBUG != initialDebugLogger
 }
+
+// LogLevel limits which log entries a single client produces, see
+// Client.SetLogLevel. Each level includes the ones before it.
+type LogLevel int32
+
+const (
+	// LogLevelDefault leaves the choice to the logger: every entry is passed
+	// to a configured Logger, while the default one writes debug and info
+	// entries only when DEBUG has been set.
+	LogLevelDefault LogLevel = iota
+	LogLevelError
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+// Logger is the interface a Client uses for its log output. Each entry
+// is a message followed by alternating keys and values, as accepted by
+// most structured loggers. Entries produced by the client carry a
+// "component" key naming the part of the client they came from, such
+// as "client", "net" or "pinger". Errors which end the connection, such
+// as an unanswered PINGREQ, are passed to Error unless the Logger also
+// has a Critical method taking the same arguments.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// criticalLogger is implemented by Loggers which record errors that end
+// the connection apart from other errors
+type criticalLogger interface {
+	Critical(msg string, keysAndValues ...interface{})
+}
+
+// stdLogger is the Logger used when none is configured. It writes to the
+// package level DEBUG, WARN, ERROR and CRITICAL loggers; Info entries go
+// to DEBUG.
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	if !debugActive() {
+		return
+	}
+	DEBUG.Println(formatEntry(msg, keysAndValues))
+}
+
+func (stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	if !debugActive() {
+		return
+	}
+	DEBUG.Println(formatEntry(msg, keysAndValues))
+}
+
+func (stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	WARN.Println(formatEntry(msg, keysAndValues))
+}
+
+func (stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	ERROR.Println(formatEntry(msg, keysAndValues))
+}
+
+func (stdLogger) Critical(msg string, keysAndValues ...interface{}) {
+	CRITICAL.Println(formatEntry(msg, keysAndValues))
+}
+
+// formatEntry renders a structured entry in the traditional format, with
+// the component tag first and the remaining fields as key=value pairs
+func formatEntry(msg string, keysAndValues []interface{}) string {
+	var b bytes.Buffer
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if keysAndValues[i] == "component" {
+			fmt.Fprintf(&b, "%-10s ", fmt.Sprintf("[%v]", keysAndValues[i+1]))
+		}
+	}
+	b.WriteString(msg)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if keysAndValues[i] != "component" {
+			fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+		}
+	}
+	if len(keysAndValues)%2 == 1 {
+		fmt.Fprintf(&b, " %v", keysAndValues[len(keysAndValues)-1])
+	}
+	return b.String()
+}
@@ -0,0 +1,235 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
+)
+
+// testBroker is a minimal in-process MQTT server which accepts
+// connections, answers CONNECT with CONNACK and then hands the
+// connection over to the test.
+type testBroker struct {
+	l     net.Listener
+	conns chan *testConn
+}
+
+// testConn is the broker side of a client connection
+type testConn struct {
+	net.Conn
+	r       *bufio.Reader
+	level   byte                   // protocol version requested by the client
+	connect *packets.ConnectPacket // as sent by the client, if read by handshake
+}
+
+func (tc *testConn) send(t *testing.T, cp packets.ControlPacket) {
+	w := bufio.NewWriter(tc)
+	if err := cp.Write(w); err != nil {
+		t.Fatalf("broker write failed: %v", err)
+	}
+	w.Flush()
+}
+
+// receive returns the next packet from the client, or nil if
+// nothing arrives within d
+func (tc *testConn) receive(d time.Duration) packets.ControlPacket {
+	tc.SetReadDeadline(time.Now().Add(d))
+	defer tc.SetReadDeadline(time.Time{})
+	cp, err := packets.ReadPacketVersion(tc.r, tc.level)
+	if err != nil {
+		return nil
+	}
+	return cp
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	return serveTestBroker(l)
+}
+
+// serveTestBroker accepts clients from l, see newTestBroker
+func serveTestBroker(l net.Listener) *testBroker {
+	b := &testBroker{l: l, conns: make(chan *testConn, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tc, err := handshake(conn)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			b.conns <- tc
+		}
+	}()
+	return b
+}
+
+// handshake reads the CONNECT from a new client connection and accepts it
+func handshake(conn net.Conn) (*testConn, error) {
+	return handshakeWith(conn, nil)
+}
+
+// handshakeWith is handshake with the CONNACK passed to connack, if it is
+// set, before it is sent
+func handshakeWith(conn net.Conn, connack func(*packets.ConnackPacket)) (*testConn, error) {
+	r := bufio.NewReader(conn)
+	cp, err := packets.ReadPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	connect, ok := cp.(*packets.ConnectPacket)
+	if !ok {
+		return nil, errors.New("expected CONNECT")
+	}
+	ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ca.ReturnCode = packets.Accepted
+	if connack != nil {
+		connack(ca)
+	}
+	w := bufio.NewWriter(conn)
+	ca.Write(w)
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return &testConn{Conn: conn, r: r, level: connect.ProtocolVersion, connect: connect}, nil
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.l.Addr().String()
+}
+
+func (b *testBroker) accept(t *testing.T, d time.Duration) *testConn {
+	select {
+	case conn := <-b.conns:
+		return conn
+	case <-time.After(d):
+		t.Fatalf("client did not connect within %v", d)
+	}
+	return nil
+}
+
+func (b *testBroker) close() {
+	b.l.Close()
+}
+
+// testClient is a client connected to a testBroker of its own, see
+// connectTestClient
+type testClient struct {
+	*Client
+	broker *testBroker
+	conn   *testConn // the broker side of the first connection
+}
+
+// connectTestClient starts a testBroker, adds it to ops and connects a
+// client to it
+func connectTestClient(t *testing.T, ops *ClientOptions) *testClient {
+	broker := newTestBroker(t)
+	ops.AddBroker(broker.url())
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		broker.close()
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+	return &testClient{Client: c, broker: broker, conn: broker.accept(t, time.Second)}
+}
+
+// close disconnects the client and stops its broker
+func (c *testClient) close() {
+	c.Disconnect(0)
+	c.conn.Close()
+	c.broker.close()
+}
+
+// pipeBroker has ops connect over net.Pipe to a broker which accepts
+// every connection, see handshakeWith, and passes the broker side of each
+// to the channel returned
+func pipeBroker(ops *ClientOptions, connack func(*packets.ConnackPacket)) <-chan *testConn {
+	conns := make(chan *testConn, 10)
+	ops.AddBroker("pipe://broker")
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshakeWith(server, connack); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	return conns
+}
+
+// subscribeAndAck waits for a SUBSCRIBE from the client and grants it
+func (tc *testConn) subscribeAndAck(t *testing.T) *packets.SubscribePacket {
+	cp := tc.receive(time.Second)
+	sp, ok := cp.(*packets.SubscribePacket)
+	if !ok {
+		t.Fatalf("expected subscribe, got %v", cp)
+	}
+	sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	sa.MessageID = sp.MessageID
+	sa.GrantedQoss = sp.Qoss
+	tc.send(t, sa)
+	return sp
+}
+
+func sendPublish(t *testing.T, conn *testConn, topic, payload string) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = []byte(topic)
+	p.Payload = []byte(payload)
+	conn.send(t, p)
+}
+
+// selfSignedCert returns a certificate valid for dnsName, which is its own CA
+func selfSignedCert(t *testing.T, dnsName string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
@@ -15,12 +15,23 @@
 package mqtt
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	_ "net/http/pprof"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
 )
 
 func init() {
@@ -54,3 +65,649 @@ func Test_NewClient_simple(t *testing.T) {
 		t.Fatalf("bad server host")
 	}
 }
+
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// captureLogger is a Logger which records every entry
+type captureLogger struct {
+	sync.Mutex
+	entries []logEntry
+}
+
+func (l *captureLogger) add(level, msg string, keysAndValues []interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	e := logEntry{level: level, msg: msg, fields: make(map[string]interface{})}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		e.fields[keysAndValues[i].(string)] = keysAndValues[i+1]
+	}
+	l.entries = append(l.entries, e)
+}
+
+func (l *captureLogger) Debug(msg string, kv ...interface{}) { l.add("debug", msg, kv) }
+func (l *captureLogger) Info(msg string, kv ...interface{})  { l.add("info", msg, kv) }
+func (l *captureLogger) Warn(msg string, kv ...interface{})  { l.add("warn", msg, kv) }
+func (l *captureLogger) Error(msg string, kv ...interface{}) { l.add("error", msg, kv) }
+
+func (l *captureLogger) find(level, msg string) *logEntry {
+	l.Lock()
+	defer l.Unlock()
+	for i := range l.entries {
+		if l.entries[i].level == level && l.entries[i].msg == msg {
+			return &l.entries[i]
+		}
+	}
+	return nil
+}
+
+func Test_Logger_connect(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	logger := &captureLogger{}
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("logger")
+	ops.SetKeepAlive(0)
+	ops.SetLogger(logger)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	e := logger.find("debug", "socket connected to broker")
+	if e == nil || e.fields["component"] != "client" {
+		t.Fatalf("missing socket connected entry: %+v", e)
+	}
+	e = logger.find("info", "client is connected")
+	if e == nil || e.fields["component"] != "client" {
+		t.Fatalf("missing client is connected entry: %+v", e)
+	}
+	e = logger.find("debug", "received connack")
+	if e == nil || e.fields["component"] != "net" {
+		t.Fatalf("missing received connack entry: %+v", e)
+	}
+	c.Disconnect(0)
+}
+
+func Test_SetLogLevel(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	verbose, quiet := &captureLogger{}, &captureLogger{}
+	var clients []*Client
+	for _, logger := range []*captureLogger{verbose, quiet} {
+		ops := NewClientOptions().AddBroker(broker.url()).SetClientID("loglevel")
+		ops.SetKeepAlive(0)
+		ops.SetLogger(logger)
+		c := NewClient(ops)
+		clients = append(clients, c)
+	}
+	clients[0].SetLogLevel(LogLevelDebug)
+	clients[1].SetLogLevel(LogLevelInfo)
+	for _, c := range clients {
+		if !c.Connect().WaitTimeout(2 * time.Second) {
+			t.Fatalf("connect timed out")
+		}
+		conn := broker.accept(t, time.Second)
+		defer conn.Close()
+		defer c.Disconnect(0)
+	}
+
+	if verbose.find("debug", "socket connected to broker") == nil {
+		t.Fatalf("debug entry missing from the client at debug level")
+	}
+	if quiet.find("info", "client is connected") == nil {
+		t.Fatalf("info entry missing from the client at info level")
+	}
+	quiet.Lock()
+	defer quiet.Unlock()
+	for _, e := range quiet.entries {
+		if e.level == "debug" {
+			t.Fatalf("client at info level logged debug entry %q", e.msg)
+		}
+	}
+	if clients[1].debugActive() {
+		t.Fatalf("debugActive is true for the client at info level")
+	}
+}
+
+func Test_formatEntry(t *testing.T) {
+	s := formatEntry("received puback", []interface{}{"component", "net", "id", 5})
+	if s != "[net]      received puback id=5" {
+		t.Fatalf("bad formatted entry: %q", s)
+	}
+}
+
+func Test_critical(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(l *log.Logger) { CRITICAL = l }(CRITICAL)
+	CRITICAL = log.New(&buf, "", 0)
+	c := NewClient(NewClientOptions())
+	c.critical(PNG, "pingresp not received, disconnecting")
+	if buf.String() != "[pinger]   pingresp not received, disconnecting\n" {
+		t.Fatalf("CRITICAL got %q", buf.String())
+	}
+
+	// loggers without a Critical method get the entry as an error
+	logger := &captureLogger{}
+	c = NewClient(NewClientOptions().SetLogger(logger))
+	c.critical(PNG, "pingresp not received, disconnecting")
+	if logger.find("error", "pingresp not received, disconnecting") == nil {
+		t.Fatalf("critical entry not passed to Error")
+	}
+}
+
+// failingConn is a client connection whose writes fail once err is set
+type failingConn struct {
+	net.Conn
+	err atomic.Value
+}
+
+func (fc *failingConn) Write(b []byte) (int, error) {
+	if err, ok := fc.err.Load().(error); ok {
+		return 0, err
+	}
+	return fc.Conn.Write(b)
+}
+
+func Test_OnError_write(t *testing.T) {
+	writeErr := errors.New("induced write failure")
+	conns := make(chan *failingConn, 2)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("onerror")
+	ops.SetKeepAlive(0)
+	ops.SetAutoReconnect(false)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go handshake(server)
+		fc := &failingConn{Conn: client}
+		conns <- fc
+		return fc, nil
+	})
+	errs := make(chan error, 2)
+	ops.SetOnErrorHandler(func(err error) { errs <- err })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+
+	conn.err.Store(writeErr)
+	c.Publish("error/topic", 0, false, "lost")
+	select {
+	case err := <-errs:
+		if err != writeErr {
+			t.Fatalf("expected %v, got %v", writeErr, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("error handler was not called")
+	}
+}
+
+func Test_MaxReconnectAttempts_gaveUp(t *testing.T) {
+	refused := errors.New("broker unreachable")
+	conns := make(chan *testConn, 1)
+	var opened int32
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("gaveup")
+	ops.SetKeepAlive(0)
+	ops.SetMaxReconnectInterval(0)
+	ops.SetMaxReconnectAttempts(3)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		// only the initial connection succeeds
+		if atomic.AddInt32(&opened, 1) > 1 {
+			return nil, refused
+		}
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	gaveUp := make(chan error, 2)
+	ops.SetReconnectGaveUpHandler(func(err error) { gaveUp <- err })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	(<-conns).Close()
+
+	select {
+	case err := <-gaveUp:
+		if err != refused {
+			t.Fatalf("expected %v, got %v", refused, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client did not give up reconnecting")
+	}
+	if n := atomic.LoadInt32(&opened); n != 4 {
+		t.Fatalf("expected 3 reconnect attempts, got %d", n-1)
+	}
+	if c.IsConnected() {
+		t.Fatalf("client should be disconnected after giving up")
+	}
+	if token := c.Publish("gaveup/topic", 1, false, "late"); token.Wait() && token.Error() != ErrNotConnected {
+		t.Fatalf("expected publish to fail with ErrNotConnected, got %v", token.Error())
+	}
+	select {
+	case <-gaveUp:
+		t.Fatalf("give up handler called more than once")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_UnhandledPacket(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		unhandled := make(chan packets.ControlPacket, 1)
+		lost := make(chan error, 1)
+		ops := NewClientOptions().SetClientID("unhandled")
+		ops.SetKeepAlive(0)
+		ops.SetAutoReconnect(false)
+		ops.SetStrictProtocol(strict)
+		ops.SetUnhandledPacketHandler(func(cp packets.ControlPacket) { unhandled <- cp })
+		ops.SetConnectionLostHandler(func(c *Client, err error) { lost <- err })
+		c := connectTestClient(t, ops)
+		conn := c.conn
+
+		// brokers never send CONNECT
+		cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+		cp.ProtocolName = "MQTT"
+		cp.ProtocolVersion = 4
+		cp.ClientIdentifier = "broker"
+		conn.send(t, cp)
+		select {
+		case got := <-unhandled:
+			if p, ok := got.(*packets.ConnectPacket); !ok || p.ClientIdentifier != "broker" {
+				t.Fatalf("handler got %v", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("unhandled packet handler not called")
+		}
+
+		select {
+		case err := <-lost:
+			if !strict {
+				t.Fatalf("connection lost without strict mode: %v", err)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if strict {
+				t.Fatalf("strict mode did not disconnect")
+			}
+		}
+		c.close()
+	}
+}
+
+func Test_FlowControl_receiveMaximum(t *testing.T) {
+	ops := NewClientOptions().SetClientID("receivemax")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	conns := pipeBroker(ops, func(ca *packets.ConnackPacket) {
+		ca.ProtocolLevel = 5
+		ca.Properties = &packets.Properties{ReceiveMaximum: 1}
+	})
+	type flowEvent struct {
+		blocked       bool
+		inflight, max int
+	}
+	events := make(chan flowEvent, 2)
+	ops.SetFlowControlBlockedHandler(func(inflight, max int) { events <- flowEvent{true, inflight, max} })
+	ops.SetFlowControlResumedHandler(func(inflight, max int) { events <- flowEvent{false, inflight, max} })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+	defer conn.Close()
+
+	first := c.Publish("receivemax/topic", 1, false, "first")
+	second := make(chan Token, 1)
+	go func() { second <- c.Publish("receivemax/topic", 1, false, "second") }()
+
+	pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+	if !ok || string(pp.Payload) != "first" {
+		t.Fatalf("expected the first publish, got %v", pp)
+	}
+	select {
+	case ev := <-events:
+		if !ev.blocked || ev.inflight != 1 || ev.max != 1 {
+			t.Fatalf("expected blocked at 1 of 1, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("blocked handler was not called")
+	}
+	select {
+	case <-second:
+		t.Fatalf("second publish was not held back")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	pa.MessageID = pp.MessageID
+	conn.send(t, pa)
+	if !first.WaitTimeout(time.Second) {
+		t.Fatalf("first publish was not acknowledged")
+	}
+	pp, ok = conn.receive(time.Second).(*packets.PublishPacket)
+	if !ok || string(pp.Payload) != "second" {
+		t.Fatalf("expected the second publish, got %v", pp)
+	}
+	select {
+	case ev := <-events:
+		if ev.blocked || ev.inflight != 1 || ev.max != 1 {
+			t.Fatalf("expected resumed at 1 of 1, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("resumed handler was not called")
+	}
+	<-second
+	c.Disconnect(0)
+}
+
+func Test_FlowControl_receiveMaximum_resume(t *testing.T) {
+	store := NewMemoryStore()
+	store.Open()
+	for id := uint16(1); id <= 2; id++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = []byte("receivemax/topic")
+		pub.Qos = 1
+		pub.MessageID = id
+		store.Put(outboundKeyFromMID(id), pub)
+	}
+	ops := NewClientOptions().SetClientID("receivemaxresume")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetCleanSession(false)
+	ops.SetStore(store)
+	conns := pipeBroker(ops, func(ca *packets.ConnackPacket) {
+		ca.ProtocolLevel = 5
+		ca.TopicNameCompression = 0x01 // session present
+		ca.Properties = &packets.Properties{ReceiveMaximum: 1}
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+	defer conn.Close()
+	defer c.Disconnect(0)
+
+	pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+	if !ok || pp.MessageID != 1 || !pp.Dup {
+		t.Fatalf("expected the first stored publish to be resent, got %v", pp)
+	}
+	if cp := conn.receive(100 * time.Millisecond); cp != nil {
+		t.Fatalf("second stored publish sent beyond the receive maximum: %v", cp)
+	}
+	pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	pa.MessageID = pp.MessageID
+	conn.send(t, pa)
+	pp, ok = conn.receive(time.Second).(*packets.PublishPacket)
+	if !ok || pp.MessageID != 2 {
+		t.Fatalf("expected the second stored publish once the first was acknowledged, got %v", pp)
+	}
+}
+
+func Test_Reconnect(t *testing.T) {
+	lost := make(chan error, 1)
+	ops := NewClientOptions().SetClientID("reconnect")
+	ops.SetKeepAlive(0)
+	ops.SetInitialReconnectDelay(10 * time.Millisecond)
+	ops.SetConnectionLostHandler(func(c *Client, err error) { lost <- err })
+	c := connectTestClient(t, ops)
+	defer c.close()
+	gen := c.ConnectionGeneration()
+
+	token := c.Reconnect()
+	// a second call while reconnecting doesn't drop another connection
+	again := c.Reconnect()
+	if !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+		t.Fatalf("reconnect failed: %v", token.Error())
+	}
+	if !again.WaitTimeout(2*time.Second) || again.Error() != nil {
+		t.Fatalf("second reconnect failed: %v", again.Error())
+	}
+	if err := <-lost; err != ErrReconnectRequested {
+		t.Fatalf("connection lost with %v", err)
+	}
+	newConn := c.broker.accept(t, time.Second)
+	defer newConn.Close()
+	if !c.IsConnected() || c.ConnectionGeneration() != gen+1 {
+		t.Fatalf("connected %v with generation %d after reconnecting from %d", c.IsConnected(), c.ConnectionGeneration(), gen)
+	}
+	select {
+	case <-c.broker.conns:
+		t.Fatalf("reconnected more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_reconnect_invalidConnect(t *testing.T) {
+	var built int32
+	ops := NewClientOptions().SetClientID("reconnectinvalid")
+	ops.SetKeepAlive(0)
+	ops.SetMaxReconnectInterval(0)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	// only the CONNECT of the initial connection is valid
+	ops.SetConnectPacketBuilder(func(base *packets.ConnectPacket) *packets.ConnectPacket {
+		if atomic.AddInt32(&built, 1) > 1 {
+			base.WillRetain = true
+		}
+		return base
+	})
+	conns := pipeBroker(ops, nil)
+	gaveUp := make(chan error, 2)
+	ops.SetReconnectGaveUpHandler(func(err error) { gaveUp <- err })
+	reported := make(chan error, 2)
+	ops.SetOnErrorHandler(func(err error) {
+		if err == ErrInvalidConnect {
+			reported <- err
+		}
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	(<-conns).Close()
+
+	select {
+	case err := <-gaveUp:
+		if err != ErrInvalidConnect {
+			t.Fatalf("expected %v, got %v", ErrInvalidConnect, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("client did not give up reconnecting")
+	}
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatalf("invalid connect not passed to the error handler")
+	}
+	if n := atomic.LoadInt32(&built); n != 2 {
+		t.Fatalf("expected 1 reconnect attempt, got %d", n-1)
+	}
+	if c.IsConnected() {
+		t.Fatalf("client should be disconnected after giving up")
+	}
+}
+
+func Test_PublishWithOptions_correlationData(t *testing.T) {
+	received := make(chan Message, 1)
+	ops := NewClientOptions().SetClientID("correlation")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetDefaultPublishHandler(func(c *Client, m Message) { received <- m })
+	conns := pipeBroker(ops, func(ca *packets.ConnackPacket) { ca.ProtocolLevel = 5 })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+	defer conn.Close()
+
+	// a binary ID such as a UUID, which isn't valid UTF-8
+	id := []byte{0xff, 0xfe, 0x00, 0x01, 0x80, 0xc0, 0x7f, 0x00, 0x10, 0x20, 0xed, 0xa0, 0x80, 0xfd, 0x00, 0xff}
+	c.PublishWithOptions("rr/request", 0, false, "question", PublishOptions{ResponseTopic: "rr/response", CorrelationData: id})
+	pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+	if !ok {
+		t.Fatalf("expected a publish")
+	}
+	if pp.Properties == nil || pp.Properties.ResponseTopic != "rr/response" || !bytes.Equal(pp.Properties.CorrelationData, id) {
+		t.Fatalf("publish sent with properties %v", pp.Properties)
+	}
+
+	// the broker delivers the request back to the client
+	conn.send(t, pp)
+	select {
+	case m := <-received:
+		if m.(DetailedMessage).ResponseTopic() != "rr/response" {
+			t.Fatalf("expected response topic rr/response, got %q", m.(DetailedMessage).ResponseTopic())
+		}
+		if !bytes.Equal(m.(DetailedMessage).CorrelationData(), id) {
+			t.Fatalf("expected correlation data %x, got %x", id, m.(DetailedMessage).CorrelationData())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not delivered")
+	}
+	c.Disconnect(0)
+}
+
+func Test_Client_SetTLSConfig(t *testing.T) {
+	oldCert, oldRoots := selfSignedCert(t, "broker.example")
+	newCert, newRoots := selfSignedCert(t, "broker.example")
+	var serving atomic.Value
+	serving.Store(&oldCert)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return serving.Load().(*tls.Certificate), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	broker := serveTestBroker(l)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker("tls://" + l.Addr().String()).SetClientID("tlsrotate")
+	ops.SetKeepAlive(0)
+	ops.SetInitialReconnectDelay(10 * time.Millisecond)
+	ops.SetTLSConfig(&tls.Config{RootCAs: oldRoots, ServerName: "broker.example"})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed")
+	}
+	conn := broker.accept(t, time.Second)
+
+	// the broker's certificate is rotated, which the client only trusts
+	// with the new configuration
+	serving.Store(&newCert)
+	c.SetTLSConfig(&tls.Config{RootCAs: newRoots, ServerName: "broker.example"})
+	if !c.IsConnected() {
+		t.Fatalf("setting the TLS config disturbed the connection")
+	}
+	conn.Close()
+	conn = broker.accept(t, 2*time.Second)
+	defer conn.Close()
+	c.Disconnect(0)
+}
+
+func Test_TLSCallbacksOnReconnect(t *testing.T) {
+	pinned, _ := selfSignedCert(t, "broker.example")
+	wrong, _ := selfSignedCert(t, "broker.example")
+	var serving atomic.Value
+	serving.Store(&wrong)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return serving.Load().(*tls.Certificate), nil
+		},
+		// has the client's GetClientCertificate called
+		ClientAuth: tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	broker := serveTestBroker(l)
+	defer broker.close()
+
+	var rejected, peerChecks, clientCerts int32
+	ops := NewClientOptions().AddBroker("tls://" + l.Addr().String()).SetClientID("tlspin")
+	ops.SetKeepAlive(0)
+	ops.SetInitialReconnectDelay(10 * time.Millisecond)
+	ops.SetMaxReconnectInterval(20 * time.Millisecond)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetTLSConfig(&tls.Config{
+		// the certificate is pinned instead of verified against roots
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 || !bytes.Equal(cs.PeerCertificates[0].Raw, pinned.Certificate[0]) {
+				atomic.AddInt32(&rejected, 1)
+				return errors.New("certificate not pinned")
+			}
+			return nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			atomic.AddInt32(&peerChecks, 1)
+			return nil
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			atomic.AddInt32(&clientCerts, 1)
+			return &tls.Certificate{}, nil
+		},
+	})
+
+	if ct := NewClient(ops).Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() == nil {
+		t.Fatalf("connected to a broker with the wrong certificate")
+	}
+	if atomic.LoadInt32(&rejected) == 0 {
+		t.Fatalf("VerifyConnection not called on connect")
+	}
+
+	serving.Store(&pinned)
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect with the pinned certificate failed: %v", ct.Error())
+	}
+	defer c.Disconnect(0)
+	conn := broker.accept(t, time.Second)
+
+	// the client reconnects to a broker with the wrong certificate
+	serving.Store(&wrong)
+	before, peerBefore, clientBefore := atomic.LoadInt32(&rejected), atomic.LoadInt32(&peerChecks), atomic.LoadInt32(&clientCerts)
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&rejected) < before+2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("VerifyConnection not called on reconnect")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&peerChecks) == peerBefore {
+		t.Fatalf("VerifyPeerCertificate not called on reconnect")
+	}
+	select {
+	case <-broker.conns:
+		t.Fatalf("reconnected to a broker with the wrong certificate")
+	default:
+	}
+	if c.IsConnected() {
+		t.Fatalf("connected to a broker with the wrong certificate")
+	}
+
+	serving.Store(&pinned)
+	conn = broker.accept(t, 2*time.Second)
+	defer conn.Close()
+	// the client certificate is only asked for once the broker is trusted
+	if atomic.LoadInt32(&clientCerts) == clientBefore {
+		t.Fatalf("GetClientCertificate not called on reconnect")
+	}
+	for !c.IsConnected() {
+		time.Sleep(time.Millisecond)
+	}
+}
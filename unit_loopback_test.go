@@ -0,0 +1,180 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
+)
+
+// loopbackBroker is an in-process broker reached over net.Pipe, for measuring
+// the encode, decode and dispatch work of the client without a network in the
+// way. It accepts every connection, acknowledges subscribes, unsubscribes,
+// pings and QoS 1 and 2 publishes, and echoes every publish back to the client
+// at QoS 0, as if the client were subscribed to everything it publishes.
+type loopbackBroker struct{}
+
+// options returns client options connecting to the broker
+func (b *loopbackBroker) options(clientID string) *ClientOptions {
+	ops := NewClientOptions().AddBroker("loopback://broker").SetClientID(clientID)
+	ops.SetKeepAlive(0)
+	ops.SetCustomOpenConnectionFn(b.open)
+	return ops
+}
+
+func (b *loopbackBroker) open(uri *url.URL) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		tc, err := handshake(server)
+		if err != nil {
+			server.Close()
+			return
+		}
+		b.serve(tc)
+	}()
+	return client, nil
+}
+
+// serve answers the packets of a client until it disconnects. Replies are
+// written by their own goroutine so that the broker keeps reading while the
+// client is busy, as the pipe has no buffer.
+func (b *loopbackBroker) serve(tc *testConn) {
+	replies := make(chan packets.ControlPacket, 1024)
+	defer close(replies)
+	go func() {
+		w := bufio.NewWriter(tc)
+		for cp := range replies {
+			err := cp.Write(w)
+			cp.Release()
+			// flush once the replies waiting have been buffered
+			if err == nil && len(replies) == 0 {
+				err = w.Flush()
+			}
+			if err != nil {
+				tc.Close()
+				for range replies {
+				}
+				return
+			}
+		}
+	}()
+	for {
+		cp, err := packets.ReadPacketVersion(tc.r, tc.level)
+		if err != nil {
+			tc.Close()
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				pa.MessageID = p.MessageID
+				replies <- pa
+			case 2:
+				pr := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				pr.MessageID = p.MessageID
+				replies <- pr
+			}
+			p.Qos, p.MessageID, p.Dup, p.Retain = 0, 0, false, false
+			replies <- p
+			continue
+		case *packets.PubrelPacket:
+			pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			pc.MessageID = p.MessageID
+			replies <- pc
+		case *packets.SubscribePacket:
+			sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			sa.MessageID = p.MessageID
+			sa.GrantedQoss = append([]byte(nil), p.Qoss...)
+			replies <- sa
+		case *packets.UnsubscribePacket:
+			ua := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ua.MessageID = p.MessageID
+			replies <- ua
+		case *packets.PingreqPacket:
+			replies <- packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			cp.Release()
+			tc.Close()
+			return
+		}
+		cp.Release()
+	}
+}
+
+// loopbackClient connects a client to a new loopback broker and subscribes it
+// to everything, counting the messages echoed back in received
+func loopbackClient(tb testing.TB, received *int64, done chan struct{}, want int64) *Client {
+	broker := &loopbackBroker{}
+	c := NewClient(broker.options("loopback"))
+	// the debug log would take most of the time measured
+	c.SetLogLevel(LogLevelError)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		tb.Fatalf("connect over loopback failed")
+	}
+	st := c.Subscribe("bench/#", 0, func(c *Client, m Message) {
+		if atomic.AddInt64(received, 1) == want {
+			close(done)
+		}
+	})
+	if !st.WaitTimeout(2*time.Second) || st.Error() != nil {
+		tb.Fatalf("subscribe over loopback failed")
+	}
+	return c
+}
+
+func Test_LoopbackBroker(t *testing.T) {
+	const messages = 1000
+	for _, qos := range []byte{0, 1, 2} {
+		var received int64
+		done := make(chan struct{})
+		c := loopbackClient(t, &received, done, messages)
+		var last Token
+		for i := 0; i < messages; i++ {
+			last = c.Publish("bench/topic", qos, false, "payload")
+		}
+		if !last.WaitTimeout(5*time.Second) || last.Error() != nil {
+			t.Fatalf("QoS %d publish failed", qos)
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("QoS %d: %d of %d messages echoed", qos, atomic.LoadInt64(&received), messages)
+		}
+		c.Disconnect(0)
+	}
+}
+
+// BenchmarkLoopbackPublishQos0 measures the round trip of QoS 0 messages
+// through the loopback broker, publishing b.N of them and waiting for all
+// of them to be delivered back. Run it with -benchtime=1000000x for a
+// million messages.
+func BenchmarkLoopbackPublishQos0(b *testing.B) {
+	var received int64
+	done := make(chan struct{})
+	c := loopbackClient(b, &received, done, int64(b.N))
+	defer c.Disconnect(0)
+	payload := []byte("loopback benchmark payload")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		c.Publish("bench/topic", 0, false, payload)
+	}
+	<-done
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msgs/s")
+}
@@ -16,8 +16,11 @@ package mqtt
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
 )
 
 type DummyToken struct{}
@@ -109,3 +112,114 @@ func Test_messageids_mix(t *testing.T) {
 	<-done
 	<-done
 }
+
+// countingAllocator hands out ids in increasing order, wrapping after 65535
+type countingAllocator struct {
+	sync.Mutex
+	next  uint16
+	freed []uint16
+}
+
+func (a *countingAllocator) Next() (uint16, bool) {
+	a.Lock()
+	defer a.Unlock()
+	a.next++
+	return a.next, true
+}
+
+func (a *countingAllocator) Free(id uint16) {
+	a.Lock()
+	defer a.Unlock()
+	a.freed = append(a.freed, id)
+}
+
+func Test_messageIds_allocator(t *testing.T) {
+	alloc := &countingAllocator{next: 65533}
+	mids := &messageIds{index: make(map[uint16]Token), alloc: alloc}
+	mids.claimID(2, &DummyToken{})
+
+	// 0 and the claimed 2 are skipped when wrapping
+	var got []uint16
+	for i := 0; i < 4; i++ {
+		got = append(got, mids.getID(&DummyToken{}))
+	}
+	if fmt.Sprint(got) != "[65534 65535 1 3]" {
+		t.Fatalf("allocated %v", got)
+	}
+	mids.freeID(65535)
+	mids.freeID(65535)
+	mids.freeID(2)
+	if fmt.Sprint(alloc.freed) != "[65535 2]" {
+		t.Fatalf("freed %v, each id in use should be freed once", alloc.freed)
+	}
+}
+
+func Test_MessageIDAllocator(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	alloc := &countingAllocator{next: 99}
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("allocator")
+	ops.SetKeepAlive(0)
+	ops.SetMessageIDAllocator(alloc)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	defer c.Disconnect(0)
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	for want := uint16(100); want < 103; want++ {
+		token := c.Publish("allocator/topic", 1, false, "payload")
+		pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+		if !ok || pp.MessageID != want {
+			t.Fatalf("expected a publish with id %d, got %v", want, pp)
+		}
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.MessageID = pp.MessageID
+		conn.send(t, pa)
+		if !token.WaitTimeout(time.Second) {
+			t.Fatalf("publish %d not acknowledged", want)
+		}
+	}
+	token := c.Subscribe("allocator/#", 1, nil)
+	if sp := conn.subscribeAndAck(t); sp.MessageID != 103 {
+		t.Fatalf("expected a subscribe with id 103, got %d", sp.MessageID)
+	}
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("subscribe not acknowledged")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		alloc.Lock()
+		freed := fmt.Sprint(alloc.freed)
+		alloc.Unlock()
+		if freed == "[100 101 102 103]" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("freed %s, expected every id", freed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_freeCancelled(t *testing.T) {
+	mids := &messageIds{index: make(map[uint16]Token)}
+	parent := newToken(packets.Subscribe).(*SubscribeToken)
+	part := newToken(packets.Subscribe).(*SubscribeToken)
+	part.parent = parent
+	unsub := newToken(packets.Unsubscribe).(*UnsubscribeToken)
+	live := newToken(packets.Subscribe).(*SubscribeToken)
+	partID, unsubID, liveID := mids.getID(part), mids.getID(unsub), mids.getID(live)
+
+	parent.cancelled, unsub.cancelled = 1, 1
+	mids.freeCancelled()
+	if mids.getToken(partID) != nil || mids.getToken(unsubID) != nil {
+		t.Fatalf("ids of cancelled flows were kept")
+	}
+	if mids.getToken(liveID) != live {
+		t.Fatalf("id of a flow which wasn't cancelled was freed")
+	}
+}
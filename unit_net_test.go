@@ -0,0 +1,3419 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
+)
+
+func Test_ReadTimeout_reconnect(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	lost := make(chan error, 1)
+	connected := make(chan struct{}, 2)
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("readtimeout")
+	ops.SetKeepAlive(0)
+	ops.SetReadTimeout(200 * time.Millisecond)
+	ops.SetOnConnectHandler(func(c *Client) { connected <- struct{}{} })
+	ops.SetConnectionLostHandler(func(c *Client, err error) { lost <- err })
+	c := NewClient(ops)
+
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	// the broker goes silent without closing the socket
+	first := broker.accept(t, time.Second)
+	defer first.Close()
+	<-connected
+
+	select {
+	case err := <-lost:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("expected timeout error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("read timeout did not trigger connection lost")
+	}
+
+	second := broker.accept(t, 2*time.Second)
+	defer second.Close()
+	<-connected
+	c.Disconnect(0)
+}
+
+func Test_ReadTimeout_keepalive(t *testing.T) {
+	ops := NewClientOptions().SetKeepAlive(30 * time.Second).SetReadTimeout(5 * time.Second)
+	c := NewClient(ops)
+
+	if c.options.ReadTimeout <= c.options.KeepAlive {
+		t.Fatalf("read timeout %v not larger than keepalive %v", c.options.ReadTimeout, c.options.KeepAlive)
+	}
+}
+
+func Test_AckPolicy_redelivery(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	var acked bool
+	decided := make(chan Message, 2)
+	connected := make(chan struct{}, 2)
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("ackpolicy")
+	ops.SetKeepAlive(0)
+	ops.SetOnConnectHandler(func(c *Client) { connected <- struct{}{} })
+	ops.SetAckPolicy(func(c *Client, m Message) bool {
+		// defer the first delivery, accept the redelivery
+		ack := acked
+		acked = true
+		decided <- m
+		return ack
+	})
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	first := broker.accept(t, time.Second)
+	<-connected
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 7
+	pub.TopicName = []byte("ack/policy")
+	pub.Payload = []byte("payload")
+	first.send(t, pub)
+
+	select {
+	case m := <-decided:
+		if m.MessageID() != 7 || string(m.Payload()) != "payload" {
+			t.Fatalf("policy got wrong message: %d %s", m.MessageID(), m.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ack policy was not called")
+	}
+	if cp := first.receive(200 * time.Millisecond); cp != nil {
+		t.Fatalf("expected no ack, got %v", cp)
+	}
+	first.Close()
+
+	second := broker.accept(t, 2*time.Second)
+	defer second.Close()
+	<-connected
+	pub.Dup = true
+	second.send(t, pub)
+
+	select {
+	case m := <-decided:
+		if !m.Duplicate() {
+			t.Fatalf("redelivered message should be a duplicate")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ack policy was not called for redelivery")
+	}
+	cp := second.receive(time.Second)
+	pa, ok := cp.(*packets.PubackPacket)
+	if !ok || pa.MessageID != 7 {
+		t.Fatalf("expected puback for 7, got %v", cp)
+	}
+	c.Disconnect(0)
+}
+
+func Test_ManualAck_nack_redelivery(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	received := make(chan Message, 3)
+	connected := make(chan struct{}, 2)
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("manualack")
+	ops.SetKeepAlive(0)
+	ops.SetManualAck(true)
+	ops.SetOnConnectHandler(func(c *Client) { connected <- struct{}{} })
+	ops.SetDefaultPublishHandler(func(c *Client, m Message) {
+		am := m.(AckableMessage)
+		if m.Duplicate() && m.Qos() == 1 {
+			am.Ack()
+		} else {
+			am.Nack()
+		}
+		// acking after a nack must have no effect
+		am.Ack()
+		received <- m
+	})
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	first := broker.accept(t, time.Second)
+	<-connected
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 9
+	pub.TopicName = []byte("manual/ack")
+	pub.Payload = []byte("payload")
+	first.send(t, pub)
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("message not delivered")
+	}
+	if cp := first.receive(200 * time.Millisecond); cp != nil {
+		t.Fatalf("expected no ack after nack, got %v", cp)
+	}
+	first.Close()
+
+	second := broker.accept(t, 2*time.Second)
+	defer second.Close()
+	<-connected
+	pub.Dup = true
+	second.send(t, pub)
+
+	select {
+	case m := <-received:
+		if !m.Duplicate() || string(m.Payload()) != "payload" {
+			t.Fatalf("bad redelivered message")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not redelivered")
+	}
+	cp := second.receive(time.Second)
+	if pa, ok := cp.(*packets.PubackPacket); !ok || pa.MessageID != 9 {
+		t.Fatalf("expected puback for 9, got %v", cp)
+	}
+
+	// a nacked QoS 2 message gets no pubrec
+	pub.Qos = 2
+	pub.Dup = false
+	pub.MessageID = 10
+	second.send(t, pub)
+	<-received
+	if cp := second.receive(200 * time.Millisecond); cp != nil {
+		t.Fatalf("expected no pubrec after nack, got %v", cp)
+	}
+	c.Disconnect(0)
+}
+
+func Test_ManualAck_noRoute(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("manualacknoroute")
+	ops.SetKeepAlive(0)
+	ops.SetManualAck(true)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	defer c.Disconnect(0)
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	// no handler can ack a message matching no route
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.Qos = 1
+	pub.MessageID = 11
+	pub.TopicName = []byte("no/route")
+	conn.send(t, pub)
+	cp := conn.receive(time.Second)
+	if pa, ok := cp.(*packets.PubackPacket); !ok || pa.MessageID != 11 {
+		t.Fatalf("expected puback for 11, got %v", cp)
+	}
+	c.acksLock.Lock()
+	pending := len(c.acks)
+	c.acksLock.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d acks left pending", pending)
+	}
+}
+
+func Test_CustomOpenConnectionFn_pipe(t *testing.T) {
+	conns := make(chan *testConn, 2)
+	var uris []string
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("pipe")
+	ops.SetKeepAlive(0)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		uris = append(uris, uri.String())
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	connected := make(chan struct{}, 2)
+	ops.SetOnConnectHandler(func(c *Client) { connected <- struct{}{} })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	first := <-conns
+	<-connected
+
+	token := c.Publish("pipe/topic", 0, false, "hello")
+	cp := first.receive(time.Second)
+	if pp, ok := cp.(*packets.PublishPacket); !ok || string(pp.Payload) != "hello" {
+		t.Fatalf("expected publish over pipe, got %v", cp)
+	}
+	token.Wait()
+
+	// losing the connection calls the factory again
+	first.Close()
+	select {
+	case second := <-conns:
+		defer second.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatalf("factory was not called on reconnect")
+	}
+	<-connected
+	if len(uris) != 2 || uris[0] != "pipe://broker" {
+		t.Fatalf("factory called with %v", uris)
+	}
+	c.Disconnect(0)
+}
+
+func Test_Publish_order_mixed_qos(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("ordering")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	const count = 50
+	go func() {
+		for i := 0; i < count; i++ {
+			c.Publish("order/topic", byte(i%2), false, strconv.Itoa(i))
+		}
+	}()
+	for i := 0; i < count; i++ {
+		cp := conn.receive(time.Second)
+		pp, ok := cp.(*packets.PublishPacket)
+		if !ok {
+			t.Fatalf("expected publish %d, got %v", i, cp)
+		}
+		if string(pp.Payload) != strconv.Itoa(i) || pp.Qos != byte(i%2) {
+			t.Fatalf("publish %d arrived out of order: qos %d payload %s", i, pp.Qos, pp.Payload)
+		}
+		if pp.Qos == 1 {
+			pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			pa.MessageID = pp.MessageID
+			conn.send(t, pa)
+		}
+	}
+	c.Disconnect(0)
+}
+
+func Test_Flush(t *testing.T) {
+	conns := make(chan *testConn, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("flush")
+	ops.SetKeepAlive(0)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		// writes to a pipe block until the broker side reads them
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+	defer conn.Close()
+
+	const count = 5
+	for i := 0; i < count; i++ {
+		c.Publish("flush/topic", 0, false, strconv.Itoa(i))
+	}
+	flushed := make(chan bool, 1)
+	go func() { flushed <- c.Flush(2 * time.Second) }()
+	for i := 0; i < count; i++ {
+		select {
+		case <-flushed:
+			t.Fatalf("flush returned before publish %d was written", i)
+		default:
+		}
+		if _, ok := conn.receive(time.Second).(*packets.PublishPacket); !ok {
+			t.Fatalf("expected publish %d", i)
+		}
+	}
+	select {
+	case ok := <-flushed:
+		if !ok {
+			t.Fatalf("flush timed out")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("flush did not return after queues drained")
+	}
+	if c.Flush(time.Second) != true {
+		t.Fatalf("flush of empty queues failed")
+	}
+	c.Disconnect(0)
+}
+
+func Test_PublishBytes_qos0(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("publishbytes")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = []byte("status/topic")
+	pub.Payload = []byte("online")
+	encoded, err := pub.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+
+	// the same message sent normally and pre-encoded must be identical on the wire
+	wire := make([][]byte, 2)
+	c.Publish("status/topic", 0, false, "online")
+	c.PublishBytes(encoded)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := range wire {
+		wire[i] = make([]byte, len(encoded))
+		if _, err := io.ReadFull(conn.r, wire[i]); err != nil {
+			t.Fatalf("read of publish %d failed: %v", i, err)
+		}
+	}
+	if !bytes.Equal(wire[0], encoded) || !bytes.Equal(wire[1], encoded) {
+		t.Fatalf("pre-encoded publish differs: %x %x %x", encoded, wire[0], wire[1])
+	}
+
+	if token := c.PublishBytes([]byte{0x30, 5}); token.Wait() && token.Error() == nil {
+		t.Fatalf("truncated packet was accepted")
+	}
+	c.Disconnect(0)
+}
+
+// tickLimiter allows one event per tick
+type tickLimiter struct {
+	ticker *time.Ticker
+}
+
+func (l *tickLimiter) Wait(ctx context.Context) error {
+	select {
+	case <-l.ticker.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func Test_PublishRateLimiter(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	limiter := &tickLimiter{time.NewTicker(100 * time.Millisecond)}
+	defer limiter.ticker.Stop()
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("ratelimit")
+	ops.SetKeepAlive(0)
+	ops.SetPublishRateLimiter(limiter)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	const count = 20
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		c.Publish("rate/topic", 0, false, strconv.Itoa(i))
+	}
+	for i := 0; i < count; i++ {
+		if _, ok := conn.receive(time.Second).(*packets.PublishPacket); !ok {
+			t.Fatalf("expected publish %d", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 1800*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("%d publishes at 10/s took %v", count, elapsed)
+	}
+
+	// a disconnect isn't held up by publishes waiting on the limiter
+	for i := 0; i < count; i++ {
+		c.Publish("rate/topic", 0, false, "queued")
+	}
+	start = time.Now()
+	c.Disconnect(0)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("disconnect took %v", elapsed)
+	}
+}
+
+func Test_PublishRateLimiter_controlPackets(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	// publishes wait far longer than the test
+	limiter := &tickLimiter{time.NewTicker(time.Hour)}
+	defer limiter.ticker.Stop()
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("ratelimitcontrol")
+	ops.SetKeepAlive(0)
+	ops.SetPublishRateLimiter(limiter)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	pt := c.Publish("rate/topic", 1, false, "held")
+	token := c.Subscribe("rate/control", 1, nil)
+	conn.subscribeAndAck(t)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe held up by the rate limiter: %v", token.Error())
+	}
+
+	// the held publish is kept for the next connection
+	c.Disconnect(0)
+	if pt.WaitTimeout(100 * time.Millisecond) {
+		t.Fatalf("held publish completed with %v", pt.Error())
+	}
+}
+
+func Test_SubscribeToken_FilterTokens(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("filters")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	defer c.Disconnect(0)
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	token := c.SubscribeMultiple(map[string]byte{"f/0": 0, "f/1": 1, "f/2": 2}, nil).(*SubscribeToken)
+	filters := token.FilterTokens()
+	if len(filters) != 3 {
+		t.Fatalf("got %d filter tokens for 3 filters", len(filters))
+	}
+	for filter, ft := range filters {
+		if ft.Filter() != filter {
+			t.Fatalf("token for %s is for %s", filter, ft.Filter())
+		}
+		if ft.WaitTimeout(10 * time.Millisecond) {
+			t.Fatalf("token for %s completed before the suback", filter)
+		}
+	}
+
+	cp := conn.receive(time.Second)
+	sp, ok := cp.(*packets.SubscribePacket)
+	if !ok {
+		t.Fatalf("expected subscribe, got %v", cp)
+	}
+	// the broker downgrades f/2 to QoS 1, grants are by position
+	want := make(map[string]byte)
+	sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	sa.MessageID = sp.MessageID
+	for i, topic := range sp.Topics {
+		qos := sp.Qoss[i]
+		if topic == "f/2" {
+			qos = 1
+		}
+		sa.GrantedQoss = append(sa.GrantedQoss, qos)
+		want[topic] = qos
+	}
+	conn.send(t, sa)
+
+	for filter, ft := range filters {
+		if !ft.WaitTimeout(time.Second) || ft.Error() != nil {
+			t.Fatalf("token for %s did not complete: %v", filter, ft.Error())
+		}
+		if ft.Qos() != want[filter] {
+			t.Fatalf("token for %s granted QoS %d, expected %d", filter, ft.Qos(), want[filter])
+		}
+	}
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe did not complete: %v", token.Error())
+	}
+}
+
+func Test_SetSubscriptions(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("setsubs")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	defer c.Disconnect(0)
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	received := make(chan string, 10)
+	handler := func(name string) MessageHandler {
+		return func(c *Client, m Message) { received <- name + ":" + m.Topic() }
+	}
+	subToken := c.SubscribeMultiple(map[string]byte{"a": 1, "b": 1}, handler("old"))
+	conn.subscribeAndAck(t)
+	if !subToken.WaitTimeout(time.Second) || subToken.Error() != nil {
+		t.Fatalf("subscribe did not complete: %v", subToken.Error())
+	}
+
+	token := c.SetSubscriptions(map[string]Subscription{
+		"b": {Qos: 1, Handler: handler("new")},
+		"c": {Qos: 0, Handler: handler("new")},
+	})
+	sp := conn.subscribeAndAck(t)
+	if fmt.Sprint(sp.Topics, sp.Qoss) != "[c] [0]" {
+		t.Fatalf("subscribed to %v with %v, expected only c", sp.Topics, sp.Qoss)
+	}
+	up, ok := conn.receive(time.Second).(*packets.UnsubscribePacket)
+	if !ok || fmt.Sprint(up.Topics) != "[a]" {
+		t.Fatalf("expected an unsubscribe from a only, got %v", up)
+	}
+	ua := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+	ua.MessageID = up.MessageID
+	conn.send(t, ua)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("subscriptions not changed: %v", token.Error())
+	}
+	if cp := conn.receive(100 * time.Millisecond); cp != nil {
+		t.Fatalf("unexpected packet after changing subscriptions: %v", cp)
+	}
+
+	// b kept its subscription but has the new handler
+	sendPublish(t, conn, "b", "1")
+	sendPublish(t, conn, "c", "2")
+	for _, want := range []string{"new:b", "new:c"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("expected %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s not delivered", want)
+		}
+	}
+}
+
+func Test_SubscribeToken_Cancel(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("cancel")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	// the broker never acknowledges the subscribe
+	token := c.Subscribe("cancel/topic", 1, nil).(*SubscribeToken)
+	sp, ok := conn.receive(time.Second).(*packets.SubscribePacket)
+	if !ok {
+		t.Fatalf("expected a subscribe")
+	}
+	if token.WaitTimeout(50 * time.Millisecond) {
+		t.Fatalf("subscribe completed without a suback")
+	}
+	token.Cancel()
+	if !token.WaitTimeout(time.Second) || token.Error() != ErrCancelled {
+		t.Fatalf("expected %v, got %v", ErrCancelled, token.Error())
+	}
+	// the id stays reserved for the suback which may still come
+	if c.getToken(sp.MessageID) == nil {
+		t.Fatalf("message id %d freed before its suback", sp.MessageID)
+	}
+	token.Cancel()
+	next := c.Subscribe("cancel/next", 1, nil)
+	nsp, ok := conn.receive(time.Second).(*packets.SubscribePacket)
+	if !ok || nsp.MessageID == sp.MessageID {
+		t.Fatalf("expected a subscribe with a new id, got %v", nsp)
+	}
+
+	// a suback arriving late is dropped, leaving the client working
+	sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	sa.MessageID = sp.MessageID
+	sa.GrantedQoss = sp.Qoss
+	conn.send(t, sa)
+	if next.WaitTimeout(100 * time.Millisecond) {
+		t.Fatalf("late suback completed the next subscribe")
+	}
+	if len(token.Result()) != 0 {
+		t.Fatalf("cancelled subscribe got results %v", token.Result())
+	}
+	if c.getToken(sp.MessageID) != nil {
+		t.Fatalf("message id %d not freed by its suback", sp.MessageID)
+	}
+	sa = packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	sa.MessageID = nsp.MessageID
+	sa.GrantedQoss = nsp.Qoss
+	conn.send(t, sa)
+	if !next.WaitTimeout(time.Second) || next.Error() != nil {
+		t.Fatalf("subscribe after cancelling failed: %v", next.Error())
+	}
+
+	// the filter of a cancelled subscribe no longer counts as subscribed to,
+	// even with the QoS it had before
+	handler := func(c *Client, m Message) {}
+	token = c.Subscribe("cancel/next", 2, handler).(*SubscribeToken)
+	if _, ok := conn.receive(time.Second).(*packets.SubscribePacket); !ok {
+		t.Fatalf("expected a subscribe")
+	}
+	token.Cancel()
+	if c.msgRouter.getRoute("cancel/next") != nil {
+		t.Fatalf("route kept after cancelling")
+	}
+	next = c.Subscribe("cancel/next", 1, handler)
+	if sp := conn.subscribeAndAck(t); fmt.Sprint(sp.Topics) != "[cancel/next]" {
+		t.Fatalf("subscribed to %v", sp.Topics)
+	}
+	if !next.WaitTimeout(time.Second) || next.Error() != nil {
+		t.Fatalf("subscribe after cancelling failed: %v", next.Error())
+	}
+
+	unsub := c.Unsubscribe("cancel/next").(*UnsubscribeToken)
+	if _, ok := conn.receive(time.Second).(*packets.UnsubscribePacket); !ok {
+		t.Fatalf("expected an unsubscribe")
+	}
+	unsub.Cancel()
+	if !unsub.WaitTimeout(time.Second) || unsub.Error() != ErrCancelled {
+		t.Fatalf("expected %v, got %v", ErrCancelled, unsub.Error())
+	}
+	c.Disconnect(0)
+}
+
+func Test_Subscribe_duplicate(t *testing.T) {
+	for _, policy := range []DuplicateSubscriptionPolicy{DuplicateSubscriptionUpdate, DuplicateSubscriptionError, DuplicateSubscriptionResend} {
+		broker := newTestBroker(t)
+		ops := NewClientOptions().AddBroker(broker.url()).SetClientID("duplicate")
+		ops.SetKeepAlive(0)
+		ops.SetDuplicateSubscriptions(policy)
+		c := NewClient(ops)
+		if !c.Connect().WaitTimeout(2 * time.Second) {
+			t.Fatalf("connect timed out")
+		}
+		conn := broker.accept(t, time.Second)
+
+		received := make(chan string, 2)
+		token := c.Subscribe("dup/topic", 1, func(c *Client, m Message) { received <- "first" })
+		conn.subscribeAndAck(t)
+		if !token.WaitTimeout(time.Second) || token.Error() != nil {
+			t.Fatalf("policy %d: first subscribe failed", policy)
+		}
+
+		token = c.Subscribe("dup/topic", 1, func(c *Client, m Message) { received <- "second" })
+		var want string
+		switch policy {
+		case DuplicateSubscriptionUpdate:
+			if !token.WaitTimeout(time.Second) || token.Error() != nil {
+				t.Fatalf("callback update failed: %v", token.Error())
+			}
+			if cp := conn.receive(200 * time.Millisecond); cp != nil {
+				t.Fatalf("callback update sent %v", cp)
+			}
+			if qos := token.(*SubscribeToken).Result()["dup/topic"]; qos != 1 {
+				t.Fatalf("callback update reported qos %d", qos)
+			}
+			want = "second"
+
+			// changing the QoS subscribes again
+			token = c.Subscribe("dup/topic", 0, func(c *Client, m Message) { received <- "second" })
+			if sp := conn.subscribeAndAck(t); sp.Qoss[0] != 0 {
+				t.Fatalf("resubscribed with qos %d", sp.Qoss[0])
+			}
+		case DuplicateSubscriptionError:
+			if !token.WaitTimeout(time.Second) || token.Error() != ErrDuplicateSubscription {
+				t.Fatalf("expected ErrDuplicateSubscription, got %v", token.Error())
+			}
+			want = "first"
+		case DuplicateSubscriptionResend:
+			conn.subscribeAndAck(t)
+			if !token.WaitTimeout(time.Second) || token.Error() != nil {
+				t.Fatalf("resend failed: %v", token.Error())
+			}
+			want = "second"
+		}
+
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = []byte("dup/topic")
+		pub.Payload = []byte("payload")
+		conn.send(t, pub)
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("policy %d: message went to the %s handler", policy, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("policy %d: message not delivered", policy)
+		}
+		c.Disconnect(0)
+		conn.Close()
+		broker.close()
+	}
+}
+
+func Test_Subscribe_refused_not_duplicate(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("refused")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	defer c.Disconnect(0)
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	token := c.Subscribe("refused/topic", 1, nil)
+	sp, ok := conn.receive(time.Second).(*packets.SubscribePacket)
+	if !ok {
+		t.Fatalf("expected subscribe")
+	}
+	sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	sa.MessageID = sp.MessageID
+	sa.GrantedQoss = []byte{0x80}
+	conn.send(t, sa)
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("subscribe did not complete")
+	}
+
+	// the filter was refused so subscribing again is not a duplicate
+	token = c.Subscribe("refused/topic", 1, nil)
+	conn.subscribeAndAck(t)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("second subscribe failed: %v", token.Error())
+	}
+}
+
+func Test_FileStore_resend_after_restart(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+	dir, err := ioutil.TempDir("", "paho-store")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	newClient := func() *Client {
+		ops := NewClientOptions().AddBroker(broker.url()).SetClientID("restart")
+		ops.SetKeepAlive(0)
+		ops.SetCleanSession(false)
+		ops.SetStore(NewFileStore(dir))
+		c := NewClient(ops)
+		if !c.Connect().WaitTimeout(2 * time.Second) {
+			t.Fatalf("connect timed out")
+		}
+		return c
+	}
+
+	first := newClient()
+	conn := broker.accept(t, time.Second)
+	first.Publish("store/topic", 1, false, "inflight")
+	cp := conn.receive(time.Second)
+	if pp, ok := cp.(*packets.PublishPacket); !ok || pp.Dup {
+		t.Fatalf("expected first delivery of publish, got %v", cp)
+	}
+	// the process stops before the broker acknowledges the publish
+	conn.Close()
+	first.Disconnect(0)
+
+	second := newClient()
+	conn = broker.accept(t, time.Second)
+	defer conn.Close()
+	cp = conn.receive(time.Second)
+	pp, ok := cp.(*packets.PublishPacket)
+	if !ok || !pp.Dup || pp.Qos != 1 || string(pp.Payload) != "inflight" {
+		t.Fatalf("expected publish to be resent, got %v", cp)
+	}
+	pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	pa.MessageID = pp.MessageID
+	conn.send(t, pa)
+
+	// once acknowledged the publish is removed from the store
+	deadline := time.Now().Add(time.Second)
+	for len(second.persist.All()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("store still holds %v", second.persist.All())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	second.Disconnect(0)
+}
+
+func Test_SubscribeAndWait(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("subscribewait")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	type result struct {
+		m   Message
+		err error
+	}
+	done := make(chan result, 1)
+	later := make(chan Message, 1)
+	go func() {
+		m, err := c.SubscribeAndWait("wait/+", 0, time.Second, func(c *Client, m Message) { later <- m })
+		done <- result{m, err}
+	}()
+	conn.subscribeAndAck(t)
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = []byte("wait/topic")
+	pub.Payload = []byte("first")
+	conn.send(t, pub)
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("SubscribeAndWait failed: %v", r.err)
+	}
+	if r.m.Topic() != "wait/topic" || string(r.m.Payload()) != "first" {
+		t.Fatalf("got wrong message %s %s", r.m.Topic(), r.m.Payload())
+	}
+
+	// the subscription stays with the handler that was given
+	pub.Payload = []byte("second")
+	conn.send(t, pub)
+	select {
+	case m := <-later:
+		if string(m.Payload()) != "second" {
+			t.Fatalf("handler got %s", m.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("later message not delivered to handler")
+	}
+
+	// nothing is published on this topic
+	start := time.Now()
+	go func() {
+		_, err := c.SubscribeAndWait("wait/empty", 0, 200*time.Millisecond, nil)
+		done <- result{nil, err}
+	}()
+	conn.subscribeAndAck(t)
+	if r := <-done; r.err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", r.err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timeout took %v", elapsed)
+	}
+
+	// without a handler the one the topic already had is kept
+	c.AddRoute("kept/topic", func(c *Client, m Message) { later <- m })
+	go func() {
+		m, err := c.SubscribeAndWait("kept/topic", 0, time.Second, nil)
+		done <- result{m, err}
+	}()
+	conn.subscribeAndAck(t)
+	pub.TopicName = []byte("kept/topic")
+	pub.Payload = []byte("first")
+	conn.send(t, pub)
+	if r := <-done; r.err != nil || string(r.m.Payload()) != "first" {
+		t.Fatalf("SubscribeAndWait returned %v, %v", r.m, r.err)
+	}
+	pub.Payload = []byte("second")
+	conn.send(t, pub)
+	select {
+	case m := <-later:
+		if string(m.Payload()) != "second" {
+			t.Fatalf("handler got %s", m.Payload())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("later message not delivered to the existing handler")
+	}
+	c.Disconnect(0)
+}
+
+func Test_outgoing_nil_token(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("niltoken")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	for qos := byte(0); qos < 2; qos++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = qos
+		pub.TopicName = []byte("nil/token")
+		pub.Payload = []byte("fire and forget")
+		c.obound <- &PacketAndToken{p: pub, t: nil}
+
+		cp := conn.receive(time.Second)
+		pp, ok := cp.(*packets.PublishPacket)
+		if !ok || pp.Qos != qos || string(pp.Payload) != "fire and forget" {
+			t.Fatalf("expected qos %d publish, got %v", qos, cp)
+		}
+		if qos > 0 {
+			pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			pa.MessageID = pp.MessageID
+			conn.send(t, pa)
+		}
+	}
+	if !c.Flush(time.Second) || !c.IsConnected() {
+		t.Fatalf("client failed after publishing without a token")
+	}
+	c.Disconnect(0)
+}
+
+func Test_SubscribeToken_reasonString(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("reasonstring")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	token := c.Subscribe("denied/topic", 1, nil)
+	cp := conn.receive(time.Second)
+	sp, ok := cp.(*packets.SubscribePacket)
+	if !ok {
+		t.Fatalf("expected subscribe, got %v", cp)
+	}
+	sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	sa.ProtocolLevel = 5
+	sa.MessageID = sp.MessageID
+	sa.Properties = &packets.Properties{
+		ReasonString:   "not authorized",
+		UserProperties: []packets.UserProperty{{Key: "policy", Value: "acl-7"}},
+	}
+	sa.GrantedQoss = []byte{0x87}
+	conn.send(t, sa)
+
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("subscribe not acknowledged")
+	}
+	st := token.(*SubscribeToken)
+	if st.ReasonString() != "not authorized" {
+		t.Fatalf("reason string %q", st.ReasonString())
+	}
+	if up := st.UserProperties(); len(up) != 1 || up[0].Key != "policy" || up[0].Value != "acl-7" {
+		t.Fatalf("user properties %v", up)
+	}
+	if st.Result()["denied/topic"] != 0x87 {
+		t.Fatalf("result %v", st.Result())
+	}
+	c.Disconnect(0)
+}
+
+func Test_UnsubscribeToken_reasonCodes(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("unsubreasons")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	token := c.Unsubscribe("a/b", "c/d")
+	cp := conn.receive(time.Second)
+	up, ok := cp.(*packets.UnsubscribePacket)
+	if !ok {
+		t.Fatalf("expected unsubscribe, got %v", cp)
+	}
+	ua := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+	ua.ProtocolLevel = 5
+	ua.MessageID = up.MessageID
+	ua.Properties = &packets.Properties{ReasonString: "no subscription for c/d"}
+	ua.ReasonCodes = []byte{0x00, 0x11}
+	conn.send(t, ua)
+
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("unsubscribe not acknowledged")
+	}
+	ut := token.(*UnsubscribeToken)
+	if r := ut.Result(); len(r) != 2 || r["a/b"] != 0x00 || r["c/d"] != 0x11 {
+		t.Fatalf("result %v", r)
+	}
+	if ut.ReasonString() != "no subscription for c/d" {
+		t.Fatalf("reason string %q", ut.ReasonString())
+	}
+	c.Disconnect(0)
+}
+
+func Test_DecodeErrorHandler(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	type decodeFailure struct {
+		fh   packets.FixedHeader
+		body []byte
+		err  error
+	}
+	failures := make(chan decodeFailure, 1)
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("decodeerror")
+	ops.SetKeepAlive(0)
+	ops.SetAutoReconnect(false)
+	lost := make(chan error, 1)
+	ops.SetConnectionLostHandler(func(c *Client, err error) { lost <- err })
+	ops.SetDecodeErrorHandler(func(fh packets.FixedHeader, body []byte, err error) {
+		failures <- decodeFailure{fh, body, err}
+	})
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	// a QoS 1 publish whose topic is longer than the packet
+	conn.Write([]byte{packets.Publish<<4 | 0x02, 3, 0x00, 0x05, 'a'})
+	select {
+	case f := <-failures:
+		if f.fh.MessageType != packets.Publish || f.fh.RemainingLength != 3 {
+			t.Errorf("fixed header %v", f.fh.String())
+		}
+		if !bytes.Equal(f.body, []byte{0x00, 0x05, 'a'}) || f.err == nil {
+			t.Errorf("body %v and error %v", f.body, f.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("decode error not reported")
+	}
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatalf("connection not lost after the decode error")
+	}
+}
+
+func Test_SubscribeMultiple_split(t *testing.T) {
+	const maxPacketSize = 256
+	conns := make(chan *testConn, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("split")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			r := bufio.NewReader(server)
+			if _, err := packets.ReadPacket(r); err != nil {
+				return
+			}
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ProtocolLevel = 5
+			ca.Properties = &packets.Properties{MaximumPacketSize: maxPacketSize}
+			w := bufio.NewWriter(server)
+			ca.Write(w)
+			w.Flush()
+			conns <- &testConn{Conn: server, r: r, level: 5}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+	defer conn.Close()
+
+	filters := make(map[string]byte)
+	for i := 0; i < 100; i++ {
+		filters[fmt.Sprintf("split/filter/%03d", i)] = 1
+	}
+	token := c.SubscribeMultiple(filters, nil)
+
+	var subs []*packets.SubscribePacket
+	seen := make(map[string]bool)
+	for len(seen) < len(filters) {
+		cp := conn.receive(time.Second)
+		sp, ok := cp.(*packets.SubscribePacket)
+		if !ok {
+			t.Fatalf("expected subscribe after %d filters, got %v", len(seen), cp)
+		}
+		var b bytes.Buffer
+		sp.Write(&b)
+		if b.Len() > maxPacketSize {
+			t.Fatalf("subscribe of %d bytes exceeds maximum packet size", b.Len())
+		}
+		for _, topic := range sp.Topics {
+			seen[topic] = true
+		}
+		subs = append(subs, sp)
+	}
+	if len(subs) < 2 {
+		t.Fatalf("subscribe was not split")
+	}
+
+	// acknowledge in reverse, the token completes with the last suback
+	for i := len(subs) - 1; i >= 0; i-- {
+		if token.WaitTimeout(20 * time.Millisecond) {
+			t.Fatalf("token completed with %d subacks outstanding", i+1)
+		}
+		sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+		sa.ProtocolLevel = 5
+		sa.MessageID = subs[i].MessageID
+		sa.GrantedQoss = subs[i].Qoss
+		conn.send(t, sa)
+	}
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("token not completed after all subacks")
+	}
+	result := token.(*SubscribeToken).Result()
+	for topic := range filters {
+		if qos, ok := result[topic]; !ok || qos != 1 {
+			t.Fatalf("filter %s not subscribed: %v", topic, result[topic])
+		}
+	}
+	c.Disconnect(0)
+}
+
+func Test_MaxTopicsPerSubscribe(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("maxtopics")
+	ops.SetKeepAlive(0)
+	ops.SetMaxTopicsPerSubscribe(3)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	defer c.Disconnect(0)
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	filters := make(map[string]byte)
+	for i := 0; i < 8; i++ {
+		filters[fmt.Sprintf("maxtopics/%d", i)] = 1
+	}
+	token := c.SubscribeMultiple(filters, nil)
+	var sizes []int
+	seen := make(map[string]bool)
+	for len(seen) < len(filters) {
+		sp := conn.subscribeAndAck(t)
+		for _, topic := range sp.Topics {
+			seen[topic] = true
+		}
+		sizes = append(sizes, len(sp.Topics))
+	}
+	if fmt.Sprint(sizes) != "[3 3 2]" {
+		t.Fatalf("subscribe split into packets of %v filters, expected [3 3 2]", sizes)
+	}
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("token not completed after all subacks: %v", token.Error())
+	}
+	result := token.(*SubscribeToken).Result()
+	for topic := range filters {
+		if qos, ok := result[topic]; !ok || qos != 1 {
+			t.Fatalf("filter %s not subscribed: %v", topic, result)
+		}
+	}
+}
+
+func Test_PublishWithTTL_expired(t *testing.T) {
+	conns := make(chan *testConn, 2)
+	gate := make(chan struct{})
+	var opened int32
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("ttl")
+	ops.SetKeepAlive(0)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		if atomic.AddInt32(&opened, 1) > 1 {
+			// hold the reconnect until the test is ready
+			<-gate
+		}
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	(<-conns).Close()
+	for c.connectionStatus() != reconnecting {
+		time.Sleep(time.Millisecond)
+	}
+
+	expired := GetExpiredCount()
+	stale := c.PublishWithTTL("ttl/topic", 1, false, "stale", 50*time.Millisecond)
+	fresh := c.PublishWithTTL("ttl/topic", 1, false, "fresh", time.Minute)
+	forever := c.Publish("ttl/topic", 1, false, "forever")
+	time.Sleep(100 * time.Millisecond)
+	close(gate)
+
+	conn := <-conns
+	defer conn.Close()
+	for _, want := range []string{"fresh", "forever"} {
+		cp := conn.receive(time.Second)
+		pp, ok := cp.(*packets.PublishPacket)
+		if !ok || string(pp.Payload) != want {
+			t.Fatalf("expected %s publish, got %v", want, cp)
+		}
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.MessageID = pp.MessageID
+		conn.send(t, pa)
+	}
+	if !stale.WaitTimeout(time.Second) || stale.Error() != ErrExpired {
+		t.Fatalf("expected ErrExpired, got %v", stale.Error())
+	}
+	if !fresh.WaitTimeout(time.Second) || !forever.WaitTimeout(time.Second) {
+		t.Fatalf("unexpired publishes not completed")
+	}
+	if n := GetExpiredCount() - expired; n != 1 {
+		t.Fatalf("%d publishes counted as expired", n)
+	}
+	c.Disconnect(0)
+}
+
+func Test_IsConnected_forcedLoss(t *testing.T) {
+	conns := make(chan *testConn, 2)
+	gate := make(chan struct{})
+	var opened int32
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("isconnected")
+	ops.SetKeepAlive(0)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		if atomic.AddInt32(&opened, 1) > 1 {
+			<-gate
+		}
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	var c *Client
+	// the flag is cleared before OnError runs, record what it sees
+	seen := make(chan bool, 1)
+	ops.SetOnErrorHandler(func(err error) { seen <- c.IsConnected() })
+	c = NewClient(ops)
+	if c.IsConnected() {
+		t.Fatalf("client should not be connected before Connect")
+	}
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	if !c.IsConnected() {
+		t.Fatalf("client should be connected")
+	}
+
+	(<-conns).Close()
+	select {
+	case connected := <-seen:
+		if connected {
+			t.Fatalf("IsConnected still true after the connection failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("connection loss was not reported")
+	}
+	if token := c.Publish("isconnected/topic", 1, false, "queued"); token.WaitTimeout(100*time.Millisecond) && token.Error() != nil {
+		t.Fatalf("publish while reconnecting should be queued, got %v", token.Error())
+	}
+
+	close(gate)
+	conn := <-conns
+	defer conn.Close()
+	conn.receive(time.Second)
+	if !c.IsConnected() {
+		t.Fatalf("client should be connected again after reconnecting")
+	}
+	c.Disconnect(0)
+	if c.IsConnected() {
+		t.Fatalf("client should not be connected after Disconnect")
+	}
+}
+
+func Test_PublishWhenDisconnected(t *testing.T) {
+	for _, policy := range []PublishWhenDisconnectedPolicy{PublishWhenDisconnectedError, PublishWhenDisconnectedQueue, PublishWhenDisconnectedBlock} {
+		// a client which was never connected fails whatever the policy
+		c := NewClient(NewClientOptions().SetPublishWhenDisconnected(policy))
+		if token := c.Publish("policy/topic", 1, false, "payload"); !token.WaitTimeout(time.Second) || token.Error() != ErrNotConnected {
+			t.Fatalf("policy %d: expected %v before Connect, got %v", policy, ErrNotConnected, token.Error())
+		}
+
+		conns := make(chan *testConn, 2)
+		gate := make(chan struct{})
+		var opened int32
+		ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("whendisconnected")
+		ops.SetKeepAlive(0)
+		ops.SetPublishWhenDisconnected(policy)
+		ops.SetConnectionLostHandler(func(c *Client, err error) {})
+		ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+			if atomic.AddInt32(&opened, 1) > 1 {
+				<-gate
+			}
+			client, server := net.Pipe()
+			go func() {
+				if tc, err := handshake(server); err == nil {
+					conns <- tc
+				}
+			}()
+			return client, nil
+		})
+		c = NewClient(ops)
+		if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+			t.Fatalf("connect over pipe failed")
+		}
+		(<-conns).Close()
+		for c.IsConnected() {
+			time.Sleep(time.Millisecond)
+		}
+
+		tokens := make(chan Token, 1)
+		go func() { tokens <- c.Publish("policy/topic", 1, false, "payload") }()
+		var token Token
+		select {
+		case token = <-tokens:
+		case <-time.After(100 * time.Millisecond):
+		}
+		switch policy {
+		case PublishWhenDisconnectedError:
+			if token == nil || !token.Wait() || token.Error() != ErrNotConnected {
+				t.Fatalf("expected publish to fail straight away with %v", ErrNotConnected)
+			}
+		case PublishWhenDisconnectedQueue:
+			if token == nil || token.WaitTimeout(100*time.Millisecond) {
+				t.Fatalf("expected publish to be queued")
+			}
+		case PublishWhenDisconnectedBlock:
+			if token != nil {
+				t.Fatalf("expected publish to block until reconnected")
+			}
+		}
+
+		close(gate)
+		conn := <-conns
+		if token == nil {
+			select {
+			case token = <-tokens:
+			case <-time.After(time.Second):
+				t.Fatalf("publish still blocked after reconnecting")
+			}
+		}
+		if policy != PublishWhenDisconnectedError {
+			pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+			if !ok {
+				t.Fatalf("policy %d: expected the publish after reconnecting", policy)
+			}
+			pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			pa.MessageID = pp.MessageID
+			conn.send(t, pa)
+			if !token.WaitTimeout(time.Second) || token.Error() != nil {
+				t.Fatalf("policy %d: publish not completed, got %v", policy, token.Error())
+			}
+		}
+		c.Disconnect(0)
+		conn.Close()
+	}
+}
+
+func Test_ClearRetained(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("clearretained")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	token := c.ClearRetained("retained/topic", 0)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("clear retained failed: %v", token.Error())
+	}
+	pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+	if !ok {
+		t.Fatalf("expected a publish")
+	}
+	if !pp.Retain || len(pp.Payload) != 0 || string(pp.TopicName) != "retained/topic" {
+		t.Fatalf("expected an empty retained publish, got %v", pp)
+	}
+	if want := len("retained/topic") + 2; pp.RemainingLength != want {
+		t.Fatalf("expected remaining length %d, got %d", want, pp.RemainingLength)
+	}
+	c.Disconnect(0)
+}
+
+func Test_Message_SubscriptionQos_downgrade(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("downgrade")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	received := make(chan Message, 1)
+	token := c.Subscribe("downgrade/topic", 1, func(client *Client, m Message) { received <- m })
+	conn.subscribeAndAck(t)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed: %v", token.Error())
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = []byte("downgrade/topic")
+	pub.Payload = []byte("qos0")
+	conn.send(t, pub)
+	select {
+	case m := <-received:
+		if m.Qos() != 0 || m.(DetailedMessage).SubscriptionQos() != 1 {
+			t.Fatalf("expected delivery at QoS 0 on a QoS 1 subscription, got %d and %d", m.Qos(), m.(DetailedMessage).SubscriptionQos())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message was not delivered")
+	}
+	c.Disconnect(0)
+}
+
+func Test_PublishToken_reasonCode(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("reasoncode")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	for _, reason := range []byte{0x10, 0x99} {
+		token := c.Publish("reason/topic", 1, false, "payload")
+		pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+		if !ok {
+			t.Fatalf("expected a publish")
+		}
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.ProtocolLevel = 5
+		pa.MessageID = pp.MessageID
+		pa.ReasonCode = reason
+		conn.send(t, pa)
+		if !token.WaitTimeout(time.Second) {
+			t.Fatalf("publish not acknowledged")
+		}
+		if rc := token.(*PublishToken).ReasonCode(); rc != reason {
+			t.Fatalf("expected reason code 0x%02x, got 0x%02x", reason, rc)
+		}
+		if failed := token.Error() != nil; failed != (reason >= 0x80) {
+			t.Fatalf("reason code 0x%02x gave error %v", reason, token.Error())
+		}
+	}
+	c.Disconnect(0)
+}
+
+func Test_OnPublishDelivered(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	type delivery struct {
+		topic string
+		id    uint16
+	}
+	delivered := make(chan delivery, 4)
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("delivered")
+	ops.SetKeepAlive(0)
+	ops.SetPublishDeliveredHandler(func(topic string, id uint16) { delivered <- delivery{topic, id} })
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	// QoS 0 publishes have no ack and are never reported
+	c.Publish("delivered/qos0", 0, false, "payload")
+	if _, ok := conn.receive(time.Second).(*packets.PublishPacket); !ok {
+		t.Fatalf("expected a publish")
+	}
+	var pubs []*packets.PublishPacket
+	for i := 0; i < 3; i++ {
+		c.Publish(fmt.Sprintf("delivered/%d", i), 1, false, "payload")
+		pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+		if !ok {
+			t.Fatalf("expected a publish")
+		}
+		pubs = append(pubs, pp)
+	}
+	// acked out of order, each is reported as its ack arrives
+	for _, i := range []int{2, 0, 1} {
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.MessageID = pubs[i].MessageID
+		conn.send(t, pa)
+		select {
+		case d := <-delivered:
+			if want := (delivery{fmt.Sprintf("delivered/%d", i), pubs[i].MessageID}); d != want {
+				t.Fatalf("expected %v, got %v", want, d)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delivery of message %d not reported", pubs[i].MessageID)
+		}
+	}
+
+	// QoS 2 is reported on the pubcomp, not the pubrec
+	c.Publish("delivered/qos2", 2, false, "payload")
+	pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+	if !ok {
+		t.Fatalf("expected a publish")
+	}
+	prec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	prec.MessageID = pp.MessageID
+	conn.send(t, prec)
+	if _, ok := conn.receive(time.Second).(*packets.PubrelPacket); !ok {
+		t.Fatalf("expected a pubrel")
+	}
+	select {
+	case d := <-delivered:
+		t.Fatalf("delivery %v reported before pubcomp", d)
+	default:
+	}
+	pc := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pc.MessageID = pp.MessageID
+	conn.send(t, pc)
+	select {
+	case d := <-delivered:
+		if want := (delivery{"delivered/qos2", pp.MessageID}); d != want {
+			t.Fatalf("expected %v, got %v", want, d)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("delivery of qos 2 message not reported")
+	}
+	c.Disconnect(0)
+}
+
+func Test_ServerCapabilities(t *testing.T) {
+	conns := make(chan *testConn, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("capabilities")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetEnforceCapabilities(true)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			r := bufio.NewReader(server)
+			if _, err := packets.ReadPacket(r); err != nil {
+				return
+			}
+			maxQos := byte(1)
+			unavailable := false
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ProtocolLevel = 5
+			ca.Properties = &packets.Properties{MaximumQoS: &maxQos, WildcardSubscriptionAvailable: &unavailable}
+			w := bufio.NewWriter(server)
+			ca.Write(w)
+			w.Flush()
+			conns <- &testConn{Conn: server, r: r, level: 5}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if caps := c.ServerCapabilities(); caps.MaximumQoS != 2 || !caps.WildcardSubscriptionAvailable {
+		t.Fatalf("everything should be available before connecting, got %+v", caps)
+	}
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+	defer conn.Close()
+
+	want := ServerCapabilities{
+		MaximumQoS:                      1,
+		RetainAvailable:                 true,
+		SubscriptionIdentifierAvailable: true,
+		SharedSubscriptionAvailable:     true,
+	}
+	if caps := c.ServerCapabilities(); caps != want {
+		t.Fatalf("expected %+v, got %+v", want, caps)
+	}
+
+	if token := c.Publish("capabilities/topic", 2, false, "payload"); !token.WaitTimeout(time.Second) || token.Error() != ErrNotSupportedByServer {
+		t.Fatalf("expected QoS 2 publish to fail with %v, got %v", ErrNotSupportedByServer, token.Error())
+	}
+	if token := c.Subscribe("capabilities/+", 1, nil); !token.WaitTimeout(time.Second) || token.Error() != ErrNotSupportedByServer {
+		t.Fatalf("expected wildcard subscribe to fail with %v, got %v", ErrNotSupportedByServer, token.Error())
+	}
+	// nothing refused may reach the broker
+	token := c.Publish("capabilities/topic", 1, false, "payload")
+	pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+	if !ok || pp.Qos != 1 {
+		t.Fatalf("expected the QoS 1 publish, got %v", pp)
+	}
+	pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	pa.ProtocolLevel = 5
+	pa.MessageID = pp.MessageID
+	conn.send(t, pa)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("QoS 1 publish failed: %v", token.Error())
+	}
+	c.Disconnect(0)
+}
+
+func Test_QosAboveMaximum(t *testing.T) {
+	for _, policy := range []QosAboveMaximumPolicy{QosAboveMaximumReject, QosAboveMaximumDowngrade} {
+		conns := make(chan *testConn, 1)
+		ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("maxqos")
+		ops.SetKeepAlive(0)
+		ops.SetProtocolVersion(5)
+		ops.SetQosAboveMaximum(policy)
+		ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				r := bufio.NewReader(server)
+				if _, err := packets.ReadPacket(r); err != nil {
+					return
+				}
+				maxQos := byte(1)
+				ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				ca.ProtocolLevel = 5
+				ca.Properties = &packets.Properties{MaximumQoS: &maxQos}
+				w := bufio.NewWriter(server)
+				ca.Write(w)
+				w.Flush()
+				conns <- &testConn{Conn: server, r: r, level: 5}
+			}()
+			return client, nil
+		})
+		c := NewClient(ops)
+		if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+			t.Fatalf("connect over pipe failed")
+		}
+		conn := <-conns
+
+		token := c.Publish("maxqos/topic", 2, false, "payload")
+		if policy == QosAboveMaximumReject {
+			if !token.WaitTimeout(time.Second) || token.Error() != ErrNotSupportedByServer {
+				t.Fatalf("expected QoS 2 publish to fail with %v, got %v", ErrNotSupportedByServer, token.Error())
+			}
+			// the refused publish never reaches the broker
+			token = c.Publish("maxqos/topic", 1, false, "payload")
+		}
+		if qos := token.(*PublishToken).Qos(); qos != 1 {
+			t.Fatalf("publish token has QoS %d with policy %d, expected 1", qos, policy)
+		}
+		pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+		if !ok || pp.Qos != 1 {
+			t.Fatalf("expected a QoS 1 publish with policy %d, got %v", policy, pp)
+		}
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.ProtocolLevel = 5
+		pa.MessageID = pp.MessageID
+		conn.send(t, pa)
+		if !token.WaitTimeout(time.Second) || token.Error() != nil {
+			t.Fatalf("QoS 1 publish failed with policy %d: %v", policy, token.Error())
+		}
+		c.Disconnect(0)
+		conn.Close()
+	}
+}
+
+func Test_WildcardSubscriptionUnavailable(t *testing.T) {
+	conns := make(chan *testConn, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("wildcards")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			r := bufio.NewReader(server)
+			if _, err := packets.ReadPacket(r); err != nil {
+				return
+			}
+			unavailable := false
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ProtocolLevel = 5
+			ca.Properties = &packets.Properties{WildcardSubscriptionAvailable: &unavailable}
+			w := bufio.NewWriter(server)
+			ca.Write(w)
+			w.Flush()
+			conns <- &testConn{Conn: server, r: r, level: 5}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+	conn := <-conns
+	defer conn.Close()
+
+	// refused without EnforceCapabilities
+	if token := c.Subscribe("sensors/#", 1, nil); !token.WaitTimeout(time.Second) || token.Error() != ErrNotSupportedByServer {
+		t.Fatalf("expected wildcard subscribe to fail with %v, got %v", ErrNotSupportedByServer, token.Error())
+	}
+	filters := map[string]byte{"sensors/temperature": 1, "sensors/+/humidity": 1}
+	if token := c.SubscribeMultiple(filters, nil); !token.WaitTimeout(time.Second) || token.Error() != ErrNotSupportedByServer {
+		t.Fatalf("expected subscribe with a wildcard filter to fail with %v, got %v", ErrNotSupportedByServer, token.Error())
+	}
+	// only the subscribe without wildcards reaches the broker
+	c.Subscribe("sensors/temperature", 1, nil)
+	sp, ok := conn.receive(time.Second).(*packets.SubscribePacket)
+	if !ok || len(sp.Topics) != 1 || sp.Topics[0] != "sensors/temperature" {
+		t.Fatalf("expected the subscribe to sensors/temperature, got %v", sp)
+	}
+}
+
+func Test_OutboundFairness(t *testing.T) {
+	conns := make(chan *testConn, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("fairness")
+	ops.SetKeepAlive(0)
+	ops.SetOutboundFairness(2)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+	defer conn.Close()
+
+	// nothing is read until both queues are full, outgoing is stuck
+	// writing the first publish meanwhile
+	const n = 20
+	c.Publish("fairness/first", 0, false, "payload")
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < n; i++ {
+		c.Subscribe(fmt.Sprintf("fairness/%d", i), 0, nil)
+		c.Publish("fairness/topic", 0, false, "payload")
+	}
+
+	var order []byte
+	for len(order) < 2*n+1 {
+		switch cp := conn.receive(time.Second).(type) {
+		case *packets.PublishPacket:
+			order = append(order, 'p')
+		case *packets.SubscribePacket:
+			order = append(order, 's')
+		default:
+			t.Fatalf("unexpected packet %v after %s", cp, order)
+		}
+	}
+	// until the control packets run out no more than 2 of them go in a
+	// row and publishes go one at a time
+	pending := string(order[1 : strings.LastIndex(string(order), "s")+1])
+	if strings.Contains(pending, "sss") || strings.Contains(pending, "pp") {
+		t.Fatalf("queues not shared fairly, packets written in order %s", order)
+	}
+	c.Disconnect(0)
+}
+
+func Test_ConnectionGeneration(t *testing.T) {
+	conns := make(chan *testConn, 2)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("generation")
+	ops.SetKeepAlive(0)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if g := c.ConnectionGeneration(); g != 0 {
+		t.Fatalf("expected generation 0 before connecting, got %d", g)
+	}
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+
+	received := make(chan Message, 1)
+	token := c.Subscribe("generation/topic", 0, func(client *Client, m Message) { received <- m })
+	conn.subscribeAndAck(t)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed: %v", token.Error())
+	}
+
+	for want := uint64(1); want <= 2; want++ {
+		if g := c.ConnectionGeneration(); g != want {
+			t.Fatalf("expected generation %d, got %d", want, g)
+		}
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = []byte("generation/topic")
+		pub.Payload = []byte("payload")
+		conn.send(t, pub)
+		select {
+		case m := <-received:
+			if g := m.(DetailedMessage).ConnectionGeneration(); g != want {
+				t.Fatalf("expected message from generation %d, got %d", want, g)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message was not delivered")
+		}
+		if want == 1 {
+			conn.Close()
+			conn = <-conns
+			for !c.IsConnected() {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	c.Disconnect(0)
+	conn.Close()
+}
+
+func Test_SubscribeMultiple_noTopics(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("notopics")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	token := c.SubscribeMultiple(map[string]byte{}, nil)
+	if !token.WaitTimeout(time.Second) {
+		t.Fatalf("subscribe without topics did not complete")
+	}
+	if token.Error() != packets.ErrNoTopics {
+		t.Fatalf("expected %v, got %v", packets.ErrNoTopics, token.Error())
+	}
+	c.Disconnect(0)
+}
+
+func Test_ConnectPacketBuilder(t *testing.T) {
+	conns := make(chan *testConn, 2)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("builder")
+	ops.SetKeepAlive(0)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	var attempt int32
+	ops.SetConnectPacketBuilder(func(base *packets.ConnectPacket) *packets.ConnectPacket {
+		if base.UsernameFlag || base.PasswordFlag {
+			t.Errorf("builder was passed a packet changed by an earlier attempt")
+		}
+		// stands in for a token signed with the current time
+		base.UsernameFlag = true
+		base.Username = base.ClientIdentifier
+		base.PasswordFlag = true
+		base.Password = []byte(fmt.Sprintf("%s-%d-%d", base.ClientIdentifier, atomic.AddInt32(&attempt, 1), time.Now().UnixNano()))
+		return base
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+
+	first := <-conns
+	first.Close()
+	second := <-conns
+	defer second.Close()
+	for i, conn := range []*testConn{first, second} {
+		want := fmt.Sprintf("builder-%d-", i+1)
+		if conn.connect.Username != "builder" || !strings.HasPrefix(string(conn.connect.Password), want) {
+			t.Fatalf("connect %d sent %q/%q, expected a password starting %q", i+1, conn.connect.Username, conn.connect.Password, want)
+		}
+	}
+	if string(first.connect.Password) == string(second.connect.Password) {
+		t.Fatalf("reconnect reused the password %q", first.connect.Password)
+	}
+	for !c.IsConnected() {
+		time.Sleep(time.Millisecond)
+	}
+	c.Disconnect(0)
+}
+
+func Test_CredentialsProvider(t *testing.T) {
+	conns := make(chan *testConn, 2)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("credentials")
+	ops.SetKeepAlive(0)
+	ops.SetUsername("static").SetPassword("stale")
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	var attempt int32
+	ops.SetCredentialsProvider(func() (string, string) {
+		return "dynamic", fmt.Sprintf("token-%d", atomic.AddInt32(&attempt, 1))
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+
+	first := <-conns
+	first.Close()
+	second := <-conns
+	defer second.Close()
+	for i, conn := range []*testConn{first, second} {
+		want := fmt.Sprintf("token-%d", i+1)
+		if !conn.connect.UsernameFlag || conn.connect.Username != "dynamic" || !conn.connect.PasswordFlag || string(conn.connect.Password) != want {
+			t.Fatalf("connect %d sent %q/%q, expected dynamic/%s", i+1, conn.connect.Username, conn.connect.Password, want)
+		}
+	}
+	for !c.IsConnected() {
+		time.Sleep(time.Millisecond)
+	}
+	c.Disconnect(0)
+}
+
+func Test_PublishWithOptions_messageExpiry(t *testing.T) {
+	conns := make(chan *testConn, 1)
+	received := make(chan Message, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("expiry")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetDefaultPublishHandler(func(c *Client, m Message) { received <- m })
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			r := bufio.NewReader(server)
+			if _, err := packets.ReadPacket(r); err != nil {
+				return
+			}
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ProtocolLevel = 5
+			w := bufio.NewWriter(server)
+			ca.Write(w)
+			w.Flush()
+			conns <- &testConn{Conn: server, r: r, level: 5}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+	defer conn.Close()
+
+	// sent in whole seconds, rounded up so that it doesn't become 0
+	c.PublishWithOptions("expiry/topic", 0, false, "payload", PublishOptions{MessageExpiry: 1500 * time.Millisecond})
+	pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+	if !ok {
+		t.Fatalf("expected a publish")
+	}
+	if pp.Properties == nil || pp.Properties.MessageExpiryInterval != 2 {
+		t.Fatalf("expected message expiry interval 2, got %v", pp.Properties)
+	}
+
+	// the broker passes on what is left of the interval
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.ProtocolLevel = 5
+	pub.TopicName = []byte("expiry/topic")
+	pub.Properties = &packets.Properties{MessageExpiryInterval: 30}
+	conn.send(t, pub)
+	select {
+	case m := <-received:
+		if m.(DetailedMessage).MessageExpiry() != 30*time.Second {
+			t.Fatalf("expected remaining expiry of 30s, got %v", m.(DetailedMessage).MessageExpiry())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not delivered")
+	}
+	c.Disconnect(0)
+}
+
+func Test_PublishWithOptions_topicAlias(t *testing.T) {
+	conns := make(chan *testConn, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("alias")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			r := bufio.NewReader(server)
+			if _, err := packets.ReadPacket(r); err != nil {
+				return
+			}
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ProtocolLevel = 5
+			ca.Properties = &packets.Properties{TopicAliasMaximum: 10}
+			w := bufio.NewWriter(server)
+			ca.Write(w)
+			w.Flush()
+			conns <- &testConn{Conn: server, r: r, level: 5}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+	defer conn.Close()
+
+	for _, tc := range []struct {
+		opts      PublishOptions
+		wantTopic string
+	}{
+		{PublishOptions{TopicAlias: 3, SendFullTopic: true}, "alias/topic"},
+		{PublishOptions{TopicAlias: 3}, ""},
+		{PublishOptions{TopicAlias: 3, SendFullTopic: true}, "alias/topic"},
+	} {
+		c.PublishWithOptions("alias/topic", 0, false, "payload", tc.opts)
+		pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+		if !ok {
+			t.Fatalf("expected a publish")
+		}
+		if string(pp.TopicName) != tc.wantTopic || pp.Properties == nil || pp.Properties.TopicAlias != 3 {
+			t.Fatalf("%+v: expected topic %q with alias 3, got %q %v", tc.opts, tc.wantTopic, pp.TopicName, pp.Properties)
+		}
+	}
+
+	for _, tc := range []struct {
+		topic string
+		opts  PublishOptions
+		err   error
+	}{
+		{"alias/topic", PublishOptions{TopicAlias: 4}, ErrTopicAliasUnknown},
+		{"other/topic", PublishOptions{TopicAlias: 3}, ErrTopicAliasUnknown},
+		{"alias/topic", PublishOptions{TopicAlias: 11, SendFullTopic: true}, ErrTopicAliasInvalid},
+	} {
+		token := c.PublishWithOptions(tc.topic, 0, false, "payload", tc.opts)
+		if !token.WaitTimeout(time.Second) || token.Error() != tc.err {
+			t.Fatalf("%s %+v: expected %v, got %v", tc.topic, tc.opts, tc.err, token.Error())
+		}
+	}
+	c.Disconnect(0)
+}
+
+func Test_PublishWithOptions_topicAliasResend(t *testing.T) {
+	conns := make(chan *testConn, 2)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("aliasresend")
+	ops.SetCleanSession(false)
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetInitialReconnectDelay(10 * time.Millisecond)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			r := bufio.NewReader(server)
+			if _, err := packets.ReadPacket(r); err != nil {
+				return
+			}
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ProtocolLevel = 5
+			ca.Properties = &packets.Properties{TopicAliasMaximum: 10}
+			w := bufio.NewWriter(server)
+			ca.Write(w)
+			w.Flush()
+			conns <- &testConn{Conn: server, r: r, level: 5}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+	conn := <-conns
+
+	c.PublishWithOptions("alias/topic", 0, false, "payload", PublishOptions{TopicAlias: 3, SendFullTopic: true})
+	if _, ok := conn.receive(time.Second).(*packets.PublishPacket); !ok {
+		t.Fatalf("expected the publish setting the alias")
+	}
+	token := c.PublishWithOptions("alias/topic", 1, false, "payload", PublishOptions{TopicAlias: 3})
+	if pp, ok := conn.receive(time.Second).(*packets.PublishPacket); !ok || len(pp.TopicName) != 0 {
+		t.Fatalf("expected an alias only publish, got %v", pp)
+	}
+
+	// the alias is unknown on the next connection, so the resent
+	// publish has to carry its topic
+	conn.Close()
+	conn = <-conns
+	defer conn.Close()
+	pp, ok := conn.receive(2 * time.Second).(*packets.PublishPacket)
+	if !ok || string(pp.TopicName) != "alias/topic" || pp.Properties == nil || pp.Properties.TopicAlias != 3 {
+		t.Fatalf("expected the resent publish with its topic and alias, got %v", pp)
+	}
+	ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	ack.MessageID = pp.MessageID
+	conn.send(t, ack)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("resent publish failed: %v", token.Error())
+	}
+
+	// the resend set the alias again
+	c.PublishWithOptions("alias/topic", 0, false, "payload", PublishOptions{TopicAlias: 3})
+	if pp, ok := conn.receive(time.Second).(*packets.PublishPacket); !ok || len(pp.TopicName) != 0 {
+		t.Fatalf("expected an alias only publish, got %v", pp)
+	}
+}
+
+func Test_ConnectedBroker_failover(t *testing.T) {
+	// a port with nothing listening on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	down := "tcp://" + l.Addr().String()
+	l.Close()
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(down).AddBroker(broker.url()).SetClientID("failover")
+	ops.SetKeepAlive(0)
+	c := NewClient(ops)
+	if _, ok := c.ConnectedBroker(); ok {
+		t.Fatalf("broker reported before connecting")
+	}
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect failed: %v", ct.Error())
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+
+	u, ok := c.ConnectedBroker()
+	if !ok || u.String() != broker.url() {
+		t.Fatalf("expected %s, got %v %v", broker.url(), u, ok)
+	}
+	c.Disconnect(0)
+	if _, ok := c.ConnectedBroker(); ok {
+		t.Fatalf("broker reported after disconnecting")
+	}
+}
+
+func Test_AddRoute_reconnect(t *testing.T) {
+	conns := make(chan *testConn, 2)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("addroute")
+	ops.SetKeepAlive(0)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	received := make(chan string, 1)
+	ops.SetDefaultPublishHandler(func(client *Client, m Message) { received <- "default" })
+	c := NewClient(ops)
+	c.AddRoute("route/+", func(client *Client, m Message) { received <- "route" })
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	conn := <-conns
+
+	deliver := func(want string) {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = []byte("route/topic")
+		conn.send(t, pub)
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("expected the %s handler, got the %s handler", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message was not delivered")
+		}
+	}
+	// the broker sends without a SUBSCRIBE, as it would for a persistent session
+	deliver("route")
+
+	conn.Close()
+	conn = <-conns
+	for !c.IsConnected() {
+		time.Sleep(time.Millisecond)
+	}
+	deliver("route")
+
+	c.RemoveRoute("route/+")
+	deliver("default")
+	c.Disconnect(0)
+	conn.Close()
+}
+
+func Test_OnConnack(t *testing.T) {
+	connacks := make(chan *packets.ConnackPacket, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("connack")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			r := bufio.NewReader(server)
+			if _, err := packets.ReadPacket(r); err != nil {
+				return
+			}
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ProtocolLevel = 5
+			ca.TopicNameCompression = 0x01
+			ca.Properties = &packets.Properties{
+				ReasonString:   "welcome",
+				UserProperties: []packets.UserProperty{{Key: "region", Value: "eu-1"}},
+			}
+			w := bufio.NewWriter(server)
+			ca.Write(w)
+			w.Flush()
+			io.Copy(ioutil.Discard, r)
+		}()
+		return client, nil
+	})
+	ops.SetConnackHandler(func(ca *packets.ConnackPacket) { connacks <- ca })
+	c := NewClient(ops)
+	ct := c.Connect()
+	var ca *packets.ConnackPacket
+	select {
+	case ca = <-connacks:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("connack handler not called")
+	}
+	if !ct.Wait() || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+
+	if ca.ReturnCode != packets.Accepted || ca.TopicNameCompression != 0x01 {
+		t.Fatalf("connack had return code %d and flags %d", ca.ReturnCode, ca.TopicNameCompression)
+	}
+	if ca.Properties == nil || ca.Properties.ReasonString != "welcome" {
+		t.Fatalf("connack properties not passed on: %+v", ca.Properties)
+	}
+	if up := ca.Properties.UserProperties; len(up) != 1 || up[0].Key != "region" || up[0].Value != "eu-1" {
+		t.Fatalf("connack user properties were %v", up)
+	}
+}
+
+func Test_ConnectReasonCodes(t *testing.T) {
+	for _, test := range []struct {
+		level byte
+		code  byte
+		err   string
+	}{
+		{5, 0x97, "Quota exceeded"},
+		{5, 0x95, "Packet too large"},
+		{5, 0x86, "Bad user name or password"},
+		{5, 0x9F, "Connection rate exceeded"},
+		{5, 0xA0, "Connection refused with code 0xa0"},
+		{4, packets.ErrRefusedNotAuthorised, "Not Authorized"},
+	} {
+		ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("refused")
+		ops.SetKeepAlive(0)
+		ops.SetProtocolVersion(uint(test.level))
+		ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				r := bufio.NewReader(server)
+				if _, err := packets.ReadPacket(r); err != nil {
+					return
+				}
+				ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				ca.ProtocolLevel = test.level
+				ca.ReturnCode = test.code
+				w := bufio.NewWriter(server)
+				ca.Write(w)
+				w.Flush()
+			}()
+			return client, nil
+		})
+		c := NewClient(ops)
+		ct := c.Connect()
+		if !ct.WaitTimeout(2 * time.Second) {
+			t.Fatalf("connect refused with 0x%02x did not complete", test.code)
+		}
+		if err := ct.Error(); err == nil || err.Error() != test.err {
+			t.Errorf("MQTT %d connect refused with 0x%02x failed with %v, expected %q", test.level, test.code, err, test.err)
+		}
+	}
+}
+
+func Test_PublishBeforeConnack(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		unhandled := make(chan packets.ControlPacket, 1)
+		ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("early")
+		ops.SetKeepAlive(0)
+		ops.SetProtocolVersion(4)
+		ops.SetAllowPreConnackPackets(allow)
+		ops.SetUnhandledPacketHandler(func(cp packets.ControlPacket) { unhandled <- cp })
+		ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				r := bufio.NewReader(server)
+				if _, err := packets.ReadPacket(r); err != nil {
+					return
+				}
+				w := bufio.NewWriter(server)
+				pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				pub.TopicName = []byte("early/topic")
+				pub.Payload = []byte("too soon")
+				pub.Write(w)
+				packets.NewControlPacket(packets.Connack).Write(w)
+				w.Flush()
+				io.Copy(ioutil.Discard, r)
+			}()
+			return client, nil
+		})
+		c := NewClient(ops)
+		ct := c.Connect()
+		if !ct.WaitTimeout(2 * time.Second) {
+			t.Fatalf("connect did not complete")
+		}
+		if !allow {
+			if err := ct.Error(); err != packets.ConnErrors[packets.ErrProtocolViolation] {
+				t.Fatalf("connect with a PUBLISH before the CONNACK returned %v", err)
+			}
+			if c.IsConnected() {
+				t.Fatalf("client connected despite the protocol violation")
+			}
+			continue
+		}
+		if ct.Error() != nil {
+			t.Fatalf("connect allowing early packets failed: %v", ct.Error())
+		}
+		select {
+		case cp := <-unhandled:
+			if p, ok := cp.(*packets.PublishPacket); !ok || string(p.TopicName) != "early/topic" {
+				t.Fatalf("unhandled packet handler got %v", cp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("early PUBLISH not passed to the unhandled packet handler")
+		}
+		c.Disconnect(0)
+	}
+}
+
+// bufferConn records the socket buffer sizes set on it
+type bufferConn struct {
+	net.Conn
+	read, write int
+}
+
+func (b *bufferConn) SetReadBuffer(bytes int) error {
+	b.read = bytes
+	return nil
+}
+
+func (b *bufferConn) SetWriteBuffer(bytes int) error {
+	b.write = bytes
+	return nil
+}
+
+func Test_SocketBufferSizes(t *testing.T) {
+	conns := make(chan *bufferConn, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("buffers")
+	ops.SetKeepAlive(0)
+	ops.SetReadBufferBytes(4 << 20)
+	ops.SetWriteBufferBytes(1 << 20)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go handshake(server)
+		conn := &bufferConn{Conn: client}
+		conns <- conn
+		return conn, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+	conn := <-conns
+	if conn.read != 4<<20 || conn.write != 1<<20 {
+		t.Fatalf("socket buffers set to %d and %d, expected %d and %d", conn.read, conn.write, 4<<20, 1<<20)
+	}
+}
+
+// noDelayConn records the TCP_NODELAY setting in effect for each packet
+// written through it
+type noDelayConn struct {
+	net.Conn
+	mu      sync.Mutex
+	noDelay bool
+	calls   []bool
+	writes  []string
+}
+
+func (n *noDelayConn) SetNoDelay(noDelay bool) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.noDelay = noDelay
+	n.calls = append(n.calls, noDelay)
+	return nil
+}
+
+func (n *noDelayConn) Write(b []byte) (int, error) {
+	n.mu.Lock()
+	n.writes = append(n.writes, fmt.Sprintf("%s:%v", packets.PacketNames[b[0]>>4], n.noDelay))
+	n.mu.Unlock()
+	return n.Conn.Write(b)
+}
+
+func (n *noDelayConn) log() ([]bool, []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]bool(nil), n.calls...), append([]string(nil), n.writes...)
+}
+
+func Test_LowLatencyControlPackets(t *testing.T) {
+	brokers := make(chan *testConn, 1)
+	var conn *noDelayConn
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("nodelay")
+	ops.SetKeepAlive(0)
+	ops.SetLowLatencyControlPackets(true)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				brokers <- tc
+			}
+		}()
+		conn = &noDelayConn{Conn: client}
+		return conn, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	broker := <-brokers
+	defer broker.Close()
+	defer c.Disconnect(0)
+
+	c.Subscribe("nodelay/#", 1, func(c *Client, m Message) {})
+	broker.subscribeAndAck(t)
+	// net.Pipe writes wait for the reader
+	read := make(chan struct{})
+	go func() {
+		broker.receive(time.Second)
+		broker.receive(time.Second)
+		close(read)
+	}()
+	for _, payload := range []string{"1", "2"} {
+		if token := c.Publish("nodelay/out", 0, false, payload); !token.WaitTimeout(time.Second) {
+			t.Fatalf("publish %s not written", payload)
+		}
+	}
+	<-read
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = []byte("nodelay/in")
+	p.Qos = 1
+	p.MessageID = 7
+	broker.send(t, p)
+	if _, ok := broker.receive(time.Second).(*packets.PubackPacket); !ok {
+		t.Fatalf("expected PUBACK")
+	}
+
+	calls, writes := conn.log()
+	if want := []bool{true, false, true}; fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("SetNoDelay called with %v, expected %v", calls, want)
+	}
+	want := []string{"CONNECT:false", "SUBSCRIBE:true", "PUBLISH:false", "PUBLISH:false", "PUBACK:true"}
+	if fmt.Sprint(writes) != fmt.Sprint(want) {
+		t.Fatalf("packets written as %v, expected %v", writes, want)
+	}
+}
+
+func Test_LowLatencyControlPackets_pingreq(t *testing.T) {
+	brokers := make(chan *testConn, 1)
+	var conn *noDelayConn
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("nodelayping")
+	ops.SetKeepAlive(200 * time.Millisecond)
+	ops.SetPingTimeout(500 * time.Millisecond)
+	ops.SetLowLatencyControlPackets(true)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				brokers <- tc
+			}
+		}()
+		conn = &noDelayConn{Conn: client}
+		return conn, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	broker := <-brokers
+	defer broker.Close()
+	defer c.Disconnect(0)
+
+	// net.Pipe writes wait for the reader
+	published := make(chan struct{})
+	go func() {
+		if token := c.Publish("nodelay/out", 0, false, "1"); !token.WaitTimeout(time.Second) {
+			t.Errorf("publish not written")
+		}
+		close(published)
+	}()
+	if _, ok := broker.receive(time.Second).(*packets.PublishPacket); !ok {
+		t.Fatalf("expected PUBLISH")
+	}
+	<-published
+	if _, ok := broker.receive(2 * time.Second).(*packets.PingreqPacket); !ok {
+		t.Fatalf("expected PINGREQ")
+	}
+
+	_, writes := conn.log()
+	want := []string{"CONNECT:false", "PUBLISH:false", "PINGREQ:true"}
+	if fmt.Sprint(writes) != fmt.Sprint(want) {
+		t.Fatalf("packets written as %v, expected %v", writes, want)
+	}
+}
+
+func Test_nextReconnectDelay(t *testing.T) {
+	delay := 100 * time.Millisecond
+	var got []time.Duration
+	for i := 0; i < 12; i++ {
+		got = append(got, delay)
+		delay = nextReconnectDelay(delay, 30*time.Second)
+	}
+	want := []time.Duration{100, 200, 400, 800, 1600, 3200, 6400, 12800, 25600, 30000, 30000, 30000}
+	for i := range want {
+		if got[i] != want[i]*time.Millisecond {
+			t.Fatalf("delays were %v", got)
+		}
+	}
+	if d := nextReconnectDelay(time.Second, 0); d != time.Second {
+		t.Fatalf("expected delay to stay at 1s with no maximum, got %v", d)
+	}
+
+	// an initial delay of 0 retries at once, then backs off from 1s
+	delay, got = 0, nil
+	for i := 0; i < 5; i++ {
+		got = append(got, delay)
+		delay = nextReconnectDelay(delay, 5*time.Second)
+	}
+	want = []time.Duration{0, 1000, 2000, 4000, 5000}
+	for i := range want {
+		if got[i] != want[i]*time.Millisecond {
+			t.Fatalf("delays from 0 were %v", got)
+		}
+	}
+	if d := nextReconnectDelay(0, 500*time.Millisecond); d != 500*time.Millisecond {
+		t.Fatalf("expected delay from 0 to be capped at 500ms, got %v", d)
+	}
+}
+
+func Test_PublishWriteErrorResent(t *testing.T) {
+	for _, clean := range []bool{true, false} {
+		conns := make(chan *testConn, 2)
+		var opened int32
+		var failing *failingConn
+		ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("unsent")
+		ops.SetKeepAlive(0)
+		ops.SetCleanSession(clean)
+		ops.SetInitialReconnectDelay(10 * time.Millisecond)
+		ops.SetConnectionLostHandler(func(c *Client, err error) {})
+		ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				if tc, err := handshake(server); err == nil {
+					conns <- tc
+				}
+			}()
+			if atomic.AddInt32(&opened, 1) == 1 {
+				failing = &failingConn{Conn: client}
+				return failing, nil
+			}
+			return client, nil
+		})
+		c := NewClient(ops)
+		if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+			t.Fatalf("connect over pipe failed")
+		}
+		first := <-conns
+
+		failing.err.Store(errors.New("induced write failure"))
+		token := c.Publish("unsent/topic", 1, false, "payload")
+		var conn *testConn
+		select {
+		case conn = <-conns:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("client did not reconnect after the write error")
+		}
+		first.Close()
+		if token.WaitTimeout(10 * time.Millisecond) {
+			t.Fatalf("token completed after the write error: %v", token.Error())
+		}
+		pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+		if !ok || string(pp.Payload) != "payload" || !pp.Dup || pp.MessageID != token.(*PublishToken).MessageID() {
+			t.Fatalf("expected the publish to be resent with DUP set (clean session %t), got %v", clean, pp)
+		}
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.MessageID = pp.MessageID
+		conn.send(t, pa)
+		if !token.WaitTimeout(time.Second) || token.Error() != nil {
+			t.Fatalf("resent publish not completed: %v", token.Error())
+		}
+		if cp := conn.receive(100 * time.Millisecond); cp != nil {
+			t.Fatalf("publish sent again (clean session %t): %v", clean, cp)
+		}
+		c.Disconnect(0)
+		conn.Close()
+	}
+}
+
+func Test_PublishDupOnlyWhenResent(t *testing.T) {
+	conns := make(chan *testConn, 2)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("dup")
+	ops.SetKeepAlive(0)
+	ops.SetCleanSession(false)
+	ops.SetInitialReconnectDelay(10 * time.Millisecond)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+	conn := <-conns
+
+	// a pre-encoded packet marked as a duplicate is still sent as the original
+	encoded := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	encoded.TopicName = []byte("dup/encoded")
+	encoded.Qos = 1
+	encoded.Dup = true
+	encoded.MessageID = 1
+	b, err := encoded.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	tokens := []Token{c.Publish("dup/topic", 1, false, "payload"), c.PublishBytes(b)}
+	for _, topic := range []string{"dup/topic", "dup/encoded"} {
+		pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+		if !ok || string(pp.TopicName) != topic || pp.Dup {
+			t.Fatalf("expected %s to be sent without DUP, got %v", topic, pp)
+		}
+	}
+
+	// unacknowledged, both are resent with DUP after reconnecting
+	conn.Close()
+	conn = <-conns
+	defer conn.Close()
+	for _, topic := range []string{"dup/topic", "dup/encoded"} {
+		pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+		if !ok || string(pp.TopicName) != topic || !pp.Dup {
+			t.Fatalf("expected %s to be resent with DUP, got %v", topic, pp)
+		}
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.MessageID = pp.MessageID
+		conn.send(t, pa)
+	}
+	for _, token := range tokens {
+		if !token.WaitTimeout(time.Second) || token.Error() != nil {
+			t.Fatalf("resent publish not completed: %v", token.Error())
+		}
+	}
+}
+
+func Test_ReconnectSuccessHandler(t *testing.T) {
+	const outage = 200 * time.Millisecond
+	conns := make(chan *testConn, 2)
+	var opened int32
+	type reconnected struct {
+		downtime time.Duration
+		broker   *url.URL
+	}
+	reports := make(chan reconnected, 2)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("downtime")
+	ops.SetKeepAlive(0)
+	ops.SetInitialReconnectDelay(10 * time.Millisecond)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetReconnectSuccessHandler(func(downtime time.Duration, broker *url.URL) {
+		reports <- reconnected{downtime, broker}
+	})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		if atomic.AddInt32(&opened, 1) > 1 {
+			// the broker is unreachable for a while
+			time.Sleep(outage)
+		}
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+	(<-conns).Close()
+
+	select {
+	case r := <-reports:
+		if r.downtime < outage || r.downtime > outage+500*time.Millisecond {
+			t.Fatalf("reported downtime %v for an outage of %v", r.downtime, outage)
+		}
+		if r.broker == nil || r.broker.String() != "pipe://broker" {
+			t.Fatalf("reported reconnecting to %v", r.broker)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("reconnect not reported")
+	}
+	conn := <-conns
+	defer conn.Close()
+	select {
+	case r := <-reports:
+		t.Fatalf("reconnect reported twice: %v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func Test_ReconnectBackoff(t *testing.T) {
+	conns := make(chan *testConn, 1)
+	attempts := make(chan time.Time, 10)
+	var opened int32
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("backoff")
+	ops.SetKeepAlive(0)
+	ops.SetInitialReconnectDelay(50 * time.Millisecond)
+	ops.SetMaxReconnectInterval(200 * time.Millisecond)
+	ops.SetMaxReconnectAttempts(6)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		// only the initial connection succeeds
+		if atomic.AddInt32(&opened, 1) > 1 {
+			attempts <- time.Now()
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	gaveUp := make(chan error, 1)
+	ops.SetReconnectGaveUpHandler(func(err error) { gaveUp <- err })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	(<-conns).Close()
+
+	select {
+	case <-gaveUp:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client did not give up reconnecting")
+	}
+	close(attempts)
+	var times []time.Time
+	for at := range attempts {
+		times = append(times, at)
+	}
+	if len(times) != 6 {
+		t.Fatalf("expected 6 reconnect attempts, got %d", len(times))
+	}
+	want := []time.Duration{50, 100, 200, 200, 200}
+	for i, w := range want {
+		w *= time.Millisecond
+		if gap := times[i+1].Sub(times[i]); gap < w || gap > w+w/2+50*time.Millisecond {
+			t.Fatalf("attempt %d came %v after the previous, expected %v", i+2, gap, w)
+		}
+	}
+}
+
+func Test_ClearSessionOnce(t *testing.T) {
+	type session struct {
+		connect *packets.ConnectPacket
+		present bool
+	}
+	sessions := make(chan session, 2)
+	var lock sync.Mutex
+	// the broker starts out holding a stale session for the client
+	stored, connects := true, 0
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("clearonce")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetCleanSession(false)
+	ops.SetInitialReconnectDelay(10 * time.Millisecond)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			r := bufio.NewReader(server)
+			cp, err := packets.ReadPacket(r)
+			if err != nil {
+				return
+			}
+			connect := cp.(*packets.ConnectPacket)
+			lock.Lock()
+			present := stored && !connect.CleanSession
+			stored = true
+			connects++
+			first := connects == 1
+			lock.Unlock()
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ProtocolLevel = 5
+			if present {
+				ca.TopicNameCompression = 0x01
+			}
+			w := bufio.NewWriter(server)
+			ca.Write(w)
+			w.Flush()
+			sessions <- session{connect, present}
+			// the first connection is dropped to make the client reconnect
+			if first {
+				server.Close()
+				return
+			}
+			io.Copy(ioutil.Discard, r)
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	c.ClearSessionOnce()
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+
+	var got []session
+	for len(got) < 2 {
+		select {
+		case s := <-sessions:
+			got = append(got, s)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("client made %d connections, expected 2", len(got))
+		}
+	}
+	first, second := got[0], got[1]
+	if !first.connect.CleanSession || first.connect.Properties.SessionExpiryInterval != 0 {
+		t.Fatalf("first connect had clean start %t and session expiry %d", first.connect.CleanSession, first.connect.Properties.SessionExpiryInterval)
+	}
+	if first.present {
+		t.Fatalf("first connack reported a session present")
+	}
+	if second.connect.CleanSession || second.connect.Properties.SessionExpiryInterval != packets.SessionNeverExpires {
+		t.Fatalf("reconnect had clean start %t and session expiry %d", second.connect.CleanSession, second.connect.Properties.SessionExpiryInterval)
+	}
+	if !second.present {
+		t.Fatalf("reconnect did not resume the session")
+	}
+}
+
+func Test_PublishToken_MessageID(t *testing.T) {
+	conns := make(chan *testConn, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("msgid")
+	ops.SetKeepAlive(0)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+	broker := <-conns
+
+	ids := make(map[uint16]bool)
+	var order []uint16
+	for i := 0; i < 3; i++ {
+		id := c.Publish("msgid/topic", 1, false, "payload").(*PublishToken).MessageID()
+		if id == 0 || ids[id] {
+			t.Fatalf("publish %d was given message ID %d, already assigned %v", i, id, order)
+		}
+		ids[id] = true
+		order = append(order, id)
+	}
+	if id := c.Publish("msgid/topic", 0, false, "payload").(*PublishToken).MessageID(); id != 0 {
+		t.Fatalf("QoS 0 publish was given message ID %d", id)
+	}
+	for i, want := range order {
+		p, ok := broker.receive(time.Second).(*packets.PublishPacket)
+		if !ok || p.MessageID != want {
+			t.Fatalf("publish %d reached the broker as %v, expected message ID %d", i, p, want)
+		}
+	}
+}
+
+func Test_MaxQueuedBytes(t *testing.T) {
+	conns := make(chan *testConn, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("queued")
+	ops.SetKeepAlive(0)
+	ops.SetMaxQueuedBytes(100)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+	broker := <-conns
+
+	// each publish encodes to 38 bytes, so two fit and the broker
+	// doesn't ack them
+	payload := strings.Repeat("x", 20)
+	var sent []*PublishToken
+	for {
+		token := c.Publish("queued/topic", 1, false, payload).(*PublishToken)
+		if token.WaitTimeout(50*time.Millisecond) && token.Error() != nil {
+			if token.Error() != ErrQueueFull {
+				t.Fatalf("publish failed with %v, expected ErrQueueFull", token.Error())
+			}
+			break
+		}
+		sent = append(sent, token)
+		if len(sent) > 2 {
+			t.Fatalf("publish beyond the limit was queued, %d bytes queued", c.QueuedBytes())
+		}
+	}
+	if len(sent) != 2 || c.QueuedBytes() != 76 {
+		t.Fatalf("%d publishes queued taking %d bytes, expected 2 taking 76", len(sent), c.QueuedBytes())
+	}
+	if token := c.Publish("queued/topic", 1, false, payload); !token.WaitTimeout(time.Second) || token.Error() != ErrQueueFull {
+		t.Fatalf("publish over the limit returned %v", token.Error())
+	}
+
+	p, ok := broker.receive(time.Second).(*packets.PublishPacket)
+	if !ok {
+		t.Fatalf("publish did not reach the broker")
+	}
+	pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	pa.MessageID = p.MessageID
+	broker.send(t, pa)
+	if !sent[0].WaitTimeout(time.Second) || sent[0].Error() != nil {
+		t.Fatalf("acked publish did not complete")
+	}
+	if n := c.QueuedBytes(); n != 38 {
+		t.Fatalf("%d bytes queued after an ack, expected 38", n)
+	}
+	if token := c.Publish("queued/topic", 1, false, payload); token.WaitTimeout(50*time.Millisecond) {
+		t.Fatalf("publish after an ack was not queued: %v", token.Error())
+	}
+}
+
+func Test_ResponseInformation(t *testing.T) {
+	requested := make(chan bool, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("response")
+	ops.SetKeepAlive(0)
+	ops.SetProtocolVersion(5)
+	ops.SetRequestResponseInfo(true)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			r := bufio.NewReader(server)
+			cp, err := packets.ReadPacket(r)
+			if err != nil {
+				return
+			}
+			props := cp.(*packets.ConnectPacket).Properties
+			requested <- props != nil && props.RequestResponseInformation
+			ca := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ca.ProtocolLevel = 5
+			ca.Properties = &packets.Properties{ResponseInformation: "responses/response/"}
+			w := bufio.NewWriter(server)
+			ca.Write(w)
+			w.Flush()
+			io.Copy(ioutil.Discard, r)
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+
+	if !<-requested {
+		t.Fatalf("CONNECT did not request response information")
+	}
+	if info := c.ResponseInformation(); info != "responses/response/" {
+		t.Fatalf("expected response information responses/response/, got %q", info)
+	}
+}
+
+func Test_CacheRetained(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("cacheretained")
+	ops.SetKeepAlive(0)
+	ops.SetCacheRetained(true)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+	defer c.Disconnect(0)
+
+	received := make(chan Message, 10)
+	handler := func(c *Client, m Message) { received <- m }
+	expect := func(payload string) {
+		select {
+		case m := <-received:
+			if string(m.Payload()) != payload || !m.Retained() || m.Topic() != "retained/a" {
+				t.Fatalf("expected retained %s on retained/a, got %s on %s", payload, m.Payload(), m.Topic())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("retained %s not delivered", payload)
+		}
+	}
+	sendRetained := func(payload string) {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = []byte("retained/a")
+		p.Payload = []byte(payload)
+		p.Retain = true
+		conn.send(t, p)
+	}
+
+	c.Subscribe("retained/#", 0, handler)
+	conn.subscribeAndAck(t)
+	sendRetained("v1")
+	expect("v1")
+
+	// resubscribing replays the cached value before the broker sends anything
+	c.Unsubscribe("retained/#")
+	conn.receive(time.Second)
+	c.Subscribe("retained/#", 0, handler)
+	expect("v1")
+	conn.subscribeAndAck(t)
+	sendRetained("v2")
+	expect("v2")
+
+	// an empty retained message clears the cache
+	sendRetained("")
+	expect("")
+	c.Unsubscribe("retained/#")
+	conn.receive(time.Second)
+	c.Subscribe("retained/#", 0, handler)
+	conn.subscribeAndAck(t)
+	select {
+	case m := <-received:
+		t.Fatalf("cleared retained message replayed: %s", m.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_CacheRetained_subscribeFromHandler(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("cacheretainedorder")
+	ops.SetKeepAlive(0)
+	ops.SetCacheRetained(true)
+	ops.SetOrderMatters(true)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+	defer c.Disconnect(0)
+
+	replayed := make(chan Message, 1)
+	subscribed := make(chan struct{})
+	handler := func(c *Client, m Message) {
+		// the cached value is replayed while this handler still runs
+		c.Subscribe("other/#", 0, func(c *Client, m Message) { replayed <- m })
+		close(subscribed)
+	}
+	c.Subscribe("retained/#", 0, func(*Client, Message) {})
+	conn.subscribeAndAck(t)
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = []byte("other/a")
+	p.Payload = []byte("v1")
+	p.Retain = true
+	conn.send(t, p)
+	c.Subscribe("trigger", 0, handler)
+	conn.subscribeAndAck(t)
+	p = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = []byte("trigger")
+	p.Payload = []byte("go")
+	conn.send(t, p)
+
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatalf("handler blocked subscribing")
+	}
+	select {
+	case m := <-replayed:
+		if m.Topic() != "other/a" || string(m.Payload()) != "v1" {
+			t.Fatalf("expected v1 on other/a, got %s on %s", m.Payload(), m.Topic())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("cached retained message not replayed")
+	}
+}
+
+func Test_cacheRetained_bound(t *testing.T) {
+	c := NewClient(NewClientOptions().SetCacheRetained(true))
+	retain := func(topic string) {
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = []byte(topic)
+		p.Payload = []byte("v")
+		p.Retain = true
+		c.cacheRetained(p, 1)
+	}
+	for i := 0; i < maxRetainedCache; i++ {
+		retain(fmt.Sprintf("t/%d", i))
+	}
+	// updating the oldest topic keeps it, the next oldest is dropped
+	retain("t/0")
+	retain("t/new")
+	if n := len(c.retained.messages); n != maxRetainedCache {
+		t.Fatalf("expected %d cached topics, got %d", maxRetainedCache, n)
+	}
+	if _, ok := c.retained.messages["t/1"]; ok {
+		t.Fatalf("least recently updated topic not dropped")
+	}
+	for _, topic := range []string{"t/0", "t/2", "t/new"} {
+		if _, ok := c.retained.messages[topic]; !ok {
+			t.Fatalf("%s dropped from the cache", topic)
+		}
+	}
+}
+
+func Test_RetainedComplete(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	const window = 200 * time.Millisecond
+	completed := make(chan string, 10)
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("retainedcomplete")
+	ops.SetKeepAlive(0)
+	ops.SetRetainedQuietWindow(window)
+	ops.SetRetainedCompleteHandler(func(filter string) { completed <- filter })
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+	defer c.Disconnect(0)
+
+	c.Subscribe("state/#", 0, func(c *Client, m Message) {})
+	conn.subscribeAndAck(t)
+	for _, topic := range []string{"state/a", "state/b"} {
+		time.Sleep(window / 4)
+		p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		p.TopicName = []byte(topic)
+		p.Payload = []byte("1")
+		p.Retain = true
+		conn.send(t, p)
+	}
+	last := time.Now()
+
+	select {
+	case filter := <-completed:
+		if filter != "state/#" {
+			t.Fatalf("completion reported for %q", filter)
+		}
+		if elapsed := time.Since(last); elapsed < window*3/4 {
+			t.Fatalf("completion reported %v after the last retained message", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("retained completion not reported")
+	}
+
+	// a live message afterwards does not report completion again
+	sendPublish(t, conn, "state/a", "2")
+	select {
+	case filter := <-completed:
+		t.Fatalf("completion reported twice, again for %q", filter)
+	case <-time.After(2 * window):
+	}
+}
+
+func Test_Qos0BackpressureWithErrors(t *testing.T) {
+	const cycles = 20
+	connects := make(chan struct{}, cycles+5)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("backpressure")
+	ops.SetKeepAlive(0)
+	ops.SetMessageChannelDepth(1)
+	ops.SetInitialReconnectDelay(time.Millisecond)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			r := bufio.NewReader(server)
+			if _, err := packets.ReadPacket(r); err != nil {
+				return
+			}
+			w := bufio.NewWriter(server)
+			packets.NewControlPacket(packets.Connack).Write(w)
+			w.Flush()
+			connects <- struct{}{}
+			// flood the slow handler, then fail the connection while
+			// alllogic is blocked delivering a message
+			time.AfterFunc(20*time.Millisecond, func() { server.Close() })
+			for i := 0; ; i++ {
+				pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				pub.TopicName = []byte("flood")
+				pub.Payload = []byte(strconv.Itoa(i))
+				pub.Write(w)
+				if w.Flush() != nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	})
+	ops.SetDefaultPublishHandler(func(*Client, Message) {
+		time.Sleep(5 * time.Millisecond)
+	})
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	<-connects
+	// let the first cycle settle before counting
+	time.Sleep(50 * time.Millisecond)
+	base := runtime.NumGoroutine()
+
+	for i := 0; i < cycles; i++ {
+		select {
+		case <-connects:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no reconnect after %d cycles", i)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := runtime.NumGoroutine(); n > base+10 {
+		t.Fatalf("goroutines grew from %d to %d over %d connection errors", base, n, cycles)
+	}
+	c.Disconnect(0)
+}
+
+func Test_TLSServerNameForBroker(t *testing.T) {
+	cert, roots := selfSignedCert(t, "broker.example")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	broker := serveTestBroker(l)
+	defer broker.close()
+	brokerURL := "tls://" + l.Addr().String()
+
+	ops := NewClientOptions().AddBroker(brokerURL).SetClientID("sni")
+	ops.SetKeepAlive(0)
+	ops.SetTLSConfig(&tls.Config{RootCAs: roots})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() == nil {
+		t.Fatalf("connected to a broker whose certificate doesn't name the dialled host")
+	}
+
+	var asked *url.URL
+	ops.SetTLSServerNameForBroker(func(broker *url.URL) string {
+		asked = broker
+		return "broker.example"
+	})
+	c = NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect with the server name override failed: %v", ct.Error())
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+	if asked == nil || asked.String() != brokerURL {
+		t.Fatalf("server name asked for %v, should be %s", asked, brokerURL)
+	}
+	if c.options.TLSConfig.ServerName != "" {
+		t.Fatalf("TLSConfig changed to server name %q", c.options.TLSConfig.ServerName)
+	}
+	c.Disconnect(0)
+}
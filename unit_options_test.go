@@ -15,10 +15,17 @@
 package mqtt
 
 import (
+	"bufio"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
 )
 
 func Test_NewClientOptions_default(t *testing.T) {
@@ -39,6 +46,10 @@ func Test_NewClientOptions_default(t *testing.T) {
 	if o.KeepAlive != 30*time.Second {
 		t.Fatalf("bad default timeout")
 	}
+
+	if o.DuplicateSubscriptions != DuplicateSubscriptionResend || (&ClientOptions{}).DuplicateSubscriptions != DuplicateSubscriptionResend {
+		t.Fatalf("bad default duplicate subscription policy")
+	}
 }
 
 func Test_NewClientOptions_mix(t *testing.T) {
@@ -124,3 +135,216 @@ func Test_OnConnectionLost(t *testing.T) {
 		t.Fatalf("client options.onconnlost was nil")
 	}
 }
+
+func Test_SessionExpiryInterval(t *testing.T) {
+	tests := []struct {
+		clean  bool
+		expiry time.Duration
+		want   uint32
+	}{
+		{true, 0, 0},
+		{false, 0, packets.SessionNeverExpires},
+		{true, time.Minute, 60},
+		{false, time.Hour, 3600},
+	}
+	for _, test := range tests {
+		o := NewClientOptions().SetCleanSession(test.clean).SetSessionExpiryInterval(test.expiry)
+		m := newConnectMsgFromOptions(o)
+		if m.CleanSession != test.clean {
+			t.Fatalf("clean flag %v, want %v", m.CleanSession, test.clean)
+		}
+		if m.Properties.SessionExpiryInterval != test.want {
+			t.Fatalf("clean %v expiry %v: got session expiry %d, want %d", test.clean, test.expiry, m.Properties.SessionExpiryInterval, test.want)
+		}
+	}
+}
+
+func Test_WillDelayInterval(t *testing.T) {
+	tests := []struct {
+		delay time.Duration
+		want  uint32
+	}{
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Minute, 60},
+	}
+	for _, test := range tests {
+		o := NewClientOptions().SetWill("will", "gone", 0, false).SetWillDelay(test.delay)
+		m := newConnectMsgFromOptions(o)
+		if m.WillProperties == nil || m.WillProperties.WillDelayInterval != test.want {
+			t.Fatalf("delay %v: got will properties %v, want a delay of %d", test.delay, m.WillProperties, test.want)
+		}
+	}
+}
+
+func Test_MaxQoS(t *testing.T) {
+	ops := NewClientOptions().SetClientID("maxqos")
+	ops.SetKeepAlive(0)
+	ops.SetMaxSubscribeQoS(1).SetMaxPublishQoS(1)
+	c := connectTestClient(t, ops)
+	defer c.close()
+	conn := c.conn
+
+	token := c.Subscribe("max/topic", 2, nil)
+	if sp := conn.subscribeAndAck(t); sp.Qoss[0] != 1 {
+		t.Fatalf("subscribed with qos %d", sp.Qoss[0])
+	}
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed: %v", token.Error())
+	}
+	token = c.SubscribeMultiple(map[string]byte{"max/a": 2, "max/b": 0}, nil)
+	sp := conn.subscribeAndAck(t)
+	for i, topic := range sp.Topics {
+		if want := map[string]byte{"max/a": 1, "max/b": 0}[topic]; sp.Qoss[i] != want {
+			t.Fatalf("%s subscribed with qos %d", topic, sp.Qoss[i])
+		}
+	}
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe multiple failed: %v", token.Error())
+	}
+
+	pt := c.Publish("max/topic", 2, false, "payload")
+	pp, ok := conn.receive(time.Second).(*packets.PublishPacket)
+	if !ok || pp.Qos != 1 {
+		t.Fatalf("expected a QoS 1 publish, got %v", pp)
+	}
+	if pt.(*PublishToken).Qos() != 1 {
+		t.Fatalf("token reports qos %d", pt.(*PublishToken).Qos())
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName, pub.Qos, pub.MessageID = []byte("max/topic"), 2, 1
+	encoded, err := pub.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	if pt := c.PublishBytes(encoded); !pt.WaitTimeout(time.Second) || pt.Error() != ErrInvalidQos {
+		t.Fatalf("expected ErrInvalidQos for a pre-encoded QoS 2 publish, got %v", pt.Error())
+	}
+}
+
+func Test_MaxQoS_literalOptions(t *testing.T) {
+	ops := &ClientOptions{ClientID: "maxqosliteral", CleanSession: true, ConnectTimeout: time.Second}
+	c := connectTestClient(t, ops)
+	defer c.close()
+	conn := c.conn
+
+	token := c.Subscribe("max/topic", 2, nil)
+	if sp := conn.subscribeAndAck(t); sp.Qoss[0] != 2 {
+		t.Fatalf("subscribed with qos %d", sp.Qoss[0])
+	}
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed: %v", token.Error())
+	}
+
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName, pub.Qos, pub.MessageID = []byte("max/topic"), 1, 1
+	encoded, err := pub.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	c.PublishBytes(encoded)
+	if pp, ok := conn.receive(time.Second).(*packets.PublishPacket); !ok || pp.Qos != 1 {
+		t.Fatalf("expected a QoS 1 publish, got %v", pp)
+	}
+}
+
+func Test_Connect_invalidWill(t *testing.T) {
+	for name, configure := range map[string]func(*ClientOptions){
+		"will retain without will": func(ops *ClientOptions) {
+			ops.SetConnectPacketBuilder(func(base *packets.ConnectPacket) *packets.ConnectPacket {
+				base.WillRetain = true
+				return base
+			})
+		},
+		"will without topic": func(ops *ClientOptions) {
+			ops.SetWill("", "gone", 1, true)
+		},
+	} {
+		sent := make(chan packets.ControlPacket, 1)
+		ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("invalidwill")
+		ops.SetKeepAlive(0)
+		ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				// nil once the client closes the connection without writing
+				cp, _ := packets.ReadPacket(bufio.NewReader(server))
+				sent <- cp
+			}()
+			return client, nil
+		})
+		configure(ops)
+		c := NewClient(ops)
+		ct := c.Connect()
+		if !ct.WaitTimeout(2 * time.Second) {
+			t.Fatalf("%s: connect timed out", name)
+		}
+		if ct.Error() != ErrInvalidConnect {
+			t.Fatalf("%s: connect failed with %v", name, ct.Error())
+		}
+		if cp := <-sent; cp != nil {
+			t.Fatalf("%s: invalid connect was sent: %v", name, cp)
+		}
+		if c.IsConnected() {
+			t.Fatalf("%s: connected", name)
+		}
+	}
+
+	// will settings without a will are left out of the packet
+	ops := NewClientOptions().SetClientID("nowill")
+	ops.SetKeepAlive(0)
+	ops.WillQos, ops.WillRetained = 1, true
+	c := connectTestClient(t, ops)
+	defer c.close()
+	if cp := c.conn.connect; cp.WillFlag || cp.WillQos != 0 || cp.WillRetain {
+		t.Fatalf("will flags sent without a will: %v", cp)
+	}
+}
+
+func Test_BrokerCredentialsProvider(t *testing.T) {
+	conns := make(chan *testConn, 2)
+	var primaryDown int32
+	ops := NewClientOptions().AddBroker("pipe://primary").AddBroker("pipe://dr").SetClientID("failover")
+	ops.SetKeepAlive(0)
+	ops.SetConnectionLostHandler(func(c *Client, err error) {})
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		if uri.Host == "primary" && atomic.LoadInt32(&primaryDown) == 1 {
+			return nil, errors.New("primary down")
+		}
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	credentials := map[string][2]string{"primary": {"main", "main-secret"}, "dr": {"backup", "backup-secret"}}
+	ops.SetCredentialsProvider(func() (string, string) { return "shared", "shared-secret" })
+	ops.SetBrokerCredentialsProvider(func(broker *url.URL) (string, string) {
+		cred := credentials[broker.Host]
+		return cred[0], cred[1]
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+
+	primary := <-conns
+	atomic.StoreInt32(&primaryDown, 1)
+	primary.Close()
+	dr := <-conns
+	defer dr.Close()
+	for i, cred := range [][2]string{credentials["primary"], credentials["dr"]} {
+		cp := []*testConn{primary, dr}[i].connect
+		if !cp.UsernameFlag || cp.Username != cred[0] || !cp.PasswordFlag || string(cp.Password) != cred[1] {
+			t.Fatalf("connect %d sent %q/%q, expected %s/%s", i+1, cp.Username, cp.Password, cred[0], cred[1])
+		}
+	}
+	for !c.IsConnected() {
+		time.Sleep(time.Millisecond)
+	}
+	c.Disconnect(0)
+}
@@ -15,8 +15,22 @@
 package mqtt
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
 )
@@ -61,3 +75,657 @@ func Test_DecodeMessage_pingresp(t *testing.T) {
 		t.Errorf("DecodeMessage ping response wrong rem len: %d", presp.(*packets.PingrespPacket).RemainingLength)
 	}
 }
+
+// readWebsocketFrame reads a single frame sent by a websocket client
+func readWebsocketFrame(r *bufio.Reader) (byte, []byte, error) {
+	first, payload, err := readWebsocketFrameFlags(r)
+	return first & 0x0f, payload, err
+}
+
+// readWebsocketFrameFlags reads a single frame sent by a websocket client,
+// returning the whole first byte of its header with the FIN and RSV flags
+func readWebsocketFrameFlags(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if hdr[1]&0x80 != 0 {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return hdr[0], payload, nil
+}
+
+func Test_WebsocketKeepalive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	pings := make(chan time.Time, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		h := sha1.New()
+		h.Write([]byte(req.Header.Get("Sec-Websocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: mqtt\r\n\r\n", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		for {
+			opcode, payload, err := readWebsocketFrame(r)
+			if err != nil {
+				return
+			}
+			switch {
+			case opcode == 2 && len(payload) > 0 && payload[0]>>4 == packets.Connect:
+				// answer with a CONNACK in a binary frame
+				conn.Write([]byte{0x82, 4, packets.Connack << 4, 2, 0, packets.Accepted})
+			case opcode == 9:
+				pings <- time.Now()
+			}
+		}
+	}()
+
+	ops := NewClientOptions().AddBroker("ws://" + l.Addr().String() + "/mqtt").SetClientID("wsping")
+	ops.SetKeepAlive(0)
+	ops.SetWebsocketPingInterval(50 * time.Millisecond)
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("websocket connect failed")
+	}
+	defer c.Disconnect(0)
+
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		select {
+		case at := <-pings:
+			if !last.IsZero() && at.Sub(last) < 25*time.Millisecond {
+				t.Fatalf("pings sent too often: %v apart", at.Sub(last))
+			}
+			last = at
+		case <-time.After(time.Second):
+			t.Fatalf("websocket ping %d not received", i+1)
+		}
+	}
+}
+
+// deflateMessage compresses a websocket message as permessage-deflate does
+func deflateMessage(b []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(b)
+	w.Flush()
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff})
+}
+
+// inflateMessage decompresses a permessage-deflate websocket message
+func inflateMessage(b []byte) ([]byte, error) {
+	b = append(b, 0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff)
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(b)))
+}
+
+func Test_WebsocketCompression(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	payload := bytes.Repeat([]byte{0x00, 0xff, 0x10, 0x82}, 100)
+	received := make(chan []byte, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		h := sha1.New()
+		h.Write([]byte(req.Header.Get("Sec-Websocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\nSec-WebSocket-Protocol: mqtt\r\n"+
+			"Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n\r\n",
+			base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		send := func(cp packets.ControlPacket) {
+			var b bytes.Buffer
+			cp.Write(&b)
+			m := deflateMessage(b.Bytes())
+			frame := []byte{0xc2, 126, byte(len(m) >> 8), byte(len(m))}
+			conn.Write(append(frame, m...))
+		}
+		for {
+			first, data, err := readWebsocketFrameFlags(r)
+			if err != nil {
+				return
+			}
+			if first&0x0f != 2 {
+				continue
+			}
+			if first&0x40 == 0 {
+				received <- nil
+				continue
+			}
+			data, err = inflateMessage(data)
+			if err != nil {
+				received <- nil
+				continue
+			}
+			cp, err := packets.ReadPacket(bytes.NewReader(data))
+			if err != nil {
+				received <- nil
+				continue
+			}
+			switch p := cp.(type) {
+			case *packets.ConnectPacket:
+				send(packets.NewControlPacket(packets.Connack))
+			case *packets.SubscribePacket:
+				sa := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+				sa.MessageID = p.MessageID
+				sa.GrantedQoss = p.Qoss
+				send(sa)
+				pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				pub.TopicName = []byte("ws/compressed")
+				pub.Payload = payload
+				send(pub)
+			case *packets.PublishPacket:
+				received <- p.Payload
+			}
+		}
+	}()
+
+	ops := NewClientOptions().AddBroker("ws://" + l.Addr().String() + "/mqtt").SetClientID("wsdeflate")
+	ops.SetKeepAlive(0)
+	ops.SetWebsocketCompression(true)
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("websocket connect failed")
+	}
+	defer c.Disconnect(0)
+
+	messages := make(chan []byte, 1)
+	c.Subscribe("ws/#", 0, func(c *Client, m Message) { messages <- m.Payload() })
+	select {
+	case got := <-messages:
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("compressed publish decoded as %x", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("compressed publish not delivered")
+	}
+
+	c.Publish("ws/out", 0, false, payload)
+	select {
+	case got := <-received:
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("server decoded publish as %x", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("compressed publish not received by the server")
+	}
+}
+
+func Test_WebsocketCompression_tooLarge(t *testing.T) {
+	const max = 1024
+	frame := func(m []byte) []byte {
+		return append([]byte{0xc2, 126, byte(len(m) >> 8), byte(len(m))}, m...)
+	}
+	// a few bytes inflating past the limit
+	small := deflateMessage(make([]byte, 4*max))
+	c := &deflateConn{r: bufio.NewReader(bytes.NewReader(frame(small))), compressed: true, maxMessage: max}
+	if _, err := c.readMessage(); err != errWebsocketTooLarge {
+		t.Fatalf("inflating past the limit read with error %v", err)
+	}
+
+	within := deflateMessage(make([]byte, max))
+	c = &deflateConn{r: bufio.NewReader(bytes.NewReader(frame(within))), compressed: true, maxMessage: max}
+	if m, err := c.readMessage(); err != nil || len(m) != max {
+		t.Fatalf("message at the limit read as %d bytes with error %v", len(m), err)
+	}
+}
+
+func Test_OutgoingStallWatchdog(t *testing.T) {
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("stall")
+	ops.SetKeepAlive(0)
+	ops.SetAutoReconnect(false)
+	ops.SetOutgoingStallTimeout(100 * time.Millisecond)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		// after the handshake nothing is read, so writes block forever
+		go handshake(server)
+		return client, nil
+	})
+	lost := make(chan error, 1)
+	ops.SetConnectionLostHandler(func(c *Client, err error) { lost <- err })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+
+	start := time.Now()
+	c.Publish("stall/topic", 0, false, "blocked")
+	select {
+	case err := <-lost:
+		if err != ErrOutgoingStalled {
+			t.Fatalf("expected %v, got %v", ErrOutgoingStalled, err)
+		}
+		if d := time.Since(start); d < 100*time.Millisecond {
+			t.Fatalf("connection dropped after only %v", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("stalled write was not detected")
+	}
+}
+
+func Test_writeDeadline(t *testing.T) {
+	ops := NewClientOptions()
+	ops.SetAdaptiveWriteTimeout(true)
+	ops.SetWriteTimeoutBounds(50*time.Millisecond, 2*time.Second)
+	w := newWriteDeadline(ops)
+	if d := w.timeout(); d != 2*time.Second {
+		t.Fatalf("timeout before any write was %v, expected the ceiling", d)
+	}
+	for i := 0; i < 20; i++ {
+		w.record(100 * time.Millisecond)
+	}
+	if d := w.timeout(); d != 400*time.Millisecond {
+		t.Fatalf("timeout after 100ms writes was %v", d)
+	}
+	// a slower network raises the timeout gradually
+	w.record(300 * time.Millisecond)
+	if d := w.timeout(); d <= 400*time.Millisecond || d >= 1200*time.Millisecond {
+		t.Fatalf("timeout after one slow write was %v", d)
+	}
+	for i := 0; i < 50; i++ {
+		w.record(time.Second)
+	}
+	if d := w.timeout(); d != 2*time.Second {
+		t.Fatalf("timeout was %v, expected it held at the ceiling", d)
+	}
+	for i := 0; i < 100; i++ {
+		w.record(time.Millisecond)
+	}
+	if d := w.timeout(); d != 50*time.Millisecond {
+		t.Fatalf("timeout was %v, expected it held at the floor", d)
+	}
+
+	// without a ceiling the floor applies until the first write
+	ops.SetWriteTimeoutBounds(50*time.Millisecond, 0)
+	if d := newWriteDeadline(ops).timeout(); d != 50*time.Millisecond {
+		t.Fatalf("timeout before any write without a ceiling was %v, expected the floor", d)
+	}
+	ops.SetWriteTimeoutBounds(0, 0)
+	if d := newWriteDeadline(ops).timeout(); d != 0 {
+		t.Fatalf("timeout without bounds was %v, expected none", d)
+	}
+	// a floor above the ceiling is ignored by the setter and capped otherwise
+	ops.SetWriteTimeoutBounds(50*time.Millisecond, 2*time.Second)
+	ops.SetWriteTimeoutBounds(3*time.Second, time.Second)
+	if ops.WriteTimeoutFloor != 50*time.Millisecond || ops.WriteTimeoutCeiling != 2*time.Second {
+		t.Fatalf("inverted bounds were set to %v and %v", ops.WriteTimeoutFloor, ops.WriteTimeoutCeiling)
+	}
+	ops.WriteTimeoutFloor = 3 * time.Second
+	w = newWriteDeadline(ops)
+	w.record(time.Second)
+	if d := w.timeout(); d != 2*time.Second {
+		t.Fatalf("timeout with the floor above the ceiling was %v", d)
+	}
+
+	ops.SetAdaptiveWriteTimeout(false)
+	ops.SetWriteTimeout(time.Second)
+	w = newWriteDeadline(ops)
+	w.record(time.Millisecond)
+	if d := w.timeout(); d != time.Second {
+		t.Fatalf("fixed timeout was %v", d)
+	}
+}
+
+func Test_AdaptiveWriteTimeout(t *testing.T) {
+	const slow = 10
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("adaptive")
+	ops.SetKeepAlive(0)
+	ops.SetAutoReconnect(false)
+	ops.SetAdaptiveWriteTimeout(true)
+	ops.SetWriteTimeoutBounds(10*time.Millisecond, 10*time.Second)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			tc, err := handshake(server)
+			if err != nil {
+				return
+			}
+			// each write takes 20ms until the broker stops reading
+			for i := 0; i < slow; i++ {
+				time.Sleep(20 * time.Millisecond)
+				if tc.receive(time.Second) == nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	})
+	lost := make(chan error, 1)
+	ops.SetConnectionLostHandler(func(c *Client, err error) { lost <- err })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+
+	// slow writes are well above the floor, but the timeout follows them
+	for i := 0; i < slow; i++ {
+		if token := c.Publish("adaptive/topic", 0, false, "slow"); !token.WaitTimeout(time.Second) || token.Error() != nil {
+			t.Fatalf("slow publish %d failed: %v", i, token.Error())
+		}
+	}
+	select {
+	case err := <-lost:
+		t.Fatalf("connection lost during slow writes: %v", err)
+	default:
+	}
+
+	start := time.Now()
+	c.Publish("adaptive/topic", 0, false, "stalled")
+	select {
+	case err := <-lost:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("connection lost with %v, expected a timeout", err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("stall took %v to detect", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("stalled write was not detected")
+	}
+}
+
+func Test_PacketReadTimeout(t *testing.T) {
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("dribble")
+	ops.SetKeepAlive(0)
+	ops.SetAutoReconnect(false)
+	ops.SetPacketReadTimeout(100 * time.Millisecond)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if _, err := handshake(server); err != nil {
+				return
+			}
+			// an idle connection is fine, only a started packet is timed
+			time.Sleep(200 * time.Millisecond)
+			server.Write([]byte{packets.Publish << 4, 10, 0})
+			for i := 0; i < 10; i++ {
+				time.Sleep(50 * time.Millisecond)
+				if _, err := server.Write([]byte{'a'}); err != nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	})
+	lost := make(chan error, 1)
+	ops.SetConnectionLostHandler(func(c *Client, err error) { lost <- err })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+
+	start := time.Now()
+	select {
+	case err := <-lost:
+		if err != ErrPacketReadTimeout {
+			t.Fatalf("expected %v, got %v", ErrPacketReadTimeout, err)
+		}
+		if d := time.Since(start); d < 250*time.Millisecond {
+			t.Fatalf("connection dropped after only %v", d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("dribbled packet was not timed out")
+	}
+}
+
+func Test_MeasureLatency(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("latency")
+	ops.SetKeepAlive(0)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			tc, err := handshake(server)
+			if err != nil {
+				return
+			}
+			for {
+				cp, err := packets.ReadPacket(tc.r)
+				if err != nil {
+					return
+				}
+				if _, ok := cp.(*packets.PingreqPacket); ok {
+					time.Sleep(delay)
+					w := bufio.NewWriter(tc)
+					packets.NewControlPacket(packets.Pingresp).Write(w)
+					w.Flush()
+				}
+			}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	rtt, err := c.MeasureLatency(ctx)
+	if err != nil {
+		t.Fatalf("MeasureLatency failed: %v", err)
+	}
+	if rtt < delay || rtt > delay+100*time.Millisecond {
+		t.Fatalf("measured latency %v, expected about %v", rtt, delay)
+	}
+
+	// the broker answers one at a time, so concurrent measurements queue up
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	rtts := make(chan time.Duration, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rtt, err := c.MeasureLatency(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			rtts <- rtt
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(rtts)
+	for err := range errs {
+		t.Fatalf("concurrent MeasureLatency failed: %v", err)
+	}
+	for rtt := range rtts {
+		if rtt < delay || rtt > 3*delay+100*time.Millisecond {
+			t.Fatalf("measured latency %v, expected %v to %v", rtt, delay, 3*delay)
+		}
+	}
+}
+
+func Test_MeasureLatency_connectionLost(t *testing.T) {
+	conns := make(chan *testConn, 1)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("latencylost")
+	ops.SetKeepAlive(0)
+	ops.SetAutoReconnect(false)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			if tc, err := handshake(server); err == nil {
+				conns <- tc
+			}
+		}()
+		return client, nil
+	})
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	broker := <-conns
+	go func() {
+		// drop the connection instead of answering the ping
+		if _, ok := broker.receive(time.Second).(*packets.PingreqPacket); ok {
+			broker.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := c.MeasureLatency(ctx); err != ErrNotConnected {
+		t.Fatalf("expected %v, got %v", ErrNotConnected, err)
+	}
+}
+
+func Test_Keepalive_rateLimited(t *testing.T) {
+	pings := make(chan struct{}, 4)
+	ops := NewClientOptions().AddBroker("pipe://broker").SetClientID("ratelimitedping")
+	ops.SetKeepAlive(time.Second)
+	ops.SetPingTimeout(500 * time.Millisecond)
+	// publishes wait far longer than the keepalive interval
+	limiter := &tickLimiter{time.NewTicker(time.Hour)}
+	defer limiter.ticker.Stop()
+	ops.SetPublishRateLimiter(limiter)
+	ops.SetCustomOpenConnectionFn(func(uri *url.URL) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			tc, err := handshake(server)
+			if err != nil {
+				return
+			}
+			for {
+				cp, err := packets.ReadPacket(tc.r)
+				if err != nil {
+					return
+				}
+				if _, ok := cp.(*packets.PingreqPacket); ok {
+					pings <- struct{}{}
+					w := bufio.NewWriter(tc)
+					packets.NewControlPacket(packets.Pingresp).Write(w)
+					w.Flush()
+				}
+			}
+		}()
+		return client, nil
+	})
+	lost := make(chan error, 1)
+	ops.SetConnectionLostHandler(func(c *Client, err error) { lost <- err })
+	c := NewClient(ops)
+	if ct := c.Connect(); !ct.WaitTimeout(2*time.Second) || ct.Error() != nil {
+		t.Fatalf("connect over pipe failed")
+	}
+	defer c.Disconnect(0)
+
+	c.Publish("rate/topic", 0, false, "held")
+	for i := 0; i < 2; i++ {
+		select {
+		case <-pings:
+		case err := <-lost:
+			t.Fatalf("connection lost while publishes were rate limited: %v", err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("keepalive ping %d not sent while publishes were rate limited", i)
+		}
+	}
+}
+
+func Test_IdleTimeout(t *testing.T) {
+	idled := make(chan struct{}, 2)
+	ops := NewClientOptions().SetClientID("idle")
+	ops.SetKeepAlive(0)
+	ops.SetInitialReconnectDelay(10 * time.Millisecond)
+	ops.SetIdleTimeout(150 * time.Millisecond)
+	ops.SetIdleDisconnectHandler(func(c *Client) { idled <- struct{}{} })
+	ops.SetConnectionLostHandler(func(c *Client, err error) {
+		t.Errorf("connection lost with %v", err)
+	})
+	c := connectTestClient(t, ops)
+	defer c.close()
+	conn := c.conn
+
+	// a publish keeps the connection open
+	time.Sleep(100 * time.Millisecond)
+	c.Publish("idle/busy", 0, false, "busy")
+	if _, ok := conn.receive(time.Second).(*packets.PublishPacket); !ok {
+		t.Fatalf("publish not received")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !c.IsConnected() {
+		t.Fatalf("disconnected before the idle timeout")
+	}
+
+	select {
+	case <-idled:
+	case <-time.After(time.Second):
+		t.Fatalf("idle connection not closed")
+	}
+	if _, ok := conn.receive(time.Second).(*packets.DisconnectPacket); !ok {
+		t.Fatalf("disconnect not received")
+	}
+	if c.IsConnected() {
+		t.Fatalf("connected after the idle timeout")
+	}
+	select {
+	case <-c.broker.conns:
+		t.Fatalf("reconnected without being used")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the next publish reconnects, QoS 0 isn't dropped
+	token := c.Publish("idle/wake", 0, false, "wake")
+	newConn := c.broker.accept(t, time.Second)
+	defer newConn.Close()
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("publish after idling failed: %v", token.Error())
+	}
+	pp, ok := newConn.receive(time.Second).(*packets.PublishPacket)
+	if !ok || string(pp.TopicName) != "idle/wake" {
+		t.Fatalf("publish not received after reconnecting")
+	}
+	if !c.IsConnected() {
+		t.Fatalf("not connected after publishing")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
+)
+
+func publishOnceOptions(broker string) *ClientOptions {
+	ops := NewClientOptions().AddBroker(broker).SetClientID("once")
+	ops.SetAutoReconnect(false)
+	ops.SetConnectTimeout(time.Second)
+	return ops
+}
+
+// publishOnceStage returns the stage of err, which must be a *PublishOnceError
+func publishOnceStage(t *testing.T, err error) PublishOnceStage {
+	var poe *PublishOnceError
+	if !errors.As(err, &poe) {
+		t.Fatalf("expected a PublishOnceError, got %v", err)
+	}
+	return poe.Stage
+}
+
+func Test_PublishOnce(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	received := make(chan *packets.PublishPacket, 1)
+	disconnected := make(chan bool, 1)
+	go func() {
+		conn := <-broker.conns
+		defer conn.Close()
+		pp, ok := conn.receive(2 * time.Second).(*packets.PublishPacket)
+		if !ok {
+			close(received)
+			return
+		}
+		received <- pp
+		pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		pa.MessageID = pp.MessageID
+		conn.send(t, pa)
+		_, ok = conn.receive(2 * time.Second).(*packets.DisconnectPacket)
+		disconnected <- ok
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := PublishOnce(ctx, publishOnceOptions(broker.url()), "once/topic", 1, true, "payload"); err != nil {
+		t.Fatalf("publish once failed: %v", err)
+	}
+	pp := <-received
+	if pp == nil || string(pp.TopicName) != "once/topic" || string(pp.Payload) != "payload" || pp.Qos != 1 || !pp.Retain {
+		t.Fatalf("broker received %v", pp)
+	}
+	select {
+	case ok := <-disconnected:
+		if !ok {
+			t.Fatalf("disconnect not received")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("client did not disconnect")
+	}
+}
+
+func Test_PublishOnce_connectFailure(t *testing.T) {
+	// nothing listens on the address once the listener is closed
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = PublishOnce(ctx, publishOnceOptions("tcp://"+addr), "once/topic", 1, false, "payload")
+	if stage := publishOnceStage(t, err); stage != PublishOnceConnect {
+		t.Fatalf("failed at %v: %v", stage, err)
+	}
+}
+
+func Test_PublishOnce_publishFailure(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := PublishOnce(ctx, publishOnceOptions(broker.url()), "once/topic", 1, false, 42)
+	if stage := publishOnceStage(t, err); stage != PublishOncePublish {
+		t.Fatalf("failed at %v: %v", stage, err)
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+	if _, ok := conn.receive(time.Second).(*packets.DisconnectPacket); !ok {
+		t.Fatalf("disconnect not received after the failed publish")
+	}
+}
+
+func Test_PublishOnce_ackTimeout(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	// the broker never acknowledges the publish
+	err := PublishOnce(ctx, publishOnceOptions(broker.url()), "once/topic", 1, false, "payload")
+	if stage := publishOnceStage(t, err); stage != PublishOnceAck {
+		t.Fatalf("failed at %v: %v", stage, err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	conn := broker.accept(t, time.Second)
+	defer conn.Close()
+	if _, ok := conn.receive(time.Second).(*packets.PublishPacket); !ok {
+		t.Fatalf("publish not received")
+	}
+	if _, ok := conn.receive(time.Second).(*packets.DisconnectPacket); !ok {
+		t.Fatalf("disconnect not received after the ack timeout")
+	}
+}
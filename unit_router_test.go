@@ -15,7 +15,11 @@
 package mqtt
 
 import (
+	"fmt"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/contactless/org.eclipse.paho.mqtt.golang/packets"
 )
@@ -46,6 +50,29 @@ func Test_AddRoute(t *testing.T) {
 	}
 }
 
+func Test_AddRoute_overlapping(t *testing.T) {
+	router, _ := newRouter()
+	router.addRoute("#", nil)
+	router.addRoute("a/#", nil)
+	router.addRoute("a/+", nil)
+	if router.routes.Len() != 3 {
+		t.Fatalf("overlapping routes were merged, %d left", router.routes.Len())
+	}
+
+	router.deleteRoute("a/#")
+	if router.routes.Len() != 2 {
+		t.Fatalf("removing a/# left %d routes", router.routes.Len())
+	}
+	for e := router.routes.Front(); e != nil; e = e.Next() {
+		if e.Value.(*route).is("a/#") {
+			t.Fatalf("a/# wasn't removed")
+		}
+	}
+	if !router.routes.Front().Value.(*route).is("#") {
+		t.Fatalf("removing a/# also removed #")
+	}
+}
+
 func Test_Match(t *testing.T) {
 	router, _ := newRouter()
 	router.addRoute("/alpha", nil)
@@ -266,23 +293,588 @@ func Test_MatchAndDispatch(t *testing.T) {
 	pub.TopicName = []byte("a")
 	pub.Payload = []byte("foo")
 
-	msgs := make(chan *packets.PublishPacket)
+	msgs := make(chan incomingPublish)
 
 	router, stopper := newRouter()
 	router.addRoute("a", cb)
 
-	router.matchAndDispatch(msgs, true, nil)
+	router.matchAndDispatch(msgs, dispatchOrdered, nil)
 
-	msgs <- pub
+	msgs <- incomingPublish{packet: pub}
 
 	<-calledback
 
 	stopper <- true
 
 	select {
-	case msgs <- pub:
+	case msgs <- incomingPublish{packet: pub}:
 		t.Errorf("msgs should not have a listener")
 	default:
 	}
 
 }
+
+func Test_MatchAndDispatch_perRoute(t *testing.T) {
+	const count = 10
+	var wg sync.WaitGroup
+	wg.Add(2 * count)
+	var gotA, gotB []string
+	bStarted := make(chan struct{})
+	var once sync.Once
+
+	router, stopper := newRouter()
+	router.addRoute("a", func(c *Client, m Message) {
+		if len(gotA) == 0 {
+			// only returns if b's handler can run while this one is busy
+			select {
+			case <-bStarted:
+			case <-time.After(2 * time.Second):
+				t.Error("handlers of different routes did not run concurrently")
+			}
+		}
+		gotA = append(gotA, string(m.Payload()))
+		wg.Done()
+	})
+	router.addRoute("b", func(c *Client, m Message) {
+		once.Do(func() { close(bStarted) })
+		gotB = append(gotB, string(m.Payload()))
+		wg.Done()
+	})
+
+	msgs := make(chan incomingPublish)
+	router.matchAndDispatch(msgs, dispatchPerRoute, nil)
+	for i := 0; i < count; i++ {
+		for _, topic := range []string{"a", "b"} {
+			pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pub.TopicName = []byte(topic)
+			pub.Payload = []byte(strconv.Itoa(i))
+			msgs <- incomingPublish{packet: pub}
+		}
+	}
+	wg.Wait()
+	stopper <- true
+
+	for _, got := range [][]string{gotA, gotB} {
+		for i, payload := range got {
+			if payload != strconv.Itoa(i) {
+				t.Fatalf("messages delivered out of order: %v", got)
+			}
+		}
+	}
+}
+
+func Test_MatchAndDispatch_perRoute_removed(t *testing.T) {
+	const count = 10
+	release := make(chan struct{})
+	handled := make(chan string, count)
+
+	router, stopper := newRouter()
+	router.addRoute("a", func(c *Client, m Message) {
+		<-release
+		handled <- string(m.Payload())
+	})
+
+	msgs := make(chan incomingPublish)
+	router.matchAndDispatch(msgs, dispatchPerRoute, nil)
+	for i := 0; i < count; i++ {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = []byte("a")
+		pub.Payload = []byte(strconv.Itoa(i))
+		msgs <- incomingPublish{packet: pub}
+	}
+	// a message is only known to be queued once the next one is taken
+	msgs <- incomingPublish{packet: packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)}
+
+	// the messages queued for a removed route are still handled
+	router.deleteRoute("a")
+	close(release)
+	for i := 0; i < count; i++ {
+		select {
+		case payload := <-handled:
+			if payload != strconv.Itoa(i) {
+				t.Fatalf("message %d handled as %s", i, payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d dropped with its route", i)
+		}
+	}
+	stopper <- true
+}
+
+func Test_MatchAndDispatch_subscriptionIdentifier(t *testing.T) {
+	calledback := make(chan string, 2)
+
+	router, stopper := newRouter()
+	id := router.addIdentifiedRoute("a/+", func(c *Client, m Message) {
+		calledback <- "a/+"
+	})
+	router.addRoute("#", func(c *Client, m Message) {
+		calledback <- "#"
+	})
+	if id == 0 {
+		t.Fatalf("no subscription identifier assigned")
+	}
+	if again := router.addIdentifiedRoute("a/+", nil); again != id {
+		t.Fatalf("subscription identifier changed from %d to %d", id, again)
+	}
+	router.addIdentifiedRoute("a/+", func(c *Client, m Message) {
+		calledback <- "a/+"
+	})
+
+	msgs := make(chan incomingPublish)
+	router.matchAndDispatch(msgs, dispatchOrdered, nil)
+
+	// the topic matches neither route but the identifier does,
+	// so the message must not be matched by topic
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = []byte("b")
+	pub.Properties = &packets.Properties{SubscriptionIdentifiers: []int{id}}
+	msgs <- incomingPublish{packet: pub}
+
+	if r := <-calledback; r != "a/+" {
+		t.Fatalf("dispatched to %s instead of the identified route", r)
+	}
+
+	// unknown identifiers fall back to topic matching
+	pub = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = []byte("b")
+	pub.Properties = &packets.Properties{SubscriptionIdentifiers: []int{id + 1}}
+	msgs <- incomingPublish{packet: pub}
+
+	if r := <-calledback; r != "#" {
+		t.Fatalf("dispatched to %s instead of the matching route", r)
+	}
+	stopper <- true
+
+	router.deleteRoute("a/+")
+	if _, ok := router.subIDs[id]; ok {
+		t.Fatalf("subscription identifier not removed with its route")
+	}
+}
+
+func Test_MatchAndDispatch_subscriptionIdentifiers(t *testing.T) {
+	calledback := make(chan string, 10)
+
+	router, stopper := newRouter()
+	idA := router.addIdentifiedRoute("a/+", func(c *Client, m Message) {
+		calledback <- "a/+"
+	})
+	idB := router.addIdentifiedRoute("a/b", func(c *Client, m Message) {
+		calledback <- "a/b"
+	})
+	router.addRoute("#", func(c *Client, m Message) {
+		calledback <- "#"
+	})
+
+	msgs := make(chan incomingPublish)
+	router.matchAndDispatch(msgs, dispatchOrdered, nil)
+
+	// both identified routes are called once, a repeated identifier is
+	// ignored and topic matching isn't used
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = []byte("a/b")
+	pub.Properties = &packets.Properties{SubscriptionIdentifiers: []int{idA, idB, idA}}
+	msgs <- incomingPublish{packet: pub}
+	stopper <- true
+
+	called := make(map[string]int)
+	for len(calledback) > 0 {
+		called[<-calledback]++
+	}
+	if len(called) != 2 || called["a/+"] != 1 || called["a/b"] != 1 {
+		t.Fatalf("expected each identified route to be called once, got %v", called)
+	}
+}
+
+func Test_MatchAndDispatch_handlerPanic(t *testing.T) {
+	for _, mode := range []dispatchMode{dispatchOrdered, dispatchPerRoute, dispatchUnordered} {
+		panicked := make(chan string, 1)
+		client := NewClient(NewClientOptions().SetHandlerPanicHandler(func(topic string, recovered interface{}) {
+			panicked <- fmt.Sprintf("%s %v", topic, recovered)
+		}))
+		delivered := make(chan string, 2)
+		cb := func(c *Client, m Message) {
+			if string(m.Payload()) == "bad" {
+				panic("bad payload")
+			}
+			delivered <- string(m.Payload())
+		}
+
+		msgs := make(chan incomingPublish)
+		router, stopper := newRouter()
+		router.addRoute("a", cb)
+		router.matchAndDispatch(msgs, mode, client)
+
+		for _, payload := range []string{"bad", "good"} {
+			pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pub.TopicName = []byte("a")
+			pub.Payload = []byte(payload)
+			msgs <- incomingPublish{packet: pub}
+		}
+
+		select {
+		case p := <-panicked:
+			if p != "a bad payload" {
+				t.Errorf("mode %v: panic reported as %q", mode, p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("mode %v: panic not reported", mode)
+		}
+		select {
+		case payload := <-delivered:
+			if payload != "good" {
+				t.Errorf("mode %v: delivered %q", mode, payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("mode %v: message after the panic not delivered", mode)
+		}
+		stopper <- true
+	}
+}
+
+func Test_MatchAndDispatch_maxDeliveryAge(t *testing.T) {
+	client := NewClient(NewClientOptions().SetMaxDeliveryAge(50 * time.Millisecond))
+	delivered := make(chan string, 3)
+	cb := func(c *Client, m Message) {
+		if string(m.Payload()) == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		delivered <- string(m.Payload())
+	}
+
+	msgs := make(chan incomingPublish, 3)
+	router, stopper := newRouter()
+	router.addRoute("a", cb)
+	router.matchAndDispatch(msgs, dispatchOrdered, client)
+	defer func() { stopper <- true }()
+
+	send := func(payload string, received time.Time) {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = []byte("a")
+		pub.Payload = []byte(payload)
+		msgs <- incomingPublish{packet: pub, received: received}
+	}
+	before := GetStaleCount()
+	// the second message waits behind the slow handler for too long
+	send("slow", time.Now())
+	send("stale", time.Now())
+	if payload := <-delivered; payload != "slow" {
+		t.Fatalf("delivered %q", payload)
+	}
+	send("fresh", time.Now())
+	select {
+	case payload := <-delivered:
+		if payload != "fresh" {
+			t.Fatalf("delivered %q after the slow message", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("fresh message not delivered")
+	}
+	if n := GetStaleCount() - before; n != 1 {
+		t.Fatalf("%d stale messages counted, should be 1", n)
+	}
+}
+
+func Test_MatchAndDispatch_rejectUnsolicited(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		client := NewClient(NewClientOptions().SetRejectUnsolicitedMessages(reject))
+		delivered := make(chan string, 2)
+		msgs := make(chan incomingPublish, 2)
+		router, stopper := newRouter()
+		router.addRoute("a", func(c *Client, m Message) { delivered <- m.Topic() })
+		router.matchAndDispatch(msgs, dispatchOrdered, client)
+
+		before := GetUnsolicitedCount()
+		// messages are handled in order, the second is delivered once the
+		// first has been dealt with
+		for _, topic := range []string{"b", "a"} {
+			pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			pub.TopicName = []byte(topic)
+			msgs <- incomingPublish{packet: pub}
+		}
+		select {
+		case topic := <-delivered:
+			if topic != "a" {
+				t.Fatalf("delivered a message on %q", topic)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("subscribed message not delivered")
+		}
+		want := 0
+		if reject {
+			want = 1
+		}
+		if n := GetUnsolicitedCount() - before; n != want {
+			t.Fatalf("%d unsolicited messages counted with reject %v, should be %d", n, reject, want)
+		}
+		stopper <- true
+	}
+}
+
+func Test_SubscriptionStats(t *testing.T) {
+	client := NewClient(NewClientOptions())
+	delivered := make(chan string, 10)
+	cb := func(c *Client, m Message) { delivered <- m.Topic() }
+	msgs := make(chan incomingPublish, 10)
+	client.msgRouter.addRoute("a/+", cb)
+	client.msgRouter.addRoute("b", cb)
+	client.msgRouter.addRoute("c", cb)
+	client.msgRouter.matchAndDispatch(msgs, dispatchOrdered, client)
+	defer func() { client.stopRouter <- true }()
+
+	start := time.Now()
+	topics := []string{"a/1", "b", "a/2", "a/3", "b", "d"}
+	for _, topic := range topics {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = []byte(topic)
+		msgs <- incomingPublish{packet: pub}
+	}
+	// d matches no route
+	for range topics[:len(topics)-1] {
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatalf("message not delivered")
+		}
+	}
+
+	stats := client.SubscriptionStats()
+	if len(stats) != 3 {
+		t.Fatalf("expected stats for 3 filters, got %v", stats)
+	}
+	for filter, want := range map[string]int64{"a/+": 3, "b": 2} {
+		if stats[filter].Count != want {
+			t.Errorf("counted %d messages for %s, should be %d", stats[filter].Count, filter, want)
+		}
+		if stats[filter].LastSeen.Before(start) {
+			t.Errorf("last message for %s seen at %v, before they were sent", filter, stats[filter].LastSeen)
+		}
+	}
+	if stat := stats["c"]; stat.Count != 0 || !stat.LastSeen.IsZero() {
+		t.Errorf("filter without messages has stats %v", stat)
+	}
+}
+
+func Test_Message_TopicBytes(t *testing.T) {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = []byte("a/b")
+	pub.Payload = []byte("payload")
+	m := messageFromPublish(pub, 0, 0, nil)
+	// the message must not share memory with the packet, which is pooled
+	pub.TopicName[0], pub.Payload[0] = 'x', 'x'
+	if string(m.(DetailedMessage).TopicBytes()) != "a/b" || m.Topic() != "a/b" || string(m.Payload()) != "payload" {
+		t.Fatalf("message changed with its packet: %s %s", m.(DetailedMessage).TopicBytes(), m.Payload())
+	}
+	// growing the topic must not overwrite the payload
+	_ = append(m.(DetailedMessage).TopicBytes(), 'x')
+	if string(m.Payload()) != "payload" {
+		t.Fatalf("payload overwritten through the topic: %s", m.Payload())
+	}
+}
+
+var benchTopicLen int
+
+// run with -benchtime=1000000x to compare 1M deliveries
+func benchmarkDelivery(b *testing.B, handler func(Message)) {
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = []byte("sensors/building1/floor2/room3/temperature")
+	pub.Payload = []byte("21.5")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		handler(messageFromPublish(pub, 0, 0, nil))
+	}
+}
+
+func BenchmarkMessageTopic(b *testing.B) {
+	benchmarkDelivery(b, func(m Message) { benchTopicLen += len(m.Topic()) })
+}
+
+func BenchmarkMessageTopicBytes(b *testing.B) {
+	benchmarkDelivery(b, func(m Message) { benchTopicLen += len(m.(DetailedMessage).TopicBytes()) })
+}
+
+// subscribeChanClient connects a client to a test broker, subscribes to
+// chan/# with SubscribeChan and to marker with a callback which signals
+// markers, whose messages show that everything sent before was routed
+func subscribeChanClient(t *testing.T, broker *testBroker, policy ChannelFullPolicy, size int) (*Client, *testConn, <-chan Message, chan struct{}) {
+	ops := NewClientOptions().AddBroker(broker.url()).SetClientID("subchan")
+	ops.SetKeepAlive(0)
+	ops.SetSubscribeChannelFull(policy)
+	c := NewClient(ops)
+	if !c.Connect().WaitTimeout(2 * time.Second) {
+		t.Fatalf("connect timed out")
+	}
+	conn := broker.accept(t, time.Second)
+
+	ch, token, err := c.SubscribeChan("chan/#", 0, size)
+	if err != nil {
+		t.Fatalf("SubscribeChan failed: %v", err)
+	}
+	conn.subscribeAndAck(t)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed")
+	}
+	markers := make(chan struct{}, 10)
+	token = c.Subscribe("marker", 0, func(c *Client, m Message) { markers <- struct{}{} })
+	conn.subscribeAndAck(t)
+	token.Wait()
+	return c, conn, ch, markers
+}
+
+func Test_SubscribeChan(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+	c, conn, ch, _ := subscribeChanClient(t, broker, ChannelFullBlock, 2)
+	defer conn.Close()
+
+	sendPublish(t, conn, "chan/a", "1")
+	sendPublish(t, conn, "chan/b", "2")
+	for _, want := range []string{"1", "2"} {
+		select {
+		case m := <-ch:
+			if string(m.Payload()) != want {
+				t.Fatalf("expected payload %s, got %s", want, m.Payload())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %s not delivered to the channel", want)
+		}
+	}
+
+	c.Unsubscribe("chan/#")
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("unexpected message after unsubscribing")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("channel not closed by Unsubscribe")
+	}
+	c.Disconnect(0)
+}
+
+func Test_DrainChan(t *testing.T) {
+	ops := NewClientOptions().SetClientID("drain")
+	ops.SetKeepAlive(0)
+	ops.SetManualAck(true)
+	c := connectTestClient(t, ops)
+	defer c.close()
+	conn := c.conn
+
+	ch, token, err := c.SubscribeChan("drain/#", 1, 4)
+	if err != nil {
+		t.Fatalf("SubscribeChan failed: %v", err)
+	}
+	conn.subscribeAndAck(t)
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe failed")
+	}
+	markers := make(chan struct{}, 1)
+	token = c.Subscribe("marker", 0, func(c *Client, m Message) { markers <- struct{}{} })
+	conn.subscribeAndAck(t)
+	token.Wait()
+
+	for i, payload := range []string{"1", "2", "3"} {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		pub.MessageID = uint16(i + 1)
+		pub.TopicName = []byte("drain/topic")
+		pub.Payload = []byte(payload)
+		conn.send(t, pub)
+	}
+	sendPublish(t, conn, "marker", "")
+	select {
+	case <-markers:
+	case <-time.After(time.Second):
+		t.Fatalf("messages not delivered")
+	}
+
+	drained := c.DrainChan("drain/#")
+	if len(drained) != 3 {
+		t.Fatalf("expected 3 messages drained, got %d", len(drained))
+	}
+	for i, m := range drained {
+		if want := fmt.Sprint(i + 1); string(m.Payload()) != want {
+			t.Fatalf("expected payload %s, got %s", want, m.Payload())
+		}
+	}
+	if len(ch) != 0 || len(c.DrainChan("drain/#")) != 0 {
+		t.Fatalf("messages left in the channel after draining")
+	}
+	if c.DrainChan("other") != nil {
+		t.Fatalf("drained a filter without a channel")
+	}
+
+	// the drained messages are acked when Ack is called
+	if cp := conn.receive(200 * time.Millisecond); cp != nil {
+		t.Fatalf("expected no ack before Ack, got %v", cp)
+	}
+	for i, m := range drained {
+		m.(AckableMessage).Ack()
+		cp := conn.receive(time.Second)
+		if pa, ok := cp.(*packets.PubackPacket); !ok || pa.MessageID != uint16(i+1) {
+			t.Fatalf("expected puback for %d, got %v", i+1, cp)
+		}
+	}
+}
+
+func Test_SubscribeChan_full(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.close()
+
+	// with ChannelFullDrop messages which don't fit are discarded
+	c, conn, ch, markers := subscribeChanClient(t, broker, ChannelFullDrop, 1)
+	sendPublish(t, conn, "chan/a", "kept")
+	sendPublish(t, conn, "chan/a", "dropped")
+	sendPublish(t, conn, "marker", "")
+	select {
+	case <-markers:
+	case <-time.After(time.Second):
+		t.Fatalf("delivery blocked by a full channel with ChannelFullDrop")
+	}
+	if m := <-ch; string(m.Payload()) != "kept" {
+		t.Fatalf("expected the first message to be kept, got %s", m.Payload())
+	}
+	select {
+	case m := <-ch:
+		t.Fatalf("message %s should have been dropped", m.Payload())
+	default:
+	}
+	conn.Close()
+	c.Disconnect(0)
+
+	// with ChannelFullBlock delivery waits for room
+	c, conn, ch, markers = subscribeChanClient(t, broker, ChannelFullBlock, 1)
+	defer conn.Close()
+	sendPublish(t, conn, "chan/a", "1")
+	sendPublish(t, conn, "chan/a", "2")
+	sendPublish(t, conn, "marker", "")
+	select {
+	case <-markers:
+		t.Fatalf("delivery went on past a full channel with ChannelFullBlock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	for _, want := range []string{"1", "2"} {
+		if m := <-ch; string(m.Payload()) != want {
+			t.Fatalf("expected payload %s, got %s", want, m.Payload())
+		}
+	}
+	select {
+	case <-markers:
+	case <-time.After(time.Second):
+		t.Fatalf("delivery did not resume once the channel had room")
+	}
+
+	// disconnecting closes the channel, releasing a blocked delivery
+	sendPublish(t, conn, "chan/a", "3")
+	sendPublish(t, conn, "chan/a", "4")
+	sendPublish(t, conn, "marker", "")
+	time.Sleep(50 * time.Millisecond)
+	c.Disconnect(0)
+	var got []string
+	for m := range ch {
+		got = append(got, string(m.Payload()))
+	}
+	if len(got) != 1 || got[0] != "3" {
+		t.Fatalf("expected only message 3 before the channel closed, got %v", got)
+	}
+}
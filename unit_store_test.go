@@ -255,7 +255,7 @@ func Test_persistOutbound_subscribe(t *testing.T) {
 	m.MessageID = 44
 	persistOutbound(ts, m)
 
-	if len(ts.mput) != 1 || ts.mput[0] != 44 {
+	if len(ts.mput) != 0 {
 		t.Fatalf("persistOutbound put message it should not have")
 	}
 
@@ -275,7 +275,7 @@ func Test_persistOutbound_unsubscribe(t *testing.T) {
 	m.MessageID = 45
 	persistOutbound(ts, m)
 
-	if len(ts.mput) != 1 || ts.mput[0] != 45 {
+	if len(ts.mput) != 0 {
 		t.Fatalf("persistOutbound put message it should not have")
 	}
 
@@ -45,3 +45,11 @@ func Test_ValidateTopicAndQos_H(t *testing.T) {
 		t.Fatalf("invalid error for bad multilevel topic filter")
 	}
 }
+
+func Test_ValidateTopicAndQos_partialWildcard(t *testing.T) {
+	for _, topic := range []string{"a/b+", "a#"} {
+		if validateTopicAndQos(topic, 0) == nil {
+			t.Fatalf("no error for wildcard in part of a level in %q", topic)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+/*
+ * This program and the accompanying materials
+ * are made available under the terms of the Eclipse Public License v1.0
+ * which accompanies this distribution, and is available at
+ * http://www.eclipse.org/legal/epl-v10.html
+ */
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes, RFC 6455 section 5.2
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// maxWebsocketMessage is the size of the largest MQTT packet, 256MB, which
+// no message read should exceed
+const maxWebsocketMessage = 1 << 28
+
+var errWebsocketTooLarge = errors.New("websocket: message too large")
+
+// deflateTail ends every compressed message, it is removed before a
+// message is sent and put back before one is inflated, RFC 7692 7.2
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateEnd is an empty final block, added after deflateTail so that
+// the inflater reaches the end of the stream cleanly
+var deflateEnd = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// deflateConn is a ws or wss connection which negotiates the
+// permessage-deflate extension, which golang.org/x/net/websocket can't.
+// Each Write is sent as a single binary message. Neither side keeps its
+// compression context between messages, so each is inflated on its own.
+// If the server doesn't agree to compression messages are sent as they are.
+type deflateConn struct {
+	net.Conn
+	r          *bufio.Reader
+	compressed bool   // permessage-deflate was agreed in the handshake
+	message    []byte // what is left to Read of the last message received
+	maxMessage int    // bounds messages read, before and after inflating
+	writeLock  sync.Mutex
+	deflater   *flate.Writer
+	deflated   bytes.Buffer
+}
+
+// dialWebsocketDeflate opens a ws or wss connection to uri offering the
+// permessage-deflate extension
+func dialWebsocketDeflate(uri *url.URL, tlsc *tls.Config, timeout time.Duration) (net.Conn, error) {
+	port := uri.Port()
+	if port == "" {
+		port = "80"
+		if uri.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(uri.Hostname(), port)
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if uri.Scheme == "wss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsc)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	ws, err := websocketHandshake(conn, uri)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+func websocketHandshake(conn net.Conn, uri *url.URL) (*deflateConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: uri.Path, RawQuery: uri.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       uri.Host,
+		Header: http.Header{
+			"Upgrade":                  {"websocket"},
+			"Connection":               {"Upgrade"},
+			"Origin":                   {"ws://localhost"},
+			"Sec-Websocket-Key":        {key},
+			"Sec-Websocket-Version":    {"13"},
+			"Sec-Websocket-Protocol":   {"mqtt"},
+			"Sec-Websocket-Extensions": {"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		},
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReaderSize(conn, IN_BUF_SIZE)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket: handshake failed with status %s", resp.Status)
+	}
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	if resp.Header.Get("Sec-Websocket-Accept") != base64.StdEncoding.EncodeToString(h.Sum(nil)) {
+		return nil, errors.New("websocket: bad Sec-WebSocket-Accept from server")
+	}
+	if p := resp.Header.Get("Sec-Websocket-Protocol"); p != "mqtt" {
+		return nil, fmt.Errorf("websocket: server chose protocol %q instead of mqtt", p)
+	}
+	compressed, err := acceptedDeflate(resp.Header["Sec-Websocket-Extensions"])
+	if err != nil {
+		return nil, err
+	}
+	return &deflateConn{Conn: conn, r: r, compressed: compressed, maxMessage: maxWebsocketMessage}, nil
+}
+
+// acceptedDeflate reports whether the server's extensions header accepts
+// the permessage-deflate offer made in the handshake
+func acceptedDeflate(headers []string) (bool, error) {
+	for _, header := range headers {
+		for _, extension := range strings.Split(header, ",") {
+			params := strings.Split(extension, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+			noContext := false
+			for _, param := range params[1:] {
+				name := strings.TrimSpace(strings.SplitN(param, "=", 2)[0])
+				switch name {
+				case "server_no_context_takeover":
+					noContext = true
+				case "client_no_context_takeover", "server_max_window_bits":
+				default:
+					return false, fmt.Errorf("websocket: unexpected permessage-deflate parameter %q", name)
+				}
+			}
+			if !noContext {
+				return false, errors.New("websocket: server keeps its permessage-deflate context")
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	for len(c.message) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.message = message
+	}
+	n := copy(b, c.message)
+	c.message = c.message[n:]
+	return n, nil
+}
+
+// readMessage reads the frames of the next data message, answering any
+// control frames in between
+func (c *deflateConn) readMessage() ([]byte, error) {
+	var message []byte
+	started, compressed := false, false
+	for {
+		hdr, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode := hdr & 0x0f; opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload, false); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload, false)
+			return nil, io.EOF
+		case wsContinuation:
+			if !started {
+				return nil, errors.New("websocket: continuation frame without a message")
+			}
+		case wsText, wsBinary:
+			if started {
+				return nil, errors.New("websocket: message interrupted by another")
+			}
+			started = true
+			compressed = hdr&0x40 != 0
+			if compressed && !c.compressed {
+				return nil, errors.New("websocket: compressed message without permessage-deflate")
+			}
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %d", opcode)
+		}
+		if len(message)+len(payload) > c.maxMessage {
+			return nil, errWebsocketTooLarge
+		}
+		message = append(message, payload...)
+		if hdr&0x80 != 0 {
+			break
+		}
+	}
+	if !compressed {
+		return message, nil
+	}
+	inflater := flate.NewReader(io.MultiReader(bytes.NewReader(message), bytes.NewReader(deflateTail), bytes.NewReader(deflateEnd)))
+	defer inflater.Close()
+	// a small compressed message may inflate to any size
+	inflated, err := ioutil.ReadAll(io.LimitReader(inflater, int64(c.maxMessage)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inflated) > c.maxMessage {
+		return nil, errWebsocketTooLarge
+	}
+	return inflated, nil
+}
+
+// readFrame reads one frame, returning the first byte of its header,
+// which holds the FIN and RSV1 flags and the opcode, and its payload
+func (c *deflateConn) readFrame() (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	if hdr[1]&0x80 != 0 {
+		return 0, nil, errors.New("websocket: masked frame from server")
+	}
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > uint64(c.maxMessage) {
+		return 0, nil, errors.New("websocket: frame too large")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+func (c *deflateConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	payload := b
+	if c.compressed {
+		c.deflated.Reset()
+		if c.deflater == nil {
+			c.deflater, _ = flate.NewWriter(&c.deflated, flate.DefaultCompression)
+		} else {
+			c.deflater.Reset(&c.deflated)
+		}
+		c.deflater.Write(b)
+		c.deflater.Flush()
+		payload = bytes.TrimSuffix(c.deflated.Bytes(), deflateTail)
+	}
+	if err := c.writeFrameLocked(wsBinary, payload, c.compressed); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *deflateConn) writeFrame(opcode byte, payload []byte, compressed bool) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.writeFrameLocked(opcode, payload, compressed)
+}
+
+// writeFrameLocked sends payload as a single masked frame, the caller
+// holds writeLock
+func (c *deflateConn) writeFrameLocked(opcode byte, payload []byte, compressed bool) error {
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | opcode
+	if compressed {
+		frame[0] |= 0x40
+	}
+	switch {
+	case len(payload) < 126:
+		frame[1] = 0x80 | byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 0x80 | 126
+		frame = append(frame, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame[1] = 0x80 | 127
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(len(payload)))
+		frame = append(frame, ext[:]...)
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// ping sends a WebSocket ping frame, for the websocket keepalive
+func (c *deflateConn) ping() error {
+	return c.writeFrame(wsPing, nil, false)
+}
+
+func (c *deflateConn) Close() error {
+	// a normal closure, the server's reply isn't waited for, nor is a
+	// write which is stuck
+	if c.writeLock.TryLock() {
+		c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrameLocked(wsClose, []byte{0x03, 0xe8}, false)
+		c.writeLock.Unlock()
+	}
+	return c.Conn.Close()
+}